@@ -1,3 +1,13 @@
 module github.com/draychev/smirc
 
 go 1.19
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/crypto v0.14.0
+)
+
+require (
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
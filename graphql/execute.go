@@ -0,0 +1,143 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Object is a GraphQL object: its fields are plain values, Objects, lists
+// of them, or Resolvers computing them from the arguments of the field
+type Object map[string]interface{}
+
+// Resolver computes the value of a field from its arguments
+type Resolver func(args map[string]interface{}) (interface{}, error)
+
+// Response is the result of an operation, as served to the client
+type Response struct {
+	Data   *Result `json:"data"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+// Error is a field that could not be resolved, its value then being null
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Result holds the fields of an object in the order they were asked for
+type Result struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// Get returns the value of the field with key
+func (r *Result) Get(key string) interface{} {
+	return r.values[key]
+}
+
+func (r *Result) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Execute resolves the selection of op from root with the given variables
+func Execute(op *Operation, variables map[string]interface{}, root Object) *Response {
+	e := &executor{variables: op.Variables(variables)}
+	response := &Response{Data: e.object(root, op.Selection, nil)}
+	response.Errors = e.errors
+	return response
+}
+
+type executor struct {
+	variables map[string]interface{}
+	errors    []Error
+}
+
+func (e *executor) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, Error{Message: err.Error(), Path: append([]interface{}{}, path...)})
+}
+
+// object resolves the fields of o. The fields asked for twice under the same
+// key, e.g. by two fragments, are merged.
+func (e *executor) object(o Object, selection []*Field, path []interface{}) *Result {
+	result := &Result{values: make(map[string]interface{})}
+	merged := make(map[string]*Field)
+	for _, f := range selection {
+		key := f.Key()
+		if m, ok := merged[key]; ok {
+			m.Selection = append(m.Selection, f.Selection...)
+			continue
+		}
+		copied := *f
+		copied.Selection = append([]*Field{}, f.Selection...)
+		merged[key] = &copied
+		result.keys = append(result.keys, key)
+	}
+	for _, key := range result.keys {
+		f := merged[key]
+		fieldPath := append(path[:len(path):len(path)], key)
+		value, ok := o[f.Name]
+		if !ok {
+			e.fail(fieldPath, fmt.Errorf("unknown field %q", f.Name))
+			result.values[key] = nil
+			continue
+		}
+		if resolve, ok := value.(Resolver); ok {
+			var err error
+			if value, err = resolve(f.Args(e.variables)); err != nil {
+				e.fail(fieldPath, err)
+				result.values[key] = nil
+				continue
+			}
+		}
+		result.values[key] = e.value(value, f, fieldPath)
+	}
+	return result
+}
+
+// value completes the value of f, selecting the fields of objects
+func (e *executor) value(value interface{}, f *Field, path []interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case Object:
+		if len(f.Selection) == 0 {
+			e.fail(path, fmt.Errorf("field %q is an object and needs a selection of its fields", f.Name))
+			return nil
+		}
+		return e.object(v, f.Selection, path)
+	case []Object:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.value(item, f, append(path[:len(path):len(path)], i))
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.value(item, f, append(path[:len(path):len(path)], i))
+		}
+		return list
+	}
+	if len(f.Selection) > 0 {
+		e.fail(path, fmt.Errorf("field %q has no fields to select", f.Name))
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,564 @@
+// Package graphql is the small part of GraphQL that smirc needs to serve
+// its API: it parses queries, with variables, aliases and fragments, and
+// resolves their fields from Objects. There is no schema and no
+// introspection; what an Object has is what can be asked for.
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Document is a parsed GraphQL request
+type Document struct {
+	Operations []*Operation
+}
+
+// Operation is a query, mutation or subscription of a Document, its
+// fragments already spread into its selection
+type Operation struct {
+	// Type is "query", "mutation" or "subscription"
+	Type      string
+	Name      string
+	Selection []*Field
+	// defaults are the default values of the variables
+	defaults map[string]interface{}
+}
+
+// Field is a field asked for, with the fields to return of its value
+type Field struct {
+	Alias     string
+	Name      string
+	Arguments map[string]interface{}
+	Selection []*Field
+}
+
+// Variable is a $variable used as an argument
+type Variable string
+
+// Key is where the value of f goes in the result: its alias, or its name
+func (f *Field) Key() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// Args returns the arguments of f with the variables filled in
+func (f *Field) Args(variables map[string]interface{}) map[string]interface{} {
+	args := make(map[string]interface{}, len(f.Arguments))
+	for name, value := range f.Arguments {
+		args[name] = substitute(value, variables)
+	}
+	return args
+}
+
+func substitute(value interface{}, variables map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case Variable:
+		return variables[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = substitute(item, variables)
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[key] = substitute(item, variables)
+		}
+		return object
+	}
+	return value
+}
+
+// Operation returns the operation called name, or the only one if name is
+// ""
+func (d *Document) Operation(name string) (*Operation, error) {
+	if name == "" {
+		if len(d.Operations) != 1 {
+			return nil, fmt.Errorf("the document has %d operations, pick one with operationName", len(d.Operations))
+		}
+		return d.Operations[0], nil
+	}
+	for _, op := range d.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("no operation called %q", name)
+}
+
+// Variables returns the variables of op: those given, and the defaults of
+// the others
+func (op *Operation) Variables(given map[string]interface{}) map[string]interface{} {
+	variables := make(map[string]interface{}, len(op.defaults)+len(given))
+	for name, value := range op.defaults {
+		variables[name] = value
+	}
+	for name, value := range given {
+		variables[name] = value
+	}
+	return variables
+}
+
+// selection is a field, a fragment spread or an inline fragment, before the
+// fragments are spread
+type selection struct {
+	field    *Field
+	fields   []*selection
+	spread   string
+	children []*selection
+}
+
+// Limits on the documents Parse accepts, so that a query cannot make the
+// server parse, spread or resolve more than a client reasonably asks for
+const (
+	// MaxLength is the longest document in bytes
+	MaxLength = 16 << 10
+	// MaxDepth is how deep selections and values may nest, fragments
+	// spread
+	MaxDepth = 12
+	// MaxFields is how many fields an operation may ask for, fragments
+	// spread
+	MaxFields = 1000
+)
+
+type parser struct {
+	src   string
+	pos   int
+	token string
+	kind  tokenKind
+	// depth is how deep the current selection or value is nested
+	depth int
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+// Parse parses a GraphQL document
+func Parse(src string) (doc *Document, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if syntaxErr, ok := r.(syntaxError); ok {
+				doc, err = nil, syntaxErr
+				return
+			}
+			panic(r)
+		}
+	}()
+	if len(src) > MaxLength {
+		return nil, fmt.Errorf("the document is longer than %d bytes", MaxLength)
+	}
+	p := &parser{src: src}
+	p.next()
+	type operation struct {
+		op        *Operation
+		selection []*selection
+	}
+	var operations []operation
+	fragments := make(map[string][]*selection)
+	for p.kind != tokenEOF {
+		switch {
+		case p.is("{"):
+			operations = append(operations, operation{&Operation{Type: "query"}, p.selectionSet()})
+		case p.token == "query" || p.token == "mutation" || p.token == "subscription":
+			op := &Operation{Type: p.token, defaults: make(map[string]interface{})}
+			p.next()
+			if p.kind == tokenName {
+				op.Name = p.name()
+			}
+			if p.is("(") {
+				p.variableDefinitions(op)
+			}
+			p.directives()
+			operations = append(operations, operation{op, p.selectionSet()})
+		case p.token == "fragment":
+			p.next()
+			name := p.name()
+			if p.name() != "on" {
+				p.fail("expected on")
+			}
+			p.name()
+			p.directives()
+			fragments[name] = p.selectionSet()
+		default:
+			p.fail("expected an operation or a fragment")
+		}
+	}
+	if len(operations) == 0 {
+		return nil, syntaxError("the document has no operation")
+	}
+	doc = &Document{}
+	for _, o := range operations {
+		fields := 0
+		o.op.Selection = spread(o.selection, fragments, nil, 1, &fields)
+		doc.Operations = append(doc.Operations, o.op)
+	}
+	return doc, nil
+}
+
+// spread resolves the fragments in a selection at depth, seen being the
+// ones being spread to catch cycles, and counts the fields
+func spread(selections []*selection, fragments map[string][]*selection, seen []string, depth int, count *int) []*Field {
+	if depth > MaxDepth {
+		panic(syntaxError(fmt.Sprintf("the selection is nested deeper than %d", MaxDepth)))
+	}
+	var fields []*Field
+	for _, s := range selections {
+		switch {
+		case s.field != nil:
+			if *count++; *count > MaxFields {
+				panic(syntaxError(fmt.Sprintf("the operation has more than %d fields", MaxFields)))
+			}
+			if s.fields != nil {
+				s.field.Selection = spread(s.fields, fragments, seen, depth+1, count)
+			}
+			fields = append(fields, s.field)
+		case s.spread != "":
+			fragment, ok := fragments[s.spread]
+			if !ok {
+				panic(syntaxError(fmt.Sprintf("unknown fragment %q", s.spread)))
+			}
+			for _, name := range seen {
+				if name == s.spread {
+					panic(syntaxError(fmt.Sprintf("fragment %q spreads itself", s.spread)))
+				}
+			}
+			fields = append(fields, spread(fragment, fragments, append(seen, s.spread), depth, count)...)
+		default:
+			fields = append(fields, spread(s.children, fragments, seen, depth, count)...)
+		}
+	}
+	return fields
+}
+
+type syntaxError string
+
+func (e syntaxError) Error() string { return "syntax error: " + string(e) }
+
+func (p *parser) fail(expected string) {
+	token := p.token
+	if p.kind == tokenEOF {
+		token = "end of document"
+	}
+	panic(syntaxError(fmt.Sprintf("%s at %q, offset %d", expected, token, p.pos-len(p.token))))
+}
+
+func (p *parser) is(punctuator string) bool {
+	return p.kind == tokenPunctuator && p.token == punctuator
+}
+
+func (p *parser) expect(punctuator string) {
+	if !p.is(punctuator) {
+		p.fail("expected " + punctuator)
+	}
+	p.next()
+}
+
+func (p *parser) name() string {
+	if p.kind != tokenName {
+		p.fail("expected a name")
+	}
+	name := p.token
+	p.next()
+	return name
+}
+
+// variableDefinitions parses ($name: Type = default, ...), keeping the
+// defaults; the types are not checked
+func (p *parser) variableDefinitions(op *Operation) {
+	p.expect("(")
+	for !p.is(")") {
+		p.expect("$")
+		name := p.name()
+		p.expect(":")
+		p.typeReference()
+		if p.is("=") {
+			p.next()
+			op.defaults[name] = p.value(true)
+		}
+		p.directives()
+	}
+	p.next()
+}
+
+func (p *parser) typeReference() {
+	if p.is("[") {
+		p.next()
+		p.typeReference()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	if p.is("!") {
+		p.next()
+	}
+}
+
+// directives skips @directive(args), which are not supported
+func (p *parser) directives() {
+	for p.is("@") {
+		p.next()
+		p.name()
+		if p.is("(") {
+			p.arguments()
+		}
+	}
+}
+
+// nest enters a selection or value nested in the current one
+func (p *parser) nest() {
+	if p.depth++; p.depth > MaxDepth {
+		p.fail(fmt.Sprintf("nested deeper than %d", MaxDepth))
+	}
+}
+
+func (p *parser) selectionSet() []*selection {
+	p.nest()
+	defer func() { p.depth-- }()
+	p.expect("{")
+	var selections []*selection
+	for !p.is("}") {
+		if p.is("...") {
+			p.next()
+			if p.kind == tokenName && p.token != "on" {
+				selections = append(selections, &selection{spread: p.name()})
+				p.directives()
+				continue
+			}
+			if p.token == "on" {
+				p.next()
+				p.name()
+			}
+			p.directives()
+			selections = append(selections, &selection{children: p.selectionSet()})
+			continue
+		}
+		field := &Field{Name: p.name()}
+		if p.is(":") {
+			p.next()
+			field.Alias, field.Name = field.Name, p.name()
+		}
+		if p.is("(") {
+			field.Arguments = p.arguments()
+		}
+		p.directives()
+		s := &selection{field: field}
+		if p.is("{") {
+			s.fields = p.selectionSet()
+		}
+		selections = append(selections, s)
+	}
+	p.next()
+	if len(selections) == 0 {
+		p.fail("expected a field")
+	}
+	return selections
+}
+
+func (p *parser) arguments() map[string]interface{} {
+	p.expect("(")
+	args := make(map[string]interface{})
+	for !p.is(")") {
+		name := p.name()
+		p.expect(":")
+		args[name] = p.value(false)
+	}
+	p.next()
+	return args
+}
+
+// value parses a value, which may only be a variable if constant is false
+func (p *parser) value(constant bool) interface{} {
+	switch p.kind {
+	case tokenInt:
+		n, err := strconv.Atoi(p.token)
+		if err != nil {
+			p.fail("expected an integer")
+		}
+		p.next()
+		return n
+	case tokenFloat:
+		f, err := strconv.ParseFloat(p.token, 64)
+		if err != nil {
+			p.fail("expected a number")
+		}
+		p.next()
+		return f
+	case tokenString:
+		s := p.token
+		p.next()
+		return s
+	case tokenName:
+		// true, false, null or an enum value, passed as a string
+		name := p.name()
+		switch name {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return name
+	}
+	switch {
+	case p.is("$") && !constant:
+		p.next()
+		return Variable(p.name())
+	case p.is("["):
+		p.nest()
+		defer func() { p.depth-- }()
+		p.next()
+		list := []interface{}{}
+		for !p.is("]") {
+			list = append(list, p.value(constant))
+		}
+		p.next()
+		return list
+	case p.is("{"):
+		p.nest()
+		defer func() { p.depth-- }()
+		p.next()
+		object := make(map[string]interface{})
+		for !p.is("}") {
+			name := p.name()
+			p.expect(":")
+			object[name] = p.value(constant)
+		}
+		p.next()
+		return object
+	}
+	p.fail("expected a value")
+	return nil
+}
+
+// next reads the next token, skipping white space, commas and comments
+func (p *parser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.token, p.kind = "", tokenEOF
+		return
+	}
+	start, c := p.pos, p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.token, p.kind = "...", tokenPunctuator
+	case strings.IndexByte("!$&()::=@[]{}|", c) >= 0:
+		p.pos++
+		p.token, p.kind = string(c), tokenPunctuator
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.token, p.kind = p.src[start:p.pos], tokenName
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		p.kind = tokenInt
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c == '.' || c == 'e' || c == 'E' || (c == '+' || c == '-') && p.kind == tokenFloat {
+				p.kind = tokenFloat
+			} else if c < '0' || c > '9' {
+				break
+			}
+			p.pos++
+		}
+		p.token = p.src[start:p.pos]
+	case c == '"':
+		p.token, p.kind = p.string(), tokenString
+	default:
+		p.pos++
+		p.token, p.kind = string(c), tokenPunctuator
+		p.fail("unexpected character")
+	}
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// string reads a "string" or a """block string""" and returns its value
+func (p *parser) string() string {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.fail("unterminated string")
+		}
+		s := p.src[p.pos+3 : p.pos+3+end]
+		p.pos += end + 6
+		return strings.TrimSpace(strings.ReplaceAll(s, `\"""`, `"""`))
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			p.fail("unterminated string")
+		}
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return b.String()
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				p.fail("unterminated string")
+			}
+			escape := p.src[p.pos+1]
+			p.pos += 2
+			switch escape {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					p.fail("invalid escape")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					p.fail("invalid escape")
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				b.WriteByte(escape)
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			b.WriteString(p.src[p.pos : p.pos+size])
+			p.pos += size
+		}
+	}
+}
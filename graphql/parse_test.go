@@ -0,0 +1,128 @@
+package graphql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := Parse(`
+		# the messages of a channel
+		query Recent($channel: String! = "#go", $limit: Int) {
+			recent: messages(channel: $channel, limit: $limit, filter: {nick: "alice", ids: [1, 2.5, true, null]}) {
+				...message
+				... on Message { time }
+			}
+			status { connected }
+		}
+		fragment message on Message { id nick text: message }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := doc.Operation("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Type != "query" || op.Name != "Recent" {
+		t.Errorf("operation is %s %s, want query Recent", op.Type, op.Name)
+	}
+	if variables := op.Variables(map[string]interface{}{"limit": 10}); !reflect.DeepEqual(variables, map[string]interface{}{"channel": "#go", "limit": 10}) {
+		t.Errorf("variables are %v", variables)
+	}
+	if len(op.Selection) != 2 {
+		t.Fatalf("got %d fields, want 2", len(op.Selection))
+	}
+	recent := op.Selection[0]
+	if recent.Key() != "recent" || recent.Name != "messages" {
+		t.Errorf("field is %s: %s, want recent: messages", recent.Key(), recent.Name)
+	}
+	args := recent.Args(map[string]interface{}{"channel": "#go", "limit": 10})
+	want := map[string]interface{}{
+		"channel": "#go",
+		"limit":   10,
+		"filter":  map[string]interface{}{"nick": "alice", "ids": []interface{}{1, 2.5, true, nil}},
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("arguments are %v, want %v", args, want)
+	}
+	var keys []string
+	for _, f := range recent.Selection {
+		keys = append(keys, f.Key())
+	}
+	if strings.Join(keys, " ") != "id nick text time" {
+		t.Errorf("fragments spread to %v, want id nick text time", keys)
+	}
+}
+
+func TestParseShorthandAndStrings(t *testing.T) {
+	doc, err := Parse(`{ search(q: "say \"hi\"\né", block: """ multi "line" """) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := doc.Operations[0].Selection[0].Arguments
+	if args["q"] != "say \"hi\"\né" {
+		t.Errorf("q is %q", args["q"])
+	}
+	if args["block"] != `multi "line"` {
+		t.Errorf("block is %q", args["block"])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, src, wantErr string
+	}{
+		{"empty", "", "no operation"},
+		{"only a comment", "# nothing", "no operation"},
+		{"unclosed selection", "{ messages { id }", "expected a name"},
+		{"empty selection", "{ }", "expected a field"},
+		{"missing colon", "{ messages(channel \"#go\") { id } }", "expected :"},
+		{"missing value", "{ messages(channel: ) { id } }", "expected a value"},
+		{"variable in a default", "query ($a: Int = $b) { x }", "expected a value"},
+		{"unterminated string", "{ messages(channel: \"#go) { id } }", "unterminated string"},
+		{"unterminated block string", `{ messages(channel: """#go) { id } }`, "unterminated string"},
+		{"invalid escape", `{ messages(channel: "\u12") { id } }`, "invalid escape"},
+		{"unexpected character", "{ messages; }", "unexpected character"},
+		{"fragment without on", "{ ...f } fragment f Message { id }", "expected on"},
+		{"unknown fragment", "{ ...f }", "unknown fragment"},
+		{"fragment spreading itself", "{ ...f } fragment f on Query { a { ...f } }", "spreads itself"},
+		{"stray token", "{ id } }", "expected an operation"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := Parse(tc.src)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, %v; want an error about %q", doc, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// nested returns a query with fields nested depth deep
+func nested(depth int) string {
+	return strings.Repeat("{ a ", depth) + strings.Repeat("}", depth)
+}
+
+func TestParseLimits(t *testing.T) {
+	if _, err := Parse(nested(MaxDepth)); err != nil {
+		t.Errorf("selections nested %d deep: %s", MaxDepth, err)
+	}
+	for _, tc := range []struct {
+		name, src, wantErr string
+	}{
+		{"nested selections", nested(MaxDepth + 1), "nested deeper"},
+		{"nested values", "{ a(x: " + strings.Repeat("[", MaxDepth+1) + strings.Repeat("]", MaxDepth+1) + ") }", "nested deeper"},
+		{"nested by fragments", "{ a { ...f } } fragment f on A { b " + nested(MaxDepth-1) + " }", "nested deeper"},
+		{"too long", "{ a(x: \"" + strings.Repeat("x", MaxLength) + "\") }", "longer than"},
+		// Each fragment spreads the next one ten times, a thousand fields
+		{"too many fields", "{ ...f1 } fragment f1 on Q { " + strings.Repeat("...f2 ", 10) + "} " +
+			"fragment f2 on Q { " + strings.Repeat("...f3 ", 10) + "} fragment f3 on Q { a b c d e f g h i j k }", "more than"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := Parse(tc.src)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, %v; want an error about %q", doc, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package ircclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Defaults
+const (
+	defaultDialTimeout   = 30 * time.Second
+	defaultFloodBurst    = 5
+	defaultFloodInterval = 2 * time.Second
+	sendQueueSize        = 512
+)
+
+// AllLines registers a handler for every line received
+const AllLines = "*"
+
+// Handler is called with every line of the command it was registered for,
+// one line at a time
+type Handler func(c *Client, l Line)
+
+// Client is a connection to an IRC server. Create it with New and call Run,
+// again after it returned to reconnect.
+type Client struct {
+	addr        string
+	nick        string
+	user        string
+	realName    string
+	password    string
+	tlsConfig   *tls.Config
+	dialTimeout time.Duration
+	keepAlive   *KeepAlive
+	burst       int
+	interval    time.Duration
+	dial        func(ctx context.Context, addr string) (net.Conn, error)
+	// register is nil for the default registration, see WithRegistration
+	register  func(c *Client)
+	onConnect func(c *Client, conn net.Conn)
+	onSent    func()
+
+	handlersMutex sync.Mutex
+	handlers      map[string][]Handler
+
+	mutex       sync.Mutex
+	conn        net.Conn
+	outgoing    chan []byte
+	currentNick string
+	registered  bool
+	// writeMutex keeps the lines written to conn from interleaving
+	writeMutex sync.Mutex
+
+	// waiters get the answers to JoinWait and ChangeNick
+	waiters Waiters
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithUser sets the user name and real name sent with USER, the nick by
+// default
+func WithUser(user, realName string) Option {
+	return func(c *Client) { c.user, c.realName = user, realName }
+}
+
+// WithPassword sends PASS before registering
+func WithPassword(password string) Option {
+	return func(c *Client) { c.password = password }
+}
+
+// WithTLS connects over TLS with the given config, which may be nil for the
+// defaults
+func WithTLS(config *tls.Config) Option {
+	return func(c *Client) {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		c.tlsConfig = config
+	}
+}
+
+// WithDialTimeout limits how long connecting may take, 30 seconds by
+// default
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Client) { c.dialTimeout = timeout }
+}
+
+// WithKeepAlive sets the TCP keepalive of the connection, which otherwise
+// sends probes every 15 seconds
+func WithKeepAlive(keepAlive KeepAlive) Option {
+	return func(c *Client) { c.keepAlive = &keepAlive }
+}
+
+// WithDialer connects with dial instead of over TCP, e.g. through a proxy or
+// a WebSocket. WithTLS still applies to the connection it returns,
+// WithDialTimeout and WithKeepAlive do not.
+func WithDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(c *Client) { c.dial = dial }
+}
+
+// WithFloodControl sends up to burst lines at once and then one line per
+// interval, by default 5 lines and then one every 2 seconds
+func WithFloodControl(burst int, interval time.Duration) Option {
+	return func(c *Client) { c.burst, c.interval = burst, interval }
+}
+
+// WithRegistration replaces the PASS, NICK and USER sent on connecting,
+// e.g. to negotiate capabilities first. The handlers then have to pick
+// another nick when the server says it is in use.
+func WithRegistration(register func(c *Client)) Option {
+	return func(c *Client) { c.register = register }
+}
+
+// WithOnConnect calls onConnect once connected, before registering, e.g. to
+// set up the state of the new connection
+func WithOnConnect(onConnect func(c *Client, conn net.Conn)) Option {
+	return func(c *Client) { c.onConnect = onConnect }
+}
+
+// WithOnSent calls onSent after every queued line written to the server,
+// e.g. to notice a connection that stopped taking them
+func WithOnSent(onSent func()) Option {
+	return func(c *Client) { c.onSent = onSent }
+}
+
+// WithHandler registers a handler like Handle
+func WithHandler(command string, h Handler) Option {
+	return func(c *Client) { c.Handle(command, h) }
+}
+
+// New returns a client for the server at addr, a host:port, that registers
+// as nick
+func New(addr, nick string, options ...Option) *Client {
+	c := &Client{
+		addr:        addr,
+		nick:        nick,
+		user:        nick,
+		realName:    nick,
+		dialTimeout: defaultDialTimeout,
+		burst:       defaultFloodBurst,
+		interval:    defaultFloodInterval,
+		handlers:    make(map[string][]Handler),
+	}
+	c.dial = c.dialTCP
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Handle registers h for the lines with command, e.g. "PRIVMSG" or "001",
+// or for all lines with AllLines
+func (c *Client) Handle(command string, h Handler) {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+	command = strings.ToUpper(command)
+	c.handlers[command] = append(c.handlers[command], h)
+}
+
+// dialTCP connects to addr with the dial timeout and keepalive settings
+func (c *Client) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	if c.keepAlive != nil {
+		// Set after connecting, Go would override it with its own
+		dialer.KeepAlive = -1
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.keepAlive != nil {
+		if err := c.keepAlive.Apply(conn.(*net.TCPConn)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Run connects, registers and handles the lines from the server until the
+// connection breaks or ctx is done. The returned error says why.
+func (c *Client) Run(ctx context.Context) error {
+	conn, err := c.dial(ctx, c.addr)
+	if err != nil {
+		return err
+	}
+	if c.tlsConfig != nil {
+		config := c.tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(c.addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	defer conn.Close()
+
+	outgoing, stop := make(chan []byte, sendQueueSize), make(chan struct{})
+	defer close(stop)
+	c.mutex.Lock()
+	c.conn, c.outgoing, c.currentNick, c.registered = conn, outgoing, c.nick, false
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.conn, c.outgoing, c.registered = nil, nil, false
+		c.mutex.Unlock()
+		c.waiters.Fail(ErrNotConnected)
+	}()
+	go c.sendQueued(conn, outgoing, stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if c.onConnect != nil {
+		c.onConnect(c, conn)
+	}
+	if c.register != nil {
+		c.register(c)
+	} else {
+		if c.password != "" {
+			_ = c.Send("PASS %s", c.password)
+		}
+		_ = c.Send("NICK %s", c.nick)
+		_ = c.Send("USER %s 0 * :%s", c.user, c.realName)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		raw, err := reader.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		c.handle(ParseLine(raw))
+	}
+}
+
+// handle keeps track of the connection state and dispatches l to the
+// handlers
+func (c *Client) handle(l Line) {
+	switch l.Command {
+	case "PING":
+		// Answered right away, a queued PONG could come too late
+		_, _ = c.Write([]byte("PONG :" + l.Param(0) + "\r\n"))
+	case "001":
+		c.mutex.Lock()
+		c.currentNick, c.registered = l.Param(0), true
+		c.mutex.Unlock()
+	case "433":
+		// Nick in use: try another one until the server welcomes us, unless
+		// the registration is up to the handlers
+		c.mutex.Lock()
+		retry := !c.registered && c.register == nil
+		if retry {
+			c.currentNick += "_"
+		}
+		nick := c.currentNick
+		c.mutex.Unlock()
+		if retry {
+			_ = c.Send("NICK %s", nick)
+		}
+	case "NICK":
+		c.mutex.Lock()
+		if strings.EqualFold(l.Nick(), c.currentNick) {
+			c.currentNick = l.Param(0)
+		}
+		c.mutex.Unlock()
+	}
+	c.waiters.Dispatch(l)
+	c.handlersMutex.Lock()
+	handlers := append(append([]Handler{}, c.handlers[l.Command]...), c.handlers[AllLines]...)
+	c.handlersMutex.Unlock()
+	for _, h := range handlers {
+		h(c, l)
+	}
+}
+
+// sendQueued sends the queued lines to conn at the flood rate until stop is
+// closed or conn fails
+func (c *Client) sendQueued(conn net.Conn, outgoing chan []byte, stop chan struct{}) {
+	bucket := NewTokenBucket(c.burst, c.interval)
+	for {
+		select {
+		case <-stop:
+			return
+		case line := <-outgoing:
+			if delay := bucket.Delay(time.Now()); delay > 0 {
+				select {
+				case <-stop:
+					return
+				case <-time.After(delay):
+				}
+			}
+			c.writeMutex.Lock()
+			_, err := conn.Write(line)
+			c.writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+			if c.onSent != nil {
+				c.onSent()
+			}
+		}
+	}
+}
+
+// Write queues raw protocol lines, line breaks included, so that a Client
+// can be used as an io.Writer. They are sent at the flood rate, except for
+// PONG, which must not wait.
+func (c *Client) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	conn, outgoing := c.conn, c.outgoing
+	c.mutex.Unlock()
+	if conn == nil {
+		return 0, ErrNotConnected
+	}
+	if bytes.HasPrefix(p, []byte("PONG ")) {
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+		return conn.Write(p)
+	}
+	select {
+	case outgoing <- append([]byte{}, p...):
+		return len(p), nil
+	default:
+		return 0, ErrSendQueueFull
+	}
+}
+
+// Send queues a line for the server. Line breaks in it are dropped, so that
+// it cannot smuggle in another command.
+func (c *Client) Send(format string, args ...interface{}) error {
+	line := strings.NewReplacer("\r", "", "\n", "").Replace(fmt.Sprintf(format, args...))
+	_, err := c.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// SendQueue returns how many lines wait to be sent to the server
+func (c *Client) SendQueue() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.outgoing)
+}
+
+// Close hangs up without saying goodbye, which ends Run
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.Close()
+}
+
+// Join joins a channel
+func (c *Client) Join(channel string) error {
+	return c.Send("JOIN %s", channel)
+}
+
+// JoinWait joins a channel and waits for the server to confirm it. A refusal
+// is returned as a *ReplyError, e.g. ErrChannelFull, and no answer until ctx
+// is done as ErrSendTimeout.
+func (c *Client) JoinWait(ctx context.Context, channel string) error {
+	w := c.waiters.Add(Joined(c.Nick, channel))
+	if err := c.Join(channel); err != nil {
+		c.waiters.Cancel(w)
+		return err
+	}
+	return c.waiters.Wait(ctx, w)
+}
+
+// ChangeNick switches to another nick and waits for the server to confirm
+// it, returning ErrNickInUse if somebody has it
+func (c *Client) ChangeNick(ctx context.Context, nick string) error {
+	if !c.Registered() {
+		return ErrNotConnected
+	}
+	old := c.Nick()
+	w := c.waiters.Add(func(l Line) (bool, error) {
+		switch {
+		case l.Command == "NICK" && strings.EqualFold(l.Nick(), old):
+			return true, nil
+		case l.IsError() && strings.EqualFold(l.Param(1), nick):
+			return true, &ReplyError{Line: l}
+		}
+		return false, nil
+	})
+	if err := c.Send("NICK %s", nick); err != nil {
+		c.waiters.Cancel(w)
+		return err
+	}
+	return c.waiters.Wait(ctx, w)
+}
+
+// Privmsg sends a message to a channel or nick
+func (c *Client) Privmsg(target, text string) error {
+	return c.Send("PRIVMSG %s :%s", target, text)
+}
+
+// Notice sends a notice to a channel or nick
+func (c *Client) Notice(target, text string) error {
+	return c.Send("NOTICE %s :%s", target, text)
+}
+
+// Quit says goodbye; the server then hangs up, which ends Run
+func (c *Client) Quit(message string) error {
+	return c.Send("QUIT :%s", message)
+}
+
+// Nick is the nick the server knows us by
+func (c *Client) Nick() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.currentNick == "" {
+		return c.nick
+	}
+	return c.currentNick
+}
+
+// Registered reports whether the server has welcomed us on this connection
+func (c *Client) Registered() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.registered
+}
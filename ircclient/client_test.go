@@ -0,0 +1,115 @@
+package ircclient
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer listens on a local port and hands over the first connection
+// to it
+func fakeServer(t *testing.T) (addr string, accepted chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	accepted = make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	return listener.Addr().String(), accepted
+}
+
+func expectLine(t *testing.T, r *bufio.Reader, want string) {
+	t.Helper()
+	got, err := r.ReadString('\n')
+	if got != want+"\r\n" || err != nil {
+		t.Fatalf("server read %q, %v; want %q", got, err, want)
+	}
+}
+
+func TestClient(t *testing.T) {
+	addr, accepted := fakeServer(t)
+	received := make(chan Line, 1)
+	c := New(addr, "bot",
+		WithUser("user", "Real Name"),
+		WithFloodControl(100, time.Millisecond),
+		WithHandler("PRIVMSG", func(c *Client, l Line) { received <- l }))
+	done := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { done <- c.Run(ctx) }()
+
+	conn := <-accepted
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	expectLine(t, r, "NICK bot")
+	expectLine(t, r, "USER user 0 * :Real Name")
+
+	// A nick in use is retried with another one until we are welcomed
+	_, _ = conn.Write([]byte(":server 433 * bot :Nickname is already in use\r\n"))
+	expectLine(t, r, "NICK bot_")
+	_, _ = conn.Write([]byte(":server 001 bot_ :Welcome\r\nPING :token\r\n"))
+	expectLine(t, r, "PONG :token")
+	if !c.Registered() || c.Nick() != "bot_" {
+		t.Errorf("registered %t as %q; want bot_", c.Registered(), c.Nick())
+	}
+
+	_, _ = conn.Write([]byte(":alice!a@h PRIVMSG #c :hi\r\n"))
+	if l := <-received; l.Nick() != "alice" || l.Param(1) != "hi" || l.Raw != ":alice!a@h PRIVMSG #c :hi\r\n" {
+		t.Errorf("handler got %+v", l)
+	}
+
+	// Line breaks cannot smuggle in another command
+	if err := c.Privmsg("#c", "one\r\nQUIT"); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, r, "PRIVMSG #c :oneQUIT")
+	if err := c.Join("#d"); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, r, "JOIN #d")
+
+	cancel()
+	<-done
+	if err := c.Send("PING x"); err != ErrNotConnected {
+		t.Errorf("Send after Run returned %v; want ErrNotConnected", err)
+	}
+}
+
+func TestClientRegistration(t *testing.T) {
+	addr, accepted := fakeServer(t)
+	connected := make(chan net.Conn, 1)
+	c := New(addr, "bot",
+		WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		}),
+		WithOnConnect(func(c *Client, conn net.Conn) { connected <- conn }),
+		WithRegistration(func(c *Client) { _ = c.Send("CAP LS 302") }))
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+
+	conn := <-accepted
+	r := bufio.NewReader(conn)
+	expectLine(t, r, "CAP LS 302")
+	select {
+	case <-connected:
+	default:
+		t.Errorf("registered without calling the on-connect callback")
+	}
+
+	// The handlers pick another nick with a registration of their own
+	_, _ = conn.Write([]byte(":server 433 * bot :Nickname is already in use\r\nPING :token\r\n"))
+	expectLine(t, r, "PONG :token")
+	_ = conn.Close()
+	if err := <-done; err == nil {
+		t.Errorf("Run returned no error after the server hung up")
+	}
+}
@@ -0,0 +1,150 @@
+package ircclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var ErrNotConnected = errors.New("not connected to the IRC server")
+
+var ErrSendQueueFull = errors.New("too many lines waiting to be sent to the IRC server")
+
+var ErrNickInUse = errors.New("nick is already in use")
+
+var ErrChannelFull = errors.New("channel is full")
+
+var ErrNoSuchNick = errors.New("no such nick")
+
+// ErrSendTimeout is returned when the server did not answer what we sent in
+// time
+var ErrSendTimeout = errors.New("the IRC server did not answer in time")
+
+// ReplyError is an error reply of the server, a numeric from 400 to 599.
+// errors.Is matches it against ErrNickInUse, ErrChannelFull and
+// ErrNoSuchNick.
+type ReplyError struct {
+	Line Line
+}
+
+func (e *ReplyError) Error() string {
+	// The first parameter is our own nick
+	if len(e.Line.Params) < 2 {
+		return e.Line.Command
+	}
+	return e.Line.Command + " " + strings.Join(e.Line.Params[1:], " ")
+}
+
+func (e *ReplyError) Unwrap() error {
+	switch e.Line.Command {
+	case "433", "436":
+		return ErrNickInUse
+	case "471":
+		return ErrChannelFull
+	case "401":
+		return ErrNoSuchNick
+	}
+	return nil
+}
+
+// IsError reports whether l is an error reply
+func (l Line) IsError() bool {
+	return len(l.Command) == 3 && (l.Command[0] == '4' || l.Command[0] == '5')
+}
+
+// Waiters lets callers wait for the answer of the server to something they
+// sent. Every line received has to be passed to Dispatch.
+type Waiters struct {
+	mutex   sync.Mutex
+	waiters []*Waiter
+}
+
+// Waiter waits for the first line its match function accepts
+type Waiter struct {
+	match func(l Line) (ok bool, err error)
+	done  chan error
+}
+
+// Add starts waiting for a line for which match returns true, with the error
+// to return from Wait. Add before sending, the answer could come first.
+func (ws *Waiters) Add(match func(l Line) (ok bool, err error)) *Waiter {
+	w := &Waiter{match: match, done: make(chan error, 1)}
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	ws.waiters = append(ws.waiters, w)
+	return w
+}
+
+// Dispatch hands a line received to the waiters
+func (ws *Waiters) Dispatch(l Line) {
+	ws.mutex.Lock()
+	waiters := append([]*Waiter{}, ws.waiters...)
+	ws.mutex.Unlock()
+	for _, w := range waiters {
+		if ok, err := w.match(l); ok {
+			ws.finish(w, err)
+		}
+	}
+}
+
+// Fail ends every wait with err, e.g. when the connection is gone
+func (ws *Waiters) Fail(err error) {
+	ws.mutex.Lock()
+	waiters := ws.waiters
+	ws.waiters = nil
+	ws.mutex.Unlock()
+	for _, w := range waiters {
+		w.done <- err
+	}
+}
+
+// Cancel stops waiting without an answer
+func (ws *Waiters) Cancel(w *Waiter) {
+	ws.remove(w)
+}
+
+// finish ends the wait of w with err, unless it ended already
+func (ws *Waiters) finish(w *Waiter, err error) {
+	if ws.remove(w) {
+		w.done <- err
+	}
+}
+
+func (ws *Waiters) remove(w *Waiter) bool {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	for i, waiter := range ws.waiters {
+		if waiter == w {
+			ws.waiters = append(ws.waiters[:i], ws.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Wait returns the error of the answer, or ErrSendTimeout when ctx is done
+// first
+func (ws *Waiters) Wait(ctx context.Context, w *Waiter) error {
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		ws.remove(w)
+		return fmt.Errorf("%w: %s", ErrSendTimeout, ctx.Err())
+	}
+}
+
+// Joined matches our JOIN of channel, or the error reply refusing it
+func Joined(nick func() string, channel string) func(l Line) (bool, error) {
+	return func(l Line) (bool, error) {
+		switch {
+		case l.Command == "JOIN" && strings.EqualFold(l.Param(0), channel) && strings.EqualFold(l.Nick(), nick()):
+			return true, nil
+		case l.IsError() && strings.EqualFold(l.Param(1), channel):
+			return true, &ReplyError{Line: l}
+		}
+		return false, nil
+	}
+}
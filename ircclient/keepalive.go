@@ -0,0 +1,24 @@
+package ircclient
+
+import (
+	"net"
+	"time"
+)
+
+// KeepAlive are the TCP keepalive settings of a connection: the first probe
+// is sent after Idle without traffic, then one every Interval, and the
+// connection is dropped after Count unanswered probes. Zero values keep the
+// system defaults.
+type KeepAlive struct {
+	Idle     time.Duration
+	Interval time.Duration
+	Count    int
+}
+
+// Apply turns on keepalive for conn with these settings
+func (k KeepAlive) Apply(conn *net.TCPConn) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return k.apply(conn)
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package ircclient
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+func (k KeepAlive) apply(conn *net.TCPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		set := func(option, value int) {
+			if sockErr == nil && value > 0 {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, option, value)
+			}
+		}
+		set(syscall.TCP_KEEPIDLE, int(k.Idle/time.Second))
+		set(syscall.TCP_KEEPINTVL, int(k.Interval/time.Second))
+		set(syscall.TCP_KEEPCNT, k.Count)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ircclient
+
+import "net"
+
+// Elsewhere only the idle time can be set, which then is the interval too
+func (k KeepAlive) apply(conn *net.TCPConn) error {
+	if k.Idle > 0 {
+		return conn.SetKeepAlivePeriod(k.Idle)
+	}
+	return nil
+}
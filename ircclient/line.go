@@ -0,0 +1,81 @@
+// Package ircclient is the IRC side of smirc without the web UI: a Client
+// connects to a server, registers, answers PINGs, paces what it sends so
+// that the server does not disconnect it for flooding, and hands the lines
+// it receives to the handlers of the program embedding it. The parts it is
+// made of, parsing lines, waiting for the answers to commands, the errors
+// servers reply with and TCP keepalive, can be used on their own.
+package ircclient
+
+import "strings"
+
+// Line is a line of the IRC protocol, see RFC 1459 section 2.3.1:
+// [@<tags>] [:<prefix>] <command> <params> [:<trailing>]
+type Line struct {
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	// Params holds the middle parameters followed by the trailing one
+	Params []string
+	// Raw is the line as received, line break included
+	Raw string
+}
+
+var tagValueUnescaper = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// ParseLine splits a line received from the server into its parts
+func ParseLine(raw string) Line {
+	l := Line{Raw: raw}
+	line := strings.TrimRight(raw, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		var tags string
+		tags, line, _ = strings.Cut(line[1:], " ")
+		l.Tags = make(map[string]string)
+		for _, tag := range strings.Split(tags, ";") {
+			key, value, _ := strings.Cut(tag, "=")
+			l.Tags[key] = tagValueUnescaper.Replace(value)
+		}
+	}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		l.Prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	line = strings.TrimLeft(line, " ")
+	l.Command, line, _ = strings.Cut(line, " ")
+	l.Command = strings.ToUpper(l.Command)
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, ":") {
+			l.Params = append(l.Params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		l.Params = append(l.Params, param)
+	}
+	return l
+}
+
+// Nick returns the nickname part of a nick!user@host prefix
+func (l Line) Nick() string {
+	nick, _, _ := strings.Cut(l.Prefix, "!")
+	return nick
+}
+
+// Param returns the i-th parameter, or "" if there are not that many
+func (l Line) Param(i int) string {
+	if i < len(l.Params) {
+		return l.Params[i]
+	}
+	return ""
+}
+
+// SplitHostmask splits nick!user@host; user and host may be missing.
+// Everything after the "@" is the host, colons of IPv6 addresses included.
+func SplitHostmask(mask string) (nick, user, host string) {
+	nickUser, host, _ := strings.Cut(mask, "@")
+	nick, user, _ = strings.Cut(nickUser, "!")
+	return nick, user, host
+}
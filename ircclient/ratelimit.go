@@ -0,0 +1,30 @@
+package ircclient
+
+import "time"
+
+// TokenBucket allows burst events at once and then one per interval. It is
+// not safe for concurrent use.
+type TokenBucket struct {
+	burst    float64
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func NewTokenBucket(burst int, interval time.Duration) *TokenBucket {
+	return &TokenBucket{burst: float64(burst), interval: interval, tokens: float64(burst), last: time.Now()}
+}
+
+// Delay takes a token and returns how long to wait until it is due
+func (b *TokenBucket) Delay(now time.Time) time.Duration {
+	b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(b.interval))
+}
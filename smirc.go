@@ -1,38 +1,242 @@
-// This is a minimalistic IRC server. See: https://www.ietf.org/rfc/rfc1459.txt
+// Smirc is a minimalistic IRC client. It keeps one connection to an IRC
+// server and serves a web UI and HTTP, GraphQL and WebSocket APIs for it.
+// See: https://www.ietf.org/rfc/rfc1459.txt
+//
+// Usage:
+//
+//	smirc                connect and serve the web UI, see CONFIG_FILENAME
+//	smirc hash-password  read a password from stdin and print its hash
+//	smirc bench          measure how many messages smirc keeps up with
+//
+// The SQLite driver needs cgo.
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/draychev/smirc/graphql"
+	"github.com/draychev/smirc/ircclient"
+	"github.com/draychev/smirc/store"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 // --- Web Server Endpoints
 const (
 	endPointSendMessage           = "/send-message"
+	endPointCaptcha               = "/captcha"
+	endPointLogin                 = "/login"
+	endPointLogout                = "/logout"
+	endPointThemes                = "/themes/"
+	endPointStatic                = "/static/"
+	endPointManifest              = "/manifest.webmanifest"
+	endPointServiceWorker         = "/sw.js"
 	endPointGetMessagesForChannel = "/get-messages-for-channel"
 	endPointGetUsersForChannel    = "/get-users-for-channel"
+	endPointStarMessage           = "/star-message"
+	endPointReportMessage         = "/report-message"
+	endPointSaveDraft             = "/save-draft"
+	endPointPaste                 = "/paste/"
+	endPointLogs                  = "/logs/"
+	endPointSitemap               = "/sitemap.xml"
+	endPointRobots                = "/robots.txt"
+	endPointHistory               = "/history"
+	endPointSearch                = "/search"
+	endPointWhois                 = "/whois"
+	endPointSaveSearch            = "/save-search"
+	endPointSetTopic              = "/set-topic"
+	endPointRegisterChannel       = "/register-channel"
+	endPointPeekChannel           = "/peek-channel"
+	endPointWebSocket             = "/ws"
+	endPointEvents                = "/events"
+	endPointAPIMessages           = "/api/v1/messages"
+	endPointAPIBookmarks          = "/api/v1/bookmarks"
+	endPointAPIPrefs              = "/api/v1/prefs"
+	endPointAPIChannels           = "/api/v1/channels"
+	endPointAPIUsers              = "/api/v1/users"
+	endPointAPIWhois              = "/api/v1/whois"
+	endPointAPITopic              = "/api/v1/topic"
+	endPointAPISearch             = "/api/v1/search"
+	endPointAPISavedSearches      = "/api/v1/saved-searches"
+	endPointAPIStatus             = "/api/v1/status"
+	endPointAPIGraphQL            = "/api/v1/graphql"
+	endPointAPIConfigSchema       = "/api/v1/config-schema"
+	endPointAPIRelay              = "/api/v1/relay"
+	endPointAPIBridge             = "/api/v1/bridge"
+	endPointAPIReports            = "/api/v1/reports"
+	endPointAPIAdminKill          = "/api/v1/admin/kill"
+	endPointAPIAdminRehash        = "/api/v1/admin/rehash"
+	endPointAPIAdminConfig        = "/api/v1/admin/config"
+	endPointAdminConfig           = "/admin/config"
+	endPointAPIAdminHooks         = "/api/v1/admin/hooks"
+	endPointAdminHooks            = "/admin/hooks"
+	endPointAPIAdminDeadLetters   = "/api/v1/admin/dead-letters"
+	endPointAPIAdminRedact        = "/api/v1/admin/redact"
+	endPointAPIAdminAnnotate      = "/api/v1/admin/annotate"
+	endPointAPIAdminMask          = "/api/v1/admin/mask"
+	endPointAPIAdminAudit         = "/api/v1/admin/audit"
+	endPointAPIAdminPurge         = "/api/v1/admin/purge"
+	endPointAPIAdminDeletions     = "/api/v1/admin/deletions"
+	endPointAPIAdminExport        = "/api/v1/admin/export"
+	endPointAPIAdminGuests        = "/api/v1/admin/guests"
+	endPointAPIAdminReports       = "/api/v1/admin/reports"
+	endPointDebugInject           = "/debug/inject"
+	endPointMetrics               = "/metrics"
+	endPointHealthz               = "/healthz"
+	endPointReadyz                = "/readyz"
+	endPointAPIRegisterChannel    = "/api/v1/chanserv/register"
 )
 
 // --- HTML Components
 const (
-	formKeyMessage = "message"
+	formKeyMessage      = "message"
+	formKeyTopic        = "topic"
+	formKeyDeliveryID   = "id"
+	formKeyMessageID    = "id"
+	formKeyNick         = "nick"
+	formKeyReason       = "reason"
+	formKeyNote         = "note"
+	formKeyChannel      = "channel"
+	formKeyLastID       = "last-id"
+	formKeyClient       = "client"
+	formKeyDescription  = "description"
+	formKeyStatus       = "status"
+	formKeyAction       = "action"
+	formKeySeconds      = "seconds"
+	formKeyLine         = "line"
+	formKeyLines        = "lines"
+	formKeyUser         = "user"
+	formKeyPassword     = "password"
+	formKeyCSRFToken    = "csrf-token"
+	formKeyQuery        = "q"
+	formKeySince        = "since"
+	formKeyUntil        = "until"
+	formKeyAround       = "around"
+	formKeyName         = "name"
+	formKeyAlert        = "alert"
+	formKeyPseudonymize = "pseudonymize"
 )
 
 // --- Default Config Values
 const (
 	defaultIRCServer           = "irc.freenode.net"
 	defaultIRCPort             = 6667
+	defaultIRCTLSPort          = 6697
 	defaultWebServerPortNumber = 8080
 	defaultChannel             = "#midnightcafe"
+	defaultThreadWindowSeconds = 300
+	defaultPasteThresholdLines = 5
+	defaultPasteExpiryHours    = 24
+	defaultPasteQuotaBytes     = 1 << 20
+	defaultMaxBodyBytes        = 64 << 10
+	defaultHistoryPageSize     = 50
+	defaultChanServNick        = "ChanServ"
+	defaultNickServNick        = "NickServ"
+	registrationTimeout        = 30 * time.Second
+	joinTimeout                = 10 * time.Second
+	echoTimeout                = 30 * time.Second
+	whoisTimeout               = 10 * time.Second
+	pingInterval               = 30 * time.Second
+	defaultCTCPLimit           = 3
+	defaultCTCPWindowSeconds   = 60
+	defaultCTCPIgnoreSeconds   = 300
+	defaultCTCPVersion         = "smirc - https://github.com/draychev/smirc"
+	defaultSASLMechanism       = saslScramSHA256
+	defaultDialTimeout         = 30
+	defaultTLSHandshakeTimeout = 30
+	defaultWelcomeTimeout      = 60
+	defaultReconnectDelay      = 5
+	defaultRejoinDelay         = 10
+	defaultQuitMessage         = "Leaving"
+	defaultShutdownTimeout     = 10
+	defaultWatchdogRead        = 600
+	defaultWatchdogSend        = 120
+	watchdogCheckInterval      = 10 * time.Second
+	defaultMaxChannels         = 20
+	defaultPeekGraceSeconds    = 60
+	defaultWSPingInterval      = 30
+	defaultFloodBurst          = 5
+	defaultFloodInterval       = 2
+	maxLineBytes               = 512
+	// What the server may add in front of our lines when relaying them,
+	// until our own JOIN shows our actual user@host
+	maxUserHostBytes           = len("~username@") + 63
+	defaultGuestLinesPerHour   = 60
+	defaultGuestInterval       = 3
+	defaultGuestMuteSeconds    = 60
+	maxGuestMute               = 24 * time.Hour
+	defaultCaptchaSessionHours = 24
+	defaultWebSessionHours     = 7 * 24
+	defaultTheme               = themeAuto
+	defaultAutocertCacheDir    = "autocert"
+	passwordHashIterations     = 600000
+	maxLoginFailures           = 5
+	loginFailureWindow         = 15 * time.Minute
+	captchaVerifyTimeout       = 10 * time.Second
+	defaultHistorySize         = 1000
+	defaultBufferSize          = 1000
+	listInterval               = 10 * time.Minute
+	whoInterval                = 30 * time.Second
+	maxReconnectDelay          = 5 * time.Minute
+)
+
+// --- What the web UI does with mIRC formatting codes
+const (
+	formattingRender = "render"
+	formattingStrip  = "strip"
+)
+
+// --- SASL mechanisms
+const (
+	saslScramSHA256 = "SCRAM-SHA-256"
+	saslPlain       = "PLAIN"
 )
 
 // --- Environment Variables
@@ -41,341 +245,12782 @@ var (
 	envVarUserName       = os.Getenv("IRC_USERNAME")
 	envVarRealName       = os.Getenv("IRC_REALNAME")
 	envVarConfigFileName = os.Getenv("CONFIG_FILENAME")
+	envVarSASLUsername   = os.Getenv("IRC_SASL_USERNAME")
+	envVarSASLPassword   = os.Getenv("IRC_SASL_PASSWORD")
 )
 
 var (
-	lastWho = time.Now().Add(-1)
+	lastWho  = time.Now().Add(-1)
+	nextWho  int
+	lastList time.Time
 )
 
 // IRCConfig keeps the config needed to connect to the IRC network
 type IRCConfig struct {
 	Server              string `json:"server"`
 	Port                int    `json:"port"`
-	Channel             string `json:"channel"`
+	TLS                 bool   `json:"tls"`
+	TLSSkipVerify       bool   `json:"tls-skip-verify"`
+	TLSFingerprintsFile string `json:"tls-fingerprints-file"`
+
+	// TLSPins are accepted SHA-256 certificate fingerprints ("AB:CD:...") or
+	// public key hashes ("sha256/<base64>"); when set they replace CA checks
+	TLSPins []string `json:"tls-pins"`
+
+	// WebSocketURL connects over IRC-over-WebSocket (ws:// or wss://)
+	// instead of plain IRC to server and port
+	WebSocketURL string `json:"websocket-url"`
+	Channel      string `json:"channel"`
+	// Channels are all the channels to join; Channel is the first of them
+	Channels []string `json:"channels"`
+	// ChannelPatterns (e.g. "#project-*") also join the matching channels
+	// found with LIST or that we are invited to, up to MaxChannels in total
+	ChannelPatterns []string `json:"channel-patterns"`
+	MaxChannels     int      `json:"max-channels"`
+	// PeekGraceSeconds is how long a channel peeked at from the web UI is
+	// kept after the last page showing it was loaded
+	PeekGraceSeconds    int    `json:"peek-grace-seconds"`
 	WebServerPortNumber int    `json:"web-server-port-number"`
+	Threads             bool   `json:"threads"`
+	ThreadWindowSeconds int    `json:"thread-window-seconds"`
+	BookmarksFile       string `json:"bookmarks-file"`
+	// PrefsFile keeps the preferences of the web users when there is no
+	// DatabaseFile, which keeps them otherwise
+	PrefsFile string `json:"prefs-file"`
+	// DatabaseFile is a SQLite database keeping the messages across
+	// restarts; the latest HistorySize of them are loaded on startup
+	DatabaseFile string `json:"database-file"`
+	HistorySize  int    `json:"history-size"`
+	// BufferSize is how many messages of each channel are kept in memory
+	BufferSize          int    `json:"buffer-size"`
+	PublicURL           string `json:"public-url"`
+	PasteThresholdLines int    `json:"paste-threshold-lines"`
+	PasteExpiryHours    int    `json:"paste-expiry-hours"`
+	PasteQuotaBytes     int    `json:"paste-quota-bytes"`
+	MaxBodyBytes        int64  `json:"max-body-bytes"`
+	HistoryPageSize     int    `json:"history-page-size"`
+	OperName            string `json:"oper-name"`
+	OperPassword        string `json:"oper-password"`
+	AdminToken          string `json:"admin-token"`
+	// DebugInject enables /debug/inject, which breaks the connection on
+	// purpose to test how smirc copes. Never turn it on in production.
+	DebugInject  bool   `json:"debug-inject"`
+	ChanServNick string `json:"chanserv-nick"`
+	// NickServPassword identifies us to NickServ after connecting. If our
+	// nick was taken we use AlternateNick and regain ours once identified.
+	NickServNick      string `json:"nickserv-nick"`
+	NickServPassword  string `json:"nickserv-password"`
+	AlternateNick     string `json:"alternate-nick"`
+	CTCPLimit         int    `json:"ctcp-limit"`
+	CTCPWindowSeconds int    `json:"ctcp-window-seconds"`
+	CTCPIgnoreSeconds int    `json:"ctcp-ignore-seconds"`
+	CTCPIgnoreAll     bool   `json:"ctcp-ignore-all"`
+	// CTCPReplies are the answers to CTCP queries such as VERSION, keyed by
+	// the query. An empty answer leaves the query unanswered.
+	CTCPReplies   map[string]string `json:"ctcp-replies"`
+	SASLMechanism string            `json:"sasl-mechanism"`
+	SASLUsername  string            `json:"sasl-username"`
+	SASLPassword  string            `json:"sasl-password"`
+
+	// Timeouts in seconds for connecting to the IRC server and for it to
+	// welcome us. A failed attempt is retried after reconnect-delay-seconds,
+	// doubling up to 5 minutes.
+	DialTimeoutSeconds         int `json:"dial-timeout-seconds"`
+	TLSHandshakeTimeoutSeconds int `json:"tls-handshake-timeout-seconds"`
+	RegistrationTimeoutSeconds int `json:"registration-timeout-seconds"`
+	ReconnectDelaySeconds      int `json:"reconnect-delay-seconds"`
+
+	// AutoRejoin joins a configured channel again rejoin-delay-seconds
+	// after we were kicked from it
+	AutoRejoin         bool `json:"auto-rejoin"`
+	RejoinDelaySeconds int  `json:"rejoin-delay-seconds"`
+
+	// TCP keepalive of the connection to the server: the first probe after
+	// tcp-keepalive-idle-seconds without traffic, then one every
+	// tcp-keepalive-interval-seconds, giving up after tcp-keepalive-count
+	// probes. Unset they are Go's and the system's defaults, as is
+	// TCP_NODELAY, which Go turns on.
+	TCPKeepAliveIdleSeconds     int   `json:"tcp-keepalive-idle-seconds"`
+	TCPKeepAliveIntervalSeconds int   `json:"tcp-keepalive-interval-seconds"`
+	TCPKeepAliveCount           int   `json:"tcp-keepalive-count"`
+	TCPNoDelay                  *bool `json:"tcp-nodelay"`
+
+	// QuitMessage is said when smirc is stopped. Sending what is still
+	// queued and waiting for the server to hang up may take up to
+	// shutdown-timeout-seconds.
+	QuitMessage            string `json:"quit-message"`
+	ShutdownTimeoutSeconds int    `json:"shutdown-timeout-seconds"`
+
+	// The connection is cycled when nothing was read from it for
+	// watchdog-read-seconds, or queued lines were not sent for
+	// watchdog-send-seconds
+	WatchdogReadSeconds int `json:"watchdog-read-seconds"`
+	WatchdogSendSeconds int `json:"watchdog-send-seconds"`
+
+	// Lines are sent to the server at most flood-burst-lines at once and
+	// then one every flood-interval-seconds, to stay clear of Excess Flood
+	FloodBurstLines      int `json:"flood-burst-lines"`
+	FloodIntervalSeconds int `json:"flood-interval-seconds"`
+
+	// GuestMode limits what each web client may send to the channel: lines
+	// per hour and seconds between messages. A client going over the limits
+	// is muted, twice as long every time.
+	GuestMode               bool `json:"guest-mode"`
+	GuestLinesPerHour       int  `json:"guest-lines-per-hour"`
+	GuestMinIntervalSeconds int  `json:"guest-min-interval-seconds"`
+	GuestMuteSeconds        int  `json:"guest-mute-seconds"`
+
+	// CaptchaProvider, "hcaptcha" or "turnstile", makes web clients solve a
+	// captcha before they may send anything. A solved captcha is good for
+	// captcha-session-hours.
+	CaptchaProvider     string `json:"captcha-provider"`
+	CaptchaSiteKey      string `json:"captcha-site-key"`
+	CaptchaSecretKey    string `json:"captcha-secret-key"`
+	CaptchaSessionHours int    `json:"captcha-session-hours"`
+
+	// WebUsers maps user names to password hashes made with
+	// "smirc hash-password". With them or a WebToken, only logged in web
+	// clients may send, and with WebAuthReads also read. Logins last
+	// web-session-hours.
+	WebUsers        map[string]string `json:"web-users"`
+	WebToken        string            `json:"web-token"`
+	WebAuthReads    bool              `json:"web-auth-reads"`
+	WebSessionHours int               `json:"web-session-hours"`
+
+	// APITokens let scripts use the API with "Authorization: Bearer
+	// <token>" instead of logging in, as far as the scopes of the token go
+	APITokens []APIToken `json:"api-tokens"`
+
+	// WSPingIntervalSeconds is how often browsers on /ws are pinged; one
+	// that stays silent for two intervals is dropped. AutoAwayMessage, if
+	// set, marks us away with it while no browser is connected.
+	WSPingIntervalSeconds int    `json:"ws-ping-interval-seconds"`
+	AutoAwayMessage       string `json:"auto-away-message"`
+
+	// RetentionHours is how long messages, pastes and bookmarks are kept;
+	// 0 keeps them until restart. Deletions are logged to DeletionLogFile.
+	RetentionHours  int    `json:"retention-hours"`
+	DeletionLogFile string `json:"deletion-log-file"`
+
+	// Hooks are run on connection events, e.g. to alert someone. The
+	// deliveries that failed for good are kept in DeadLetterFile, or in
+	// memory until restart, to be retried.
+	Hooks          []Hook `json:"hooks"`
+	DeadLetterFile string `json:"dead-letter-file"`
+
+	// ReportNoticeTarget, a channel or nick, gets a NOTICE about every
+	// message reported from the web UI
+	ReportNoticeTarget string `json:"report-notice-target"`
+
+	// VirtualChannels are read-only channels of the web UI that are fed
+	// through the relay API instead of IRC, e.g. build notifications
+	VirtualChannels []VirtualChannel `json:"virtual-channels"`
+
+	// Bridges may post the messages of users of other chat networks to
+	// IRC channels through the bridge API
+	Bridges []Bridge `json:"bridges"`
+
+	// TorControlAddress publishes the web UI as an onion service through
+	// the control port of a running tor, e.g. "127.0.0.1:9051"
+	TorControlAddress  string `json:"tor-control-address"`
+	TorControlPassword string `json:"tor-control-password"`
+	TorOnionKeyFile    string `json:"tor-onion-key-file"`
+
+	// WebTLSCertFile and WebTLSKeyFile serve the web UI over HTTPS. With
+	// WebClientCAFile set, clients must present a certificate signed by it.
+	// Those whose certificate has one of the AdminCertSubjects, a subject
+	// such as "CN=ops" or a SHA-256 fingerprint, may use the admin API.
+	WebTLSCertFile    string   `json:"web-tls-cert-file"`
+	WebTLSKeyFile     string   `json:"web-tls-key-file"`
+	WebClientCAFile   string   `json:"web-client-ca-file"`
+	AdminCertSubjects []string `json:"admin-cert-subjects"`
+
+	// WebAutocertDomains get their certificates from Let's Encrypt instead
+	// of WebTLSCertFile, which reaches us on port 443, the web server
+	// port, or on WebHTTPPortNumber. Certificates are kept in
+	// WebAutocertCacheDir, and Let's Encrypt writes to WebAutocertEmail
+	// about problems with them.
+	WebAutocertDomains  []string `json:"web-autocert-domains"`
+	WebAutocertEmail    string   `json:"web-autocert-email"`
+	WebAutocertCacheDir string   `json:"web-autocert-cache-dir"`
+	// WebHTTPPortNumber serves plain HTTP next to HTTPS, e.g. on port 80,
+	// that only redirects to HTTPS
+	WebHTTPPortNumber int `json:"web-http-port-number"`
+
+	// Templates overrides the text/template used for messages smirc sends on
+	// its own, keyed by the template name (e.g. "paste")
+	Templates map[string]string `json:"templates"`
+
+	// UITemplatesDir holds html/templates replacing the built-in ones of the
+	// web UI with the same file name, e.g. "index.html"
+	UITemplatesDir string `json:"ui-templates-dir"`
+
+	// Theme is the CSS theme of the web UI for those who did not pick one,
+	// "auto" by default, which follows the light or dark mode of the
+	// browser. ThemesDir holds more themes, or replacements of the built-in
+	// ones, as <name>.css files.
+	Theme     string `json:"theme"`
+	ThemesDir string `json:"themes-dir"`
+
+	// SpoilerTags mark messages starting with one of them, e.g.
+	// "[spoiler]", as hidden until clicked in the web UI
+	SpoilerTags []string `json:"spoiler-tags"`
+
+	// AutolinkURLs turns http(s) URLs in messages into links, and
+	// InlineImages also shows the images they point to
+	AutolinkURLs bool `json:"autolink-urls"`
+	InlineImages bool `json:"inline-images"`
+
+	// Formatting is formattingRender to show the colors, bold, italics
+	// etc. of mIRC formatting codes in the web UI, or formattingStrip to
+	// drop them
+	Formatting string `json:"formatting"`
+
+	// TimeFormat and Timezone are how the web UI shows the time of messages
+	// to those who did not pick their own: timeFormat24h by default, in
+	// the time zone of the server
+	TimeFormat string `json:"time-format"`
+	Timezone   string `json:"timezone"`
+
+	// PublicLogs publishes the logs at /logs/ to everybody, even with
+	// WebAuthReads, and lists them in /sitemap.xml for search engines. The
+	// channels in LogsOptOut have no logs, Archive has the settings of the
+	// others. Messages starting with logsNoLogTag and those of the nicks in
+	// LogsOptOutNicks are left out of the logs.
+	PublicLogs      bool                       `json:"public-logs"`
+	LogsOptOut      []string                   `json:"logs-opt-out"`
+	Archive         map[string]ArchiveSettings `json:"archive"`
+	LogsOptOutNicks []string                   `json:"logs-opt-out-nicks"`
+	// PseudonymKey keys the pseudonyms of nicks, see pseudonym
+	PseudonymKey string `json:"pseudonym-key"`
+
+	// NickChangeMessages adds "alice is now known as alicia" to the
+	// channels of a user who changed nicks, which otherwise only the server
+	// buffer shows
+	NickChangeMessages bool `json:"nick-change-messages"`
+	// PresenceMessages adds "→ alice joined", "← alice left (reason)" and
+	// the like to the channels as users come and go, nick changes included
+	PresenceMessages bool `json:"presence-messages"`
+
+	// VendorCaps are the capabilities of particular servers to use when the
+	// server offers them, see vendorCaps
+	VendorCaps []string `json:"vendor-caps"`
+	// DisableCaps are capabilities not to request even when the server
+	// offers them, e.g. server-time for servers with a wrong clock
+	DisableCaps []string `json:"disable-caps"`
 }
 
 // IRC keeps all the inbound and outbound IRC messages
 type IRC struct {
 	messagesMutex sync.Mutex
-	messages      []IRCMessage
-	usersMutex    sync.Mutex
-	users         map[string]*User
-	config        *IRCConfig
-	conn          net.Conn
+	// messages has a ring buffer per channel, "" holding the raw lines
+	messages   map[string]*messageRing
+	usersMutex sync.Mutex
+	users      map[string]*User
+	config     *IRCConfig
+	connMutex  sync.Mutex
+	// client is the current connection to the server, nil between
+	// connections
+	client        *ircclient.Client
+	lastMessageID int
+	stateMutex    sync.Mutex
+	nick          string
+	// userHost is the user@host part of our hostmask, as seen on our JOIN
+	userHost   string
+	userModes  map[rune]bool
+	oper       bool
+	account    string
+	sasl       *saslSession
+	registered bool
+	// serverCaps collects the capabilities the server offers while
+	// registering, caps has those it acknowledged with the values offered
+	serverCaps []string
+	caps       map[string]string
+	// isupport has the tokens of RPL_ISUPPORT, e.g. PREFIX, with their
+	// values
+	isupport map[string]string
+	// joined has the channels we are in on this connection, lower case
+	joined map[string]bool
+	// topics has the topics of the channels we are in, lower case
+	topics map[string]Topic
+	// channelModes has the modes of the channels we are in, lower case,
+	// with their parameters, e.g. the limit for l
+	channelModes  map[string]map[rune]string
+	channelsMutex sync.Mutex
+	channels      []string
+	// store is where messages are persisted; nil keeps them in memory only.
+	// It is read directly and written through writer.
+	store  MessageStore
+	writer *StoreWriter
+	// stopped is closed once Run returned
+	stopped chan struct{}
+	// receiveMutex has the lines from the server, and those injected for
+	// testing, handled one at a time
+	receiveMutex sync.Mutex
+	// waiters get the answers to what the web UI waits for, like joins
+	waiters ircclient.Waiters
 }
 
-// User is an IRC User
-type User struct {
-	Nickname string
-	Hostname string
-	Server   string
-	Channel  string
+// serverBuffer is the read-only channel of the web UI that collects what
+// the server tells us outside of channels, like the MOTD, notices and
+// errors, together with our connection events
+const serverBuffer = "*server*"
+
+// apiStatus is the JSON representation of the connection status
+type apiStatus struct {
+	Server    string   `json:"server"`
+	Port      int      `json:"port"`
+	Channel   string   `json:"channel"`
+	Channels  []string `json:"channels"`
+	Nick      string   `json:"nick"`
+	UserModes string   `json:"user-modes"`
+	Oper      bool     `json:"oper"`
+	Account   string   `json:"account,omitempty"`
+
+	CTCPReceived int `json:"ctcp-received"`
+	CTCPDropped  int `json:"ctcp-dropped"`
+
+	OversizedRequests  int64 `json:"oversized-requests"`
+	PasteQuotaExceeded int   `json:"paste-quota-exceeded"`
+
+	WebViewers int `json:"web-viewers"`
+
+	Onion string `json:"onion,omitempty"`
+
+	// SendQueue is how many lines wait to be sent to the server
+	SendQueue int `json:"send-queue"`
+	// WatchdogRestarts is how often the watchdog cycled a stuck connection
+	WatchdogRestarts int `json:"watchdog-restarts"`
+	// Caps are the capabilities negotiated with the server
+	Caps []string `json:"caps"`
 }
 
-// IRCMessage is a message sent or received from the IRC network
-type IRCMessage struct {
-	channel  string
-	userName string
-	message  string
+// Watchdog notices a connection that is open but stuck: nothing was read
+// from it for readTimeout, or lines queued for it were not sent for
+// sendTimeout. It then closes the connection, which makes Run reconnect.
+type Watchdog struct {
+	mutex       sync.Mutex
+	readTimeout time.Duration
+	sendTimeout time.Duration
+	conn        net.Conn
+	lastRead    time.Time
+	lastSent    time.Time
+	restarts    int
 }
 
-func (irc *IRC) Join() {
-	log.Printf(">> JOIN %s\n\n", irc.config.Channel)
-	_, _ = fmt.Fprintf(irc.conn, "JOIN %s\r\n", irc.config.Channel)
+// Chaos injects failures into the connection to the server on request, to
+// test reconnecting and backpressure against a running instance
+type Chaos struct {
+	mutex    sync.Mutex
+	lagUntil time.Time
+	lag      time.Duration
 }
 
-func (irc *IRC) Pong(message string) {
-	log.Printf(">> PONG %s\n\n", message[5:])
-	_, _ = fmt.Fprintf(irc.conn, "PONG %s\r\n", message[5:])
+// --- Chaos actions
+const (
+	chaosDisconnect = "disconnect"
+	chaosLag        = "lag"
+	chaosLine       = "line"
+	chaosFlood      = "flood"
+)
+
+// Metrics counts what smirc does for the Prometheus endpoint
+type Metrics struct {
+	mutex      sync.Mutex
+	received   map[string]int64
+	sent       map[string]int64
+	reconnects int64
+	pingRTT    time.Duration
+	requests   map[string]*latencyHistogram
 }
 
-func (irc *IRC) AddIncomingMessage(chatRoom, userName, message string) {
-	irc.messagesMutex.Lock()
-	defer irc.messagesMutex.Unlock()
-	irc.messages = append(irc.messages, IRCMessage{chatRoom, userName, message})
+// latencyHistogram counts HTTP requests into the latencyBuckets, in seconds
+type latencyHistogram struct {
+	counts []int64
+	sum    float64
+	count  int64
 }
 
-func (irc *IRC) SendMessage(chatRoom, message string) {
-	irc.messagesMutex.Lock()
-	defer irc.messagesMutex.Unlock()
-	irc.messages = append(irc.messages, IRCMessage{chatRoom, envVarNickName, message})
-	sendMessage(irc.conn, irc.config.Channel, message)
+// latencyBuckets are the upper bounds of the request latency histogram, in
+// seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// pingTokenPrefix marks the PINGs we send to measure the round trip time
+const pingTokenPrefix = "smirc-"
+
+// CTCPLimiter rate limits CTCP requests per source. Answering every request
+// in a big channel is an easy way to get disconnected for excess flood, so a
+// source that sends more than limit requests within window is ignored for a
+// while.
+type CTCPLimiter struct {
+	mutex     sync.Mutex
+	limit     int
+	window    time.Duration
+	ignoreFor time.Duration
+	ignoreAll bool
+	sources   map[string]*ctcpSource
+	received  int
+	dropped   int
 }
 
-func (irc *IRC) GetMessagesForChatRoom(channel string) string {
-	irc.messagesMutex.Lock()
-	defer irc.messagesMutex.Unlock()
-	var msgs []string
-	for _, m := range irc.messages {
-		if m.channel == channel {
-			msgs = append(msgs, fmt.Sprintf("%s: %s", m.userName, m.message))
-		}
-	}
-	return strings.Join(msgs, "<br/>")
+type ctcpSource struct {
+	requests     []time.Time
+	ignoredUntil time.Time
 }
 
-func (irc *IRC) GetUsersForChannel() string {
-	irc.usersMutex.Lock()
-	defer irc.usersMutex.Unlock()
-	var users []string
-	for _, u := range irc.users {
-		if u.Channel == irc.config.Channel {
-			users = append(users, u.Nickname)
+// --- Channel registration states
+const (
+	registrationPending    = "pending"
+	registrationRegistered = "registered"
+	registrationFailed     = "failed"
+	registrationTimedOut   = "timeout"
+)
+
+// ChannelRegistration tracks the last REGISTER request sent to ChanServ
+type ChannelRegistration struct {
+	mutex   sync.Mutex
+	Channel string    `json:"channel,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Reply   string    `json:"reply,omitempty"`
+	Started time.Time `json:"started,omitempty"`
+}
+
+// Bookmarks keeps the messages starred in the web UI by user, see webUser.
+// When fileName is set the bookmarks are saved there so they survive
+// restarts.
+type Bookmarks struct {
+	mutex    sync.Mutex
+	fileName string
+	users    map[string]map[int]apiMessage
+}
+
+// Drafts keeps unsent composer text by user, see webUser, and channel so
+// that reloading the page does not lose a half-written message. They are
+// saved in the database, if there is one, so they survive restarts.
+type Drafts struct {
+	mutex  sync.Mutex
+	store  DraftsStore
+	drafts map[string]map[string]string
+}
+
+// DraftsStore is a storage backend keeping the drafts
+type DraftsStore interface {
+	LoadDrafts() (map[string]map[string]string, error)
+	// SaveDraft stores the draft of user for channel, deleting it when text
+	// is empty
+	SaveDraft(user, channel, text string) error
+}
+
+// Prefs keeps the preferences of the web users, like their time zone, as
+// JSON values by user and key. They are saved in the database, or else in
+// fileName, so they survive restarts.
+type Prefs struct {
+	mutex    sync.Mutex
+	store    PrefsStore
+	fileName string
+	users    map[string]map[string]json.RawMessage
+}
+
+// PrefsStore is a storage backend keeping the preferences
+type PrefsStore interface {
+	LoadPrefs() (map[string]map[string]json.RawMessage, error)
+	// SavePrefs replaces all preferences of user
+	SavePrefs(user string, prefs map[string]json.RawMessage) error
+}
+
+// Paste is a long message from the web UI, served at /paste/<id> instead of
+// being sent to the channel line by line
+type Paste = store.Paste
+
+// Pastes keeps the pastes until they expire. Every client may paste up to
+// quota bytes a day, so that a public instance does not become a file host.
+// They are saved in the database, if there is one, so they survive restarts.
+type Pastes struct {
+	mutex    sync.Mutex
+	store    PastesStore
+	expiry   time.Duration
+	pastes   map[string]*Paste
+	quota    int
+	day      string
+	used     map[string]int
+	rejected int
+}
+
+// PastesStore is a storage backend keeping the pastes
+type PastesStore interface {
+	LoadPastes() ([]*Paste, error)
+	SavePaste(paste *Paste) error
+	DeletePastes(ids []string) error
+}
+
+// GuestLimits enforces the guest mode limits per web client
+type GuestLimits struct {
+	mutex    sync.Mutex
+	perHour  int
+	interval time.Duration
+	mute     time.Duration
+	guests   map[string]*guest
+}
+
+// guest is what a web client sent recently and how often it was muted
+type guest struct {
+	Client     string    `json:"client"`
+	Sent       int       `json:"sent-last-hour"`
+	Strikes    int       `json:"strikes"`
+	MutedUntil time.Time `json:"muted-until"`
+	sent       []time.Time
+}
+
+// guestLimitError tells a guest how long to wait before sending again
+type guestLimitError struct {
+	reason string
+	wait   time.Duration
+}
+
+func (e guestLimitError) Error() string {
+	return fmt.Sprintf("%s, try again in %s", e.reason, e.wait.Round(time.Second))
+}
+
+// Fingerprints remembers the certificate fingerprint of every server we
+// connected to over TLS, so that a changed certificate gets noticed. When
+// fileName is set they are saved there and survive restarts.
+type Fingerprints struct {
+	mutex    sync.Mutex
+	fileName string
+	known    map[string]string
+}
+
+// --- Hook events
+const (
+	hookConnect    = "connect"
+	hookDisconnect = "disconnect"
+	hookHighlight  = "highlight"
+	hookReport     = "report"
+	hookWatchdog   = "watchdog"
+	hookAlert      = "alert"
+	hookKick       = "kick"
+	hookDigest     = "digest"
+	hookTimeout    = 30 * time.Second
+	// hookRetryDelay is the wait before the first retry of a failed
+	// delivery, doubling for every further one
+	hookRetryDelay = 2 * time.Second
+	// hookDeliveryLogSize is how many deliveries the log keeps
+	hookDeliveryLogSize = 200
+	// maxDeadLetters is how many failed deliveries are kept to be retried
+	maxDeadLetters = 1000
+	// maxQuietEvents is how many events are held back for a user during
+	// their quiet hours
+	maxQuietEvents = 1000
+)
+
+// Hook runs an external command and/or posts to a webhook when event
+// happens. The command gets the event as SMIRC_* environment variables and
+// as JSON on stdin; the webhook gets the same JSON.
+type Hook struct {
+	Event   string   `json:"event"`
+	Command []string `json:"command,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	// Retries is how often a failed delivery is tried again
+	Retries int `json:"retries,omitempty"`
+}
+
+// ArchiveSettings control the logs of a channel
+type ArchiveSettings struct {
+	// Public publishes the logs of the channel with public-logs, which it
+	// does by default; if false they are kept from search engines and
+	// need a login with web-auth-reads
+	Public *bool `json:"public,omitempty"`
+	// AnonymizeNicks numbers the nicks in the logs instead, "User 1" and
+	// so on every day, for those who did not log in
+	AnonymizeNicks bool `json:"anonymize-nicks,omitempty"`
+	// PseudonymizeNicks shows them their pseudonyms instead, which stay the
+	// same from day to day
+	PseudonymizeNicks bool `json:"pseudonymize-nicks,omitempty"`
+}
+
+// VirtualChannel is a read-only channel fed by a webhook or bridge, which
+// authenticates with the channel's token
+type VirtualChannel struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// jsonSchema is the part of JSON Schema needed to describe the config
+type jsonSchema struct {
+	Schema string `json:"$schema,omitempty"`
+	Title  string `json:"title,omitempty"`
+	// Type is a type name, or a list of them for values that may be null
+	Type       interface{}            `json:"type"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	// AdditionalProperties is false for structs and the schema of the
+	// values for maps
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema `json:"items,omitempty"`
+	Enum                 []string    `json:"enum,omitempty"`
+}
+
+// Bridge connects IRC channels to another chat network: it authenticates
+// with its token and posts the messages of the users over there
+type Bridge struct {
+	Name     string   `json:"name"`
+	Token    string   `json:"token"`
+	Channels []string `json:"channels"`
+	// RelayMsg sends the messages as coming from the users themselves,
+	// "nick/name", on servers with draft/relaymsg, instead of prefixing
+	// them with "<nick>"
+	RelayMsg bool `json:"relaymsg"`
+}
+
+// APIToken is a bearer token for scripts, e.g. CI jobs, allowed to do what
+// its Scopes, scopeRead and scopeSend, say
+type APIToken struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// --- API token scopes
+const (
+	// scopeRead reads messages and everything else readers of the web UI can
+	scopeRead = "read"
+	// scopeSend sends messages and does everything else that needs a login
+	scopeSend = "send"
+)
+
+// hasScope reports whether the token grants scope
+func (token APIToken) hasScope(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
 		}
 	}
-	sort.Strings(users)
-	return strings.Join(users, ",")
+	return false
 }
 
-func (irc *IRC) ResetUsersForChannel() {
-	irc.usersMutex.Lock()
-	defer irc.usersMutex.Unlock()
-	irc.users = nil
+// relayMessage is the JSON body accepted by the relay API
+type relayMessage struct {
+	Nick    string `json:"nick"`
+	Message string `json:"message"`
 }
 
-func (irc *IRC) RemoveUser(nickname string) {
-	irc.usersMutex.Lock()
-	defer irc.usersMutex.Unlock()
-	nickname = strings.Trim(nickname, ":@+ \n")
-	delete(irc.users, nickname)
+// hookEvent is the JSON payload of a hook
+type hookEvent struct {
+	Event   string `json:"event"`
+	Server  string `json:"server"`
+	Channel string `json:"channel,omitempty"`
+	Nick    string `json:"nick,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Time is when it happened, now unless set, e.g. when the message of
+	// an alert was sent
+	Time time.Time `json:"time"`
+	// User and Search are the user and the name of the saved search that
+	// raised an alert; User and Keyword the user and the keyword of theirs
+	// that raised a highlight
+	User    string `json:"user,omitempty"`
+	Search  string `json:"search,omitempty"`
+	Keyword string `json:"keyword,omitempty"`
+	// Digest holds the events of a digest, oldest first
+	Digest []hookEvent `json:"digest,omitempty"`
 }
 
-func (irc *IRC) AddUserForChannel(user *User) {
-	irc.usersMutex.Lock()
-	defer irc.usersMutex.Unlock()
-	// Remove any special characters from the nickname, username, and hostname
-	user.Nickname = strings.Trim(user.Nickname, ":@+ \n")
-	user.Hostname = strings.Trim(user.Hostname, ":@+ \n")
-	irc.users[user.Nickname] = user
+// OnionService publishes the web UI as a Tor onion service. The service only
+// lives as long as the control connection, so it is kept open. When keyFile
+// is set the onion key is saved there and the address survives restarts.
+type OnionService struct {
+	mutex    sync.Mutex
+	keyFile  string
+	address  string
+	password string
 }
 
-var irc = &IRC{}
+// --- Moderation actions
+const (
+	moderationRedact   = "redact"
+	moderationAnnotate = "annotate"
+	moderationMask     = "mask"
+)
 
-func handlerSendMessage(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Printf("Error: %s", err)
-		http.Redirect(w, r, "/", 302)
-		return
-	}
-	message := r.Form.Get(formKeyMessage)
-	irc.SendMessage(irc.config.Channel, message)
-	http.Redirect(w, r, "/", 302)
+// ModerationLog is the audit trail of redacted and annotated messages. It
+// keeps the original text, so it is only available through the admin API.
+type ModerationLog struct {
+	mutex   sync.Mutex
+	entries []moderationEntry
 }
 
-func handlerGetMessagesForChannel(w http.ResponseWriter, r *http.Request) {
-	content := `<!doctype html><html itemscope="" itemtype="http://schema.org/WebPage" lang="en">
-	<head><title>smirc: messages</title><meta http-equiv="refresh" content="1"></head>
-    <body>` + irc.GetMessagesForChatRoom(irc.config.Channel) + `</body></html>`
-	_, _ = fmt.Fprintf(w, "%s", content)
+type moderationEntry struct {
+	MessageID int       `json:"id"`
+	Action    string    `json:"action"`
+	Original  string    `json:"original"`
+	Author    string    `json:"author"`
+	Note      string    `json:"note,omitempty"`
+	Client    string    `json:"client"`
+	Time      time.Time `json:"time"`
 }
 
-func handlerGetUsersForChannel(w http.ResponseWriter, r *http.Request) {
-	content := `<!doctype html><html itemscope="" itemtype="http://schema.org/WebPage" lang="en">
-	<head><title>smirc: users</title><meta http-equiv="refresh" content="5"></head>
-    <body><strong>Users:</strong> ` + irc.GetUsersForChannel() + `</body></html>`
-	_, _ = fmt.Fprintf(w, "%s", content)
+// --- Report states
+const (
+	reportOpen            = "open"
+	reportResolved        = "resolved"
+	reportDismissed       = "dismissed"
+	reportContextMessages = 5
+	// A client may file maxReports reports in reportWindow, so that anybody
+	// who can reach the web UI cannot bury the moderators in them
+	maxReports   = 10
+	reportWindow = time.Hour
+)
+
+// Reports are the messages web users reported to the moderators, each with
+// the messages said before it in the channel, and what became of them
+type Reports struct {
+	mutex   sync.Mutex
+	lastID  int
+	reports []*report
 }
 
-func handlerIndex(w http.ResponseWriter, r *http.Request) {
-	content := `<!doctype html><html itemscope="" itemtype="http://schema.org/WebPage" lang="en">
-	<head><title>smirc</title></head><body>
-      <iframe marginwidth="0" marginheight="0" width="500" height="500" scrolling="no" frameborder=0 src="` + endPointGetMessagesForChannel + `">
-      </iframe>
-      <iframe marginwidth="0" marginheight="0" width="500" height="25" scrolling="no" frameborder=0 src="` + endPointGetUsersForChannel + `">
-      </iframe>
-      <form action="` + endPointSendMessage + `">
-        <input type="text" id="` + formKeyMessage + `" name="` + formKeyMessage + `" />
-        <input type="submit" value="Send" />
-      </form></body></html>`
-	_, _ = fmt.Fprintf(w, "%s", content)
+type report struct {
+	ID       int          `json:"id"`
+	Message  apiMessage   `json:"message"`
+	Context  []apiMessage `json:"context"`
+	Reason   string       `json:"reason,omitempty"`
+	Reporter string       `json:"reporter"`
+	Status   string       `json:"status"`
+	Note     string       `json:"note,omitempty"`
+	Time     time.Time    `json:"time"`
+	Updated  time.Time    `json:"updated"`
 }
 
-func connectToIRC(irc *IRC) net.Conn {
-	if envVarNickName == "" || envVarUserName == "" || envVarRealName == "" {
-		log.Fatal("Environment variables IRC_NICKNAME, IRC_USERNAME, IRC_REALNAME are required")
-	}
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", irc.config.Server, irc.config.Port))
-	if err != nil {
-		fmt.Printf("Failed to connect to IRC server [%s:%d]: %s\n", irc.config.Server, irc.config.Port, err)
-		return nil
-	}
+// Peeks are the channels joined for a look from the web UI. Every page
+// showing one of them keeps it; once none was loaded for grace the channel
+// is parted again.
+type Peeks struct {
+	mutex    sync.Mutex
+	grace    time.Duration
+	lastSeen map[string]time.Time
+}
 
-	_, _ = fmt.Fprintf(conn, "USER %s 0 * :realname\r\n", envVarUserName)
-	_, _ = fmt.Fprintf(conn, "NICK %s\r\n", envVarNickName)
+// Streams hands new messages to the browsers connected to /ws or /events,
+// each subscribed to one channel. A browser that does not keep up misses
+// messages rather than holding up everybody else. It also tells them when
+// the users of their channel change.
+type Streams struct {
+	mutex       sync.Mutex
+	subscribers map[chan IRCMessage]string
+	userWatches map[chan struct{}]string
+}
 
-	reader := bufio.NewReader(conn)
+// wsUsers is the user list of a channel, sent on /ws and /events when it
+// changes. Its type is "users".
+type wsUsers struct {
+	Type  string   `json:"type"`
+	Nicks []string `json:"nicks"`
+	// Away are the nicks of those away
+	Away  []string `json:"away"`
+	HTML  string   `json:"html"`
+	Topic string   `json:"topic"`
+}
 
-	// Continuously read messages from the server
-	go func() {
-		for {
-			message, err := reader.ReadString('\n')
-			if err != nil {
-				log.Fatalf("Failed to read message from IRC server: %s\n", err)
-			}
+// wsEvent is a new message sent on /ws, with its HTML rendering for the
+// web UI to show. Its type is "message".
+type wsEvent struct {
+	Type string `json:"type"`
+	apiMessage
+	HTML string `json:"html"`
+}
 
-			fmt.Print(message)
-			irc.AddIncomingMessage("", "", message)
-			spaceDelimited := strings.SplitN(message, " ", 3)
-			messageCode := spaceDelimited[1]
+// wsCommand is what the web UI sends on /ws. The only type is "send", to
+// send message to the channel; the id chosen by the browser comes back in
+// the wsReply.
+type wsCommand struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
 
-			if messageCode == "001" {
-				irc.Join()
-			}
+// wsReply answers a wsCommand: "ack" with the ids of the messages sent and
+// their HTML rendering, or "error"
+type wsReply struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	MessageIDs []int  `json:"message-ids,omitempty"`
+	HTML       string `json:"html,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
 
-			if message[0:4] == "PING" {
-				irc.Pong(message)
-			}
+// MessageStore keeps messages beyond the lifetime of the process. Every
+// message is saved as it is added and changes to it are written through.
+type MessageStore interface {
+	Save(m IRCMessage) error
+	// Update stores the moderation of a saved message
+	Update(m IRCMessage) error
+	// DeleteBefore deletes the messages from before cutoff and returns
+	// how many there were
+	DeleteBefore(cutoff time.Time) (int, error)
+	// DeleteSaidBy deletes the messages and raw lines of nick and returns
+	// their ids
+	DeleteSaidBy(nick string) ([]int, error)
+	// Recent returns the latest limit messages, oldest first
+	Recent(limit int) ([]IRCMessage, error)
+	// Between returns the messages of channel said from from until before
+	// to, oldest first
+	Between(channel string, from, to time.Time) ([]IRCMessage, error)
+	// Days returns the days in loc on which something was said in channel,
+	// as 2006-01-02, oldest first
+	Days(channel string, loc *time.Location) ([]string, error)
+	Close() error
+}
 
-			// Message sent to the channel
-			if strings.Contains(message, fmt.Sprintf("PRIVMSG %s", irc.config.Channel)) {
-				parts := strings.SplitN(message, ":", 3)
-				if len(parts) == 3 {
-					username := strings.Split(parts[1], "!")[0]
-					msg := strings.TrimSpace(parts[2])
-					fmt.Printf("[%s] %s: %s\n", irc.config.Channel, username, msg)
-					irc.AddIncomingMessage(irc.config.Channel, username, msg)
-				}
-			}
+// SQLiteStore is a MessageStore in a SQLite database file, which also
+// keeps the preferences, drafts and pastes
+type SQLiteStore struct {
+	*store.SQLite
+}
 
-			// Get Users
-			if messageCode == "353" {
-				getUsersFrom353(message)
-			}
+// User is an IRC User. Hostname may be an IPv4 or IPv6 address, a reverse
+// DNS name or a cloak set by the network, e.g. "user/alice".
+type User struct {
+	Nickname string `json:"nick"`
+	Username string `json:"user,omitempty"`
+	Hostname string `json:"host,omitempty"`
+	Cloaked  bool   `json:"cloaked,omitempty"`
+	Server   string `json:"server,omitempty"`
+	Channel  string `json:"channel"`
+	// Prefixes are the membership prefixes of the user in the channel,
+	// highest first, e.g. "@" for an op or "+" with voice
+	Prefixes string `json:"prefixes,omitempty"`
+	// Away is set while the user is away, with the AwayMessage if we know
+	// it, as told by away-notify, WHO and RPL_AWAY
+	Away        bool   `json:"away,omitempty"`
+	AwayMessage string `json:"away-message,omitempty"`
+}
 
-			// Get Users
-			if messageCode == "352" {
-				getUsersFrom352(message)
-			}
+// ircLine is a line of the IRC protocol
+type ircLine = ircclient.Line
 
-			// Send WHO once every 30 seconds to refresh the list
-			if time.Since(lastWho) > 30*time.Second {
-				// Send a WHO command to the server to get a list of users in the #midnightcafe channel
-				_, _ = fmt.Fprintf(conn, "WHO %s\r\n", irc.config.Channel)
-				// irc.ResetUsersForChannel()
-				lastWho = time.Now()
-			}
+// --- Events
+const (
+	eventRaw     = "raw"
+	eventConnect = "connect"
+	eventMessage = "message"
+	eventJoin    = "join"
+	eventPart    = "part"
+	eventNick    = "nick"
+	eventQuit    = "quit"
+	eventKick    = "kick"
+)
 
-			if strings.Contains(message, " JOIN ") {
-				getUserFromNewJoin(message)
-			}
+// ircEvent is a line from the server as handed to the event handlers, raw
+// as received and parsed
+type ircEvent struct {
+	ircLine
+	raw string
+}
 
-			if strings.Contains(message, " PART ") {
-				removeNick(message)
-			}
-		}
-	}()
-	return conn
+type eventHandler func(irc *IRC, e ircEvent)
+
+// EventBus hands what the server says to the features subscribed to it, so
+// that each of them is a handler of its own rather than another branch of
+// the read loop. Handlers run on the read loop, in the order they
+// subscribed.
+type EventBus struct {
+	mutex    sync.Mutex
+	handlers map[string][]eventHandler
 }
 
-func getUserFromNewJoin(message string) {
-	// :web-50!web-50@freenode-otsuav.ut8c.4jho.iho72g.IP JOIN :#midnightcafe
-	// :<nick>!<user>@host JOIN :<channel>
-	parts := strings.Split(message, " ")
-	user := &User{
-		Nickname: strings.Split(parts[0], "!")[0],
-		Channel:  strings.Trim(parts[2], ":"),
-	}
-	irc.AddUserForChannel(user)
+// --- Numeric replies
+const (
+	rplWelcome        = "001"
+	rplISupport       = "005"
+	rplMotd           = "372"
+	rplMotdStart      = "375"
+	rplEndOfMotd      = "376"
+	errNoMotd         = "422"
+	rplUModeIs        = "221"
+	rplAway           = "301"
+	rplNoTopic        = "331"
+	rplTopic          = "332"
+	rplTopicWhoTime   = "333"
+	rplWhoisUser      = "311"
+	rplWhoisServer    = "312"
+	rplWhoisOperator  = "313"
+	rplWhoisIdle      = "317"
+	rplEndOfWhois     = "318"
+	rplWhoisChannels  = "319"
+	rplWhoisAccount   = "330"
+	rplList           = "322"
+	rplChannelModeIs  = "324"
+	rplWhoReply       = "352"
+	rplNamReply       = "353"
+	rplYoureOper      = "381"
+	errNicknameInUse  = "433"
+	errPasswdMismatch = "464"
+	errNoOperHost     = "491"
+	rplLoggedIn       = "900"
+	rplLoggedOut      = "901"
+	rplSASLSuccess    = "903"
+	errSASLFail       = "904"
+	errSASLTooLong    = "905"
+	errSASLAborted    = "906"
+	errSASLAlready    = "907"
+	rplSASLMechs      = "908"
+)
+
+// numericReply describes a numeric reply by the names of its parameters
+// after our own nick, and how to handle it. A name starting with ":" always
+// gets the trailing parameter, so a reply still parses when a server sends
+// extra parameters before it.
+type numericReply struct {
+	params []string
+	handle func(irc *IRC, l ircLine, params map[string]string)
 }
 
-func removeNick(message string) {
-	// :web-50!web-50@freenode-otsuav.ut8c.4jho.iho72g.IP PART :#midnightcafe
-	// :<nick>!<user>@server PART :<channel>
-	parts := strings.Split(message, " ")
-	nick := strings.Split(parts[0], "!")[0]
-	irc.RemoveUser(nick)
+var numericReplies = map[string]numericReply{
+	rplWelcome: {
+		handle: handleWelcome,
+	},
+	rplISupport: {
+		params: []string{"token", ":text"},
+		handle: handleISupport,
+	},
+	rplMotdStart: {
+		params: []string{":text"},
+		handle: handleServerText,
+	},
+	rplMotd: {
+		params: []string{":text"},
+		handle: handleServerText,
+	},
+	rplEndOfMotd: {
+		params: []string{":text"},
+		handle: handleServerText,
+	},
+	errNoMotd: {
+		params: []string{":text"},
+		handle: handleServerText,
+	},
+	rplUModeIs: {
+		params: []string{":modes"},
+		handle: func(irc *IRC, _ ircLine, p map[string]string) { irc.SetUserModes(p["modes"]) },
+	},
+	rplYoureOper: {
+		handle: func(irc *IRC, _ ircLine, _ map[string]string) {
+			log.Printf("We are now an IRC operator")
+			irc.stateMutex.Lock()
+			irc.oper = true
+			irc.stateMutex.Unlock()
+		},
+	},
+	errPasswdMismatch: {
+		params: []string{":text"},
+		handle: handleOperError,
+	},
+	errNoOperHost: {
+		params: []string{":text"},
+		handle: handleOperError,
+	},
+	rplLoggedIn: {
+		params: []string{"mask", "account", ":text"},
+		handle: func(irc *IRC, _ ircLine, p map[string]string) {
+			irc.SetAccount(p["account"])
+			if irc.Registered() {
+				irc.RegainNick()
+			}
+		},
+	},
+	errNicknameInUse: {
+		params: []string{"nick", ":text"},
+		handle: handleNickInUse,
+	},
+	rplLoggedOut: {
+		params: []string{"mask", ":text"},
+		handle: func(irc *IRC, _ ircLine, _ map[string]string) { irc.SetAccount("") },
+	},
+	rplSASLSuccess: {
+		params: []string{":text"},
+		handle: handleSASLDone,
+	},
+	errSASLFail: {
+		params: []string{":text"},
+		handle: handleSASLDone,
+	},
+	errSASLTooLong: {
+		params: []string{":text"},
+		handle: handleSASLDone,
+	},
+	errSASLAborted: {
+		params: []string{":text"},
+		handle: handleSASLDone,
+	},
+	errSASLAlready: {
+		params: []string{":text"},
+		handle: handleSASLDone,
+	},
+	rplSASLMechs: {
+		params: []string{"mechanisms", ":text"},
+		handle: func(_ *IRC, _ ircLine, p map[string]string) {
+			log.Printf("The server supports the SASL mechanisms %s", p["mechanisms"])
+		},
+	},
+	rplWhoReply: {
+		params: []string{"channel", "user", "host", "server", "nick", "flags", ":hops-realname"},
+		handle: handleWhoReply,
+	},
+	rplAway: {
+		params: []string{"nick", ":text"},
+		handle: func(irc *IRC, _ ircLine, p map[string]string) { irc.SetUserAway(p["nick"], true, p["text"]) },
+	},
+	rplNoTopic: {
+		params: []string{"channel", ":text"},
+		handle: func(irc *IRC, _ ircLine, p map[string]string) { irc.SetTopic(p["channel"], Topic{}) },
+	},
+	rplTopic: {
+		params: []string{"channel", ":topic"},
+		handle: func(irc *IRC, _ ircLine, p map[string]string) {
+			// Who set it and when follows in RPL_TOPICWHOTIME, if at all
+			irc.SetTopic(p["channel"], Topic{Text: p["topic"]})
+		},
+	},
+	rplTopicWhoTime: {
+		params: []string{"channel", "set-by", "set-at"},
+		handle: handleTopicWhoTime,
+	},
+	rplChannelModeIs: {
+		params: []string{"channel", "modes"},
+		handle: func(irc *IRC, l ircLine, p map[string]string) {
+			// :srv 324 me #channel +ntl 10
+			irc.SetChannelModes(p["channel"], p["modes"], l.Params[3:])
+		},
+	},
+	rplList: {
+		params: []string{"channel", "visible", ":topic"},
+		handle: func(irc *IRC, _ ircLine, p map[string]string) { irc.Discover(p["channel"]) },
+	},
+	rplNamReply: {
+		params: []string{"symbol", "channel", ":names"},
+		handle: handleNamesReply,
+	},
 }
 
-func getUsersFrom353(message string) {
-	// <server>        353 <my-nickname>    = <channel>     :<nick> <nick>
-	// :*.freenode.net 353 HelloMyNameIsGNU = #midnightcafe :@web-50 HelloMyNameIsGNU
+// IRCMessage is a message sent or received from the IRC network
+type IRCMessage struct {
+	id       int
+	channel  string
+	userName string
+	hostmask string
+	message  string
+	time     time.Time
+	threadID int
+	redacted bool
+	note     string
+	// masked is set by moderators to hide the message until clicked
+	masked bool
+	// action is set for CTCP ACTIONs ("/me waves"), whose message is
+	// stored without the CTCP framing
+	action bool
+	// relayedBy is the bridge that relayed the message of a user on
+	// another network, see capRelayMsg
+	relayedBy string
+}
 
-	parts := strings.Split(message, " ")
-	if len(parts) < 5 {
-		return
+// apiMessage is the JSON representation of an IRCMessage
+type apiMessage struct {
+	ID        int       `json:"id"`
+	Channel   string    `json:"channel"`
+	Nick      string    `json:"nick"`
+	Message   string    `json:"message"`
+	Thread    int       `json:"thread,omitempty"`
+	Time      time.Time `json:"time"`
+	Timestamp string    `json:"timestamp,omitempty"`
+	Redacted  bool      `json:"redacted,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Hostmask  string    `json:"hostmask,omitempty"`
+	Masked    bool      `json:"masked,omitempty"`
+	Action    bool      `json:"action,omitempty"`
+	RelayedBy string    `json:"relayed-by,omitempty"`
+}
+
+func (irc *IRC) Join() {
+	for _, channel := range irc.Channels() {
+		log.Printf(">> JOIN %s\n\n", channel)
+		_, _ = fmt.Fprintf(irc, "JOIN %s\r\n", channel)
 	}
+}
 
-	for idx, user := range parts {
-		if idx < 5 {
-			continue
+// channel returns the configured channel called name, spelled as in the
+// config
+func (config *IRCConfig) channel(name string) (string, bool) {
+	for _, channel := range config.Channels {
+		if strings.EqualFold(channel, name) {
+			return channel, true
 		}
-		user := &User{
-			Nickname: user,
-			Channel:  parts[4],
-		}
-		irc.AddUserForChannel(user)
 	}
+	return "", false
 }
 
-func getUsersFrom352(message string) {
-	// The WHO command response has the following format:
-	// <server> 352 <my-nickname> <channel> <username> <hostname> <server> <nickname> <H|G>[*][@|+] :<hopcount> <realname>
-	// Example:
-	// :*.freenode.net 352 HelloMyNameIsGNU #midnightcafe web-50     freenode-otsuav.ut8c.4jho.iho72g.IP *.freenode.net web-50     H@s           :0          https://kiwiirc.com/
-	// <server>        352 <my-nickname>    <channel>     <username> <hostname>                          <server>       <nickname> <H|G>[*][@|+] :<hopcount> <realname>
+// Channels returns the channels we are in: the configured ones followed by
+// those found through channel patterns
+func (irc *IRC) Channels() []string {
+	irc.channelsMutex.Lock()
+	defer irc.channelsMutex.Unlock()
+	return append([]string{}, irc.channels...)
+}
 
-	parts := strings.Split(message, " ")
-	if len(parts) < 9 {
-		return
+// channel returns the channel called name we are in, spelled as we know it
+func (irc *IRC) channel(name string) (string, bool) {
+	for _, channel := range irc.Channels() {
+		if strings.EqualFold(channel, name) {
+			return channel, true
+		}
 	}
+	return "", false
+}
 
-	user := &User{
-		// Remove any special characters from the nickname, username, and hostname
-		Nickname: parts[7],
-		Hostname: parts[5],
-		Channel:  parts[3],
-		Server:   parts[6],
+// virtualChannel returns the virtual channel called name
+func (config *IRCConfig) virtualChannel(name string) (VirtualChannel, bool) {
+	for _, channel := range config.VirtualChannels {
+		if strings.EqualFold(channel.Name, name) {
+			return channel, true
+		}
 	}
-	irc.AddUserForChannel(user)
+	return VirtualChannel{}, false
 }
 
-func sendMessage(conn net.Conn, channel string, message string) {
-	log.Printf("Sending message: PRIVMSG %s :%s\r\n", channel, message)
-	// Send the message to the channel
-	_, _ = fmt.Fprintf(conn, "PRIVMSG %s :%s\r\n", channel, message)
+// bridge returns the bridge with the given token
+func (config *IRCConfig) bridge(token string) (Bridge, bool) {
+	for _, bridge := range config.Bridges {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(bridge.Token)) == 1 {
+			return bridge, true
+		}
+	}
+	return Bridge{}, false
 }
 
-func readConfig(fileName string) *IRCConfig {
-	var config IRCConfig
-	// Load the JSON file
-	data, err := os.ReadFile(fileName)
-	if err != nil {
-		log.Fatalf("Failed to read config file [%s]: %s", fileName, err)
+// apiToken returns the API token with the given value
+func (config *IRCConfig) apiToken(token string) (APIToken, bool) {
+	for _, apiToken := range config.APITokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken.Token)) == 1 {
+			return apiToken, true
+		}
 	}
+	return APIToken{}, false
+}
 
-	// Parse the JSON into a Config struct
-	if err := json.Unmarshal(data, &config); err != nil {
-		fmt.Println("Failed to parse config file:", err)
-		return nil
-	}
+// adminEnabled tells whether anybody may use the admin API, with the admin
+// token or a client certificate
+func (config *IRCConfig) adminEnabled() bool {
+	return config.AdminToken != "" || (config.WebClientCAFile != "" && len(config.AdminCertSubjects) > 0)
+}
 
-	if config.Port == 0 {
-		config.Port = defaultIRCPort
+// adminCertificate tells whether r comes with a verified client
+// certificate that AdminCertSubjects name, by its subject or fingerprint
+func (config *IRCConfig) adminCertificate(r *http.Request) bool {
+	if config.WebClientCAFile == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
 	}
-	if config.Server == "" {
-		config.Server = defaultIRCServer
+	cert := r.TLS.VerifiedChains[0][0]
+	subject, fingerprint := cert.Subject.String(), certificateFingerprint(cert)
+	for _, admin := range config.AdminCertSubjects {
+		if admin == subject || strings.EqualFold(strings.ReplaceAll(admin, ":", ""), strings.ReplaceAll(fingerprint, ":", "")) {
+			return true
+		}
 	}
-	if config.WebServerPortNumber == 0 {
-		config.WebServerPortNumber = defaultWebServerPortNumber
+	return false
+}
+
+// vendorCap reports whether the vendor capability name is turned on
+func (config *IRCConfig) vendorCap(name string) bool {
+	for _, c := range config.VendorCaps {
+		if c == name {
+			return true
+		}
 	}
-	if config.Channel == "" {
-		config.Channel = defaultChannel
+	return false
+}
+
+// disabledCap reports whether disable-caps keeps smirc from requesting the
+// capability name
+func (config *IRCConfig) disabledCap(name string) bool {
+	for _, c := range config.DisableCaps {
+		if c == name {
+			return true
+		}
 	}
+	return false
+}
 
-	fmt.Printf("Config: %+v\n", config)
-	return &config
+// readOnlyChannel reports whether channel is only shown in the web UI,
+// like the virtual channels and the server buffer
+func readOnlyChannel(channel string) bool {
+	_, virtual := irc.config.virtualChannel(channel)
+	return virtual || channel == serverBuffer
 }
 
-func main() {
-	irc.config = readConfig(envVarConfigFileName)
-	irc.conn = connectToIRC(irc)
-	irc.users = make(map[string]*User)
+// matchesChannelPatterns reports whether channel matches a channel pattern
+func (config *IRCConfig) matchesChannelPatterns(channel string) bool {
+	for _, pattern := range config.ChannelPatterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(channel)); ok {
+			return true
+		}
+	}
+	return false
+}
 
-	http.HandleFunc("/", handlerIndex)
-	http.HandleFunc(endPointGetMessagesForChannel, handlerGetMessagesForChannel)
-	http.HandleFunc(endPointGetUsersForChannel, handlerGetUsersForChannel)
-	http.HandleFunc(endPointSendMessage, handlerSendMessage)
+// Discover joins a channel that turned up in LIST or an invite, if it
+// matches a channel pattern and we are not in too many channels already
+func (irc *IRC) Discover(channel string) {
+	if !irc.config.matchesChannelPatterns(channel) {
+		return
+	}
+	if _, err := irc.joinChannel(channel); err != nil {
+		log.Printf("Not joining %s: %s", channel, err)
+	}
+}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", irc.config.WebServerPortNumber), nil))
+var errTooManyChannels = errors.New("already in too many channels")
+
+// joinChannel joins a channel on top of the configured ones, unless we are
+// in max-channels channels already. It returns false if we were in it.
+func (irc *IRC) joinChannel(channel string) (bool, error) {
+	irc.channelsMutex.Lock()
+	for _, known := range irc.channels {
+		if strings.EqualFold(known, channel) {
+			irc.channelsMutex.Unlock()
+			return false, nil
+		}
+	}
+	if len(irc.channels) >= irc.config.MaxChannels {
+		irc.channelsMutex.Unlock()
+		return false, errTooManyChannels
+	}
+	irc.channels = append(irc.channels, channel)
+	irc.channelsMutex.Unlock()
+	log.Printf(">> JOIN %s\n\n", channel)
+	_, _ = fmt.Fprintf(irc, "JOIN %s\r\n", channel)
+	return true, nil
+}
+
+// Forget drops a discovered channel we left; configured channels are kept
+// and joined again on the next connect
+func (irc *IRC) Forget(channel string) {
+	if _, ok := irc.config.channel(channel); ok {
+		return
+	}
+	irc.channelsMutex.Lock()
+	defer irc.channelsMutex.Unlock()
+	for i, known := range irc.channels {
+		if strings.EqualFold(known, channel) {
+			irc.channels = append(irc.channels[:i], irc.channels[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetAway marks us away with the auto-away message, or back, if auto-away is
+// configured
+func (irc *IRC) SetAway(away bool) {
+	if irc.config.AutoAwayMessage == "" || !irc.Registered() {
+		return
+	}
+	if away {
+		log.Printf(">> AWAY :%s\n\n", irc.config.AutoAwayMessage)
+		_, _ = fmt.Fprintf(irc, "AWAY :%s\r\n", irc.config.AutoAwayMessage)
+		return
+	}
+	log.Printf(">> AWAY\n\n")
+	_, _ = fmt.Fprintf(irc, "AWAY\r\n")
+}
+
+// Write sends raw protocol lines on the current connection, so that IRC can
+// be used as an io.Writer. The client queues them and sends them at the
+// flood rate, except for PONG, which must not wait.
+func (irc *IRC) Write(p []byte) (int, error) {
+	irc.connMutex.Lock()
+	client := irc.client
+	irc.connMutex.Unlock()
+	if client == nil {
+		return 0, ircclient.ErrNotConnected
+	}
+	if client.SendQueue() == 0 && !bytes.HasPrefix(p, []byte("PONG ")) {
+		watchdog.Sent()
+	}
+	n, err := client.Write(p)
+	if errors.Is(err, ircclient.ErrSendQueueFull) {
+		log.Printf("Error: %s", err)
+	}
+	return n, err
+}
+
+// Registered reports whether the server has welcomed us on this connection
+func (irc *IRC) Registered() bool {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	return irc.registered
+}
+
+// Unready tells why we cannot serve the channels yet: the server has not
+// welcomed us or we are not in all the configured channels. It returns ""
+// when we are ready.
+func (irc *IRC) Unready() string {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	if !irc.registered {
+		return "not registered on the IRC server"
+	}
+	var missing []string
+	for _, channel := range irc.config.Channels {
+		if !irc.joined[strings.ToLower(channel)] {
+			missing = append(missing, channel)
+		}
+	}
+	if len(missing) > 0 {
+		return "not in " + strings.Join(missing, ", ")
+	}
+	return ""
+}
+
+// setConn switches to a new connection and forgets everything we knew
+// about the previous one
+func (irc *IRC) setConn(client *ircclient.Client) {
+	irc.connMutex.Lock()
+	irc.client = client
+	irc.connMutex.Unlock()
+
+	irc.stateMutex.Lock()
+	irc.nick, irc.userModes, irc.oper, irc.account = "", nil, false, ""
+	irc.sasl, irc.registered, irc.joined = nil, false, make(map[string]bool)
+	irc.channelModes = make(map[string]map[rune]string)
+	irc.serverCaps, irc.caps, irc.isupport = nil, make(map[string]string), make(map[string]string)
+	irc.stateMutex.Unlock()
+
+	irc.usersMutex.Lock()
+	irc.users = make(map[string]*User)
+	irc.usersMutex.Unlock()
+	streams.UsersChanged("")
+}
+
+// dropConn forgets the connection that broke, so that sending fails with
+// ErrNotConnected until the next one, and ends the waits for answers on it
+func (irc *IRC) dropConn() {
+	irc.connMutex.Lock()
+	irc.client = nil
+	irc.connMutex.Unlock()
+
+	irc.stateMutex.Lock()
+	irc.registered = false
+	irc.stateMutex.Unlock()
+	irc.waiters.Fail(ircclient.ErrNotConnected)
+}
+
+// Nick is our current nickname
+func (irc *IRC) Nick() string {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	if irc.nick == "" {
+		return envVarNickName
+	}
+	return irc.nick
+}
+
+// SetUserModes replaces our user modes, as reported by 221
+func (irc *IRC) SetUserModes(modes string) {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	irc.userModes = make(map[rune]bool)
+	applyModeChange(irc.userModes, modes)
+}
+
+// ChangeUserModes applies a MODE change such as "+iZ-x" to our user modes
+func (irc *IRC) ChangeUserModes(change string) {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	if irc.userModes == nil {
+		irc.userModes = make(map[rune]bool)
+	}
+	applyModeChange(irc.userModes, change)
+}
+
+// applyModeChange adds the modes following a + and removes those following a -
+func applyModeChange(modes map[rune]bool, change string) {
+	adding := true
+	for _, mode := range change {
+		switch mode {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			if adding {
+				modes[mode] = true
+			} else {
+				delete(modes, mode)
+			}
+		}
+	}
+}
+
+// --- Defaults of RPL_ISUPPORT tokens for servers that do not send them
+const (
+	defaultPrefix    = "(qaohv)~&@%+"
+	defaultChanModes = "beI,k,l,imnpst"
+)
+
+func handleISupport(irc *IRC, l ircLine, _ map[string]string) {
+	// :srv 005 me CHANTYPES=# PREFIX=(ov)@+ CHANMODES=beI,k,l,imnpst :are supported by this server
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	if irc.isupport == nil {
+		irc.isupport = make(map[string]string)
+	}
+	for _, token := range l.Params[1 : len(l.Params)-1] {
+		name, value, _ := strings.Cut(token, "=")
+		if strings.HasPrefix(name, "-") {
+			delete(irc.isupport, name[1:])
+			continue
+		}
+		irc.isupport[name] = value
+	}
+}
+
+// ISupport returns the value of an RPL_ISUPPORT token, or def if the server
+// did not send it
+func (irc *IRC) ISupport(token, def string) string {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	if value, ok := irc.isupport[token]; ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// membershipModes returns the channel modes giving a membership prefix and
+// the prefixes, highest first, e.g. "ov" and "@+"
+func (irc *IRC) membershipModes() (modes, prefixes string) {
+	prefix := irc.ISupport("PREFIX", defaultPrefix)
+	modes, prefixes, ok := strings.Cut(strings.TrimPrefix(prefix, "("), ")")
+	if !ok || len(modes) != len(prefixes) {
+		modes, prefixes, _ = strings.Cut(strings.TrimPrefix(defaultPrefix, "("), ")")
+	}
+	return modes, prefixes
+}
+
+// splitPrefixes splits the membership prefixes off a nick as listed by
+// NAMES, e.g. "@+alice"
+func (irc *IRC) splitPrefixes(name string) (prefixes, nick string) {
+	_, known := irc.membershipModes()
+	nick = strings.TrimLeft(name, known)
+	return name[:len(name)-len(nick)], nick
+}
+
+// modeChange is a single change of a channel MODE, e.g. +o with the nick
+type modeChange struct {
+	adding bool
+	mode   rune
+	param  string
+}
+
+// channelModeChanges splits a channel MODE such as "+ov-k alice bob key"
+// into single changes, giving each the parameter it takes according to
+// PREFIX and CHANMODES
+func (irc *IRC) channelModeChanges(change string, params []string) []modeChange {
+	membership, _ := irc.membershipModes()
+	types := strings.SplitN(irc.ISupport("CHANMODES", defaultChanModes), ",", 4)
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	var changes []modeChange
+	adding := true
+	for _, mode := range change {
+		switch mode {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+		c := modeChange{adding: adding, mode: mode}
+		// Lists and membership always take a parameter, keys too, limits
+		// only when set
+		takesParam := strings.ContainsRune(membership+types[0]+types[1], mode) ||
+			(adding && strings.ContainsRune(types[2], mode))
+		if takesParam && len(params) > 0 {
+			c.param, params = params[0], params[1:]
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// SetChannelModes replaces the modes of a channel, as reported by 324
+func (irc *IRC) SetChannelModes(channel, modes string, params []string) {
+	irc.stateMutex.Lock()
+	delete(irc.channelModes, strings.ToLower(channel))
+	irc.stateMutex.Unlock()
+	irc.ChangeChannelModes(channel, modes, params)
+}
+
+// ChangeChannelModes applies a channel MODE: ops and voices given or taken
+// change the membership prefixes of the users, the other modes except for
+// bans and other lists those of the channel
+func (irc *IRC) ChangeChannelModes(channel, change string, params []string) {
+	modes, prefixes := irc.membershipModes()
+	lists := strings.SplitN(irc.ISupport("CHANMODES", defaultChanModes), ",", 2)[0]
+	changes := irc.channelModeChanges(change, params)
+
+	irc.stateMutex.Lock()
+	if irc.channelModes == nil {
+		irc.channelModes = make(map[string]map[rune]string)
+	}
+	channelModes := irc.channelModes[strings.ToLower(channel)]
+	if channelModes == nil {
+		channelModes = make(map[rune]string)
+		irc.channelModes[strings.ToLower(channel)] = channelModes
+	}
+	changedModes := false
+	for _, c := range changes {
+		if strings.ContainsRune(modes+lists, c.mode) {
+			continue
+		}
+		if c.adding {
+			channelModes[c.mode] = c.param
+		} else {
+			delete(channelModes, c.mode)
+		}
+		changedModes = true
+	}
+	irc.stateMutex.Unlock()
+
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	changed := changedModes
+	for _, c := range changes {
+		i := strings.IndexRune(modes, c.mode)
+		if i < 0 || c.param == "" {
+			continue
+		}
+		for _, u := range irc.users {
+			if !strings.EqualFold(u.Channel, channel) || !strings.EqualFold(u.Nickname, c.param) {
+				continue
+			}
+			has := strings.IndexByte(u.Prefixes, prefixes[i]) >= 0
+			if has == c.adding {
+				continue
+			}
+			// Keep them highest first
+			var kept []byte
+			for j := 0; j < len(prefixes); j++ {
+				if (j == i && c.adding) || (j != i && strings.IndexByte(u.Prefixes, prefixes[j]) >= 0) {
+					kept = append(kept, prefixes[j])
+				}
+			}
+			u.Prefixes = string(kept)
+			changed = true
+		}
+	}
+	if changed {
+		streams.UsersChanged(channel)
+	}
+}
+
+// ChannelModes returns the modes of a channel as a mode string, e.g.
+// "+lnt 10". The key of a channel with +k is left out.
+func (irc *IRC) ChannelModes(channel string) string {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	channelModes := irc.channelModes[strings.ToLower(channel)]
+	if len(channelModes) == 0 {
+		return ""
+	}
+	var modes []rune
+	for mode := range channelModes {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	mode := "+" + string(modes)
+	for _, m := range modes {
+		if param := channelModes[m]; param != "" && m != 'k' {
+			mode += " " + param
+		}
+	}
+	return mode
+}
+
+func (irc *IRC) Status() apiStatus {
+	nick := irc.Nick()
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	var modes []string
+	for mode := range irc.userModes {
+		modes = append(modes, string(mode))
+	}
+	sort.Strings(modes)
+	userModes := ""
+	if len(modes) > 0 {
+		userModes = "+" + strings.Join(modes, "")
+	}
+	caps := []string{}
+	for c := range irc.caps {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	return apiStatus{
+		Caps:      caps,
+		Server:    irc.config.Server,
+		Port:      irc.config.Port,
+		Channel:   irc.config.Channel,
+		Channels:  irc.Channels(),
+		Nick:      nick,
+		UserModes: userModes,
+		Oper:      irc.oper,
+		Account:   irc.account,
+		SendQueue: irc.SendQueue(),
+	}
+}
+
+// SendQueue returns how many lines wait to be sent to the server
+func (irc *IRC) SendQueue() int {
+	irc.connMutex.Lock()
+	client := irc.client
+	irc.connMutex.Unlock()
+	if client == nil {
+		return 0
+	}
+	return client.SendQueue()
+}
+
+// ctcpCommand returns the command of a CTCP message, which is framed by \x01
+// characters, e.g. "VERSION" for "\x01VERSION\x01"
+func ctcpCommand(text string) (string, bool) {
+	command, _, ok := ctcpParse(text)
+	return command, ok
+}
+
+// ctcpParse splits a CTCP message into its command and arguments
+func ctcpParse(text string) (command, args string, ok bool) {
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+	command, args, _ = strings.Cut(strings.TrimSuffix(text[1:], "\x01"), " ")
+	return strings.ToUpper(command), args, true
+}
+
+// ctcpReply returns our answer to a CTCP query, or false for the queries we
+// do not answer. Configured replies take precedence over the built-in ones.
+func ctcpReply(command, args string) (string, bool) {
+	if reply, ok := irc.config.CTCPReplies[command]; ok {
+		return reply, reply != ""
+	}
+	switch command {
+	case "PING":
+		return args, true
+	case "TIME":
+		return time.Now().Format(time.RFC1123Z), true
+	case "CLIENTINFO":
+		return strings.Join(ctcpClientInfo(), " "), true
+	}
+	return "", false
+}
+
+// ctcpClientInfo lists the CTCP queries we understand
+func ctcpClientInfo() []string {
+	commands := []string{"ACTION"}
+	for _, command := range []string{"CLIENTINFO", "PING", "TIME"} {
+		if reply, ok := irc.config.CTCPReplies[command]; !ok || reply != "" {
+			commands = append(commands, command)
+		}
+	}
+	for command, reply := range irc.config.CTCPReplies {
+		if reply != "" && !strings.Contains(" ACTION CLIENTINFO PING TIME ", " "+command+" ") {
+			commands = append(commands, command)
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// CTCPReply answers a CTCP query from nick
+func (irc *IRC) CTCPReply(nick, command, reply string) {
+	reply = strings.Map(func(r rune) rune {
+		if r == '\x01' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, reply)
+	if reply != "" {
+		command += " " + reply
+	}
+	log.Printf(">> NOTICE %s :\\x01%s\\x01\n\n", nick, command)
+	_, _ = fmt.Fprintf(irc, "NOTICE %s :\x01%s\x01\r\n", nick, command)
+}
+
+// Notice sends a NOTICE, which must not be answered automatically
+func (irc *IRC) Notice(target, text string) {
+	log.Printf(">> NOTICE %s :%s\n\n", target, text)
+	_, _ = fmt.Fprintf(irc, "NOTICE %s :%s\r\n", target, text)
+}
+
+// Allow records a CTCP request from source and reports whether it may be
+// answered
+func (c *CTCPLimiter) Allow(source string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.received++
+	now := time.Now()
+	for name, s := range c.sources {
+		// Forget sources that have been quiet for a whole window
+		if now.After(s.ignoredUntil) && (len(s.requests) == 0 || now.Sub(s.requests[len(s.requests)-1]) > c.window) {
+			delete(c.sources, name)
+		}
+	}
+	if c.ignoreAll {
+		c.dropped++
+		return false
+	}
+	s, ok := c.sources[source]
+	if !ok {
+		s = &ctcpSource{}
+		c.sources[source] = s
+	}
+	if now.Before(s.ignoredUntil) {
+		c.dropped++
+		return false
+	}
+	recent := s.requests[:0]
+	for _, t := range s.requests {
+		if now.Sub(t) <= c.window {
+			recent = append(recent, t)
+		}
+	}
+	s.requests = append(recent, now)
+	if len(s.requests) > c.limit {
+		log.Printf("Ignoring CTCP from %s for %s", source, c.ignoreFor)
+		s.ignoredUntil = now.Add(c.ignoreFor)
+		s.requests = nil
+		c.dropped++
+		return false
+	}
+	return true
+}
+
+// Stats returns how many CTCP requests were received and dropped
+func (c *CTCPLimiter) Stats() (received, dropped int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.received, c.dropped
+}
+
+// SetAccount records the services account we are logged in to, see 900/901
+func (irc *IRC) SetAccount(account string) {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	irc.account = account
+}
+
+// Identified reports whether we are identified to services, either through
+// a logged-in account or the +r (registered nick) user mode
+func (irc *IRC) Identified() bool {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	return irc.account != "" || irc.userModes['r']
+}
+
+// IsOper reports whether the server accepted our OPER credentials
+func (irc *IRC) IsOper() bool {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	return irc.oper
+}
+
+// AddIncomingMessage stores a message from source, a nick or a full
+// nick!user@host hostmask
+func (irc *IRC) AddIncomingMessage(chatRoom, source, message string) {
+	irc.AddRelayedMessage(chatRoom, source, "", message, time.Now())
+}
+
+// AddRelayedMessage stores a message from source that the bridge relayedBy
+// relayed, or that was not relayed if it is ""
+func (irc *IRC) AddRelayedMessage(chatRoom, source, relayedBy, message string, at time.Time) {
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	nick, _, _ := strings.Cut(source, "!")
+	m := irc.appendMessage(chatRoom, nick, message, at)
+	if nick != source {
+		m.hostmask = source
+	}
+	m.relayedBy = relayedBy
+	irc.persist(*m)
+	streams.Publish(*m)
+}
+
+// SendMessage sends a message to a channel and returns it as stored. A
+// message that would not fit into an IRC line is sent as several.
+func (irc *IRC) SendMessage(chatRoom, message string) ([]IRCMessage, error) {
+	parts := irc.splitMessage(chatRoom, message)
+	if irc.HasCap(capEchoMessage) {
+		return irc.sendEchoed(chatRoom, parts)
+	}
+	// Not the configured nick, we may have had to fall back to another one
+	nick := irc.Nick()
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	var sent []IRCMessage
+	for _, part := range parts {
+		if err := sendMessage(irc, chatRoom, part); err != nil {
+			return sent, err
+		}
+		m := irc.appendMessage(chatRoom, nick, part, time.Now())
+		irc.persist(*m)
+		streams.Publish(*m)
+		metrics.Sent(chatRoom)
+		sent = append(sent, *m)
+	}
+	return sent, nil
+}
+
+// sendEchoed sends parts to chatRoom with echo-message: every part is
+// stored when the server echoes it, and a part the server refuses, e.g. in
+// a moderated channel or one we are banned from, ends sending with a
+// *ircclient.ReplyError
+func (irc *IRC) sendEchoed(chatRoom string, parts []string) ([]IRCMessage, error) {
+	var sent []IRCMessage
+	for _, part := range parts {
+		var echo string
+		w := irc.waiters.Add(func(l ircLine) (bool, error) {
+			switch {
+			case l.Command == "PRIVMSG" && strings.EqualFold(l.Nick(), irc.Nick()) && strings.EqualFold(l.Param(0), chatRoom) &&
+				stripFormatting(l.Param(1)) == stripFormatting(part):
+				// The server may strip the formatting
+				echo = l.Param(1)
+				return true, nil
+			case l.IsError() && strings.EqualFold(l.Param(1), chatRoom):
+				return true, &ircclient.ReplyError{Line: l}
+			}
+			return false, nil
+		})
+		if err := sendMessage(irc, chatRoom, part); err != nil {
+			irc.waiters.Cancel(w)
+			return sent, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), echoTimeout)
+		err := irc.waiters.Wait(ctx, w)
+		cancel()
+		if err != nil {
+			return sent, err
+		}
+		metrics.Sent(chatRoom)
+		// handleChannelMessage stored the echo before the waiter got it
+		if m, ok := irc.lastMessageOf(chatRoom, irc.Nick(), echo); ok {
+			sent = append(sent, m)
+		}
+	}
+	return sent, nil
+}
+
+// lastMessageOf returns the latest message nick said in channel that reads
+// text
+func (irc *IRC) lastMessageOf(channel, nick, text string) (IRCMessage, bool) {
+	msgs := irc.messagesForChatRoom(channel)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if strings.EqualFold(msgs[i].userName, nick) && msgs[i].message == text {
+			return msgs[i], true
+		}
+	}
+	return IRCMessage{}, false
+}
+
+// isEcho reports whether l is the server echoing a message we sent
+func (irc *IRC) isEcho(l ircLine) bool {
+	return (l.Command == "PRIVMSG" || l.Command == "NOTICE") && strings.EqualFold(l.Nick(), irc.Nick()) && irc.HasCap(capEchoMessage)
+}
+
+// SendBridged sends a message that a bridge relays for nick, a user of
+// another chat network. Where the bridge may and the server supports it,
+// the message comes from nick with the bridge's name appended, as in
+// "nick/name"; otherwise we send it as "<nick> message".
+func (irc *IRC) SendBridged(bridge Bridge, channel, nick, message string) error {
+	separators := irc.CapValue(capRelayMsg)
+	if !bridge.RelayMsg || !irc.HasCap(capRelayMsg) {
+		_, err := irc.SendMessage(channel, "<"+nick+"> "+message)
+		return err
+	}
+	if separators == "" {
+		separators = "/"
+	}
+	relayed := nick
+	if !strings.ContainsAny(nick, separators) {
+		// The server only relays nicks that cannot be IRC users
+		relayed = nick + separators[:1] + bridge.Name
+	}
+	ourNick, echoed := irc.Nick(), irc.HasCap(capEchoMessage)
+	parts := irc.splitMessage(channel, message)
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	for _, part := range parts {
+		log.Printf(">> RELAYMSG %s %s :%s\n\n", channel, relayed, part)
+		if _, err := fmt.Fprintf(irc, "RELAYMSG %s %s :%s\r\n", channel, relayed, part); err != nil {
+			return err
+		}
+		metrics.Sent(channel)
+		if echoed {
+			// Stored once the server echoes it
+			continue
+		}
+		m := irc.appendMessage(channel, relayed, part, time.Now())
+		m.relayedBy = ourNick
+		irc.persist(*m)
+		streams.Publish(*m)
+	}
+	return nil
+}
+
+// userHostForPrefix is our user@host, or as long a placeholder as the
+// server might use before we know it
+func (irc *IRC) userHostForPrefix() string {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	if irc.userHost == "" {
+		return strings.Repeat("x", maxUserHostBytes)
+	}
+	return irc.userHost
+}
+
+// splitMessage cuts message into parts that each fit into one line as the
+// server relays it to others, ":nick!user@host PRIVMSG channel :text\r\n",
+// preferably between words. Each part of an ACTION stays an ACTION.
+func (irc *IRC) splitMessage(channel, message string) []string {
+	userHost := irc.userHostForPrefix()
+	head, tail := "", ""
+	if command, args, ok := ctcpParse(message); ok && command == "ACTION" {
+		head, tail = "\x01ACTION ", "\x01"
+		message = args
+	}
+	prefix := ":" + irc.Nick() + "!" + userHost + " "
+	room := maxLineBytes - len(prefix+"PRIVMSG "+channel+" :"+head+tail+"\r\n")
+	if room < 1 {
+		return []string{head + message + tail}
+	}
+	var parts []string
+	for len(message) > room {
+		cut := strings.LastIndexByte(message[:room+1], ' ')
+		if cut <= 0 {
+			// One long word: cut it without splitting a UTF-8 character
+			cut = room
+			for cut > 0 && !utf8.RuneStart(message[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				// Not even one character fits, which is sent anyway
+				_, cut = utf8.DecodeRuneInString(message)
+			}
+		}
+		parts = append(parts, head+message[:cut]+tail)
+		message = strings.TrimLeft(message[cut:], " ")
+	}
+	if message == "" && len(parts) > 0 {
+		return parts
+	}
+	return append(parts, head+message+tail)
+}
+
+// persist queues a new message for the store, if there is one
+func (irc *IRC) persist(m IRCMessage) {
+	if irc.writer == nil {
+		return
+	}
+	irc.writer.Queue(func(store MessageStore) error { return store.Save(m) })
+}
+
+// storeQueueSize is how many writes may wait for the store; queueing more
+// waits for the store to catch up
+const storeQueueSize = 1024
+
+// StoreWriter writes to a store in the background, in the order the writes
+// were queued, so that the messages lock is not held while the database
+// writes. A message is thus saved before it is moderated or deleted.
+type StoreWriter struct {
+	store  MessageStore
+	writes chan func(MessageStore) error
+	done   chan struct{}
+}
+
+func newStoreWriter(store MessageStore) *StoreWriter {
+	w := &StoreWriter{store: store, writes: make(chan func(MessageStore) error, storeQueueSize), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *StoreWriter) run() {
+	defer close(w.done)
+	for write := range w.writes {
+		if err := write(w.store); err != nil {
+			log.Printf("Error: %s", err)
+		}
+	}
+}
+
+// Queue queues a write, whose error is logged
+func (w *StoreWriter) Queue(write func(MessageStore) error) {
+	w.writes <- write
+}
+
+// Wait queues a write and returns its error once it is done
+func (w *StoreWriter) Wait(write func(MessageStore) error) error {
+	result := make(chan error, 1)
+	w.writes <- func(store MessageStore) error {
+		result <- write(store)
+		return nil
+	}
+	return <-result
+}
+
+// Close writes what is still queued and closes the store
+func (w *StoreWriter) Close() error {
+	close(w.writes)
+	<-w.done
+	return w.store.Close()
+}
+
+// loadHistory fills the message buffer with the latest messages from the
+// store and continues numbering after them
+func (irc *IRC) loadHistory(limit int) error {
+	msgs, err := irc.store.Recent(limit)
+	if err != nil {
+		return err
+	}
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	for _, m := range msgs {
+		irc.ring(m.channel).push(m)
+	}
+	if len(msgs) > 0 && msgs[len(msgs)-1].id > irc.lastMessageID {
+		irc.lastMessageID = msgs[len(msgs)-1].id
+	}
+	return nil
+}
+
+// appendMessage stores a message with a fresh id and returns it;
+// messagesMutex must be held
+func (irc *IRC) appendMessage(chatRoom, userName, message string, at time.Time) *IRCMessage {
+	irc.lastMessageID++
+	m := IRCMessage{
+		id:       irc.lastMessageID,
+		channel:  chatRoom,
+		userName: userName,
+		message:  message,
+		time:     at,
+	}
+	if command, args, ok := ctcpParse(message); ok && command == "ACTION" && chatRoom != "" {
+		m.message, m.action = args, true
+	}
+	m.threadID = irc.threadFor(m)
+	return irc.ring(chatRoom).push(m)
+}
+
+// ring returns the message buffer of a channel, creating it on first use;
+// messagesMutex must be held
+func (irc *IRC) ring(channel string) *messageRing {
+	if irc.messages == nil {
+		irc.messages = make(map[string]*messageRing)
+	}
+	r, ok := irc.messages[channel]
+	if !ok {
+		r = &messageRing{size: irc.config.BufferSize}
+		irc.messages[channel] = r
+	}
+	return r
+}
+
+// findMessage returns the buffered message with the given id, or nil;
+// messagesMutex must be held
+func (irc *IRC) findMessage(id int) *IRCMessage {
+	for _, r := range irc.messages {
+		for i := 0; i < len(r.buf); i++ {
+			if r.buf[i].id == id {
+				return &r.buf[i]
+			}
+		}
+	}
+	return nil
+}
+
+// messageRing keeps the latest size messages of a channel. Once it is full
+// every new message takes the place of the oldest one.
+type messageRing struct {
+	size  int
+	buf   []IRCMessage
+	start int
+}
+
+// push adds a message, evicting the oldest one if the ring is full, and
+// returns where it is stored
+func (r *messageRing) push(m IRCMessage) *IRCMessage {
+	if len(r.buf) < r.size {
+		r.buf = append(r.buf, m)
+		return &r.buf[len(r.buf)-1]
+	}
+	slot := r.start
+	r.buf[slot] = m
+	r.start = (r.start + 1) % len(r.buf)
+	return &r.buf[slot]
+}
+
+// at returns the i-th oldest message
+func (r *messageRing) at(i int) *IRCMessage {
+	return &r.buf[(r.start+i)%len(r.buf)]
+}
+
+// all returns a copy of the messages, oldest first
+func (r *messageRing) all() []IRCMessage {
+	msgs := make([]IRCMessage, 0, len(r.buf))
+	msgs = append(msgs, r.buf[r.start:]...)
+	return append(msgs, r.buf[:r.start]...)
+}
+
+// deleteWhere deletes the messages matching del and returns how many there
+// were
+func (r *messageRing) deleteWhere(del func(IRCMessage) bool) int {
+	kept := make([]IRCMessage, 0, len(r.buf))
+	for i := 0; i < len(r.buf); i++ {
+		if m := *r.at(i); !del(m) {
+			kept = append(kept, m)
+		}
+	}
+	deleted := len(r.buf) - len(kept)
+	// Clear the leftovers so that the deleted text is really gone
+	for i := range r.buf {
+		r.buf[i] = IRCMessage{}
+	}
+	r.buf, r.start = append(r.buf[:0], kept...), 0
+	return deleted
+}
+
+// threadFor guesses which conversation thread a message belongs to. A line
+// starting with "<nick>:" or "<nick>," is a reply to that nick's most recent
+// message in the channel, provided it was said within the thread window.
+// Anything else starts a new thread. Returns 0 when threads are disabled.
+func (irc *IRC) threadFor(m IRCMessage) int {
+	if irc.config == nil || !irc.config.Threads || m.channel == "" {
+		return 0
+	}
+	window := time.Duration(irc.config.ThreadWindowSeconds) * time.Second
+	addressee := irc.repliedToNick(m.channel, m.message, m.time.Add(-window))
+	r := irc.ring(m.channel)
+	for i := len(r.buf) - 1; addressee != "" && i >= 0; i-- {
+		prev := r.at(i)
+		if m.time.Sub(prev.time) > window {
+			break
+		}
+		if strings.EqualFold(prev.userName, addressee) {
+			return prev.threadID
+		}
+	}
+	return m.id
+}
+
+// repliedToNick returns the nick a message in channel is addressed to, e.g.
+// "web-50" for "web-50: hello", or "" when the message does not start with a
+// nick mention. Only a nick that is in the channel or said something in it
+// since the given time counts, so "http://…" or "note: …" are not replies.
+// messagesMutex must be held.
+func (irc *IRC) repliedToNick(channel, message string, since time.Time) string {
+	idx := strings.IndexAny(message, ":,")
+	if idx <= 0 || !validNick(message[:idx]) || strings.Contains(message[:idx], "\t") {
+		return ""
+	}
+	nick := message[:idx]
+	if irc.inChannel(channel, nick) {
+		return nick
+	}
+	r := irc.ring(channel)
+	for i := len(r.buf) - 1; i >= 0 && !r.at(i).time.Before(since); i-- {
+		if strings.EqualFold(r.at(i).userName, nick) {
+			return nick
+		}
+	}
+	return ""
+}
+
+// inChannel tells whether nick is in the user list of channel
+func (irc *IRC) inChannel(channel, nick string) bool {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	for _, u := range irc.users {
+		if strings.EqualFold(u.Channel, channel) && strings.EqualFold(u.Nickname, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (irc *IRC) GetMessagesForChatRoom(channel string, prefs viewPrefs) string {
+	return renderMessages(irc.messagesForChatRoom(channel), prefs)
+}
+
+// messagesForChatRoom returns a copy of the messages of a channel, oldest first
+func (irc *IRC) messagesForChatRoom(channel string) []IRCMessage {
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	r, ok := irc.messages[channel]
+	if !ok {
+		return nil
+	}
+	return r.all()
+}
+
+// renderMessages renders messages as an HTML list
+func renderMessages(msgs []IRCMessage, prefs viewPrefs) string {
+	var b strings.Builder
+	b.WriteString(`<ol style="list-style:none;margin:0;padding:0">`)
+	for _, m := range msgs {
+		b.WriteString(renderMessage(m, prefs))
+	}
+	b.WriteString(`</ol>`)
+	return b.String()
+}
+
+// renderMessage renders a single message as an item of renderMessages' list
+func renderMessage(m IRCMessage, prefs viewPrefs) string {
+	text := renderMessageText(m, prefs)
+	nick := html.EscapeString(m.userName)
+	if m.relayedBy != "" {
+		nick += ` <small>(` + html.EscapeString(fmt.Sprintf(tr(prefs.lang, uiRelayedBy), m.relayedBy)) + `)</small>`
+	}
+	format := `%s<time datetime="%s">[%s]</time> <b title="%s">%s</b>: %s`
+	if m.action {
+		format = `%s<time datetime="%s">[%s]</time> <i>* <b title="%s">%s</b> %s</i>`
+	}
+	line := fmt.Sprintf(format, starButton(m, prefs)+reportButton(m, prefs),
+		m.time.Format(time.RFC3339), prefs.formatTime(m.time), html.EscapeString(m.source()), nick, text)
+	if m.threadID != 0 && m.threadID != m.id {
+		// Replies are indented under the message that started the thread
+		return fmt.Sprintf(`<li id="m%d" style="margin-left:1.5em">&#8627; %s</li>`, m.id, line)
+	}
+	return fmt.Sprintf(`<li id="m%d">%s</li>`, m.id, line)
+}
+
+// renderMessageText renders what a message says, as moderated, with its
+// formatting, code, spoilers and the note of the moderators
+func renderMessageText(m IRCMessage, prefs viewPrefs) string {
+	text := m.message
+	label := spoilerTag(text)
+	if label != "" {
+		text = strings.TrimSpace(text[len(label):])
+	} else if m.masked {
+		label = tr(prefs.lang, uiMasked)
+	}
+	if isCode, lang := detectCode(text); isCode {
+		text = "<code>" + highlightCode(stripFormatting(text), lang) + "</code>"
+	} else if isMonospace(text) {
+		text = `<code style="white-space:pre">` + html.EscapeString(stripFormatting(text)) + `</code>`
+	} else {
+		text = renderFormatted(text)
+	}
+	if label != "" {
+		// Revealed with a click, without Javascript
+		text = `<details style="display:inline"><summary style="display:inline;cursor:pointer">` + html.EscapeString(label) + `</summary> ` + text + `</details>`
+	}
+	if m.redacted {
+		text = "<i>" + tr(prefs.lang, uiRedacted) + "</i>"
+	}
+	if m.note != "" {
+		text += ` <small title="` + tr(prefs.lang, uiModeratorNote) + `">[` + html.EscapeString(m.note) + `]</small>`
+	}
+	return text
+}
+
+// source is the hostmask of whoever said the message, or just the nick if
+// that is all we know
+func (m IRCMessage) source() string {
+	if m.hostmask != "" {
+		return m.hostmask
+	}
+	return m.userName
+}
+
+func (m IRCMessage) toAPI() apiMessage {
+	return apiMessage{
+		ID:        m.id,
+		Channel:   m.channel,
+		Nick:      m.userName,
+		Message:   m.message,
+		Thread:    m.threadID,
+		Time:      m.time,
+		Redacted:  m.redacted,
+		Note:      m.note,
+		Hostmask:  m.hostmask,
+		Masked:    m.masked || spoilerTag(m.message) != "",
+		Action:    m.action,
+		RelayedBy: m.relayedBy,
+	}
+}
+
+// deleteBuffered deletes the messages in memory matching del and returns
+// how many there were
+func (irc *IRC) deleteBuffered(del func(IRCMessage) bool) int {
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	deleted := 0
+	for _, r := range irc.messages {
+		deleted += r.deleteWhere(del)
+	}
+	return deleted
+}
+
+// DeleteMessagesBefore deletes the messages from before cutoff and returns
+// how many there were
+func (irc *IRC) DeleteMessagesBefore(cutoff time.Time) int {
+	deleted := irc.deleteBuffered(func(m IRCMessage) bool { return m.time.Before(cutoff) })
+	if irc.writer == nil {
+		return deleted
+	}
+	// The store also has the messages too old to have been loaded
+	stored := 0
+	err := irc.writer.Wait(func(store MessageStore) (err error) {
+		stored, err = store.DeleteBefore(cutoff)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error: %s", err)
+	} else if stored > deleted {
+		deleted = stored
+	}
+	return deleted
+}
+
+// DeleteMessagesOf deletes the messages and raw lines of nick and returns
+// their ids
+func (irc *IRC) DeleteMessagesOf(nick string) map[int]bool {
+	deleted := make(map[int]bool)
+	irc.deleteBuffered(func(m IRCMessage) bool {
+		if m.saidBy(nick) {
+			deleted[m.id] = true
+			return true
+		}
+		return false
+	})
+	if irc.writer == nil {
+		return deleted
+	}
+	var stored []int
+	err := irc.writer.Wait(func(store MessageStore) (err error) {
+		stored, err = store.DeleteSaidBy(nick)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+	for _, id := range stored {
+		deleted[id] = true
+	}
+	return deleted
+}
+
+// Moderate redacts, masks and/or annotates a stored message and returns what
+// it said before
+func (irc *IRC) Moderate(id int, action, note string) (original IRCMessage, ok bool) {
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	m := irc.findMessage(id)
+	if m == nil {
+		return IRCMessage{}, false
+	}
+	original = *m
+	switch action {
+	case moderationRedact:
+		m.message, m.redacted = "", true
+	case moderationMask:
+		m.masked = true
+	}
+	if note != "" {
+		m.note = note
+	}
+	if irc.writer != nil {
+		moderated := *m
+		irc.writer.Queue(func(store MessageStore) error { return store.Update(moderated) })
+	}
+	return original, true
+}
+
+// GetMessage returns the stored message with the given id
+func (irc *IRC) GetMessage(id int) (apiMessage, bool) {
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	if m := irc.findMessage(id); m != nil {
+		return m.toAPI(), true
+	}
+	return apiMessage{}, false
+}
+
+// MessageContext returns up to n messages said before the message with the
+// given id in its channel
+func (irc *IRC) MessageContext(id, n int) []apiMessage {
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	context := []apiMessage{}
+	m := irc.findMessage(id)
+	if m == nil {
+		return context
+	}
+	msgs := irc.ring(m.channel).all()
+	for i, other := range msgs {
+		if other.id == id {
+			start := i - n
+			if start < 0 {
+				start = 0
+			}
+			for _, before := range msgs[start:i] {
+				context = append(context, before.toAPI())
+			}
+			break
+		}
+	}
+	return context
+}
+
+func (irc *IRC) GetAPIMessagesForChatRoom(channel string) []apiMessage {
+	msgs := []apiMessage{}
+	for _, m := range irc.messagesForChatRoom(channel) {
+		msgs = append(msgs, m.toAPI())
+	}
+	return msgs
+}
+
+// saidBy reports whether nick said the message, or sent the raw line
+func (m IRCMessage) saidBy(nick string) bool {
+	if m.channel == "" {
+		return strings.EqualFold(ircclient.ParseLine(m.message).Nick(), nick)
+	}
+	return strings.EqualFold(m.userName, nick)
+}
+
+// MessagesSaidBy returns all stored messages and raw lines of nick
+func (irc *IRC) MessagesSaidBy(nick string) []apiMessage {
+	irc.messagesMutex.Lock()
+	defer irc.messagesMutex.Unlock()
+	msgs := []apiMessage{}
+	for _, r := range irc.messages {
+		for _, m := range r.all() {
+			if m.saidBy(nick) {
+				msgs = append(msgs, m.toAPI())
+			}
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs
+}
+
+// UsersNamed returns what we know about nick in each channel
+func (irc *IRC) UsersNamed(nick string) []User {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	users := []User{}
+	for _, u := range irc.users {
+		if strings.EqualFold(u.Nickname, nick) {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Channel < users[j].Channel })
+	return users
+}
+
+// Hostmask is the nick!user@host of the user, as far as we know it
+func (u User) Hostmask() string {
+	mask := u.Nickname
+	if u.Username != "" {
+		mask += "!" + u.Username
+	}
+	if u.Hostname != "" {
+		mask += "@" + u.Hostname
+	}
+	return mask
+}
+
+// isCloak guesses whether a host is a cloak set by the network rather than
+// a real address: cloaks like "user/alice" or "gateway/web/..." contain a
+// slash, which neither addresses nor host names do
+func isCloak(host string) bool {
+	return strings.Contains(host, "/")
+}
+
+// UserCounts returns how many users are in each channel we are in
+func (irc *IRC) UserCounts() map[string]int {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	counts := make(map[string]int)
+	for _, u := range irc.users {
+		counts[strings.ToLower(u.Channel)]++
+	}
+	return counts
+}
+
+// UsersOfChannel returns the users in a channel, ordered by nick
+func (irc *IRC) UsersOfChannel(channel string) []User {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	var users []User
+	for _, u := range irc.users {
+		if strings.EqualFold(u.Channel, channel) {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Nickname < users[j].Nickname })
+	return users
+}
+
+// membershipIcons are shown before the nicks in the user list for the
+// membership prefixes, with what they stand for as tooltip
+var membershipIcons = map[byte][2]string{
+	'~': {"&#128081;", "owner"},
+	'&': {"&#9884;", "admin"},
+	'@': {"&#9733;", "op"},
+	'%': {"&#9734;", "half-op"},
+	'+': {"&#128264;", "voice"},
+}
+
+// membershipIcon renders the icon of the highest membership prefix, the
+// tooltip naming all of them
+func membershipIcon(prefixes string) string {
+	if prefixes == "" {
+		return ""
+	}
+	icon, titles := html.EscapeString(prefixes[:1]), make([]string, len(prefixes))
+	for i := 0; i < len(prefixes); i++ {
+		titles[i] = prefixes[i : i+1]
+		if known, ok := membershipIcons[prefixes[i]]; ok {
+			titles[i] = known[1]
+			if i == 0 {
+				icon = known[0]
+			}
+		}
+	}
+	return `<span title="` + html.EscapeString(strings.Join(titles, ", ")) + `">` + icon + `</span>`
+}
+
+// GetUsersForChannel renders the nicks in a channel, with their hostmasks
+// as tooltips, linking to their WHOIS, after the icons of their membership
+// prefixes. Away users are greyed out.
+func (irc *IRC) GetUsersForChannel(channel string) string {
+	users := irc.UsersOfChannel(channel)
+	names := make([]string, len(users))
+	for i, u := range users {
+		title, style := u.Hostmask(), ""
+		if u.Away {
+			title, style = title+" (away)", ` style="opacity:0.5"`
+			if u.AwayMessage != "" {
+				title = u.Hostmask() + " (away: " + u.AwayMessage + ")"
+			}
+		}
+		names[i] = membershipIcon(u.Prefixes) + `<a href="` + html.EscapeString(endPointWhois+"?"+formKeyNick+"="+url.QueryEscape(u.Nickname)) + `" target="_top" title="` +
+			html.EscapeString(title) + `"` + style + `>` + html.EscapeString(u.Nickname) + `</a>`
+	}
+	return strings.Join(names, ",")
+}
+
+// SetUserAway marks nick away with message, or back if away is false, in
+// every channel. An empty message keeps the one we know.
+func (irc *IRC) SetUserAway(nick string, away bool, message string) {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	for _, u := range irc.users {
+		if !strings.EqualFold(u.Nickname, nick) || (u.Away == away && (message == "" || u.AwayMessage == message)) {
+			continue
+		}
+		u.Away = away
+		if !away {
+			u.AwayMessage = ""
+		} else if message != "" {
+			u.AwayMessage = message
+		}
+		streams.UsersChanged(u.Channel)
+	}
+}
+
+// Whois is what the server tells about a nick when asked with WHOIS
+type Whois struct {
+	Nick       string `json:"nick"`
+	User       string `json:"user,omitempty"`
+	Host       string `json:"host,omitempty"`
+	RealName   string `json:"real-name,omitempty"`
+	Server     string `json:"server,omitempty"`
+	ServerInfo string `json:"server-info,omitempty"`
+	// Channels are the channels the nick is in that we may see, prefixed
+	// with its status in them, e.g. "@#ops"
+	Channels    []string   `json:"channels"`
+	IdleSeconds int        `json:"idle-seconds"`
+	SignedOn    *time.Time `json:"signed-on,omitempty"`
+	Account     string     `json:"account,omitempty"`
+	Away        string     `json:"away,omitempty"`
+	Oper        bool       `json:"oper,omitempty"`
+}
+
+// Whois asks the server about nick and collects the replies until the end
+// of them. A nick that is not online is reported as
+// ircclient.ErrNoSuchNick.
+func (irc *IRC) Whois(ctx context.Context, nick string) (Whois, error) {
+	whois := Whois{Nick: nick, Channels: []string{}}
+	w := irc.waiters.Add(func(l ircLine) (bool, error) {
+		if !strings.EqualFold(l.Param(1), nick) {
+			return false, nil
+		}
+		switch l.Command {
+		case rplWhoisUser:
+			whois.Nick, whois.User, whois.Host, whois.RealName = l.Param(1), l.Param(2), l.Param(3), l.Param(5)
+		case rplWhoisServer:
+			whois.Server, whois.ServerInfo = l.Param(2), l.Param(3)
+		case rplWhoisOperator:
+			whois.Oper = true
+		case rplWhoisIdle:
+			whois.IdleSeconds, _ = strconv.Atoi(l.Param(2))
+			if signOn, err := strconv.ParseInt(l.Param(3), 10, 64); err == nil {
+				t := time.Unix(signOn, 0)
+				whois.SignedOn = &t
+			}
+		case rplWhoisChannels:
+			whois.Channels = append(whois.Channels, strings.Fields(l.Param(2))...)
+		case rplWhoisAccount:
+			whois.Account = l.Param(2)
+		case rplAway:
+			whois.Away = l.Param(2)
+		case rplEndOfWhois:
+			return true, nil
+		default:
+			if l.IsError() {
+				return true, &ircclient.ReplyError{Line: l}
+			}
+		}
+		return false, nil
+	})
+	// Asking the server of the nick gets its idle time, too
+	if _, err := fmt.Fprintf(irc, "WHOIS %s %s\r\n", nick, nick); err != nil {
+		irc.waiters.Cancel(w)
+		return Whois{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, whoisTimeout)
+	defer cancel()
+	if err := irc.waiters.Wait(ctx, w); err != nil {
+		return Whois{}, err
+	}
+	return whois, nil
+}
+
+// Topic is the topic of a channel, with who set it and when if we know
+type Topic struct {
+	Text  string     `json:"topic"`
+	SetBy string     `json:"set-by,omitempty"`
+	SetAt *time.Time `json:"set-at,omitempty"`
+}
+
+// SetTopic keeps the topic of channel, as told on joining it and whenever
+// somebody changes it
+func (irc *IRC) SetTopic(channel string, topic Topic) {
+	irc.stateMutex.Lock()
+	if irc.topics == nil {
+		irc.topics = make(map[string]Topic)
+	}
+	irc.topics[strings.ToLower(channel)] = topic
+	irc.stateMutex.Unlock()
+	streams.UsersChanged(channel)
+}
+
+// Topic returns the topic of channel, if we know it
+func (irc *IRC) Topic(channel string) (Topic, bool) {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	topic, ok := irc.topics[strings.ToLower(channel)]
+	return topic, ok
+}
+
+// ChangeTopic sets the topic of channel and waits for the server to confirm
+// it. Channels are usually +t, where the server refuses it with a
+// *ircclient.ReplyError unless we are a channel operator.
+func (irc *IRC) ChangeTopic(ctx context.Context, channel, text string) error {
+	w := irc.waiters.Add(func(l ircLine) (bool, error) {
+		switch {
+		case l.Command == "TOPIC" && strings.EqualFold(l.Nick(), irc.Nick()) && strings.EqualFold(l.Param(0), channel):
+			return true, nil
+		case l.IsError() && strings.EqualFold(l.Param(1), channel):
+			return true, &ircclient.ReplyError{Line: l}
+		}
+		return false, nil
+	})
+	log.Printf(">> TOPIC %s :%s\n\n", channel, text)
+	if _, err := fmt.Fprintf(irc, "TOPIC %s :%s\r\n", channel, text); err != nil {
+		irc.waiters.Cancel(w)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, echoTimeout)
+	defer cancel()
+	return irc.waiters.Wait(ctx, w)
+}
+
+// validNick checks a nick typed into the web UI
+func validNick(nick string) bool {
+	return nick != "" && !strings.ContainsAny(nick, " ,*?!@#&\x07\r\n")
+}
+
+func (irc *IRC) ResetUsersForChannel() {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	irc.users = nil
+}
+
+// userKey is the key of a user in a channel in irc.users
+func userKey(channel, nickname string) string {
+	return strings.ToLower(channel) + " " + nickname
+}
+
+func (irc *IRC) RemoveUser(channel, nickname string) {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	nickname = strings.Trim(nickname, ": \n")
+	delete(irc.users, userKey(channel, nickname))
+	streams.UsersChanged(channel)
+}
+
+// RemoveChannelUsers empties the user list of a channel, e.g. when we were
+// kicked from it
+func (irc *IRC) RemoveChannelUsers(channel string) {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	for key, u := range irc.users {
+		if strings.EqualFold(u.Channel, channel) {
+			delete(irc.users, key)
+		}
+	}
+	streams.UsersChanged(channel)
+}
+
+// RemoveNick removes a nick from the user lists of all channels, e.g. when
+// it quit, and returns the channels it was in
+func (irc *IRC) RemoveNick(nickname string) []string {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	var channels []string
+	for key, u := range irc.users {
+		if strings.EqualFold(u.Nickname, nickname) {
+			delete(irc.users, key)
+			streams.UsersChanged(u.Channel)
+			channels = append(channels, u.Channel)
+		}
+	}
+	return channels
+}
+
+// RenameNick renames a user in the user lists of all channels and returns
+// the channels the user is in
+func (irc *IRC) RenameNick(old, nickname string) []string {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	var channels []string
+	for key, u := range irc.users {
+		if !strings.EqualFold(u.Nickname, old) {
+			continue
+		}
+		delete(irc.users, key)
+		u.Nickname = nickname
+		irc.users[userKey(u.Channel, nickname)] = u
+		channels = append(channels, u.Channel)
+		streams.UsersChanged(u.Channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (irc *IRC) AddUserForChannel(user *User) {
+	irc.usersMutex.Lock()
+	defer irc.usersMutex.Unlock()
+	// The membership prefixes come in user.Prefixes. The hostname is left
+	// alone, an IPv6 address may well start or end with a colon.
+	user.Nickname = strings.Trim(user.Nickname, ": \n")
+	key := userKey(user.Channel, user.Nickname)
+	// NAMES does not know what WHO or JOIN told us before
+	if known, ok := irc.users[key]; ok {
+		if user.Username == "" {
+			user.Username = known.Username
+		}
+		if user.Hostname == "" {
+			user.Hostname = known.Hostname
+		}
+		if user.Server == "" {
+			user.Server = known.Server
+		}
+		user.Away, user.AwayMessage = known.Away, known.AwayMessage
+	}
+	user.Cloaked = isCloak(user.Hostname)
+	irc.users[key] = user
+	streams.UsersChanged(user.Channel)
+}
+
+// starButton renders the form that stars or unstars a message
+func starButton(m IRCMessage, prefs viewPrefs) string {
+	star := "&#9734;"
+	if prefs.identified && bookmarks.Has(prefs.user, m.id) {
+		star = "&#9733;"
+	}
+	return fmt.Sprintf(`<form method="post" action="%s" target="_top" style="display:inline">%s%s`+
+		`<input type="hidden" name="%s" value="%d" /><button type="submit" title="%s">%s</button></form> `,
+		endPointStarMessage, channelInput(m.channel), csrfInput(prefs.csrfToken), formKeyMessageID, m.id, tr(prefs.lang, uiStar), star)
+}
+
+// reportButton renders the form that reports a message to the moderators
+func reportButton(m IRCMessage, prefs viewPrefs) string {
+	return fmt.Sprintf(`<form method="post" action="%s" target="_top" style="display:inline">%s%s`+
+		`<input type="hidden" name="%s" value="%d" /><button type="submit" title="%s">&#9873;</button></form> `,
+		endPointReportMessage, channelInput(m.channel), csrfInput(prefs.csrfToken), formKeyMessageID, m.id, tr(prefs.lang, uiReport))
+}
+
+func (b *Bookmarks) Has(user string, id int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, ok := b.users[user][id]
+	return ok
+}
+
+func (b *Bookmarks) Add(user string, m apiMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.users[user] == nil {
+		b.users[user] = make(map[int]apiMessage)
+	}
+	b.users[user][m.ID] = m
+	b.save()
+}
+
+// Update replaces a bookmarked message for everybody who starred it, e.g.
+// after it was redacted
+func (b *Bookmarks) Update(m apiMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	updated := false
+	for _, messages := range b.users {
+		if _, ok := messages[m.ID]; ok {
+			messages[m.ID] = m
+			updated = true
+		}
+	}
+	if updated {
+		b.save()
+	}
+}
+
+// DeleteWhere deletes the bookmarks of all users matching del and returns
+// how many there were
+func (b *Bookmarks) DeleteWhere(del func(apiMessage) bool) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	deleted := 0
+	for user, messages := range b.users {
+		for id, m := range messages {
+			if del(m) {
+				delete(messages, id)
+				deleted++
+			}
+		}
+		if len(messages) == 0 {
+			delete(b.users, user)
+		}
+	}
+	if deleted > 0 {
+		b.save()
+	}
+	return deleted
+}
+
+func (b *Bookmarks) Remove(user string, id int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.users[user], id)
+	if len(b.users[user]) == 0 {
+		delete(b.users, user)
+	}
+	b.save()
+}
+
+// List returns the messages user bookmarked, oldest first
+func (b *Bookmarks) List(user string) []apiMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	msgs := []apiMessage{}
+	for _, m := range b.users[user] {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs
+}
+
+// All returns the messages anybody bookmarked, each once, oldest first
+func (b *Bookmarks) All() []apiMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	all := make(map[int]apiMessage)
+	for _, messages := range b.users {
+		for id, m := range messages {
+			all[id] = m
+		}
+	}
+	msgs := []apiMessage{}
+	for _, m := range all {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs
+}
+
+// load reads the bookmarks file and returns the highest bookmarked message
+// id. Files written before bookmarks were kept per user hold a list, which
+// becomes the bookmarks of user "".
+func (b *Bookmarks) load() int {
+	b.users = make(map[string]map[int]apiMessage)
+	if b.fileName == "" {
+		return 0
+	}
+	data, err := os.ReadFile(b.fileName)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		log.Fatalf("Failed to read bookmarks file [%s]: %s", b.fileName, err)
+	}
+	users := make(map[string][]apiMessage)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var msgs []apiMessage
+		err = json.Unmarshal(data, &msgs)
+		users[""] = msgs
+	} else {
+		err = json.Unmarshal(data, &users)
+	}
+	if err != nil {
+		log.Fatalf("Failed to parse bookmarks file [%s]: %s", b.fileName, err)
+	}
+	maxID := 0
+	for user, msgs := range users {
+		for _, m := range msgs {
+			if b.users[user] == nil {
+				b.users[user] = make(map[int]apiMessage)
+			}
+			b.users[user][m.ID] = m
+			if m.ID > maxID {
+				maxID = m.ID
+			}
+		}
+	}
+	return maxID
+}
+
+// save writes the bookmarks file, a list of messages by user; mutex must be
+// held
+func (b *Bookmarks) save() {
+	if b.fileName == "" {
+		return
+	}
+	users := make(map[string][]apiMessage, len(b.users))
+	for user, messages := range b.users {
+		for _, m := range messages {
+			users[user] = append(users[user], m)
+		}
+		sort.Slice(users[user], func(i, j int) bool { return users[user][i].ID < users[user][j].ID })
+	}
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	if err := os.WriteFile(b.fileName, data, 0600); err != nil {
+		log.Printf("Failed to write bookmarks file [%s]: %s", b.fileName, err)
+	}
+}
+
+// --- Preference keys
+const (
+	prefLanguage      = "language"
+	prefTimezone      = "timezone"
+	prefTimeFormat    = "time-format"
+	prefTheme         = "theme"
+	prefKeywords      = "keywords"
+	prefMutedChannels = "muted-channels"
+	prefReadMarkers   = "read-markers"
+	prefSavedSearches = "saved-searches"
+	prefQuietHours    = "quiet-hours"
+)
+
+// prefKeys are the preferences kept in the cookies of the same name for
+// clients that are not logged in
+var prefKeys = map[string]string{
+	cookieKeyLanguage:   prefLanguage,
+	cookieKeyTimezone:   prefTimezone,
+	cookieKeyTimeFormat: prefTimeFormat,
+	cookieKeyTheme:      prefTheme,
+}
+
+// prefValidators check the values of the preferences smirc knows; others
+// may hold any JSON value, for clients of the API
+var prefValidators = map[string]func(value json.RawMessage) error{
+	prefLanguage: stringPref(func(lang string) bool { return uiCatalogs[lang] != nil }),
+	prefTimezone: stringPref(func(tz string) bool {
+		_, err := time.LoadLocation(tz)
+		return err == nil
+	}),
+	prefTimeFormat: stringPref(func(format string) bool {
+		return format == timeFormat24h || format == timeFormat12h || format == timeFormatRelative
+	}),
+	prefTheme:         stringPref(themes.Has),
+	prefKeywords:      stringListPref,
+	prefMutedChannels: stringListPref,
+	prefSavedSearches: func(value json.RawMessage) error {
+		var searches []SavedSearch
+		if err := json.Unmarshal(value, &searches); err != nil {
+			return errors.New("expected a list of searches")
+		}
+		names := make(map[string]bool)
+		for _, search := range searches {
+			if search.Name == "" || names[search.Name] {
+				return errors.New("every search needs a name of its own")
+			}
+			names[search.Name] = true
+		}
+		return nil
+	},
+	prefQuietHours: func(value json.RawMessage) error {
+		var window quietWindow
+		if err := json.Unmarshal(value, &window); err != nil {
+			return errors.New(`expected {"start": "23:00", "end": "07:00"}`)
+		}
+		_, _, err := window.minutes()
+		return err
+	},
+	prefReadMarkers: func(value json.RawMessage) error {
+		var markers map[string]int
+		if err := json.Unmarshal(value, &markers); err != nil {
+			return errors.New("expected an object of message ids")
+		}
+		return nil
+	},
+}
+
+// stringPref checks a preference that is a string accepted by valid
+func stringPref(valid func(string) bool) func(json.RawMessage) error {
+	return func(value json.RawMessage) error {
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil || !valid(s) {
+			return errors.New("invalid value")
+		}
+		return nil
+	}
+}
+
+func stringListPref(value json.RawMessage) error {
+	var list []string
+	if err := json.Unmarshal(value, &list); err != nil {
+		return errors.New("expected a list of strings")
+	}
+	return nil
+}
+
+var errInvalidPref = errors.New("invalid preference")
+
+// validPrefKey tells whether key may name a preference
+func validPrefKey(key string) bool {
+	if key == "" || len(key) > 64 {
+		return false
+	}
+	for _, c := range key {
+		if !(c == '-' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// prefsUser is the user whose preferences apply to r, if the client is
+// logged in. Without logins nobody has preferences of their own.
+func prefsUser(r *http.Request) (string, bool) {
+	if !authEnabled() {
+		return "", false
+	}
+	return sessionUser(r)
+}
+
+// webUser is who the bookmarks and drafts of the client that made r belong
+// to: the logged in user, or the API token it sent. Without logins
+// everybody shares those of user "".
+func webUser(r *http.Request) (string, bool) {
+	if token, ok := irc.config.apiToken(bearerToken(r)); ok {
+		return "api-token " + token.Name, true
+	}
+	if !authEnabled() {
+		return "", true
+	}
+	return sessionUser(r)
+}
+
+// Get returns a copy of the preferences of user
+func (p *Prefs) Get(user string) map[string]json.RawMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	copied := make(map[string]json.RawMessage, len(p.users[user]))
+	for key, value := range p.users[user] {
+		copied[key] = value
+	}
+	return copied
+}
+
+// All returns the preference key of every user that has it
+func (p *Prefs) All(key string) map[string]json.RawMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	values := make(map[string]json.RawMessage)
+	for user, userPrefs := range p.users {
+		if value, ok := userPrefs[key]; ok {
+			values[user] = value
+		}
+	}
+	return values
+}
+
+// String returns a preference of user that is a string
+func (p *Prefs) String(user, key string) (string, bool) {
+	p.mutex.Lock()
+	value, ok := p.users[user][key]
+	p.mutex.Unlock()
+	var s string
+	if !ok || json.Unmarshal(value, &s) != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// Set changes the preferences of user, deleting those set to null, and
+// saves them. Nothing changes when one of them is invalid.
+func (p *Prefs) Set(user string, changes map[string]json.RawMessage) error {
+	for key, value := range changes {
+		if !validPrefKey(key) {
+			return fmt.Errorf("%w: %q is not a valid key", errInvalidPref, key)
+		}
+		if validate, ok := prefValidators[key]; ok && string(value) != "null" {
+			if err := validate(value); err != nil {
+				return fmt.Errorf("%w %s: %s", errInvalidPref, key, err)
+			}
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	userPrefs := p.users[user]
+	if userPrefs == nil {
+		userPrefs = make(map[string]json.RawMessage)
+		p.users[user] = userPrefs
+	}
+	for key, value := range changes {
+		if string(value) == "null" {
+			delete(userPrefs, key)
+		} else {
+			userPrefs[key] = value
+		}
+	}
+	return p.save(user)
+}
+
+// load reads the preferences from the store or file
+func (p *Prefs) load() error {
+	if p.store != nil {
+		users, err := p.store.LoadPrefs()
+		if err != nil {
+			return err
+		}
+		p.users = users
+		return nil
+	}
+	if p.fileName == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &p.users)
+}
+
+// save stores the preferences of user; mutex must be held
+func (p *Prefs) save(user string) error {
+	if p.store != nil {
+		return p.store.SavePrefs(user, p.users[user])
+	}
+	if p.fileName == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.fileName, data)
+}
+
+func (d *Drafts) Get(user, channel string) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.drafts[user][channel]
+}
+
+// Set stores the draft of user for a channel; an empty text discards it
+func (d *Drafts) Set(user, channel, text string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if text == "" {
+		if _, ok := d.drafts[user][channel]; !ok {
+			return nil
+		}
+		delete(d.drafts[user], channel)
+		if len(d.drafts[user]) == 0 {
+			delete(d.drafts, user)
+		}
+	} else {
+		if d.drafts[user] == nil {
+			d.drafts[user] = make(map[string]string)
+		}
+		d.drafts[user][channel] = text
+	}
+	if d.store == nil {
+		return nil
+	}
+	return d.store.SaveDraft(user, channel, text)
+}
+
+// load reads the drafts from the database
+func (d *Drafts) load() error {
+	if d.store == nil {
+		return nil
+	}
+	loaded, err := d.store.LoadDrafts()
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.drafts = loaded
+	return nil
+}
+
+var errPasteQuota = errors.New("daily paste quota exceeded")
+
+// Add stores a new paste from client under a random id
+func (p *Pastes) Add(client, text string) (*Paste, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	paste := &Paste{
+		ID:      hex.EncodeToString(id),
+		Text:    text,
+		Created: time.Now(),
+	}
+	paste.Code, paste.Language = detectCode(text)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if today := time.Now().Format("2006-01-02"); today != p.day {
+		p.day, p.used = today, make(map[string]int)
+	}
+	if p.used[client]+len(text) > p.quota {
+		p.rejected++
+		return nil, errPasteQuota
+	}
+	if p.store != nil {
+		if err := p.store.SavePaste(paste); err != nil {
+			return nil, err
+		}
+	}
+	p.used[client] += len(text)
+	p.expire()
+	p.pastes[paste.ID] = paste
+	return paste, nil
+}
+
+// DeleteWhere deletes the pastes matching del and returns how many there were
+func (p *Pastes) DeleteWhere(del func(*Paste) bool) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.deleteWhere(del)
+}
+
+// deleteWhere deletes the pastes matching del from the map and the store;
+// mutex must be held
+func (p *Pastes) deleteWhere(del func(*Paste) bool) int {
+	var ids []string
+	for id, paste := range p.pastes {
+		if del(paste) {
+			delete(p.pastes, id)
+			ids = append(ids, id)
+		}
+	}
+	if p.store != nil && len(ids) > 0 {
+		if err := p.store.DeletePastes(ids); err != nil {
+			log.Printf("Failed to delete the pastes: %s", err)
+		}
+	}
+	return len(ids)
+}
+
+// List returns copies of the pastes, oldest first
+func (p *Pastes) List() []Paste {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expire()
+	list := []Paste{}
+	for _, paste := range p.pastes {
+		list = append(list, *paste)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Rejected is the number of pastes refused because of the quota
+func (p *Pastes) Rejected() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rejected
+}
+
+func (p *Pastes) Get(id string) (*Paste, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expire()
+	paste, ok := p.pastes[id]
+	return paste, ok
+}
+
+// expire drops pastes older than the expiry; mutex must be held
+func (p *Pastes) expire() {
+	p.deleteWhere(func(paste *Paste) bool { return time.Since(paste.Created) > p.expiry })
+}
+
+// load reads the pastes from the database, dropping those that expired
+// while smirc was not running
+func (p *Pastes) load() error {
+	if p.store == nil {
+		return nil
+	}
+	loaded, err := p.store.LoadPastes()
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, paste := range loaded {
+		p.pastes[paste.ID] = paste
+	}
+	p.expire()
+	return nil
+}
+
+// --- Localization
+const (
+	defaultLanguage     = "en"
+	defaultTimeFormat   = timeFormat24h
+	cookieKeyLanguage   = "lang"
+	cookieKeyTimezone   = "tz"
+	cookieKeyTimeFormat = "timefmt"
+	cookieKeyTheme      = "theme"
+	cookieKeyCSRF       = "csrf"
+	cookieKeyRead       = "read"
+	cookieKeyCaptcha    = "captcha"
+	cookieKeySession    = "session"
+)
+
+// --- Vendor capabilities, see vendorCaps
+const (
+	// capRelayMsg is Ergo's capability for bridges: messages of bridged
+	// users carry the nick of the bridge in the tagRelayMsg tag
+	capRelayMsg = "draft/relaymsg"
+	// capMessageTags makes the server send message tags, like UnrealIRCd's
+	// tagUserHost with the real user@host of users, sent to opers
+	capMessageTags = "message-tags"
+	tagRelayMsg    = "draft/relaymsg"
+	tagUserHost    = "unrealircd.org/userhost"
+)
+
+// --- IRCv3 capabilities, requested from every server that offers them
+const (
+	capSASL = "sasl"
+	// capServerTime makes the server tag messages with the time it got
+	// them, in tagServerTime
+	capServerTime = "server-time"
+	tagServerTime = "time"
+	// capEchoMessage makes the server echo the messages we send, so that
+	// they are only shown once they got through
+	capEchoMessage = "echo-message"
+	// capAwayNotify makes the server tell when users in our channels go
+	// away or come back, with AWAY
+	capAwayNotify = "away-notify"
+	// capMultiPrefix makes NAMES and WHO list all the membership prefixes
+	// of a user, e.g. "@+" for an op with voice, not only the highest
+	capMultiPrefix = "multi-prefix"
+)
+
+// vendorCaps are the capabilities that vendor-caps may turn on
+var vendorCaps = []string{capRelayMsg, capMessageTags}
+
+// capability is an IRCv3 capability smirc knows how to use. wanted reports
+// whether to request it on this connection when the server offers it with
+// value, e.g. the mechanisms for sasl.
+type capability struct {
+	wanted func(irc *IRC, value string) bool
+}
+
+// capabilities are the capabilities smirc requests when the server offers
+// them, unless disable-caps lists them
+var capabilities = map[string]capability{
+	capSASL:        {wanted: wantSASL},
+	capServerTime:  {wanted: wantAlways},
+	capEchoMessage: {wanted: wantAlways},
+	capMultiPrefix: {wanted: wantAlways},
+	capAwayNotify:  {wanted: wantAlways},
+	capRelayMsg:    {wanted: wantVendorCap(capRelayMsg)},
+	capMessageTags: {wanted: wantVendorCap(capMessageTags)},
+}
+
+// capabilityNames returns the names of the capabilities, sorted
+func capabilityNames() []string {
+	var names []string
+	for name := range capabilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func wantAlways(*IRC, string) bool { return true }
+
+// wantVendorCap wants the vendor capability name if vendor-caps lists it
+func wantVendorCap(name string) func(*IRC, string) bool {
+	return func(irc *IRC, _ string) bool { return irc.config.vendorCap(name) }
+}
+
+// wantSASL wants sasl when configured, while registering and if the server
+// supports our mechanism
+func wantSASL(irc *IRC, mechanisms string) bool {
+	if irc.sasl == nil || irc.Registered() {
+		return false
+	}
+	if mechanisms != "" && !strings.Contains(","+mechanisms+",", ","+irc.sasl.mechanism+",") {
+		log.Printf("The server does not support SASL %s, only %s", irc.sasl.mechanism, mechanisms)
+		return false
+	}
+	return true
+}
+
+// --- Timestamp formats
+const (
+	timeFormat24h      = "24h"
+	timeFormat12h      = "12h"
+	timeFormatRelative = "relative"
+)
+
+// --- UI strings, translated in uiCatalogs
+const (
+	uiTitleIndex    = "title-index"
+	uiTitleMessages = "title-messages"
+	uiTitleUsers    = "title-users"
+	uiTitlePaste    = "title-paste"
+	uiTitleHistory  = "title-history"
+	uiMessage       = "message"
+	uiHistory       = "history"
+	uiOlder         = "older"
+	uiNewer         = "newer"
+	uiPageOf        = "page-of"
+	uiRegister      = "register"
+	uiRegisterWith  = "register-with"
+	uiIdentified    = "identified"
+	uiNotIdentified = "not-identified"
+	uiDescription   = "description"
+	uiRegPending    = "registration-pending"
+	uiRegDone       = "registration-registered"
+	uiRegFailed     = "registration-failed"
+	uiRegTimeout    = "registration-timeout"
+	uiUsers         = "users"
+	uiSend          = "send"
+	uiSaveDraft     = "save-draft"
+	uiRaw           = "raw"
+	uiStar          = "star"
+	uiLanguage      = "language"
+	uiTimeFormat    = "time-format"
+	uiTimezone      = "timezone"
+	ui24h           = "24h"
+	ui12h           = "12h"
+	uiRelative      = "relative"
+	uiAgo           = "ago"
+	uiApply         = "apply"
+	uiPeek          = "peek"
+	uiPeekJoin      = "peek-join"
+	uiRedacted      = "redacted"
+	uiModeratorNote = "moderator-note"
+	uiMasked        = "masked"
+	uiReadOnly      = "read-only"
+	uiCaptcha       = "captcha"
+	uiContinue      = "continue"
+	uiReport        = "report"
+	uiRelayedBy     = "relayed-by"
+	uiLogin         = "login"
+	uiLogout        = "logout"
+	uiUser          = "user"
+	uiPassword      = "password"
+	uiLoginFailed   = "login-failed"
+	uiLoginToSend   = "login-to-send"
+	uiTheme         = "theme"
+	uiThemeAuto     = "theme-auto"
+	uiThemeLight    = "theme-light"
+	uiThemeDark     = "theme-dark"
+	uiMuted         = "muted"
+	uiTitleSearch   = "title-search"
+	uiSearch        = "search"
+	uiSearchText    = "search-text"
+	uiNick          = "nick"
+	uiChannel       = "channel"
+	uiAllChannels   = "all-channels"
+	uiSince         = "since"
+	uiUntil         = "until"
+	uiContext       = "context"
+	uiNoResults     = "no-results"
+	uiSavedSearches = "saved-searches"
+	uiSaveSearch    = "save-search"
+	uiSearchName    = "search-name"
+	uiAlert         = "alert"
+	uiDelete        = "delete"
+	uiNoSuchNick    = "no-such-nick"
+	uiRealName      = "real-name"
+	uiHostmask      = "hostmask"
+	uiAccount       = "account"
+	uiServer        = "server"
+	uiChannels      = "channels"
+	uiIdle          = "idle"
+	uiSignedOn      = "signed-on"
+	uiAwayMessage   = "away-message"
+	uiOper          = "oper"
+	uiYes           = "yes"
+	uiTopic         = "topic"
+	uiSetTopic      = "set-topic"
+	uiLogs          = "logs"
+	uiPreviousDay   = "previous-day"
+	uiNextDay       = "next-day"
+	uiLogSpan       = "log-span"
+	uiAnonymousUser = "anonymous-user"
+)
+
+// uiCatalogs maps a language to the translations of the UI strings
+var uiCatalogs = map[string]map[string]string{
+	"en": {
+		uiTitleIndex:    "smirc",
+		uiTitleMessages: "smirc: messages",
+		uiTitleUsers:    "smirc: users",
+		uiTitlePaste:    "smirc: paste",
+		uiTitleHistory:  "smirc: history",
+		uiMessage:       "Message",
+		uiHistory:       "History",
+		uiOlder:         "Older messages",
+		uiNewer:         "Newer messages",
+		uiPageOf:        "Page %d of %d",
+		uiRegister:      "Register channel",
+		uiRegisterWith:  "Register %s with %s",
+		uiIdentified:    "You are identified to services.",
+		uiNotIdentified: "You are not identified to services. Identify with NickServ first, ChanServ only registers channels for identified nicks.",
+		uiDescription:   "Description",
+		uiRegPending:    "Waiting for ChanServ to answer…",
+		uiRegDone:       "The channel is registered.",
+		uiRegFailed:     "ChanServ refused the registration.",
+		uiRegTimeout:    "ChanServ did not answer.",
+		uiUsers:         "Users:",
+		uiSend:          "Send",
+		uiSaveDraft:     "Save draft",
+		uiRaw:           "raw",
+		uiStar:          "Star",
+		uiReport:        "Report to the moderators",
+		uiRelayedBy:     "via %s",
+		uiLogin:         "Log in",
+		uiLogout:        "Log out",
+		uiUser:          "User",
+		uiPassword:      "Password",
+		uiLoginFailed:   "Wrong user or password.",
+		uiLoginToSend:   "Log in to send messages",
+		uiTheme:         "Theme",
+		uiThemeAuto:     "like the browser",
+		uiThemeLight:    "light",
+		uiThemeDark:     "dark",
+		uiMuted:         "Muted",
+		uiTitleSearch:   "smirc: search",
+		uiSearch:        "Search",
+		uiSearchText:    "Text",
+		uiNick:          "Nick",
+		uiChannel:       "Channel",
+		uiAllChannels:   "all",
+		uiSince:         "From",
+		uiUntil:         "To",
+		uiContext:       "Jump to context",
+		uiNoResults:     "No messages found.",
+		uiSavedSearches: "Saved searches",
+		uiSaveSearch:    "Save search",
+		uiSearchName:    "Name",
+		uiAlert:         "Alert me of new messages found",
+		uiDelete:        "Delete",
+		uiNoSuchNick:    "Nobody is online with this nick.",
+		uiRealName:      "Real name",
+		uiHostmask:      "Hostmask",
+		uiAccount:       "Account",
+		uiServer:        "Server",
+		uiChannels:      "Channels",
+		uiIdle:          "Idle for",
+		uiSignedOn:      "Online since",
+		uiAwayMessage:   "Away",
+		uiOper:          "IRC operator",
+		uiYes:           "yes",
+		uiTopic:         "Topic",
+		uiSetTopic:      "Change topic",
+		uiLogs:          "Logs",
+		uiPreviousDay:   "Previous day",
+		uiNextDay:       "Next day",
+		uiLogSpan:       "%s to %s",
+		uiAnonymousUser: "User %d",
+		uiRedacted:      "This message was removed by a moderator.",
+		uiModeratorNote: "Note from a moderator",
+		uiMasked:        "Hidden by a moderator, click to show",
+		uiReadOnly:      "This channel only relays announcements.",
+		uiCaptcha:       "Please show that you are human before sending messages.",
+		uiContinue:      "Continue",
+		uiLanguage:      "English",
+		uiTimeFormat:    "Time format",
+		uiTimezone:      "Time zone",
+		ui24h:           "24-hour",
+		ui12h:           "12-hour",
+		uiRelative:      "relative",
+		uiAgo:           "%s ago",
+		uiApply:         "Apply",
+		uiPeek:          "Have a look at another channel",
+		uiPeekJoin:      "Peek",
+	},
+	"de": {
+		uiTitleIndex:    "smirc",
+		uiTitleMessages: "smirc: Nachrichten",
+		uiTitleUsers:    "smirc: Benutzer",
+		uiTitlePaste:    "smirc: Paste",
+		uiTitleHistory:  "smirc: Verlauf",
+		uiMessage:       "Nachricht",
+		uiHistory:       "Verlauf",
+		uiOlder:         "Ältere Nachrichten",
+		uiNewer:         "Neuere Nachrichten",
+		uiPageOf:        "Seite %d von %d",
+		uiRegister:      "Kanal registrieren",
+		uiRegisterWith:  "%s bei %s registrieren",
+		uiIdentified:    "Du bist bei den Services identifiziert.",
+		uiNotIdentified: "Du bist nicht bei den Services identifiziert. Identifiziere dich zuerst bei NickServ, ChanServ registriert Kanäle nur für identifizierte Nicks.",
+		uiDescription:   "Beschreibung",
+		uiRegPending:    "Warte auf die Antwort von ChanServ…",
+		uiRegDone:       "Der Kanal ist registriert.",
+		uiRegFailed:     "ChanServ hat die Registrierung abgelehnt.",
+		uiRegTimeout:    "ChanServ hat nicht geantwortet.",
+		uiUsers:         "Benutzer:",
+		uiSend:          "Senden",
+		uiSaveDraft:     "Entwurf speichern",
+		uiRaw:           "Rohtext",
+		uiStar:          "Markieren",
+		uiReport:        "Den Moderatoren melden",
+		uiRelayedBy:     "über %s",
+		uiLogin:         "Anmelden",
+		uiLogout:        "Abmelden",
+		uiUser:          "Benutzer",
+		uiPassword:      "Passwort",
+		uiLoginFailed:   "Falscher Benutzer oder falsches Passwort.",
+		uiLoginToSend:   "Zum Senden anmelden",
+		uiTheme:         "Design",
+		uiThemeAuto:     "wie der Browser",
+		uiThemeLight:    "hell",
+		uiThemeDark:     "dunkel",
+		uiMuted:         "Stummgeschaltet",
+		uiTitleSearch:   "smirc: Suche",
+		uiSearch:        "Suchen",
+		uiSearchText:    "Text",
+		uiNick:          "Nick",
+		uiChannel:       "Kanal",
+		uiAllChannels:   "alle",
+		uiSince:         "Von",
+		uiUntil:         "Bis",
+		uiContext:       "Im Verlauf zeigen",
+		uiNoResults:     "Keine Nachrichten gefunden.",
+		uiSavedSearches: "Gespeicherte Suchen",
+		uiSaveSearch:    "Suche speichern",
+		uiSearchName:    "Name",
+		uiAlert:         "Bei neuen Treffern benachrichtigen",
+		uiDelete:        "Löschen",
+		uiNoSuchNick:    "Niemand mit diesem Nick ist online.",
+		uiRealName:      "Name",
+		uiHostmask:      "Hostmaske",
+		uiAccount:       "Konto",
+		uiServer:        "Server",
+		uiChannels:      "Kanäle",
+		uiIdle:          "Untätig seit",
+		uiSignedOn:      "Online seit",
+		uiAwayMessage:   "Abwesend",
+		uiOper:          "IRC-Operator",
+		uiYes:           "ja",
+		uiTopic:         "Thema",
+		uiSetTopic:      "Thema ändern",
+		uiLogs:          "Protokolle",
+		uiPreviousDay:   "Vorheriger Tag",
+		uiNextDay:       "Nächster Tag",
+		uiLogSpan:       "%s bis %s",
+		uiAnonymousUser: "Benutzer %d",
+		uiRedacted:      "Diese Nachricht wurde von einem Moderator entfernt.",
+		uiModeratorNote: "Anmerkung eines Moderators",
+		uiMasked:        "Von einem Moderator verborgen, zum Anzeigen klicken",
+		uiReadOnly:      "Dieser Kanal gibt nur Ankündigungen weiter.",
+		uiCaptcha:       "Bitte zeige, dass du ein Mensch bist, bevor du Nachrichten sendest.",
+		uiContinue:      "Weiter",
+		uiLanguage:      "Deutsch",
+		uiTimeFormat:    "Zeitformat",
+		uiTimezone:      "Zeitzone",
+		ui24h:           "24 Stunden",
+		ui12h:           "12 Stunden",
+		uiRelative:      "relativ",
+		uiAgo:           "vor %s",
+		uiApply:         "Übernehmen",
+		uiPeek:          "In einen anderen Kanal hineinschauen",
+		uiPeekJoin:      "Anschauen",
+	},
+	"es": {
+		uiTitleIndex:    "smirc",
+		uiTitleMessages: "smirc: mensajes",
+		uiTitleUsers:    "smirc: usuarios",
+		uiTitlePaste:    "smirc: texto pegado",
+		uiTitleHistory:  "smirc: historial",
+		uiMessage:       "Mensaje",
+		uiHistory:       "Historial",
+		uiOlder:         "Mensajes anteriores",
+		uiNewer:         "Mensajes más recientes",
+		uiPageOf:        "Página %d de %d",
+		uiRegister:      "Registrar canal",
+		uiRegisterWith:  "Registrar %s con %s",
+		uiIdentified:    "Estás identificado con los servicios.",
+		uiNotIdentified: "No estás identificado con los servicios. Identifícate primero con NickServ, ChanServ solo registra canales para nicks identificados.",
+		uiDescription:   "Descripción",
+		uiRegPending:    "Esperando la respuesta de ChanServ…",
+		uiRegDone:       "El canal está registrado.",
+		uiRegFailed:     "ChanServ rechazó el registro.",
+		uiRegTimeout:    "ChanServ no respondió.",
+		uiUsers:         "Usuarios:",
+		uiSend:          "Enviar",
+		uiSaveDraft:     "Guardar borrador",
+		uiRaw:           "texto plano",
+		uiStar:          "Destacar",
+		uiReport:        "Denunciar a los moderadores",
+		uiRelayedBy:     "vía %s",
+		uiLogin:         "Iniciar sesión",
+		uiLogout:        "Cerrar sesión",
+		uiUser:          "Usuario",
+		uiPassword:      "Contraseña",
+		uiLoginFailed:   "Usuario o contraseña incorrectos.",
+		uiLoginToSend:   "Inicia sesión para enviar mensajes",
+		uiTheme:         "Tema",
+		uiThemeAuto:     "como el navegador",
+		uiThemeLight:    "claro",
+		uiThemeDark:     "oscuro",
+		uiMuted:         "Silenciados",
+		uiTitleSearch:   "smirc: búsqueda",
+		uiSearch:        "Buscar",
+		uiSearchText:    "Texto",
+		uiNick:          "Nick",
+		uiChannel:       "Canal",
+		uiAllChannels:   "todos",
+		uiSince:         "Desde",
+		uiUntil:         "Hasta",
+		uiContext:       "Ver en contexto",
+		uiNoResults:     "No se encontraron mensajes.",
+		uiSavedSearches: "Búsquedas guardadas",
+		uiSaveSearch:    "Guardar búsqueda",
+		uiSearchName:    "Nombre",
+		uiAlert:         "Avisarme de mensajes nuevos encontrados",
+		uiDelete:        "Borrar",
+		uiNoSuchNick:    "Nadie con este nick está conectado.",
+		uiRealName:      "Nombre real",
+		uiHostmask:      "Máscara",
+		uiAccount:       "Cuenta",
+		uiServer:        "Servidor",
+		uiChannels:      "Canales",
+		uiIdle:          "Inactivo desde hace",
+		uiSignedOn:      "Conectado desde",
+		uiAwayMessage:   "Ausente",
+		uiOper:          "Operador de IRC",
+		uiYes:           "sí",
+		uiTopic:         "Tema",
+		uiSetTopic:      "Cambiar el tema",
+		uiLogs:          "Registros",
+		uiPreviousDay:   "Día anterior",
+		uiNextDay:       "Día siguiente",
+		uiLogSpan:       "del %s al %s",
+		uiAnonymousUser: "Usuario %d",
+		uiRedacted:      "Un moderador eliminó este mensaje.",
+		uiModeratorNote: "Nota de un moderador",
+		uiMasked:        "Ocultado por un moderador, haz clic para verlo",
+		uiReadOnly:      "Este canal solo retransmite anuncios.",
+		uiCaptcha:       "Demuestra que eres humano antes de enviar mensajes.",
+		uiContinue:      "Continuar",
+		uiLanguage:      "Español",
+		uiTimeFormat:    "Formato de hora",
+		uiTimezone:      "Zona horaria",
+		ui24h:           "24 horas",
+		ui12h:           "12 horas",
+		uiRelative:      "relativo",
+		uiAgo:           "hace %s",
+		uiApply:         "Aplicar",
+		uiPeek:          "Echar un vistazo a otro canal",
+		uiPeekJoin:      "Mirar",
+	},
+}
+
+// tr returns the translation of a UI string, falling back to English
+func tr(lang, key string) string {
+	if text, ok := uiCatalogs[lang][key]; ok {
+		return text
+	}
+	return uiCatalogs[defaultLanguage][key]
+}
+
+// requestLanguage picks the UI language for a request. A ?lang= parameter
+// wins and is remembered in a cookie; otherwise the cookie is used, and
+// then the browser's Accept-Language header.
+func requestLanguage(w http.ResponseWriter, r *http.Request) string {
+	lang := requestPreference(w, r, cookieKeyLanguage, func(lang string) bool { return uiCatalogs[lang] != nil })
+	if lang == "" {
+		return acceptedLanguage(r.Header.Get("Accept-Language"))
+	}
+	return lang
+}
+
+// requestTheme returns the theme picked by the client that made r, or else
+// the configured one
+func requestTheme(w http.ResponseWriter, r *http.Request) string {
+	theme := requestPreference(w, r, cookieKeyTheme, func(theme string) bool { return themes.Has(theme) })
+	if theme == "" {
+		return irc.config.Theme
+	}
+	return theme
+}
+
+// requestPreference returns a display preference set with a query parameter,
+// which is then remembered in a cookie of the same name and in the
+// preferences of a logged in user, or from those. Returns "" when none
+// holds a valid value.
+func requestPreference(w http.ResponseWriter, r *http.Request, key string, valid func(string) bool) string {
+	user, loggedIn := prefsUser(r)
+	if value := r.URL.Query().Get(key); value != "" && valid(value) {
+		http.SetCookie(w, &http.Cookie{Name: key, Value: value, Path: "/", MaxAge: 365 * 24 * 60 * 60})
+		if loggedIn {
+			data, _ := json.Marshal(value)
+			if err := prefs.Set(user, map[string]json.RawMessage{prefKeys[key]: data}); err != nil {
+				log.Printf("Error: %s", err)
+			}
+		}
+		return value
+	}
+	if value, ok := prefs.String(user, prefKeys[key]); loggedIn && ok && valid(value) {
+		return value
+	}
+	if cookie, err := r.Cookie(key); err == nil && valid(cookie.Value) {
+		return cookie.Value
+	}
+	return ""
+}
+
+// viewPrefs are the display preferences of a browser
+type viewPrefs struct {
+	lang       string
+	location   *time.Location
+	timeFormat string
+	theme      string
+	// user is whose bookmarks are shown, if identified, see webUser
+	user       string
+	identified bool
+	// csrfToken goes into the forms of rendered messages
+	csrfToken string
+}
+
+func requestPrefs(w http.ResponseWriter, r *http.Request) viewPrefs {
+	prefs := viewPrefs{
+		lang:       requestLanguage(w, r),
+		location:   time.Local,
+		timeFormat: irc.config.TimeFormat,
+		theme:      requestTheme(w, r),
+		csrfToken:  csrfToken(w, r),
+	}
+	prefs.user, prefs.identified = webUser(r)
+	if irc.config.Timezone != "" {
+		prefs.location, _ = time.LoadLocation(irc.config.Timezone)
+	}
+	validTimezone := func(tz string) bool {
+		_, err := time.LoadLocation(tz)
+		return err == nil
+	}
+	if tz := requestPreference(w, r, cookieKeyTimezone, validTimezone); tz != "" {
+		prefs.location, _ = time.LoadLocation(tz)
+	}
+	validTimeFormat := func(format string) bool {
+		return format == timeFormat24h || format == timeFormat12h || format == timeFormatRelative
+	}
+	if format := requestPreference(w, r, cookieKeyTimeFormat, validTimeFormat); format != "" {
+		prefs.timeFormat = format
+	}
+	return prefs
+}
+
+// formatTime renders a timestamp in the preferred time zone and format. The
+// date is only included for messages from before today.
+func (p viewPrefs) formatTime(t time.Time) string {
+	if p.timeFormat == timeFormatRelative {
+		age := time.Since(t)
+		switch {
+		case age < time.Minute:
+			return fmt.Sprintf(tr(p.lang, uiAgo), fmt.Sprintf("%ds", int(age.Seconds())))
+		case age < time.Hour:
+			return fmt.Sprintf(tr(p.lang, uiAgo), fmt.Sprintf("%dm", int(age.Minutes())))
+		case age < 24*time.Hour:
+			return fmt.Sprintf(tr(p.lang, uiAgo), fmt.Sprintf("%dh", int(age.Hours())))
+		}
+		return fmt.Sprintf(tr(p.lang, uiAgo), fmt.Sprintf("%dd", int(age.Hours()/24)))
+	}
+	layout := "15:04"
+	if p.timeFormat == timeFormat12h {
+		layout = "3:04 PM"
+	}
+	t = t.In(p.location)
+	if now := time.Now().In(p.location); t.YearDay() != now.YearDay() || t.Year() != now.Year() {
+		layout = "2006-01-02 " + layout
+	}
+	return t.Format(layout)
+}
+
+// localize sets the time of API messages to the preferred time zone and
+// adds the timestamp as the web UI would show it
+func (p viewPrefs) localize(msgs []apiMessage) []apiMessage {
+	for i := range msgs {
+		msgs[i].Timestamp = p.formatTime(msgs[i].Time)
+		msgs[i].Time = msgs[i].Time.In(p.location)
+	}
+	return msgs
+}
+
+// timePreferences is the data of the form that changes the time display and
+// the theme, see templates/time-preferences.html
+type timePreferences struct {
+	Lang        string
+	Timezone    string
+	TimeFormats []prefOption
+	Themes      []prefOption
+}
+
+// prefOption is an option of a select of the preferences form. Label is the
+// UI string naming it, if there is one.
+type prefOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// timePreferencesFor fills the time preferences form with prefs
+func timePreferencesFor(prefs viewPrefs) timePreferences {
+	form := timePreferences{Lang: prefs.lang, Timezone: prefs.location.String()}
+	for _, format := range []struct{ value, label string }{{timeFormat24h, ui24h}, {timeFormat12h, ui12h}, {timeFormatRelative, uiRelative}} {
+		form.TimeFormats = append(form.TimeFormats, prefOption{Value: format.value, Label: format.label, Selected: prefs.timeFormat == format.value})
+	}
+	for _, theme := range themes.Names() {
+		form.Themes = append(form.Themes, prefOption{Value: theme, Label: builtinThemeLabels[theme], Selected: theme == prefs.theme})
+	}
+	return form
+}
+
+// acceptedLanguage returns the supported language with the highest quality
+// in an Accept-Language header such as "de-DE,de;q=0.9,en;q=0.8"
+func acceptedLanguage(header string) string {
+	best, bestQuality := defaultLanguage, 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				quality = parsed
+			}
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if uiCatalogs[primary] != nil && quality > bestQuality {
+			best, bestQuality = primary, quality
+		}
+	}
+	return best
+}
+
+// uiLanguages returns the languages of the UI, sorted, for the links that
+// switch to them
+func uiLanguages() []string {
+	langs := make([]string, 0, len(uiCatalogs))
+	for lang := range uiCatalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// --- Outgoing message templates
+const (
+	templatePaste = "paste"
+)
+
+var defaultTemplates = map[string]string{
+	templatePaste: `{{.Payload.URL}} ({{with .Payload.Language}}{{.}}, {{end}}{{.Payload.Lines}} lines)`,
+}
+
+var outgoingTemplates = make(map[string]*template.Template)
+
+// templateData is what an outgoing message template can refer to
+type templateData struct {
+	Channel string
+	User    string
+	Payload interface{}
+}
+
+// pastePayload is the payload of the paste template
+type pastePayload struct {
+	ID       string
+	URL      string
+	Language string
+	Lines    int
+}
+
+// uiTemplatesFS holds the built-in templates of the web UI pages
+//
+//go:embed templates/*.html
+var uiTemplatesFS embed.FS
+
+// uiTemplates are the templates of the web UI pages, keyed by file name
+var uiTemplates *htmltemplate.Template
+
+// parseUITemplates parses the built-in templates of the web UI and then
+// those in dir, which replace the built-in ones with the same name
+func parseUITemplates(dir string) (*htmltemplate.Template, error) {
+	t, err := htmltemplate.New("").Funcs(htmltemplate.FuncMap{"tr": tr}).ParseFS(uiTemplatesFS, "templates/*.html")
+	if err != nil || dir == "" {
+		return t, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no templates in %s", dir)
+	}
+	return t.ParseFiles(files...)
+}
+
+// renderPage writes the web UI page of the template name with data
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
+	var b bytes.Buffer
+	if err := uiTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		log.Printf("Error rendering %s: %s", name, err)
+		http.Error(w, "failed to render the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = b.WriteTo(w)
+}
+
+// --- Built-in themes
+const (
+	themeAuto  = "auto"
+	themeLight = "light"
+	themeDark  = "dark"
+)
+
+// builtinThemeLabels are the UI strings naming the built-in themes
+var builtinThemeLabels = map[string]string{themeAuto: uiThemeAuto, themeLight: uiThemeLight, themeDark: uiThemeDark}
+
+// themesFS holds the built-in CSS themes of the web UI
+//
+//go:embed themes/*.css
+var themesFS embed.FS
+
+// Themes are the CSS themes of the web UI, keyed by name
+type Themes struct {
+	mutex sync.Mutex
+	css   map[string][]byte
+}
+
+var themes = &Themes{}
+
+// parseThemes reads the built-in themes and then the .css files in dir,
+// which add themes or replace built-in ones. The auto theme is the light
+// one, turning into the dark one when the browser is in dark mode.
+func parseThemes(dir string) (map[string][]byte, error) {
+	css := make(map[string][]byte)
+	files, err := fs.Glob(themesFS, "themes/*.css")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if css[strings.TrimSuffix(path.Base(file), ".css")], err = themesFS.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.css"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no themes in %s", dir)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), ".css")
+			if !validPrefKey(name) {
+				return nil, fmt.Errorf("invalid theme name %q: use lowercase letters, digits and -", name)
+			}
+			if css[name], err = os.ReadFile(file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, ok := css[themeAuto]; !ok {
+		css[themeAuto] = []byte(string(css[themeLight]) + "@media (prefers-color-scheme: dark) {\n" + string(css[themeDark]) + "}\n")
+	}
+	return css, nil
+}
+
+// Set replaces the themes
+func (t *Themes) Set(css map[string][]byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.css = css
+}
+
+// Has reports whether there is a theme called name
+func (t *Themes) Has(name string) bool {
+	_, ok := t.CSS(name)
+	return ok
+}
+
+// CSS returns the style sheet of the theme name
+func (t *Themes) CSS(name string) ([]byte, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	css, ok := t.css[name]
+	return css, ok
+}
+
+// Names lists the themes in alphabetical order
+func (t *Themes) Names() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	names := make([]string, 0, len(t.css))
+	for name := range t.css {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// staticFS holds the files of the web UI that are the same for everybody:
+// the layout, the icon, the web app manifest and the service worker
+//
+//go:embed static
+var staticFS embed.FS
+
+// handlerStatic serves the files of staticFS under /static/, and the
+// manifest and service worker at the root, where browsers let them apply
+// to the whole site
+func handlerStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, endPointStatic)
+	switch r.URL.Path {
+	case endPointManifest:
+		name = "manifest.webmanifest"
+		w.Header().Set("Content-Type", "application/manifest+json")
+	case endPointServiceWorker:
+		name = "sw.js"
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		// Browsers check for a new service worker on every visit anyway
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	data, err := staticFS.ReadFile("static/" + name)
+	if err != nil || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	}
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "max-age=3600")
+	}
+	_, _ = w.Write(data)
+}
+
+// themeURL is where the style sheet of theme is served
+func themeURL(theme string) string {
+	return endPointThemes + url.PathEscape(theme) + ".css"
+}
+
+// pageHead renders the "head" template for the pages not made from
+// templates: the viewport, the style sheets of the layout and of theme, and
+// the web app manifest
+func pageHead(theme string) string {
+	var b strings.Builder
+	if err := uiTemplates.ExecuteTemplate(&b, "head", struct{ ThemeURL string }{themeURL(theme)}); err != nil {
+		log.Printf("Error rendering the page head: %s", err)
+	}
+	return b.String()
+}
+
+// handlerTheme serves the style sheet of a theme at /themes/<name>.css
+func handlerTheme(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, endPointThemes)
+	css, found := themes.CSS(strings.TrimSuffix(name, ".css"))
+	if !strings.HasSuffix(name, ".css") || !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	_, _ = w.Write(css)
+}
+
+// parseTemplates compiles the default templates and any overrides from config
+func parseTemplates(overrides map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	for name, text := range defaultTemplates {
+		if override, ok := overrides[name]; ok {
+			text = override
+		}
+		t, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", name, err)
+		}
+		templates[name] = t
+	}
+	for name := range overrides {
+		if _, ok := defaultTemplates[name]; !ok {
+			return nil, fmt.Errorf("unknown template %q", name)
+		}
+	}
+	return templates, nil
+}
+
+// renderTemplate renders an outgoing message, falling back to the default
+// template when the configured one fails to execute
+func renderTemplate(name string, data templateData) string {
+	var b strings.Builder
+	err := outgoingTemplates[name].Execute(&b, data)
+	if err == nil {
+		return b.String()
+	}
+	log.Printf("Failed to render template %q: %s", name, err)
+	b.Reset()
+	_ = template.Must(template.New(name).Parse(defaultTemplates[name])).Execute(&b, data)
+	return b.String()
+}
+
+// --- Code highlighting
+var (
+	codeLanguageAliases = map[string]string{
+		"golang": "go",
+		"py":     "python",
+		"js":     "javascript",
+		"bash":   "sh",
+		"shell":  "sh",
+		"cpp":    "c",
+	}
+	codeLineComments = map[string]string{
+		"go":         "//",
+		"c":          "//",
+		"javascript": "//",
+		"python":     "#",
+		"sh":         "#",
+	}
+	codeKeywords = map[string]map[string]bool{
+		"go": wordSet(`break case chan const continue default defer else fallthrough for func go goto if
+			import interface map package range return select struct switch type var nil true false`),
+		"c": wordSet(`auto break case char const continue default do double else enum extern float for goto
+			if int long register return short signed sizeof static struct switch typedef union unsigned void
+			volatile while NULL`),
+		"javascript": wordSet(`async await break case catch class const continue default delete do else export
+			extends false finally for function if import in instanceof let new null return super switch this
+			throw true try typeof undefined var void while yield`),
+		"python": wordSet(`and as assert async await break class continue def del elif else except finally for
+			from global if import in is lambda None nonlocal not or pass raise return True False try while
+			with yield`),
+		"sh": wordSet(`case do done elif else esac fi for function if in then until while echo export local
+			return`),
+	}
+)
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+// detectCode reports whether text is code and which language it is in.
+// Fenced blocks (```lang) carry their own language hint; text in which every
+// non-empty line is indented by a tab or four spaces counts as code as well.
+func detectCode(text string) (bool, string) {
+	lines := strings.Split(text, "\n")
+	for _, line := range lines {
+		if fence := strings.TrimSpace(line); strings.HasPrefix(fence, "```") {
+			lang := strings.ToLower(strings.TrimPrefix(fence, "```"))
+			if alias, ok := codeLanguageAliases[lang]; ok {
+				lang = alias
+			}
+			if lang == "" {
+				lang = guessLanguage(text)
+			}
+			return true, lang
+		}
+	}
+	indented := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "    ") {
+			return false, ""
+		}
+		indented = true
+	}
+	if !indented {
+		return false, ""
+	}
+	return true, guessLanguage(text)
+}
+
+// --- mIRC formatting codes
+const (
+	formatBold          = '\x02'
+	formatColor         = '\x03'
+	formatHexColor      = '\x04'
+	formatReset         = '\x0f'
+	formatMonospace     = '\x11'
+	formatReverse       = '\x16'
+	formatItalic        = '\x1d'
+	formatStrikethrough = '\x1e'
+	formatUnderline     = '\x1f'
+)
+
+// mircColors are the colors of the mIRC color codes 0 to 15. The extended
+// codes up to 98 are shown in the default color.
+var mircColors = []string{
+	"#ffffff", "#000000", "#00007f", "#009300", "#ff0000", "#7f0000", "#9c009c", "#fc7f00",
+	"#ffff00", "#00fc00", "#009393", "#00ffff", "#0000fc", "#ff00ff", "#7f7f7f", "#d2d2d2",
+}
+
+// textStyle is the formatting in effect at some point of a message
+type textStyle struct {
+	bold, italic, underline, strikethrough, monospace, reverse bool
+	// foreground and background are CSS colors, "" for the default
+	foreground, background string
+}
+
+// styledText is a piece of a message with the same formatting throughout
+type styledText struct {
+	text  string
+	style textStyle
+}
+
+// parseFormatting splits a message at its mIRC formatting codes
+func parseFormatting(text string) []styledText {
+	var pieces []styledText
+	var style textStyle
+	start := 0
+	for i := 0; i < len(text); {
+		c := text[i]
+		if c != formatBold && c != formatColor && c != formatHexColor && c != formatReset && c != formatMonospace &&
+			c != formatReverse && c != formatItalic && c != formatStrikethrough && c != formatUnderline {
+			i++
+			continue
+		}
+		if start < i {
+			pieces = append(pieces, styledText{text[start:i], style})
+		}
+		i++
+		switch c {
+		case formatBold:
+			style.bold = !style.bold
+		case formatItalic:
+			style.italic = !style.italic
+		case formatUnderline:
+			style.underline = !style.underline
+		case formatStrikethrough:
+			style.strikethrough = !style.strikethrough
+		case formatMonospace:
+			style.monospace = !style.monospace
+		case formatReverse:
+			style.reverse = !style.reverse
+		case formatReset:
+			style = textStyle{}
+		case formatColor:
+			// ^C resets the colors, ^C4 sets the foreground, ^C4,1 both
+			fg, n := colorDigits(text[i:])
+			if n == 0 {
+				style.foreground, style.background = "", ""
+				break
+			}
+			i += n
+			style.foreground = mircColor(fg)
+			if i+1 < len(text) && text[i] == ',' {
+				if bg, n := colorDigits(text[i+1:]); n > 0 {
+					i += 1 + n
+					style.background = mircColor(bg)
+				}
+			}
+		case formatHexColor:
+			// Like ^C with RRGGBB colors
+			if !isHexColor(text[i:]) {
+				style.foreground, style.background = "", ""
+				break
+			}
+			style.foreground = "#" + strings.ToLower(text[i:i+6])
+			i += 6
+			if i+1 < len(text) && text[i] == ',' && isHexColor(text[i+1:]) {
+				style.background = "#" + strings.ToLower(text[i+1:i+7])
+				i += 7
+			}
+		}
+		start = i
+	}
+	if start < len(text) {
+		pieces = append(pieces, styledText{text[start:], style})
+	}
+	return pieces
+}
+
+// colorDigits reads the one or two digit color code text starts with and
+// returns it with its length, which is 0 if there is none
+func colorDigits(text string) (code, n int) {
+	for n < 2 && n < len(text) && text[n] >= '0' && text[n] <= '9' {
+		code = code*10 + int(text[n]-'0')
+		n++
+	}
+	return code, n
+}
+
+// mircColor is the CSS color of a mIRC color code, "" for the default
+func mircColor(code int) string {
+	if code < len(mircColors) {
+		return mircColors[code]
+	}
+	return ""
+}
+
+func isHexColor(text string) bool {
+	if len(text) < 6 {
+		return false
+	}
+	for _, c := range []byte(text[:6]) {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// css is the style attribute for text formatted with s, "" if it has the
+// default formatting
+func (s textStyle) css() string {
+	var rules []string
+	if s.bold {
+		rules = append(rules, "font-weight:bold")
+	}
+	if s.italic {
+		rules = append(rules, "font-style:italic")
+	}
+	if s.underline && s.strikethrough {
+		rules = append(rules, "text-decoration:underline line-through")
+	} else if s.underline {
+		rules = append(rules, "text-decoration:underline")
+	} else if s.strikethrough {
+		rules = append(rules, "text-decoration:line-through")
+	}
+	if s.monospace {
+		rules = append(rules, "font-family:monospace")
+	}
+	foreground, background := s.foreground, s.background
+	if s.reverse {
+		foreground, background = background, foreground
+		if foreground == "" {
+			foreground = mircColors[0]
+		}
+		if background == "" {
+			background = mircColors[1]
+		}
+	}
+	if foreground != "" {
+		rules = append(rules, "color:"+foreground)
+	}
+	if background != "" {
+		rules = append(rules, "background-color:"+background)
+	}
+	return strings.Join(rules, ";")
+}
+
+// stripFormatting removes the mIRC formatting codes from text
+func stripFormatting(text string) string {
+	var b strings.Builder
+	for _, piece := range parseFormatting(text) {
+		b.WriteString(piece.text)
+	}
+	return b.String()
+}
+
+// renderFormatted renders the text of a message like renderText, showing
+// its mIRC formatting as styled spans or dropping it, as configured
+func renderFormatted(text string) string {
+	if irc.config == nil || irc.config.Formatting == formattingStrip {
+		return renderText(stripFormatting(text))
+	}
+	var b strings.Builder
+	for _, piece := range parseFormatting(text) {
+		if css := piece.style.css(); css != "" {
+			b.WriteString(`<span style="` + css + `">` + renderText(piece.text) + `</span>`)
+		} else {
+			b.WriteString(renderText(piece.text))
+		}
+	}
+	return b.String()
+}
+
+// imageExtensions are the URL paths shown as images with inline-images
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
+
+// renderText escapes the text of a message for HTML and, if configured,
+// links the URLs in it
+func renderText(text string) string {
+	if irc.config == nil || !(irc.config.AutolinkURLs || irc.config.InlineImages) {
+		return html.EscapeString(text)
+	}
+	var b strings.Builder
+	for text != "" {
+		start, end := findURL(text)
+		if start < 0 {
+			b.WriteString(html.EscapeString(text))
+			break
+		}
+		b.WriteString(html.EscapeString(text[:start]))
+		b.WriteString(renderURL(text[start:end]))
+		text = text[end:]
+	}
+	return b.String()
+}
+
+// findURL returns where the first http(s) URL in text starts and ends, or
+// -1 if there is none. Punctuation at the end belongs to the sentence, as
+// does a closing parenthesis without an opening one.
+func findURL(text string) (start, end int) {
+	lower := strings.ToLower(text)
+	for offset := 0; offset < len(text); offset = end {
+		start = strings.Index(lower[offset:], "http")
+		if start < 0 {
+			return -1, -1
+		}
+		start += offset
+		end = start + 4
+		if !strings.HasPrefix(lower[start:], "http://") && !strings.HasPrefix(lower[start:], "https://") {
+			continue
+		}
+		if start > 0 && isWordByte(text[start-1]) {
+			// Part of a longer word
+			continue
+		}
+		end = start + strings.IndexAny(lower[start:]+" ", " \t<>\"")
+		for end > start {
+			last := text[end-1]
+			if strings.IndexByte(".,;:!?'*", last) >= 0 ||
+				(last == ')' && strings.Count(text[start:end], "(") < strings.Count(text[start:end], ")")) {
+				end--
+				continue
+			}
+			break
+		}
+		if u, err := url.Parse(text[start:end]); err == nil && u.Host != "" {
+			return start, end
+		}
+	}
+	return -1, -1
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// renderURL renders a URL found in a message as a link, or as a link and
+// the image it points to. Images are loaded without a Referer, so that
+// their hosts do not learn where they were shown.
+func renderURL(rawURL string) string {
+	escaped := html.EscapeString(rawURL)
+	link := `<a href="` + escaped + `" rel="nofollow noopener noreferrer" target="_blank">` + escaped + `</a>`
+	if !irc.config.InlineImages {
+		return link
+	}
+	u, _ := url.Parse(rawURL)
+	for _, ext := range imageExtensions {
+		if strings.HasSuffix(strings.ToLower(u.Path), ext) {
+			return link + `<br /><img src="` + escaped + `" alt="" loading="lazy" referrerpolicy="no-referrer" style="max-width:300px;max-height:200px" />`
+		}
+	}
+	return link
+}
+
+// spoilerTag returns the configured spoiler tag text starts with, if any
+func spoilerTag(text string) string {
+	if irc.config == nil {
+		return ""
+	}
+	for _, tag := range irc.config.SpoilerTags {
+		if len(text) >= len(tag) && strings.EqualFold(text[:len(tag)], tag) {
+			return text[:len(tag)]
+		}
+	}
+	return ""
+}
+
+// isMonospace reports whether text only makes sense in a monospace font,
+// like table rows and ASCII art: it draws boxes, is framed by pipes, is
+// indented or aligns columns with runs of spaces, or is mostly made of
+// line-drawing punctuation.
+func isMonospace(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return false
+	}
+	if strings.HasPrefix(trimmed, "|") && strings.HasSuffix(trimmed, "|") && strings.Count(trimmed, "|") >= 3 {
+		return true
+	}
+	if strings.HasPrefix(text, "  ") || strings.Contains(trimmed, "   ") || strings.Contains(trimmed, "\t") {
+		return true
+	}
+	drawing, visible := 0, 0
+	for _, r := range trimmed {
+		switch {
+		case r >= 0x2500 && r <= 0x259F:
+			// Box drawing and block elements
+			return true
+		case r == ' ':
+		case strings.ContainsRune(`|/\_-=+*#()<>[]{}.'^~:;,"`+"`", r):
+			drawing++
+			visible++
+		default:
+			visible++
+		}
+	}
+	return visible >= 4 && drawing*2 > visible
+}
+
+// guessLanguage makes a rough guess at the language of a piece of code
+func guessLanguage(code string) string {
+	switch {
+	case strings.HasPrefix(code, "#!") && strings.Contains(strings.SplitN(code, "\n", 2)[0], "python"):
+		return "python"
+	case strings.HasPrefix(code, "#!"):
+		return "sh"
+	case strings.Contains(code, "func "):
+		return "go"
+	case strings.Contains(code, "#include"):
+		return "c"
+	case strings.Contains(code, "def ") || strings.Contains(code, "elif "):
+		return "python"
+	case strings.Contains(code, "function ") || strings.Contains(code, "=>"):
+		return "javascript"
+	}
+	return ""
+}
+
+// lineBreaks turns the line breaks of browsers and old Macs into "\n"
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// splitLines splits text into its lines at any of "\r\n", "\r" and "\n",
+// so that no line can end an IRC command early. Trailing empty lines are
+// dropped.
+func splitLines(text string) []string {
+	return strings.Split(strings.TrimRight(lineBreaks.Replace(text), "\n"), "\n")
+}
+
+// stripCodeFences drops the ``` lines so code can be sent to IRC as plain text
+func stripCodeFences(lines []string) []string {
+	var stripped []string
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "```") {
+			stripped = append(stripped, line)
+		}
+	}
+	return stripped
+}
+
+// highlightCode renders code as escaped HTML with spans around keywords,
+// strings, numbers and comments
+func highlightCode(code, lang string) string {
+	keywords := codeKeywords[lang]
+	comment := codeLineComments[lang]
+	var b strings.Builder
+	for i, line := range strings.Split(code, "\n") {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for pos := 0; pos < len(line); {
+			rest := line[pos:]
+			end := 1
+			switch c := rest[0]; {
+			case comment != "" && strings.HasPrefix(rest, comment):
+				end = len(rest)
+				writeCodeSpan(&b, "hl-comment", rest)
+			case c == '"' || c == '\'' || c == '`':
+				end = closingQuote(rest)
+				writeCodeSpan(&b, "hl-string", rest[:end])
+			case isCodeWordChar(c):
+				for end < len(rest) && isCodeWordChar(rest[end]) {
+					end++
+				}
+				switch word := rest[:end]; {
+				case c >= '0' && c <= '9':
+					writeCodeSpan(&b, "hl-number", word)
+				case keywords[word]:
+					writeCodeSpan(&b, "hl-keyword", word)
+				default:
+					b.WriteString(html.EscapeString(word))
+				}
+			default:
+				b.WriteString(html.EscapeString(rest[:1]))
+			}
+			pos += end
+		}
+	}
+	return b.String()
+}
+
+func writeCodeSpan(b *strings.Builder, class, text string) {
+	b.WriteString(`<span class="` + class + `">` + html.EscapeString(text) + `</span>`)
+}
+
+func isCodeWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// closingQuote returns the length of the quoted string at the start of text
+func closingQuote(text string) int {
+	for i := 1; i < len(text); i++ {
+		if text[i] == '\\' {
+			i++
+			continue
+		}
+		if text[i] == text[0] {
+			return i + 1
+		}
+	}
+	return len(text)
+}
+
+// renderPaste renders a paste as HTML, highlighting its code blocks
+func renderPaste(paste *Paste) string {
+	if !paste.Code {
+		return "<pre>" + html.EscapeString(paste.Text) + "</pre>"
+	}
+	var b strings.Builder
+	var block []string
+	inFence, fenced := false, false
+	lang := paste.Language
+	flush := func(code bool) {
+		if len(block) == 0 {
+			return
+		}
+		if code {
+			b.WriteString(`<pre><code>` + highlightCode(strings.Join(block, "\n"), lang) + `</code></pre>`)
+		} else {
+			b.WriteString("<pre>" + html.EscapeString(strings.Join(block, "\n")) + "</pre>")
+		}
+		block = nil
+	}
+	for _, line := range strings.Split(paste.Text, "\n") {
+		if fence := strings.TrimSpace(line); strings.HasPrefix(fence, "```") {
+			flush(inFence)
+			if !inFence {
+				if hint := strings.ToLower(strings.TrimPrefix(fence, "```")); hint != "" {
+					lang = hint
+					if alias, ok := codeLanguageAliases[hint]; ok {
+						lang = alias
+					}
+				}
+			}
+			inFence, fenced = !inFence, true
+			continue
+		}
+		block = append(block, line)
+	}
+	// Without fences the whole paste is indented code
+	flush(inFence || !fenced)
+	return b.String()
+}
+
+// namedParams maps the parameters of a numeric reply, minus the leading nick, to
+// the given names; it returns false when the reply has too few parameters
+func namedParams(l ircLine, names []string) (map[string]string, bool) {
+	if len(l.Params) < len(names)+1 {
+		return nil, false
+	}
+	args := l.Params[1:]
+	params := make(map[string]string, len(names))
+	for i, name := range names {
+		if strings.HasPrefix(name, ":") {
+			params[name[1:]] = args[len(args)-1]
+			continue
+		}
+		params[name] = args[i]
+	}
+	return params, true
+}
+
+var errRegistrationPending = errors.New("a registration is still pending")
+
+// Start sends REGISTER for a channel to ChanServ. Only one registration can
+// be pending at a time.
+func (cr *ChannelRegistration) Start(channel, description string) error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.checkTimeout()
+	if cr.Status == registrationPending {
+		return fmt.Errorf("%w: %s", errRegistrationPending, cr.Channel)
+	}
+	if err := sendMessage(irc, irc.config.ChanServNick, strings.TrimSpace("REGISTER "+channel+" "+description)); err != nil {
+		return err
+	}
+	cr.Channel, cr.Status, cr.Reply, cr.Started = channel, registrationPending, "", time.Now()
+	return nil
+}
+
+// HandleNotice looks at a notice from ChanServ for the outcome of a pending
+// registration. Atheme and Anope both answer with a notice naming the channel.
+func (cr *ChannelRegistration) HandleNotice(notice string) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	text := stripFormatting(notice)
+	if cr.Status != registrationPending || !strings.Contains(strings.ToLower(text), strings.ToLower(cr.Channel)) {
+		return
+	}
+	cr.Reply = text
+	if lower := strings.ToLower(text); strings.Contains(lower, "is now registered") || strings.Contains(lower, "registered under") {
+		cr.Status = registrationRegistered
+	} else {
+		cr.Status = registrationFailed
+	}
+	log.Printf("Registration of %s %s: %s", cr.Channel, cr.Status, text)
+}
+
+// State returns a copy of the registration state
+func (cr *ChannelRegistration) State() ChannelRegistration {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.checkTimeout()
+	return ChannelRegistration{Channel: cr.Channel, Status: cr.Status, Reply: cr.Reply, Started: cr.Started}
+}
+
+// checkTimeout gives up on a registration ChanServ never answered; mutex
+// must be held
+func (cr *ChannelRegistration) checkTimeout() {
+	if cr.Status == registrationPending && time.Since(cr.Started) > registrationTimeout {
+		cr.Status = registrationTimedOut
+	}
+}
+
+// saslSession is the state of SASL authentication during registration
+type saslSession struct {
+	conn      net.Conn
+	mechanism string
+	username  string
+	password  string
+	// pending collects server messages that arrive in 400 byte chunks
+	pending string
+	scram   *scramClient
+}
+
+// start tells the server which mechanism we are going to authenticate with
+func (s *saslSession) start() {
+	log.Printf(">> AUTHENTICATE %s\n\n", s.mechanism)
+	_, _ = fmt.Fprintf(s.conn, "AUTHENTICATE %s\r\n", s.mechanism)
+}
+
+// authenticate answers an AUTHENTICATE message from the server
+func (s *saslSession) authenticate(data string) {
+	if s == nil {
+		return
+	}
+	// A message of exactly 400 bytes means more is to come
+	if data != "+" {
+		s.pending += data
+		if len(data) == 400 {
+			return
+		}
+	}
+	challenge, err := base64.StdEncoding.DecodeString(s.pending)
+	s.pending = ""
+	if err != nil {
+		log.Printf("Invalid SASL challenge: %s", err)
+		s.abort()
+		return
+	}
+
+	var response string
+	switch {
+	case s.mechanism == saslPlain:
+		// authzid, authcid and password, see RFC 4616
+		response = "\x00" + s.username + "\x00" + s.password
+	case s.scram == nil:
+		s.scram = &scramClient{username: s.username, password: s.password}
+		response, err = s.scram.clientFirst()
+	case s.scram.authMessage == "":
+		response, err = s.scram.clientFinal(string(challenge))
+	default:
+		if err = s.scram.verifyServerFinal(string(challenge)); err == nil {
+			// Nothing left to say, the server answers with 903
+			response = ""
+		}
+	}
+	if err != nil {
+		log.Printf("SASL %s failed: %s", s.mechanism, err)
+		s.abort()
+		return
+	}
+	s.send(response)
+}
+
+// send sends a response in chunks of at most 400 bytes, as the protocol asks
+func (s *saslSession) send(response string) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(response))
+	for len(encoded) >= 400 {
+		_, _ = fmt.Fprintf(s.conn, "AUTHENTICATE %s\r\n", encoded[:400])
+		encoded = encoded[400:]
+	}
+	if encoded == "" {
+		encoded = "+"
+	}
+	_, _ = fmt.Fprintf(s.conn, "AUTHENTICATE %s\r\n", encoded)
+}
+
+func (s *saslSession) abort() {
+	_, _ = fmt.Fprintf(s.conn, "AUTHENTICATE *\r\n")
+}
+
+// scramClient is the client side of SCRAM-SHA-256, see RFC 5802 and RFC 7677
+type scramClient struct {
+	username        string
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+// scramMaxIterations caps the iteration count the server may ask for, which
+// would otherwise let it keep us busy hashing for as long as it likes
+const scramMaxIterations = 1000000
+
+var scramNameEscaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+// clientFirst returns the client-first-message
+func (c *scramClient) clientFirst() (string, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	c.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+	c.clientFirstBare = "n=" + scramNameEscaper.Replace(c.username) + ",r=" + c.clientNonce
+	return "n,," + c.clientFirstBare, nil
+}
+
+// clientFinal answers the server-first-message with the client proof
+func (c *scramClient) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttributes(serverFirst)
+	nonce, salt64, iterations := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return "", fmt.Errorf("server nonce does not extend ours")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", fmt.Errorf("invalid salt: %w", err)
+	}
+	iter, err := strconv.Atoi(iterations)
+	if err != nil || iter < 1 {
+		return "", fmt.Errorf("invalid iteration count %q", iterations)
+	}
+	if iter > scramMaxIterations {
+		return "", fmt.Errorf("iteration count %d is over %d", iter, scramMaxIterations)
+	}
+
+	c.saltedPassword = pbkdf2.Key([]byte(c.password), salt, iter, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(c.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	c.authMessage = c.clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], c.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks that the server knows our password as well
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attrs := scramAttributes(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("server error %q", e)
+	}
+	serverKey := hmacSHA256(c.saltedPassword, "Server Key")
+	expected := base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, c.authMessage))
+	if subtle.ConstantTimeCompare([]byte(attrs["v"]), []byte(expected)) != 1 {
+		return fmt.Errorf("server signature does not match")
+	}
+	return nil
+}
+
+// scramAttributes parses a SCRAM message such as "r=abc,s=c2FsdA==,i=4096"
+func scramAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(message, ",") {
+		if key, value, ok := strings.Cut(attr, "="); ok {
+			attrs[key] = value
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// tlsSessionCache lets reconnects resume the previous TLS session instead of
+// doing a full handshake
+var tlsSessionCache = tls.NewLRUClientSessionCache(0)
+
+// dialIRC opens the connection to the IRC server, over TLS if configured
+func dialIRC(config *IRCConfig) (net.Conn, error) {
+	if config.WebSocketURL != "" {
+		return dialWebSocket(config)
+	}
+	address := net.JoinHostPort(config.Server, strconv.Itoa(config.Port))
+	conn, err := dialTCP(config, address)
+	if err != nil || !config.TLS {
+		return conn, err
+	}
+	return clientTLS(conn, config.Server, address, config)
+}
+
+// dialTCP connects to address with the configured TCP options
+func dialTCP(config *IRCConfig, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(config.DialTimeoutSeconds) * time.Second}
+	keepAlive := ircclient.KeepAlive{
+		Idle:     time.Duration(config.TCPKeepAliveIdleSeconds) * time.Second,
+		Interval: time.Duration(config.TCPKeepAliveIntervalSeconds) * time.Second,
+		Count:    config.TCPKeepAliveCount,
+	}
+	if keepAlive != (ircclient.KeepAlive{}) {
+		// Set after connecting, Go would override it with its own
+		dialer.KeepAlive = -1
+	}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tcpConn := conn.(*net.TCPConn)
+	if dialer.KeepAlive < 0 {
+		err = keepAlive.Apply(tcpConn)
+	}
+	if err == nil && config.TCPNoDelay != nil {
+		err = tcpConn.SetNoDelay(*config.TCPNoDelay)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// clientTLS does the TLS handshake on conn, checking the certificate pins and
+// fingerprints of the server at address
+func clientTLS(conn net.Conn, serverName, address string, config *IRCConfig) (net.Conn, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		ClientSessionCache: tlsSessionCache,
+	}
+	if len(config.TLSPins) > 0 {
+		// A pinned certificate is trusted on its own, e.g. a self-signed one
+		// on a private server, so the CA chain is not checked
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return checkPins(state.PeerCertificates, config.TLSPins)
+		}
+	} else if config.TLSSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.TLSHandshakeTimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	if state.DidResume {
+		log.Printf("Resumed TLS session with %s", address)
+	} else if len(state.PeerCertificates) > 0 {
+		fingerprints.Check(address, certificateFingerprint(state.PeerCertificates[0]))
+	}
+	return tlsConn, nil
+}
+
+// --- WebSocket, see https://ircv3.net/specs/extensions/websocket
+const (
+	webSocketGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	webSocketSubprotocol = "text.ircv3.net"
+	wsOpContinuation     = 0x0
+	wsOpText             = 0x1
+	wsOpBinary           = 0x2
+	wsOpClose            = 0x8
+	wsOpPing             = 0x9
+	wsOpPong             = 0xA
+	wsMaxMessageSize     = 64 * 1024
+)
+
+// wsConn carries IRC lines over a WebSocket, one line per message, so that
+// the rest of smirc can keep treating it as a plain IRC connection
+type wsConn struct {
+	net.Conn
+	// server is set for the browsers connected to /ws, whose frames are
+	// masked instead of ours
+	server bool
+	// idleTimeout, if set, is how long to wait for the next frame
+	idleTimeout time.Duration
+	reader      *bufio.Reader
+	writeMutex  sync.Mutex
+	incoming    []byte
+	outgoing    []byte
+}
+
+// dialWebSocket connects to config.WebSocketURL and upgrades the connection
+func dialWebSocket(config *IRCConfig) (net.Conn, error) {
+	u, err := url.Parse(config.WebSocketURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	switch {
+	case u.Scheme == "wss" && port == "":
+		port = "443"
+	case u.Scheme == "ws" && port == "":
+		port = "80"
+	case u.Scheme != "ws" && u.Scheme != "wss":
+		return nil, fmt.Errorf("unsupported WebSocket scheme %q", u.Scheme)
+	}
+	address := net.JoinHostPort(u.Hostname(), port)
+	conn, err := dialTCP(config, address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		if conn, err = clientTLS(conn, u.Hostname(), address, config); err != nil {
+			return nil, err
+		}
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-Websocket-Key":      {key},
+			"Sec-Websocket-Version":  {"13"},
+			"Sec-Websocket-Protocol": {webSocketSubprotocol},
+		},
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Duration(config.TLSHandshakeTimeoutSeconds) * time.Second))
+	reader := bufio.NewReader(conn)
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = conn.Close()
+		return nil, fmt.Errorf("WebSocket upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-Websocket-Accept") != webSocketAccept(key) {
+		_ = conn.Close()
+		return nil, errors.New("WebSocket upgrade returned a bad Sec-WebSocket-Accept")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, reader: reader}, nil
+}
+
+// webSocketAccept is the Sec-WebSocket-Accept expected for key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Read returns the received messages, each terminated with CRLF
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.incoming) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.incoming = append(bytes.TrimRight(message, "\r\n"), '\r', '\n')
+	}
+	n := copy(p, c.incoming)
+	c.incoming = c.incoming[n:]
+	return n, nil
+}
+
+// readMessage reads a whole, possibly fragmented, data message, answering
+// pings on the way
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			c.writeMutex.Lock()
+			err := c.writeFrame(wsOpPong, payload)
+			c.writeMutex.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.writeMutex.Lock()
+			_ = c.writeFrame(wsOpClose, payload)
+			c.writeMutex.Unlock()
+			return nil, io.EOF
+		}
+		message = append(message, payload...)
+		if len(message) > wsMaxMessageSize {
+			return nil, errors.New("WebSocket message too long")
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	if c.idleTimeout > 0 {
+		if err = c.Conn.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return
+		}
+	}
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.reader, header); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0F
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > wsMaxMessageSize {
+		err = errors.New("WebSocket frame too long")
+		return
+	}
+	// Browsers must mask their frames so that they cannot be made to send
+	// bytes of a page's choosing to a proxy, and servers must not
+	masked := header[1]&0x80 != 0
+	if masked != c.server {
+		err = fmt.Errorf("WebSocket frame with the mask bit %t", masked)
+		return
+	}
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err = io.ReadFull(c.reader, mask); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range mask {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= mask[i]
+		}
+	}
+	return
+}
+
+// Write sends every complete line in p as a text message
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.outgoing = append(c.outgoing, p...)
+	for {
+		i := bytes.IndexByte(c.outgoing, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := bytes.TrimRight(c.outgoing[:i], "\r")
+		c.outgoing = c.outgoing[i+1:]
+		if err := c.writeFrame(wsOpText, line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// writeFrame sends a single frame, masked if we are the client as the
+// protocol requires; writeMutex must be held
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	maskBit := byte(0x80)
+	if c.server {
+		maskBit = 0
+	}
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	if c.server {
+		_, err := c.Conn.Write(append(frame, payload...))
+		return err
+	}
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// WriteMessage sends data as a single text message
+func (c *wsConn) WriteMessage(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeFrame(wsOpText, data)
+}
+
+// acceptWebSocket upgrades a request from the web UI to a WebSocket, agreeing
+// on subprotocol if it is set and the client offers it. Only pages served by
+// us may connect, so that other sites cannot read along.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request, subprotocol string) (*wsConn, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" || r.Header.Get("Sec-Websocket-Version") != "13" {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade")
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin WebSocket", http.StatusForbidden)
+		return nil, fmt.Errorf("cross-origin WebSocket from %s", r.Header.Get("Origin"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	agreed := ""
+	for _, offered := range strings.Split(strings.Join(r.Header.Values("Sec-Websocket-Protocol"), ","), ",") {
+		if subprotocol != "" && strings.TrimSpace(offered) == subprotocol {
+			agreed = "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+		}
+	}
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n" + agreed + "\r\n")
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// A browser must answer our pings, so one that stays silent for two of
+	// them is gone, e.g. a tab of a laptop that went to sleep
+	idleTimeout := 2 * time.Duration(irc.config.WSPingIntervalSeconds) * time.Second
+	return &wsConn{Conn: conn, server: true, reader: rw.Reader, idleTimeout: idleTimeout}, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint of a certificate in
+// the usual colon separated form
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
+
+// checkPins fails unless the server certificate matches one of the pins
+func checkPins(certs []*x509.Certificate, pins []string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("server sent no certificate")
+	}
+	fingerprint := certificateFingerprint(certs[0])
+	spki := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	publicKeyPin := "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+	for _, pin := range pins {
+		if pin == publicKeyPin || normalizeFingerprint(pin) == normalizeFingerprint(fingerprint) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate SHA256 %s (public key %s) does not match any pin", fingerprint, publicKeyPin)
+}
+
+// normalizeFingerprint makes "ab:cd" and "ABCD" compare equal
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// validPin reports whether a pin is a SHA-256 certificate fingerprint or a
+// public key hash
+func validPin(pin string) bool {
+	if strings.HasPrefix(pin, "sha256/") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		return err == nil && len(decoded) == sha256.Size
+	}
+	decoded, err := hex.DecodeString(normalizeFingerprint(pin))
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// Check logs the fingerprint of a server certificate, and warns when it is
+// not the one seen on the previous connection to that server
+func (f *Fingerprints) Check(address, fingerprint string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	log.Printf("TLS certificate of %s: SHA256 %s", address, fingerprint)
+	previous, ok := f.known[address]
+	if ok && previous != fingerprint {
+		log.Printf("**************************************************************")
+		log.Printf("WARNING: the TLS certificate of %s has CHANGED", address)
+		log.Printf("WARNING: was SHA256 %s", previous)
+		log.Printf("WARNING: now SHA256 %s", fingerprint)
+		log.Printf("WARNING: expected after a certificate renewal, otherwise check for interception")
+		log.Printf("**************************************************************")
+	}
+	if previous == fingerprint {
+		return
+	}
+	f.known[address] = fingerprint
+	f.save()
+}
+
+func (f *Fingerprints) load() {
+	f.known = make(map[string]string)
+	if f.fileName == "" {
+		return
+	}
+	data, err := os.ReadFile(f.fileName)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to read fingerprints file [%s]: %s", f.fileName, err)
+	}
+	if err := json.Unmarshal(data, &f.known); err != nil {
+		log.Fatalf("Failed to parse fingerprints file [%s]: %s", f.fileName, err)
+	}
+}
+
+// save writes the fingerprints file; mutex must be held
+func (f *Fingerprints) save() {
+	if f.fileName == "" {
+		return
+	}
+	data, err := json.MarshalIndent(f.known, "", "  ")
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	if err := os.WriteFile(f.fileName, data, 0600); err != nil {
+		log.Printf("Failed to write fingerprints file [%s]: %s", f.fileName, err)
+	}
+}
+
+// runHooks runs every hook configured for the event in the background
+func runHooks(event hookEvent) {
+	event.Server = irc.config.Server
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.User != "" && event.Event != hookDigest && quietHours.Hold(event, time.Now()) {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	for _, hook := range irc.config.Hooks {
+		if hook.Event == event.Event {
+			go hook.run(event, payload)
+		}
+	}
+}
+
+func (h Hook) run(event hookEvent, payload []byte) {
+	for _, webhook := range []bool{false, true} {
+		if (webhook && h.URL == "") || (!webhook && len(h.Command) == 0) {
+			continue
+		}
+		// A delivery that failed for good is kept to be retried
+		if d := h.deliver(webhook, event, payload, h.Retries, 0); d.Status == deliveryFailed {
+			deadLetters.Add(deadLetter{
+				Time:      time.Now(),
+				Event:     d.Event,
+				Target:    d.Target,
+				Retries:   d.Retries,
+				LastError: d.LastError,
+				Hook:      h,
+				Webhook:   webhook,
+				Payload:   payload,
+			})
+		}
+	}
+}
+
+// deliver posts to the webhook of h, or runs its command, trying again up
+// to retries times if it fails. It logs the delivery, as a redelivery of
+// another one if redeliveryOf is set.
+func (h Hook) deliver(webhook bool, event hookEvent, payload []byte, retries, redeliveryOf int) hookDelivery {
+	target := h.URL
+	if !webhook {
+		target = h.Command[0]
+	}
+	id := hookDeliveries.Start(hookDelivery{
+		Event:        event.Event,
+		Target:       target,
+		Time:         time.Now(),
+		Status:       deliveryPending,
+		RedeliveryOf: redeliveryOf,
+		Payload:      payload,
+		hook:         h,
+		webhook:      webhook,
+		event:        event,
+	})
+	delay := hookRetryDelay
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		statusCode, err := h.attempt(webhook, event, payload)
+		status := deliveryOK
+		switch {
+		case err != nil && attempt < retries:
+			status = deliveryRetrying
+		case err != nil:
+			status = deliveryFailed
+			log.Printf("Hook %s %q failed: %s", event.Event, target, err)
+		}
+		hookDeliveries.Update(id, func(d *hookDelivery) {
+			d.Status, d.StatusCode, d.Retries = status, statusCode, attempt
+			d.LatencyMS = time.Since(start).Milliseconds()
+			if err != nil {
+				d.LastError = err.Error()
+			}
+		})
+		if status != deliveryRetrying {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	d, _ := hookDeliveries.Get(id)
+	return d
+}
+
+// attempt posts to the webhook of h or runs its command once. The status
+// code is that of the webhook's answer.
+func (h Hook) attempt(webhook bool, event hookEvent, payload []byte) (statusCode int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	if !webhook {
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"SMIRC_EVENT="+event.Event,
+			"SMIRC_SERVER="+event.Server,
+			"SMIRC_CHANNEL="+event.Channel,
+			"SMIRC_NICK="+event.Nick,
+			"SMIRC_MESSAGE="+event.Message,
+			"SMIRC_USER="+event.User,
+			"SMIRC_SEARCH="+event.Search,
+			"SMIRC_KEYWORD="+event.Keyword,
+		)
+		cmd.Stdin = bytes.NewReader(payload)
+		output, err := cmd.CombinedOutput()
+		if output = bytes.TrimSpace(output); err != nil && len(output) > 0 {
+			err = fmt.Errorf("%w: %s", err, output)
+		}
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// --- Hook delivery states
+const (
+	deliveryPending  = "pending"
+	deliveryRetrying = "retrying"
+	deliveryOK       = "ok"
+	deliveryFailed   = "failed"
+)
+
+// hookDelivery is a run of a hook's command or a post to its webhook, with
+// how it went: its status, the status code the webhook answered, how long
+// the last attempt took, how often it was retried and the last error
+type hookDelivery struct {
+	ID           int             `json:"id"`
+	Event        string          `json:"event"`
+	Target       string          `json:"target"`
+	Time         time.Time       `json:"time"`
+	Status       string          `json:"status"`
+	StatusCode   int             `json:"status-code,omitempty"`
+	LatencyMS    int64           `json:"latency-ms"`
+	Retries      int             `json:"retries"`
+	LastError    string          `json:"last-error,omitempty"`
+	RedeliveryOf int             `json:"redelivery-of,omitempty"`
+	Payload      json.RawMessage `json:"payload"`
+
+	// hook, webhook and event are what is delivered again on a redelivery
+	hook    Hook
+	webhook bool
+	event   hookEvent
+}
+
+// HookDeliveries logs the latest deliveries of the hooks, so that the admin
+// sees which failed and can deliver them again
+type HookDeliveries struct {
+	mutex      sync.Mutex
+	lastID     int
+	deliveries []hookDelivery
+}
+
+var hookDeliveries = &HookDeliveries{}
+
+// Start logs a new delivery and returns its id
+func (l *HookDeliveries) Start(d hookDelivery) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastID++
+	d.ID = l.lastID
+	l.deliveries = append(l.deliveries, d)
+	if len(l.deliveries) > hookDeliveryLogSize {
+		l.deliveries = l.deliveries[len(l.deliveries)-hookDeliveryLogSize:]
+	}
+	return d.ID
+}
+
+// Update changes the delivery with the given id, unless it was dropped from
+// the log already
+func (l *HookDeliveries) Update(id int, change func(d *hookDelivery)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i := range l.deliveries {
+		if l.deliveries[i].ID == id {
+			change(&l.deliveries[i])
+			return
+		}
+	}
+}
+
+// Get returns the delivery with the given id
+func (l *HookDeliveries) Get(id int) (hookDelivery, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, d := range l.deliveries {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return hookDelivery{}, false
+}
+
+// List returns the deliveries, the latest first
+func (l *HookDeliveries) List() []hookDelivery {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	list := make([]hookDelivery, 0, len(l.deliveries))
+	for i := len(l.deliveries) - 1; i >= 0; i-- {
+		list = append(list, l.deliveries[i])
+	}
+	return list
+}
+
+// deadLetter is a hook delivery that failed even after its retries, kept
+// with what it takes to deliver it again
+type deadLetter struct {
+	ID        int             `json:"id"`
+	Time      time.Time       `json:"time"`
+	Event     string          `json:"event"`
+	Target    string          `json:"target"`
+	Retries   int             `json:"retries"`
+	LastError string          `json:"last-error"`
+	Hook      Hook            `json:"hook"`
+	Webhook   bool            `json:"webhook"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// DeadLetters keeps the hook deliveries that failed for good until they are
+// retried successfully or purged, in fileName if it is set, so that an
+// outage of an integration does not lose them
+type DeadLetters struct {
+	mutex    sync.Mutex
+	fileName string
+	lastID   int
+	letters  []deadLetter
+}
+
+var deadLetters = &DeadLetters{}
+
+func (l *DeadLetters) load() error {
+	if l.fileName == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &l.letters); err != nil {
+		return err
+	}
+	for _, letter := range l.letters {
+		if letter.ID > l.lastID {
+			l.lastID = letter.ID
+		}
+	}
+	return nil
+}
+
+// save writes the dead letters to fileName; mutex must be held
+func (l *DeadLetters) save() {
+	if l.fileName == "" {
+		return
+	}
+	data, err := json.MarshalIndent(l.letters, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(l.fileName, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save the dead letters [%s]: %s", l.fileName, err)
+	}
+}
+
+// Add keeps a failed delivery, dropping the oldest one when there are too
+// many
+func (l *DeadLetters) Add(letter deadLetter) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastID++
+	letter.ID = l.lastID
+	l.letters = append(l.letters, letter)
+	if len(l.letters) > maxDeadLetters {
+		log.Printf("Dropping dead letter %d, there are more than %d", l.letters[0].ID, maxDeadLetters)
+		l.letters = l.letters[1:]
+	}
+	l.save()
+}
+
+// List returns the dead letters, the oldest first
+func (l *DeadLetters) List() []deadLetter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]deadLetter{}, l.letters...)
+}
+
+// Get returns the dead letter with the given id
+func (l *DeadLetters) Get(id int) (deadLetter, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, letter := range l.letters {
+		if letter.ID == id {
+			return letter, true
+		}
+	}
+	return deadLetter{}, false
+}
+
+// DeleteWhere deletes the dead letters for which match returns true and
+// returns how many it deleted
+func (l *DeadLetters) DeleteWhere(match func(letter deadLetter) bool) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	kept := l.letters[:0]
+	for _, letter := range l.letters {
+		if !match(letter) {
+			kept = append(kept, letter)
+		}
+	}
+	deleted := len(l.letters) - len(kept)
+	l.letters = kept
+	if deleted > 0 {
+		l.save()
+	}
+	return deleted
+}
+
+// Retry delivers a dead letter again, once, and forgets it if that worked
+func (l *DeadLetters) Retry(letter deadLetter) hookDelivery {
+	var event hookEvent
+	_ = json.Unmarshal(letter.Payload, &event)
+	d := letter.Hook.deliver(letter.Webhook, event, letter.Payload, 0, 0)
+	if d.Status == deliveryOK {
+		l.DeleteWhere(func(other deadLetter) bool { return other.ID == letter.ID })
+		return d
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i := range l.letters {
+		if l.letters[i].ID == letter.ID {
+			l.letters[i].Retries += d.Retries + 1
+			l.letters[i].LastError = d.LastError
+			l.save()
+		}
+	}
+	return d
+}
+
+// mentions reports whether message contains nick as a word of its own
+func mentions(message, nick string) bool {
+	words := strings.FieldsFunc(message, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("[]\\`_^{|}-", r))
+	})
+	for _, word := range words {
+		if strings.EqualFold(word, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish asks tor on controlAddress to forward port of an onion service to
+// the web server on localPort, and keeps the service up until tor closes
+// the control connection
+func (o *OnionService) Publish(controlAddress string, port, localPort int) error {
+	conn, err := net.DialTimeout("tcp", controlAddress, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	control := bufio.NewReader(conn)
+
+	if err := o.authenticate(conn, control); err != nil {
+		return err
+	}
+	key := "NEW:ED25519-V3"
+	if o.keyFile != "" {
+		data, err := os.ReadFile(o.keyFile)
+		if err == nil {
+			key = strings.TrimSpace(string(data))
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	reply, err := torCommand(conn, control, fmt.Sprintf("ADD_ONION %s Port=%d,127.0.0.1:%d", key, port, localPort))
+	if err != nil {
+		return err
+	}
+	for _, line := range reply {
+		if strings.HasPrefix(line, "ServiceID=") {
+			o.mutex.Lock()
+			o.address = strings.TrimPrefix(line, "ServiceID=") + ".onion"
+			o.mutex.Unlock()
+		}
+		if strings.HasPrefix(line, "PrivateKey=") && o.keyFile != "" {
+			privateKey := strings.TrimPrefix(line, "PrivateKey=")
+			if err := os.WriteFile(o.keyFile, []byte(privateKey+"\n"), 0600); err != nil {
+				log.Printf("Failed to write onion key file [%s]: %s", o.keyFile, err)
+			}
+		}
+	}
+	log.Printf("Web UI published at %s:%d", o.Address(), port)
+
+	// Nothing else is expected from tor, but reading notices when it goes away
+	_, err = io.Copy(io.Discard, control)
+	o.mutex.Lock()
+	o.address = ""
+	o.mutex.Unlock()
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// authenticate logs in to the control port with the configured password,
+// the cookie file or no authentication, whichever tor accepts
+func (o *OnionService) authenticate(conn net.Conn, control *bufio.Reader) error {
+	reply, err := torCommand(conn, control, "PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods, cookieFile string
+	for _, line := range reply {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "AUTH ")) {
+			if strings.HasPrefix(field, "METHODS=") {
+				methods = strings.TrimPrefix(field, "METHODS=")
+			}
+			if strings.HasPrefix(field, "COOKIEFILE=") {
+				if unquoted, err := strconv.Unquote(strings.TrimPrefix(field, "COOKIEFILE=")); err == nil {
+					cookieFile = unquoted
+				}
+			}
+		}
+	}
+	command := "AUTHENTICATE"
+	switch {
+	case o.password != "":
+		command += " " + strconv.Quote(o.password)
+	case strings.Contains(methods, "COOKIE") && cookieFile != "":
+		cookie, err := os.ReadFile(cookieFile)
+		if err != nil {
+			return err
+		}
+		command += " " + hex.EncodeToString(cookie)
+	}
+	_, err = torCommand(conn, control, command)
+	return err
+}
+
+// Address is the onion address of the web UI, if published
+func (o *OnionService) Address() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.address
+}
+
+// torCommand sends a command to the tor control port and returns the lines
+// of a successful reply without their status codes
+func torCommand(conn net.Conn, control *bufio.Reader, command string) ([]string, error) {
+	if _, err := fmt.Fprintf(conn, "%s\r\n", command); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := control.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("bad reply from tor: %q", line)
+		}
+		if line[:3] != "250" {
+			return nil, fmt.Errorf("tor: %s", line)
+		}
+		lines = append(lines, line[4:])
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+var irc = &IRC{}
+
+var bookmarks = &Bookmarks{}
+
+var drafts = &Drafts{drafts: make(map[string]map[string]string)}
+
+var prefs = &Prefs{users: make(map[string]map[string]json.RawMessage)}
+
+var pastes = &Pastes{pastes: make(map[string]*Paste)}
+
+var guests = &GuestLimits{guests: make(map[string]*guest)}
+
+// Allow records that client sends lines and returns a guestLimitError when
+// it may not. Breaking a limit mutes the client.
+func (g *GuestLimits) Allow(client string, lines int) error {
+	if !irc.config.GuestMode {
+		return nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	for name, gu := range g.guests {
+		// Forget the well-behaved guests that have been quiet for an hour
+		if gu.Strikes == 0 && (len(gu.sent) == 0 || now.Sub(gu.sent[len(gu.sent)-1]) > time.Hour) {
+			delete(g.guests, name)
+		}
+	}
+	gu, ok := g.guests[client]
+	if !ok {
+		gu = &guest{Client: client}
+		g.guests[client] = gu
+	}
+	if now.Before(gu.MutedUntil) {
+		return guestLimitError{reason: "muted", wait: gu.MutedUntil.Sub(now)}
+	}
+	recent := gu.sent[:0]
+	for _, t := range gu.sent {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	gu.sent = recent
+	reason := ""
+	switch {
+	case len(gu.sent) > 0 && now.Sub(gu.sent[len(gu.sent)-1]) < g.interval:
+		reason = "sending too fast"
+	case len(gu.sent)+lines > g.perHour:
+		reason = "hourly quota exceeded"
+	}
+	if reason != "" {
+		mute := g.mute << gu.Strikes
+		if mute > maxGuestMute || mute <= 0 {
+			mute = maxGuestMute
+		}
+		gu.Strikes++
+		gu.MutedUntil = now.Add(mute)
+		log.Printf("Muting guest %s for %s: %s", client, mute, reason)
+		return guestLimitError{reason: reason + ", muted", wait: mute}
+	}
+	for i := 0; i < lines; i++ {
+		gu.sent = append(gu.sent, now)
+	}
+	return nil
+}
+
+// List returns the guests that sent something within the last hour or were
+// muted
+func (g *GuestLimits) List() []guest {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	list := []guest{}
+	for _, gu := range g.guests {
+		entry := *gu
+		entry.Sent = 0
+		for _, t := range gu.sent {
+			if time.Since(t) < time.Hour {
+				entry.Sent++
+			}
+		}
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// Pardon lifts the mute of a client and forgets its strikes
+func (g *GuestLimits) Pardon(client string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.guests[client]; !ok {
+		return false
+	}
+	delete(g.guests, client)
+	return true
+}
+
+var registration = &ChannelRegistration{}
+
+var ctcpLimiter = &CTCPLimiter{sources: make(map[string]*ctcpSource)}
+
+var watchdog = &Watchdog{}
+
+var chaos = &Chaos{}
+
+var metrics = &Metrics{
+	received: make(map[string]int64),
+	sent:     make(map[string]int64),
+	requests: make(map[string]*latencyHistogram),
+}
+
+// Received counts a message received in channel
+func (m *Metrics) Received(channel string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.received[strings.ToLower(channel)]++
+}
+
+// Sent counts a message sent to channel
+func (m *Metrics) Sent(channel string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sent[strings.ToLower(channel)]++
+}
+
+// Reconnected counts an attempt to reconnect to the server
+func (m *Metrics) Reconnected() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reconnects++
+}
+
+// PingRTT records how long the server took to answer our last PING
+func (m *Metrics) PingRTT(rtt time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pingRTT = rtt
+}
+
+// Observe adds a request to the endpoint registered as pattern that took d
+func (m *Metrics) Observe(pattern string, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.requests[pattern]
+	if !ok {
+		h = &latencyHistogram{counts: make([]int64, len(latencyBuckets))}
+		m.requests[pattern] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Instrument times the requests handled by mux. WebSockets and event
+// streams are left out, they take as long as somebody keeps the page open.
+func (m *Metrics) Instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == endPointWebSocket || pattern == endPointEvents {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		start := time.Now()
+		mux.ServeHTTP(w, r)
+		m.Observe(pattern, time.Since(start))
+	})
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetric writes the samples of a metric in the Prometheus text format.
+// samples maps the label of each sample, e.g. `channel="#go"`, to its value.
+func writeMetric(w io.Writer, name, kind, help string, samples map[string]float64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	labels := make([]string, 0, len(samples))
+	for label := range samples {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if label == "" {
+			_, _ = fmt.Fprintf(w, "%s %g\n", name, samples[label])
+		} else {
+			_, _ = fmt.Fprintf(w, "%s{%s} %g\n", name, label, samples[label])
+		}
+	}
+}
+
+// channelSamples labels counts by channel
+func channelSamples(counts map[string]int64) map[string]float64 {
+	samples := make(map[string]float64, len(counts))
+	for channel, count := range counts {
+		samples[`channel="`+metricLabelEscaper.Replace(channel)+`"`] = float64(count)
+	}
+	return samples
+}
+
+// Write writes the counters in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	writeMetric(w, "smirc_messages_received_total", "counter", "Messages received from IRC, by channel.", channelSamples(m.received))
+	writeMetric(w, "smirc_messages_sent_total", "counter", "Messages sent to IRC, by channel.", channelSamples(m.sent))
+	writeMetric(w, "smirc_reconnects_total", "counter", "Attempts to reconnect to the IRC server.", map[string]float64{"": float64(m.reconnects)})
+	writeMetric(w, "smirc_ping_rtt_seconds", "gauge", "Round trip time of the last PING to the IRC server.", map[string]float64{"": m.pingRTT.Seconds()})
+
+	name := "smirc_http_request_duration_seconds"
+	_, _ = fmt.Fprintf(w, "# HELP %s Latency of HTTP requests, by endpoint.\n# TYPE %s histogram\n", name, name)
+	patterns := make([]string, 0, len(m.requests))
+	for pattern := range m.requests {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		h, handler := m.requests[pattern], metricLabelEscaper.Replace(pattern)
+		for i, bound := range latencyBuckets {
+			_, _ = fmt.Fprintf(w, "%s_bucket{handler=\"%s\",le=\"%g\"} %d\n", name, handler, bound, h.counts[i])
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket{handler=\"%s\",le=\"+Inf\"} %d\n", name, handler, h.count)
+		_, _ = fmt.Fprintf(w, "%s_sum{handler=\"%s\"} %g\n", name, handler, h.sum)
+		_, _ = fmt.Fprintf(w, "%s_count{handler=\"%s\"} %d\n", name, handler, h.count)
+	}
+}
+
+// StartLag holds up every line read from the server by lag, for duration
+func (c *Chaos) StartLag(lag, duration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lag, c.lagUntil = lag, time.Now().Add(duration)
+}
+
+// Lag is how long to hold up the line just read
+func (c *Chaos) Lag() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Now().After(c.lagUntil) {
+		return 0
+	}
+	return c.lag
+}
+
+var events = &EventBus{handlers: make(map[string][]eventHandler)}
+
+func (b *EventBus) On(event string, h eventHandler) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[event] = append(b.handlers[event], h)
+}
+
+// OnRaw subscribes h to every line received
+func (b *EventBus) OnRaw(h eventHandler) { b.On(eventRaw, h) }
+
+// OnConnect subscribes h to the server welcoming us
+func (b *EventBus) OnConnect(h eventHandler) { b.On(eventConnect, h) }
+
+// OnMessage subscribes h to PRIVMSGs, CTCP queries included
+func (b *EventBus) OnMessage(h eventHandler) { b.On(eventMessage, h) }
+
+// OnJoin subscribes h to anybody joining a channel we are in, us included
+func (b *EventBus) OnJoin(h eventHandler) { b.On(eventJoin, h) }
+
+// OnPart subscribes h to anybody leaving a channel we are in, us included
+func (b *EventBus) OnPart(h eventHandler) { b.On(eventPart, h) }
+
+// OnNick subscribes h to nick changes, ours included
+func (b *EventBus) OnNick(h eventHandler) { b.On(eventNick, h) }
+
+// OnQuit subscribes h to anybody in a channel we are in leaving IRC
+func (b *EventBus) OnQuit(h eventHandler) { b.On(eventQuit, h) }
+
+// OnKick subscribes h to anybody being kicked from a channel we are in, us
+// included
+func (b *EventBus) OnKick(h eventHandler) { b.On(eventKick, h) }
+
+// Emit runs the handlers of event
+func (b *EventBus) Emit(irc *IRC, event string, e ircEvent) {
+	b.mutex.Lock()
+	handlers := b.handlers[event]
+	b.mutex.Unlock()
+	for _, h := range handlers {
+		h(irc, e)
+	}
+}
+
+// subscribeHandlers wires up the features that act on what the server says
+func subscribeHandlers() {
+	events.OnRaw(func(irc *IRC, e ircEvent) {
+		fmt.Print(e.raw)
+		irc.AddIncomingMessage("", "", e.raw)
+	})
+	events.OnConnect(func(irc *IRC, e ircEvent) {
+		irc.ServerEvent("Connected as %s", e.Param(0))
+		runHooks(hookEvent{Event: hookConnect, Nick: e.Param(0)})
+	})
+	events.OnConnect(identifyOnConnect)
+	events.OnConnect(func(irc *IRC, _ ircEvent) {
+		if streams.Viewers() == 0 {
+			irc.SetAway(true)
+		}
+		irc.Join()
+	})
+	events.OnConnect(func(irc *IRC, e ircEvent) {
+		// Ask for our user modes, answered with 221
+		_, _ = fmt.Fprintf(irc, "MODE %s\r\n", e.Param(0))
+		if irc.config.OperName != "" {
+			log.Printf(">> OPER %s\n\n", irc.config.OperName)
+			_, _ = fmt.Fprintf(irc, "OPER %s %s\r\n", irc.config.OperName, irc.config.OperPassword)
+		}
+	})
+	events.OnMessage(handleCTCPQuery)
+	events.OnMessage(handleChannelMessage)
+	events.OnMessage(func(irc *IRC, e ircEvent) {
+		if _, ok := irc.channel(e.Param(0)); ok {
+			metrics.Received(e.Param(0))
+		}
+	})
+	events.OnJoin(handleJoin)
+	events.OnPart(handlePart)
+	events.OnNick(handleNick)
+	events.OnQuit(handleQuit)
+	events.OnKick(handleKick)
+}
+
+// Watch starts watching conn, nil stops watching
+func (wd *Watchdog) Watch(conn net.Conn) {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	wd.conn, wd.lastRead, wd.lastSent = conn, time.Now(), time.Now()
+}
+
+// Read records that a line was read
+func (wd *Watchdog) Read() {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	wd.lastRead = time.Now()
+}
+
+// Sent records that a line was sent, or that one was queued while the queue
+// was empty, which is when the send timeout starts
+func (wd *Watchdog) Sent() {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	wd.lastSent = time.Now()
+}
+
+// Check closes the watched connection if it is stuck and tells why
+func (wd *Watchdog) Check(now time.Time, queued int) (reason string) {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	if wd.conn == nil {
+		return ""
+	}
+	switch {
+	case now.Sub(wd.lastRead) > wd.readTimeout:
+		reason = fmt.Sprintf("nothing received for %s", now.Sub(wd.lastRead).Round(time.Second))
+	case queued > 0 && now.Sub(wd.lastSent) > wd.sendTimeout:
+		reason = fmt.Sprintf("%d lines not sent for %s", queued, now.Sub(wd.lastSent).Round(time.Second))
+	default:
+		return ""
+	}
+	_ = wd.conn.Close()
+	wd.conn = nil
+	wd.restarts++
+	return reason
+}
+
+func (wd *Watchdog) Restarts() int {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	return wd.restarts
+}
+
+// Run checks the connection every now and then until ctx is done
+func (wd *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(watchdogCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if reason := wd.Check(now, irc.SendQueue()); reason != "" {
+				log.Printf("Watchdog: %s, reconnecting", reason)
+				irc.ServerEvent("The connection looks stuck: %s. Reconnecting", reason)
+				runHooks(hookEvent{Event: hookWatchdog, Nick: irc.Nick(), Message: reason})
+			}
+		}
+	}
+}
+
+var fingerprints = &Fingerprints{}
+
+var onion = &OnionService{}
+
+var moderation = &ModerationLog{}
+
+var quietHours = &QuietHours{}
+
+var peeks = &Peeks{lastSeen: make(map[string]time.Time)}
+
+var streams = &Streams{subscribers: make(map[chan IRCMessage]string), userWatches: make(map[chan struct{}]string)}
+
+// Subscribe returns the messages of channel from now on; first is set when
+// nobody else was subscribed
+func (s *Streams) Subscribe(channel string) (messages chan IRCMessage, first bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages = make(chan IRCMessage, 64)
+	s.subscribers[messages] = channel
+	return messages, len(s.subscribers) == 1
+}
+
+// Unsubscribe stops the messages and reports whether they were the last
+// subscription
+func (s *Streams) Unsubscribe(messages chan IRCMessage) (last bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscribers, messages)
+	return len(s.subscribers) == 0
+}
+
+// Viewers returns how many browsers are connected
+func (s *Streams) Viewers() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.subscribers)
+}
+
+// WatchUsers returns a channel that is signalled when the users of channel
+// change
+func (s *Streams) WatchUsers(channel string) chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := make(chan struct{}, 1)
+	s.userWatches[changed] = channel
+	return changed
+}
+
+// UnwatchUsers stops the signals of WatchUsers
+func (s *Streams) UnwatchUsers(changed chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.userWatches, changed)
+}
+
+// UsersChanged signals the watchers of channel, or of all channels for "".
+// Changes in quick succession, like a NAMES reply, are signalled once.
+func (s *Streams) UsersChanged(channel string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for changed, watched := range s.userWatches {
+		if channel != "" && !strings.EqualFold(watched, channel) {
+			continue
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// usersEvent is the current user list of channel
+func usersEvent(channel string) wsUsers {
+	event := wsUsers{Type: "users", Nicks: []string{}, Away: []string{}, HTML: irc.GetUsersForChannel(channel)}
+	event.Topic = topicText(channel)
+	for _, u := range irc.UsersOfChannel(channel) {
+		event.Nicks = append(event.Nicks, u.Nickname)
+		if u.Away {
+			event.Away = append(event.Away, u.Nickname)
+		}
+	}
+	return event
+}
+
+func (s *Streams) Publish(m IRCMessage) {
+	if m.channel == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for messages, channel := range s.subscribers {
+		if channel != m.channel {
+			continue
+		}
+		select {
+		case messages <- m:
+		default:
+		}
+	}
+}
+
+// Peek joins channel until nobody looks at it anymore. It waits for the
+// server to let us in, which it may refuse, e.g. with ErrChannelFull.
+func (p *Peeks) Peek(ctx context.Context, channel string) error {
+	if !validChannelName(channel) {
+		return fmt.Errorf("%w %q", errInvalidChannel, channel)
+	}
+	w := irc.waiters.Add(ircclient.Joined(irc.Nick, channel))
+	added, err := irc.joinChannel(channel)
+	if err != nil || !added {
+		irc.waiters.Cancel(w)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, joinTimeout)
+	defer cancel()
+	err = irc.waiters.Wait(ctx, w)
+	var refused *ircclient.ReplyError
+	if errors.As(err, &refused) || errors.Is(err, ircclient.ErrNotConnected) {
+		irc.Forget(channel)
+		return err
+	}
+	// Without an answer the JOIN may still succeed, so the channel is kept,
+	// but the timeout is returned
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.lastSeen[strings.ToLower(channel)] = time.Now()
+	return err
+}
+
+// Touch keeps a peeked channel for another grace period
+func (p *Peeks) Touch(channel string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.lastSeen[strings.ToLower(channel)]; ok {
+		p.lastSeen[strings.ToLower(channel)] = time.Now()
+	}
+}
+
+// Expire parts the peeked channels nobody looked at within the grace period
+func (p *Peeks) Expire() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for channel, seen := range p.lastSeen {
+		if time.Since(seen) < p.grace {
+			continue
+		}
+		delete(p.lastSeen, channel)
+		irc.Forget(channel)
+		log.Printf(">> PART %s\n\n", channel)
+		_, _ = fmt.Fprintf(irc, "PART %s\r\n", channel)
+	}
+}
+
+// validChannelName checks a channel name typed into the web UI
+func validChannelName(channel string) bool {
+	return len(channel) > 1 && strings.ContainsRune("#&", rune(channel[0])) && !strings.ContainsAny(channel, " ,\x07\r\n")
+}
+
+func (l *ModerationLog) Add(entry moderationEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+func (l *ModerationLog) List() []moderationEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]moderationEntry{}, l.entries...)
+}
+
+var reports = &Reports{}
+
+// Add files a report about m by reporter, unless the reporter already has
+// an open report about it, which is returned instead
+func (rs *Reports) Add(m apiMessage, context []apiMessage, reason, reporter string) (report, bool, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	recent := 0
+	for _, r := range rs.reports {
+		if r.Message.ID == m.ID && r.Reporter == reporter && r.Status == reportOpen {
+			return *r, false, nil
+		}
+		if r.Reporter == reporter && time.Since(r.Time) < reportWindow {
+			recent++
+		}
+	}
+	if recent >= maxReports {
+		return report{}, false, errTooManyReports
+	}
+	rs.lastID++
+	r := &report{
+		ID:       rs.lastID,
+		Message:  m,
+		Context:  context,
+		Reason:   reason,
+		Reporter: reporter,
+		Status:   reportOpen,
+		Time:     time.Now(),
+	}
+	r.Updated = r.Time
+	rs.reports = append(rs.reports, r)
+	return *r, true, nil
+}
+
+// List returns the reports with the given status, all of them for ""
+func (rs *Reports) List(status string) []report {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	list := []report{}
+	for _, r := range rs.reports {
+		if status == "" || r.Status == status {
+			list = append(list, *r)
+		}
+	}
+	return list
+}
+
+// SetStatus resolves, dismisses or reopens a report
+func (rs *Reports) SetStatus(id int, status, note string) (report, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	for _, r := range rs.reports {
+		if r.ID == id {
+			r.Status, r.Updated = status, time.Now()
+			if note != "" {
+				r.Note = note
+			}
+			return *r, true
+		}
+	}
+	return report{}, false
+}
+
+// DeleteWhere drops the reports matching del, as they keep copies of the
+// messages, and returns how many it dropped
+func (rs *Reports) DeleteWhere(del func(report) bool) int {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	kept := rs.reports[:0]
+	for _, r := range rs.reports {
+		if !del(*r) {
+			kept = append(kept, r)
+		}
+	}
+	deleted := len(rs.reports) - len(kept)
+	for i := len(kept); i < len(rs.reports); i++ {
+		rs.reports[i] = nil
+	}
+	rs.reports = kept
+	return deleted
+}
+
+// DeleteWhere drops the entries matching del, as they keep original text
+func (l *ModerationLog) DeleteWhere(del func(moderationEntry) bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	kept := l.entries[:0]
+	for _, entry := range l.entries {
+		if !del(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	for i := len(kept); i < len(l.entries); i++ {
+		l.entries[i] = moderationEntry{}
+	}
+	l.entries = kept
+}
+
+// --- Deletion reasons
+const (
+	deletionRetention = "retention"
+	deletionPurge     = "purge"
+)
+
+// DeletionLog records what was deleted, without the deleted content, so
+// that deletions can be accounted for. When fileName is set every entry is
+// also appended there as a line of JSON.
+type DeletionLog struct {
+	mutex    sync.Mutex
+	fileName string
+	entries  []deletionEntry
+}
+
+type deletionEntry struct {
+	Reason      string    `json:"reason"`
+	Nick        string    `json:"nick,omitempty"`
+	Messages    int       `json:"messages"`
+	Bookmarks   int       `json:"bookmarks"`
+	Pastes      int       `json:"pastes"`
+	Moderations int       `json:"moderations"`
+	Reports     int       `json:"reports"`
+	DeadLetters int       `json:"dead-letters"`
+	Time        time.Time `json:"time"`
+}
+
+var deletions = &DeletionLog{}
+
+func (l *DeletionLog) Add(entry deletionEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, entry)
+	if l.fileName == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	f, err := os.OpenFile(l.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open deletion log [%s]: %s", l.fileName, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write deletion log [%s]: %s", l.fileName, err)
+	}
+}
+
+func (l *DeletionLog) List() []deletionEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]deletionEntry{}, l.entries...)
+}
+
+func openSQLiteStore(fileName string) (*SQLiteStore, error) {
+	db, err := store.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{SQLite: db}, nil
+}
+
+// stored is m as kept in the database
+func (m IRCMessage) stored() store.Message {
+	return store.Message{
+		ID:        m.id,
+		Channel:   m.channel,
+		Nick:      m.userName,
+		Hostmask:  m.hostmask,
+		Message:   m.message,
+		Time:      m.time,
+		ThreadID:  m.threadID,
+		Redacted:  m.redacted,
+		Note:      m.note,
+		Masked:    m.masked,
+		Action:    m.action,
+		RelayedBy: m.relayedBy,
+	}
+}
+
+// loadedMessages turns the messages read from the database back into
+// IRCMessages
+func loadedMessages(stored []store.Message, err error) ([]IRCMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]IRCMessage, 0, len(stored))
+	for _, m := range stored {
+		msgs = append(msgs, IRCMessage{
+			id:        m.ID,
+			channel:   m.Channel,
+			userName:  m.Nick,
+			hostmask:  m.Hostmask,
+			message:   m.Message,
+			time:      m.Time,
+			threadID:  m.ThreadID,
+			redacted:  m.Redacted,
+			note:      m.Note,
+			masked:    m.Masked,
+			action:    m.Action,
+			relayedBy: m.RelayedBy,
+		})
+	}
+	return msgs, nil
+}
+
+func (s *SQLiteStore) Save(m IRCMessage) error {
+	return s.SQLite.Save(m.stored())
+}
+
+func (s *SQLiteStore) Update(m IRCMessage) error {
+	return s.SQLite.Update(m.stored())
+}
+
+func (s *SQLiteStore) Recent(limit int) ([]IRCMessage, error) {
+	return loadedMessages(s.SQLite.Recent(limit))
+}
+
+func (s *SQLiteStore) Between(channel string, from, to time.Time) ([]IRCMessage, error) {
+	return loadedMessages(s.SQLite.Between(channel, from, to))
+}
+
+// expireMessages hard-deletes everything older than the retention period
+func expireMessages(retention time.Duration) {
+	cutoff := time.Now().Add(-retention)
+	entry := deletionEntry{Reason: deletionRetention, Time: time.Now()}
+	entry.Messages = irc.DeleteMessagesBefore(cutoff)
+	entry.Bookmarks = bookmarks.DeleteWhere(func(m apiMessage) bool { return m.Time.Before(cutoff) })
+	entry.Pastes = pastes.DeleteWhere(func(p *Paste) bool { return p.Created.Before(cutoff) })
+	moderation.DeleteWhere(func(e moderationEntry) bool {
+		if e.Time.Before(cutoff) {
+			entry.Moderations++
+			return true
+		}
+		return false
+	})
+	entry.Reports = reports.DeleteWhere(func(r report) bool { return r.Time.Before(cutoff) })
+	entry.DeadLetters = deadLetters.DeleteWhere(func(l deadLetter) bool { return l.Time.Before(cutoff) })
+	if entry.Messages+entry.Bookmarks+entry.Pastes+entry.Moderations+entry.Reports+entry.DeadLetters > 0 {
+		deletions.Add(entry)
+	}
+}
+
+// purgeNick hard-deletes everything said by nick, including the raw lines.
+// Pastes have no author other than us, so they are only purged for our own
+// nick.
+func purgeNick(nick string) deletionEntry {
+	entry := deletionEntry{Reason: deletionPurge, Nick: nick, Time: time.Now()}
+	purged := irc.DeleteMessagesOf(nick)
+	entry.Messages = len(purged)
+	entry.Bookmarks = bookmarks.DeleteWhere(func(m apiMessage) bool { return strings.EqualFold(m.Nick, nick) })
+	if strings.EqualFold(nick, irc.Nick()) || strings.EqualFold(nick, envVarNickName) {
+		entry.Pastes = pastes.DeleteWhere(func(*Paste) bool { return true })
+	}
+	moderation.DeleteWhere(func(e moderationEntry) bool {
+		if purged[e.MessageID] {
+			entry.Moderations++
+			return true
+		}
+		return false
+	})
+	entry.Reports = reports.DeleteWhere(func(r report) bool { return purged[r.Message.ID] })
+	entry.DeadLetters = deadLetters.DeleteWhere(func(l deadLetter) bool {
+		var event hookEvent
+		return json.Unmarshal(l.Payload, &event) == nil && strings.EqualFold(event.Nick, nick)
+	})
+	deletions.Add(entry)
+	return entry
+}
+
+// oversizedRequests counts the requests refused by parseLimitedForm
+var oversizedRequests int64
+
+// parseLimitedForm parses the form of a request whose body may not exceed
+// max-body-bytes. When it returns false the response has been written.
+func parseLimitedForm(w http.ResponseWriter, r *http.Request) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, irc.config.MaxBodyBytes)
+	err := r.ParseForm()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		atomic.AddInt64(&oversizedRequests, 1)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error: %s", err)
+		http.Redirect(w, r, "/", 302)
+		return false
+	}
+	return true
+}
+
+// clientAddress identifies the web client that made a request
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// captchaProvider is how to show and check the captcha of a provider
+type captchaProvider struct {
+	script        string
+	widgetClass   string
+	responseField string
+	verifyURL     string
+}
+
+var captchaProviders = map[string]captchaProvider{
+	"hcaptcha": {
+		script:        "https://js.hcaptcha.com/1/api.js",
+		widgetClass:   "h-captcha",
+		responseField: "h-captcha-response",
+		verifyURL:     "https://api.hcaptcha.com/siteverify",
+	},
+	"turnstile": {
+		script:        "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		widgetClass:   "cf-turnstile",
+		responseField: "cf-turnstile-response",
+		verifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+}
+
+var errCaptchaRequired = errors.New("solve the captcha first")
+
+// captchaKey signs the cookies of the clients that solved the captcha. It
+// changes with every start, so a restart asks everybody again.
+var captchaKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate the captcha key: %s", err)
+	}
+	return key
+}()
+
+// captchaSignature binds a captcha cookie to its expiry and client
+func captchaSignature(expiry, client string) string {
+	return base64.RawURLEncoding.EncodeToString(hmacSHA256(captchaKey, expiry+" "+client))
+}
+
+// captchaPassed tells whether the client that made r has solved the
+// captcha, which it always has when no captcha is configured
+func captchaPassed(r *http.Request) bool {
+	if irc.config.CaptchaProvider == "" {
+		return true
+	}
+	// Scripts cannot solve captchas, their token vouches for them
+	if _, ok := irc.config.apiToken(bearerToken(r)); ok {
+		return true
+	}
+	cookie, err := r.Cookie(cookieKeyCaptcha)
+	if err != nil {
+		return false
+	}
+	expiry, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(captchaSignature(expiry, clientAddress(r)))) {
+		return false
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() < seconds
+}
+
+// verifyCaptcha asks the provider whether response is a solved captcha
+func verifyCaptcha(response, client string) error {
+	provider := captchaProviders[irc.config.CaptchaProvider]
+	httpClient := &http.Client{Timeout: captchaVerifyTimeout}
+	resp, err := httpClient.PostForm(provider.verifyURL, url.Values{
+		"secret":   {irc.config.CaptchaSecretKey},
+		"response": {response},
+		"remoteip": {client},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("captcha not solved: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// captchaForm is the data of the form shown instead of the send form until
+// the captcha is solved, see templates/captcha.html
+type captchaForm struct {
+	Lang         string
+	Script       string
+	WidgetClass  string
+	SiteKey      string
+	CaptchaURL   string
+	ChannelInput htmltemplate.HTML
+}
+
+// captchaFormFor fills the captcha form for channel
+func captchaFormFor(lang, channel string) *captchaForm {
+	provider := captchaProviders[irc.config.CaptchaProvider]
+	return &captchaForm{
+		Lang:         lang,
+		Script:       provider.script,
+		WidgetClass:  provider.widgetClass,
+		SiteKey:      irc.config.CaptchaSiteKey,
+		CaptchaURL:   endPointCaptcha,
+		ChannelInput: htmltemplate.HTML(channelInput(channel)),
+	}
+}
+
+// handlerCaptcha checks a solved captcha and lets the client send messages
+// for captcha-session-hours
+func handlerCaptcha(w http.ResponseWriter, r *http.Request) {
+	if irc.config.CaptchaProvider == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+	channel := requestChannel(r)
+	client := clientAddress(r)
+	response := r.Form.Get(captchaProviders[irc.config.CaptchaProvider].responseField)
+	if err := verifyCaptcha(response, client); err != nil {
+		log.Printf("Captcha from %s failed: %s", client, err)
+		http.Error(w, "captcha failed", http.StatusForbidden)
+		return
+	}
+	maxAge := irc.config.CaptchaSessionHours * 60 * 60
+	expiry := strconv.FormatInt(time.Now().Unix()+int64(maxAge), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieKeyCaptcha,
+		Value:    expiry + "." + captchaSignature(expiry, client),
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, channelURL("/", channel), 302)
+}
+
+// authEnabled tells whether web clients have to log in to send
+func authEnabled() bool {
+	return len(irc.config.WebUsers) > 0 || irc.config.WebToken != ""
+}
+
+// sessionKey signs the session cookies. It changes with every start, so a
+// restart logs everybody out.
+var sessionKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate the session key: %s", err)
+	}
+	return key
+}()
+
+// sessionSignature binds a session cookie to its user and expiry
+func sessionSignature(user, expiry string) string {
+	return base64.RawURLEncoding.EncodeToString(hmacSHA256(sessionKey, user+" "+expiry))
+}
+
+// sessionUser returns who the client that made r is logged in as, "" for
+// the shared token. API clients may pass the token as a bearer token.
+func sessionUser(r *http.Request) (user string, ok bool) {
+	if token := bearerToken(r); irc.config.WebToken != "" && token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(irc.config.WebToken)) == 1 {
+		return "", true
+	}
+	cookie, err := r.Cookie(cookieKeySession)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(sessionSignature(parts[0], parts[1]))) {
+		return "", false
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= seconds {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	user = string(name)
+	// Logins end with the user or token they were made with
+	if _, exists := irc.config.WebUsers[user]; exists || (user == "" && irc.config.WebToken != "") {
+		return user, true
+	}
+	return "", false
+}
+
+// bearerToken is the token of an "Authorization: Bearer" header of r
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// loggedIn tells whether the client that made r may send, which it always
+// may when no users or token are configured
+func loggedIn(r *http.Request) bool {
+	if !authEnabled() {
+		return true
+	}
+	_, ok := sessionUser(r)
+	return ok
+}
+
+// allowed tells whether the client that made r may do what scope allows:
+// scripts as far as the scopes of their API token go, others when logged in
+func allowed(r *http.Request, scope string) bool {
+	if token, ok := irc.config.apiToken(bearerToken(r)); ok {
+		return token.hasScope(scope)
+	}
+	return loggedIn(r)
+}
+
+var errLoginRequired = errors.New("log in first")
+
+// requireLogin only lets logged in clients, and API tokens with scopeSend,
+// through to h
+func requireLogin(h http.HandlerFunc) http.HandlerFunc {
+	return requireScope(scopeSend, h)
+}
+
+// requireScope only lets clients allowed scope through to h. Those that
+// are not logged in are sent to the login page from pages, and get 401
+// Unauthorized otherwise; API tokens without scope get 403 Forbidden.
+func requireScope(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowed(r, scope) {
+			h(w, r)
+			return
+		}
+		if token, ok := irc.config.apiToken(bearerToken(r)); ok {
+			http.Error(w, fmt.Sprintf("API token %s lacks the %s scope", token.Name, scope), http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") &&
+			r.URL.Path != endPointWebSocket && r.URL.Path != endPointEvents {
+			http.Redirect(w, r, endPointLogin+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, errLoginRequired.Error(), http.StatusUnauthorized)
+	}
+}
+
+// requireLoginToRead is requireScope with scopeRead when web-auth-reads is
+// set
+func requireLoginToRead(h http.HandlerFunc) http.HandlerFunc {
+	guarded := requireScope(scopeRead, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if irc.config.WebAuthReads {
+			guarded(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requireLoginToChange is requireLoginToRead for GET and HEAD, and
+// requireLogin with requireCSRFToken for the methods that change something
+func requireLoginToChange(h http.HandlerFunc) http.HandlerFunc {
+	read, change := requireLoginToRead(h), requireLogin(requireCSRFToken(h))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read(w, r)
+			return
+		}
+		change(w, r)
+	}
+}
+
+// requireLoginToReadLogs is requireLoginToRead, except that public-logs
+// publishes the logs to everybody but those of the channels that are not
+// public
+func requireLoginToReadLogs(h http.HandlerFunc) http.HandlerFunc {
+	guarded := requireLoginToRead(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		if strings.HasPrefix(r.URL.Path, endPointLogs) {
+			name, _, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, endPointLogs), "/")
+		}
+		if irc.config.PublicLogs && (name == "" || irc.config.publicLogs(name)) {
+			h(w, r)
+			return
+		}
+		guarded(w, r)
+	}
+}
+
+// hashPassword hashes a password for web-users with PBKDF2-SHA256 as
+// "pbkdf2-sha256$<iterations>$<salt>$<key>"
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, passwordHashIterations, sha256.Size, sha256.New)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func parsePasswordHash(hash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, errors.New("not a password hash")
+	}
+	iterations, err = strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errors.New("invalid iterations in password hash")
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, errors.New("invalid salt in password hash")
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) != sha256.Size {
+		return 0, nil, nil, errors.New("invalid key in password hash")
+	}
+	return iterations, salt, key, nil
+}
+
+// checkPassword tells whether password matches a hash from hashPassword
+func checkPassword(hash, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(key, pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New))
+}
+
+// checkLogin tells whether user may log in with password; an empty user
+// logs in with the shared token
+func checkLogin(user, password string) bool {
+	if user == "" {
+		return irc.config.WebToken != "" && subtle.ConstantTimeCompare([]byte(password), []byte(irc.config.WebToken)) == 1
+	}
+	hash, ok := irc.config.WebUsers[user]
+	if !ok {
+		// Takes as long as for a user that exists
+		hash = dummyPasswordHash
+	}
+	return checkPassword(hash, password) && ok
+}
+
+// dummyPasswordHash is checked against for unknown users
+var dummyPasswordHash = fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, 16)), base64.RawStdEncoding.EncodeToString(make([]byte, sha256.Size)))
+
+// LoginFailures counts the failed logins of every client, which may fail
+// maxLoginFailures times in loginFailureWindow before being refused
+type LoginFailures struct {
+	mutex    sync.Mutex
+	failures map[string][]time.Time
+}
+
+var loginFailures = &LoginFailures{failures: make(map[string][]time.Time)}
+
+// Blocked tells whether client failed too often lately
+func (lf *LoginFailures) Blocked(client string) bool {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	var recent []time.Time
+	for _, t := range lf.failures[client] {
+		if time.Since(t) < loginFailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(lf.failures, client)
+	} else {
+		lf.failures[client] = recent
+	}
+	return len(recent) >= maxLoginFailures
+}
+
+func (lf *LoginFailures) Add(client string) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	lf.failures[client] = append(lf.failures[client], time.Now())
+}
+
+// loginPage is the data of the login.html template
+type loginPage struct {
+	Lang      string
+	ThemeURL  string
+	CSRFToken string
+	Next      string
+	// Users asks for a user name, which is left empty for the token
+	Users  bool
+	Failed bool
+}
+
+// handlerLogin shows the login form and logs in with it, setting a
+// session cookie for web-session-hours
+func handlerLogin(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	lang := requestLanguage(w, r)
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		// Only back to our own pages
+		next = "/"
+	}
+	page := loginPage{
+		Lang:      lang,
+		ThemeURL:  themeURL(requestTheme(w, r)),
+		CSRFToken: csrfToken(w, r),
+		Next:      next,
+		Users:     len(irc.config.WebUsers) > 0,
+	}
+	if r.Method == http.MethodPost {
+		if !parseLimitedForm(w, r) {
+			return
+		}
+		client := clientAddress(r)
+		if loginFailures.Blocked(client) {
+			http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+			return
+		}
+		user := r.Form.Get(formKeyUser)
+		if checkLogin(user, r.Form.Get(formKeyPassword)) {
+			log.Printf("Login of %q from %s", user, client)
+			maxAge := irc.config.WebSessionHours * 60 * 60
+			name := base64.RawURLEncoding.EncodeToString([]byte(user))
+			expiry := strconv.FormatInt(time.Now().Unix()+int64(maxAge), 10)
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieKeySession,
+				Value:    name + "." + expiry + "." + sessionSignature(name, expiry),
+				Path:     "/",
+				MaxAge:   maxAge,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+		log.Printf("Failed login of %q from %s", user, client)
+		loginFailures.Add(client)
+		page.Failed = true
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	renderPage(w, "login.html", page)
+}
+
+// csrfToken returns the token the forms of the web UI have to send back,
+// which is kept in a cookie of the client, so other sites cannot know it
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(cookieKeyCSRF); err == nil && len(cookie.Value) >= 32 {
+		return cookie.Value
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("Error: %s", err)
+		return ""
+	}
+	value := base64.RawURLEncoding.EncodeToString(token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieKeyCSRF,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Also for the forms of this very response
+	r.AddCookie(&http.Cookie{Name: cookieKeyCSRF, Value: value})
+	return value
+}
+
+// csrfInput is the hidden field with the CSRF token of a form
+func csrfInput(token string) string {
+	return `<input type="hidden" name="` + formKeyCSRFToken + `" value="` + html.EscapeString(token) + `" />`
+}
+
+// requireCSRFToken only lets form posts through to h that carry the CSRF
+// token of the client, as a form field or, for scripts of our pages that
+// send no form, in the X-CSRF-Token header. API clients with a bearer token
+// need none.
+func requireCSRFToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || bearerToken(r) != "" {
+			h(w, r)
+			return
+		}
+		if !parseLimitedForm(w, r) {
+			return
+		}
+		token := r.PostForm.Get(formKeyCSRFToken)
+		if token == "" {
+			token = r.Header.Get("X-CSRF-Token")
+		}
+		cookie, err := r.Cookie(cookieKeyCSRF)
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			http.Error(w, "invalid CSRF token, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// sameOrigin tells whether r was made by one of our own pages, or not by a
+// browser at all, as far as the Origin and Sec-Fetch-Site headers tell
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site == "cross-site" || site == "same-site" {
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	return true
+}
+
+// sameOriginOnly refuses requests that may change something, i.e. all but
+// GET and HEAD, when other sites made the browser send them
+func sameOriginOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && bearerToken(r) == "" && !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handlerLogout ends the session of the web client
+func handlerLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: cookieKeySession, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// requestChannel is the configured channel picked by the channel parameter,
+// the first channel by default
+func requestChannel(r *http.Request) string {
+	return pickChannel(r.FormValue(formKeyChannel))
+}
+
+// pickChannel returns the configured channel called name, the first channel
+// if there is none
+func pickChannel(name string) string {
+	if channel, ok := irc.channel(name); ok {
+		peeks.Touch(channel)
+		return channel
+	}
+	if channel, ok := irc.config.virtualChannel(name); ok {
+		return channel.Name
+	}
+	if name == serverBuffer {
+		return serverBuffer
+	}
+	return irc.config.Channel
+}
+
+// channelURL links to path for channel
+func channelURL(path, channel string) string {
+	return path + "?" + formKeyChannel + "=" + url.QueryEscape(channel)
+}
+
+// channelInput keeps the channel of a page in its forms
+func channelInput(channel string) string {
+	return `<input type="hidden" name="` + formKeyChannel + `" value="` + html.EscapeString(channel) + `" />`
+}
+
+// handlerPeekChannel joins a channel for as long as the web UI shows it
+func handlerPeekChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel := strings.TrimSpace(r.FormValue(formKeyChannel))
+	if err := peeks.Peek(r.Context(), channel); err != nil {
+		log.Printf("Failed to peek %s: %s", channel, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	http.Redirect(w, r, channelURL("/", channel), 302)
+}
+
+// handlerSendMessage sends the message posted with the form of the index
+// page. It is only taken from the body, never from the URL, which any page
+// could link to.
+func handlerSendMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+	channel := requestChannel(r)
+	message := r.PostForm.Get(formKeyMessage)
+	if strings.TrimSpace(message) == "" {
+		http.Redirect(w, r, channelURL("/", channel), 302)
+		return
+	}
+	if _, err := sendFromWebUI(r, channel, message); err != nil {
+		var limited guestLimitError
+		if errors.As(err, &limited) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(limited.wait.Seconds()+0.5)))
+		}
+		log.Printf("Failed to send to %s: %s", channel, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	http.Redirect(w, r, channelURL("/", channel), 302)
+}
+
+// setTopicFromWebUI changes the topic of channel to text
+func setTopicFromWebUI(r *http.Request, channel, text string) error {
+	if readOnlyChannel(channel) || channel == serverBuffer {
+		return errReadOnlyChannel
+	}
+	// The topic is a single line
+	text = strings.NewReplacer("\r", " ", "\n", " ").Replace(text)
+	return irc.ChangeTopic(r.Context(), channel, text)
+}
+
+// handlerSetTopic changes the topic from the form of the index page
+func handlerSetTopic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+	channel := requestChannel(r)
+	if err := setTopicFromWebUI(r, channel, r.PostForm.Get(formKeyTopic)); err != nil {
+		log.Printf("Failed to set the topic of %s: %s", channel, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	http.Redirect(w, r, channelURL("/", channel), 302)
+}
+
+// apiTopic is the JSON of /api/v1/topic
+type apiTopic struct {
+	Channel string `json:"channel"`
+	Topic
+}
+
+// handlerAPITopic returns the topic of a channel on GET and changes it to
+// the "topic" of a JSON or form body on POST, each for the clients allowed
+// to
+func handlerAPITopic(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		requireLoginToRead(handlerAPIGetTopic)(w, r)
+	case http.MethodPost:
+		requireLogin(handlerAPISetTopic)(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handlerAPIGetTopic(w http.ResponseWriter, r *http.Request) {
+	channel := requestChannel(r)
+	topic, _ := irc.Topic(channel)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(apiTopic{Channel: channel, Topic: topic})
+}
+
+func handlerAPISetTopic(w http.ResponseWriter, r *http.Request) {
+	var topic Topic
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		r.Body = http.MaxBytesReader(w, r.Body, irc.config.MaxBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&topic); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if !parseLimitedForm(w, r) {
+			return
+		}
+		topic.Text = r.Form.Get(formKeyTopic)
+	}
+	channel := requestChannel(r)
+	if err := setTopicFromWebUI(r, channel, topic.Text); err != nil {
+		log.Printf("Failed to set the topic of %s: %s", channel, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	handlerAPIGetTopic(w, r)
+}
+
+var errReadOnlyChannel = errors.New("read-only channel")
+
+var errInvalidChannel = errors.New("invalid channel name")
+
+var errInvalidNick = errors.New("invalid nick")
+
+// errorStatus is the HTTP status code for an error of sending to IRC or of
+// the web UI
+func errorStatus(err error) int {
+	var limited guestLimitError
+	var refused *ircclient.ReplyError
+	switch {
+	case errors.Is(err, ircclient.ErrNotConnected), errors.Is(err, ircclient.ErrSendQueueFull):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ircclient.ErrSendTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ircclient.ErrNoSuchNick):
+		return http.StatusNotFound
+	case errors.Is(err, ircclient.ErrNickInUse), errors.Is(err, ircclient.ErrChannelFull), errors.As(err, &refused),
+		errors.Is(err, errTooManyChannels), errors.Is(err, errRegistrationPending):
+		return http.StatusConflict
+	case errors.Is(err, errReadOnlyChannel), errors.Is(err, errCaptchaRequired):
+		return http.StatusForbidden
+	case errors.Is(err, errInvalidChannel), errors.Is(err, errInvalidNick), errors.Is(err, errInvalidPref):
+		return http.StatusBadRequest
+	case errors.Is(err, errPasteQuota):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &limited):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// sendFromWebUI sends what was typed into the web UI to channel and returns
+// the messages sent. Messages that are too long for the channel are turned
+// into a paste, and lines starting with "/me " are sent as ACTIONs.
+func sendFromWebUI(r *http.Request, channel, message string) ([]IRCMessage, error) {
+	if readOnlyChannel(channel) {
+		return nil, errReadOnlyChannel
+	}
+	if !captchaPassed(r) {
+		return nil, errCaptchaRequired
+	}
+	lines := splitLines(message)
+	count := len(lines)
+	if count > irc.config.PasteThresholdLines {
+		// Only the link to the paste is sent
+		count = 1
+	}
+	if err := guests.Allow(clientAddress(r), count); err != nil {
+		return nil, err
+	}
+	if len(lines) > irc.config.PasteThresholdLines {
+		// Too long for the channel: send a link to a paste instead of flooding
+		paste, err := pastes.Add(clientAddress(r), message)
+		if err != nil {
+			return nil, err
+		}
+		lines = []string{renderTemplate(templatePaste, templateData{
+			Channel: channel,
+			User:    irc.Nick(),
+			Payload: pastePayload{
+				ID:       paste.ID,
+				URL:      publicURL(r) + endPointPaste + paste.ID,
+				Language: paste.Language,
+				Lines:    len(lines),
+			},
+		})}
+	} else {
+		lines = stripCodeFences(lines)
+	}
+	var sent []IRCMessage
+	for _, line := range lines {
+		if strings.HasPrefix(line, "/me ") {
+			line = "\x01ACTION " + strings.TrimPrefix(line, "/me ") + "\x01"
+		}
+		parts, err := irc.SendMessage(channel, line)
+		sent = append(sent, parts...)
+		if err != nil {
+			return sent, err
+		}
+	}
+	if user, ok := webUser(r); ok {
+		if err := drafts.Set(user, channel, ""); err != nil {
+			log.Printf("Failed to delete the draft: %s", err)
+		}
+	}
+	return sent, nil
+}
+
+// publicURL is the base URL under which other IRC users can reach this web
+// server; it falls back to the host the request was made to
+func publicURL(r *http.Request) string {
+	if irc.config.PublicURL != "" {
+		return strings.TrimRight(irc.config.PublicURL, "/")
+	}
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func handlerPaste(w http.ResponseWriter, r *http.Request) {
+	paste, ok := pastes.Get(strings.TrimPrefix(r.URL.Path, endPointPaste))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Has("raw") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprint(w, paste.Text)
+		return
+	}
+	renderPage(w, "paste.html", pastePage{
+		Lang:     requestLanguage(w, r),
+		ThemeURL: themeURL(requestTheme(w, r)),
+		Paste:    htmltemplate.HTML(renderPaste(paste)),
+	})
+}
+
+type pastePage struct {
+	Lang     string
+	ThemeURL string
+	Paste    htmltemplate.HTML
+}
+
+func handlerSaveDraft(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+	channel := requestChannel(r)
+	if user, ok := webUser(r); ok {
+		if err := drafts.Set(user, channel, r.PostForm.Get(formKeyMessage)); err != nil {
+			log.Printf("Failed to save the draft: %s", err)
+			http.Error(w, "failed to save the draft", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, channelURL("/", channel), 302)
+}
+
+// messagesPage is the data of the messages.html template
+type messagesPage struct {
+	Lang     string
+	ThemeURL string
+	Messages htmltemplate.HTML
+}
+
+func handlerGetMessagesForChannel(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	renderPage(w, "messages.html", messagesPage{
+		Lang:     prefs.lang,
+		ThemeURL: themeURL(prefs.theme),
+		Messages: htmltemplate.HTML(irc.GetMessagesForChatRoom(requestChannel(r), prefs)),
+	})
+}
+
+// logDayLayout is how days are written in the URLs of the logs
+const logDayLayout = "2006-01-02"
+
+// logLocation is the time zone the days of the logs are in, the same for
+// everybody so that their URLs are: timezone, or that of the server
+func logLocation() *time.Location {
+	if irc.config.Timezone != "" {
+		if loc, err := time.LoadLocation(irc.config.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// logURL links to the logs of channel on day, or to the list of its days
+// without day
+func logURL(channel, day string) string {
+	return endPointLogs + url.PathEscape(channel) + "/" + day
+}
+
+// LogDays returns the days on which something was said in channel, as
+// logDayLayout in loc, oldest first
+func (irc *IRC) LogDays(channel string, loc *time.Location) []string {
+	if irc.store != nil {
+		days, err := irc.store.Days(channel, loc)
+		if err == nil {
+			return days
+		}
+		log.Printf("Error: %s", err)
+	}
+	var days []string
+	for _, m := range irc.messagesForChatRoom(channel) {
+		if day := m.time.In(loc).Format(logDayLayout); len(days) == 0 || days[len(days)-1] != day {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// LogMessages returns the messages said in channel from from until before
+// to, from the store if there is one, oldest first
+func (irc *IRC) LogMessages(channel string, from, to time.Time) []IRCMessage {
+	if irc.store != nil {
+		msgs, err := irc.store.Between(channel, from, to)
+		if err == nil {
+			return msgs
+		}
+		log.Printf("Error: %s", err)
+	}
+	var msgs []IRCMessage
+	for _, m := range irc.messagesForChatRoom(channel) {
+		if !m.time.Before(from) && m.time.Before(to) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// logsNoLogTag starts messages that are not to be logged
+const logsNoLogTag = "[nolog]"
+
+// archiveSettings returns the archive settings of a channel
+func (config *IRCConfig) archiveSettings(channel string) ArchiveSettings {
+	for name, settings := range config.Archive {
+		if strings.EqualFold(name, channel) {
+			return settings
+		}
+	}
+	return ArchiveSettings{}
+}
+
+// publicLogs tells whether the logs of channel are published with
+// public-logs
+func (config *IRCConfig) publicLogs(channel string) bool {
+	public := config.archiveSettings(channel).Public
+	return config.PublicLogs && (public == nil || *public)
+}
+
+// logged tells whether a message belongs in the logs: not if it starts with
+// logsNoLogTag or its nick opted out with logs-opt-out-nicks
+func logged(m IRCMessage) bool {
+	if text := strings.TrimSpace(m.message); len(text) >= len(logsNoLogTag) && strings.EqualFold(text[:len(logsNoLogTag)], logsNoLogTag) {
+		return false
+	}
+	for _, nick := range irc.config.LogsOptOutNicks {
+		if strings.EqualFold(nick, m.userName) {
+			return false
+		}
+	}
+	return true
+}
+
+// pseudonymKey keys the pseudonyms without a pseudonym-key. It changes
+// with every start, and so do the pseudonyms.
+var pseudonymKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate the pseudonym key: %s", err)
+	}
+	return key
+}()
+
+// pseudonym is a stable stand-in for nick, however it is capitalized, from
+// which the nick cannot be told without the key, e.g. "anon-3f9a2c1b"
+func pseudonym(nick string) string {
+	key := pseudonymKey
+	if irc.config.PseudonymKey != "" {
+		key = []byte(irc.config.PseudonymKey)
+	}
+	return "anon-" + hex.EncodeToString(hmacSHA256(key, strings.ToLower(nick)))[:8]
+}
+
+// replaceNicks replaces the nicks in text that are keys of names, lower
+// case, with their values
+func replaceNicks(text string, names map[string]string) string {
+	isNickChar := func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("-_[]\\`^{}|", c)
+	}
+	var b strings.Builder
+	word := -1
+	flush := func(end int) {
+		if word < 0 {
+			return
+		}
+		w := text[word:end]
+		// Nicks may contain brackets, but "[alice]" is most likely alice
+		trimmed := strings.Trim(w, "-_[]\\`^{}|")
+		if name, ok := names[strings.ToLower(w)]; ok {
+			b.WriteString(name)
+		} else if name, ok := names[strings.ToLower(trimmed)]; ok && trimmed != "" {
+			at := strings.Index(w, trimmed)
+			b.WriteString(w[:at] + name + w[at+len(trimmed):])
+		} else {
+			b.WriteString(w)
+		}
+		word = -1
+	}
+	for i, c := range text {
+		if isNickChar(c) {
+			if word < 0 {
+				word = i
+			}
+			continue
+		}
+		flush(i)
+		b.WriteRune(c)
+	}
+	flush(len(text))
+	return b.String()
+}
+
+// logChannels returns the channels with logs: those on the web UI but the
+// server buffer and the ones in logs-opt-out
+func logChannels() []string {
+	var channels []string
+	for _, channel := range webChannels() {
+		optedOut := channel == serverBuffer
+		for _, c := range irc.config.LogsOptOut {
+			optedOut = optedOut || strings.EqualFold(c, channel)
+		}
+		if !optedOut {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// logsPage is the data of the logs.html template: the Channels with logs,
+// the Days of Channel with messages, or the Messages of Day. NoIndex keeps
+// search engines away from logs that are not public.
+type logsPage struct {
+	Lang       string
+	ThemeURL   string
+	NoIndex    bool
+	Channels   []logLink
+	Channel    string
+	ChannelURL string
+	Days       []logLink
+	Day        string
+	Previous   *logLink
+	Next       *logLink
+	Messages   []logMessage
+}
+
+// logLink is a link to the logs of a channel or day. For a channel, Days
+// counts the days with logs, from First to Last.
+type logLink struct {
+	Name  string
+	URL   string
+	Days  int
+	First string
+	Last  string
+}
+
+// logMessage is a message on a page of the logs. Reply is set for the
+// replies to an earlier message of their thread.
+type logMessage struct {
+	ID     int
+	Time   string
+	Clock  string
+	Nick   string
+	Text   htmltemplate.HTML
+	Action bool
+	Reply  bool
+}
+
+// handlerLogs serves the logs as plain pages for public archives that
+// search engines can index: the channels at /logs/, the days of a channel
+// at /logs/%23channel/ and what was said on a day, each message with an
+// anchor, at /logs/%23channel/2024-05-01
+func handlerLogs(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	page := logsPage{Lang: prefs.lang, ThemeURL: themeURL(prefs.theme)}
+	name, day, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, endPointLogs), "/")
+	loc := logLocation()
+	// Those who did not log in only see the public logs, if that is all
+	// they may see, and anonymized or pseudonymized nicks
+	authenticated := authEnabled() && allowed(r, scopeRead)
+	if name == "" {
+		for _, channel := range logChannels() {
+			if irc.config.WebAuthReads && !authenticated && !irc.config.publicLogs(channel) {
+				continue
+			}
+			link := logLink{Name: channel, URL: logURL(channel, "")}
+			if days := irc.LogDays(channel, loc); len(days) > 0 {
+				link.Days, link.First, link.Last = len(days), days[0], days[len(days)-1]
+			}
+			page.Channels = append(page.Channels, link)
+		}
+		renderPage(w, "logs.html", page)
+		return
+	}
+	channel := ""
+	for _, c := range logChannels() {
+		if strings.EqualFold(c, name) {
+			channel = c
+		}
+	}
+	if channel == "" {
+		http.NotFound(w, r)
+		return
+	}
+	page.Channel, page.ChannelURL = channel, logURL(channel, "")
+	page.NoIndex = !irc.config.publicLogs(channel)
+	days := irc.LogDays(channel, loc)
+	if day == "" {
+		for i := len(days) - 1; i >= 0; i-- {
+			page.Days = append(page.Days, logLink{Name: days[i], URL: logURL(channel, days[i])})
+		}
+		renderPage(w, "logs.html", page)
+		return
+	}
+	at := -1
+	for i := range days {
+		if days[i] == day {
+			at = i
+		}
+	}
+	from, err := time.ParseInLocation(logDayLayout, day, loc)
+	if err != nil || at < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	page.Day = day
+	if at > 0 {
+		page.Previous = &logLink{Name: days[at-1], URL: logURL(channel, days[at-1])}
+	}
+	if at < len(days)-1 {
+		page.Next = &logLink{Name: days[at+1], URL: logURL(channel, days[at+1])}
+	}
+	settings := irc.config.archiveSettings(channel)
+	anonymize := !authenticated && (settings.AnonymizeNicks || settings.PseudonymizeNicks)
+	var msgs []IRCMessage
+	for _, m := range irc.LogMessages(channel, from, from.AddDate(0, 0, 1)) {
+		// System messages, e.g. presence messages, would give away the
+		// nicks of those who never spoke
+		if logged(m) && !(anonymize && m.userName == "*") {
+			msgs = append(msgs, m)
+		}
+	}
+	// Numbered in the order they first spoke that day, also where they
+	// are mentioned
+	names := make(map[string]string)
+	for _, m := range msgs {
+		key := strings.ToLower(m.userName)
+		if !anonymize || names[key] != "" {
+			continue
+		}
+		if settings.AnonymizeNicks {
+			names[key] = fmt.Sprintf(tr(prefs.lang, uiAnonymousUser), len(names)+1)
+		} else if settings.PseudonymizeNicks {
+			names[key] = pseudonym(m.userName)
+		}
+	}
+	for _, m := range msgs {
+		nick := m.userName
+		if anonymize {
+			nick, m.message = replaceNicks(nick, names), replaceNicks(m.message, names)
+		}
+		page.Messages = append(page.Messages, logMessage{
+			ID:     m.id,
+			Time:   m.time.Format(time.RFC3339),
+			Clock:  m.time.In(loc).Format("15:04:05"),
+			Nick:   nick,
+			Text:   htmltemplate.HTML(renderMessageText(m, prefs)),
+			Action: m.action,
+			Reply:  m.threadID != 0 && m.threadID != m.id,
+		})
+	}
+	renderPage(w, "logs.html", page)
+}
+
+// maxSitemapURLs is how many URLs a sitemap may have
+const maxSitemapURLs = 50000
+
+// sitemap is a sitemap.xml as described at https://www.sitemaps.org
+type sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// handlerSitemap lists the pages of the logs for search engines when
+// public-logs is set: the index, the channels and their days, the latest
+// first if there are too many
+func handlerSitemap(w http.ResponseWriter, r *http.Request) {
+	if !irc.config.PublicLogs {
+		http.NotFound(w, r)
+		return
+	}
+	base, loc := publicURL(r), logLocation()
+	s := sitemap{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9", URLs: []sitemapURL{{Loc: base + endPointLogs}}}
+	var days []sitemapURL
+	for _, channel := range logChannels() {
+		if !irc.config.publicLogs(channel) {
+			continue
+		}
+		channelDays := irc.LogDays(channel, loc)
+		index := sitemapURL{Loc: base + logURL(channel, "")}
+		if len(channelDays) > 0 {
+			index.LastMod = channelDays[len(channelDays)-1]
+		}
+		s.URLs = append(s.URLs, index)
+		for _, day := range channelDays {
+			days = append(days, sitemapURL{Loc: base + logURL(channel, day), LastMod: day})
+		}
+	}
+	sort.SliceStable(days, func(i, j int) bool { return days[i].LastMod > days[j].LastMod })
+	if room := maxSitemapURLs - len(s.URLs); len(days) > room {
+		days = days[:room]
+	}
+	s.URLs = append(s.URLs, days...)
+	data, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(data)
+}
+
+// handlerRobots tells search engines what to crawl: with public-logs the
+// public logs and the sitemap, otherwise nothing
+func handlerRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !irc.config.PublicLogs {
+		_, _ = fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+		return
+	}
+	_, _ = fmt.Fprint(w, "User-agent: *\n")
+	for _, channel := range logChannels() {
+		if !irc.config.publicLogs(channel) {
+			_, _ = fmt.Fprintf(w, "Disallow: %s\n", logURL(channel, ""))
+		}
+	}
+	_, _ = fmt.Fprintf(w, "Allow: %s\nAllow: %s\nDisallow: /\n\nSitemap: %s%s\n", endPointLogs, endPointSitemap, publicURL(r), endPointSitemap)
+}
+
+// handlerWebSocket streams the new messages of a channel as JSON wsEvents
+func handlerWebSocket(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	channel := requestChannel(r)
+	// A browser resuming after a lost connection passes the last message it
+	// got, and the newer ones still in the buffer are sent again
+	lastID, resume := strconv.Atoi(r.FormValue(formKeyLastID))
+	conn, err := acceptWebSocket(w, r, "")
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	defer conn.Close()
+	messages, first := streams.Subscribe(channel)
+	if first {
+		irc.SetAway(false)
+	}
+	defer func() {
+		if streams.Unsubscribe(messages) {
+			irc.SetAway(true)
+		}
+	}()
+	send := func(m IRCMessage) error {
+		lastID = m.id
+		return writeJSON(conn, wsEvent{Type: "message", apiMessage: prefs.localize([]apiMessage{m.toAPI()})[0], HTML: renderMessage(m, prefs)})
+	}
+	if resume == nil {
+		for _, m := range irc.messagesForChatRoom(channel) {
+			if m.id <= lastID {
+				continue
+			}
+			if err := send(m); err != nil {
+				return
+			}
+		}
+	}
+
+	// Reading also answers the browser's pings and notices when it goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			data, err := conn.readMessage()
+			if err != nil {
+				return
+			}
+			if err := writeJSON(conn, handleWSCommand(r, channel, data, prefs)); err != nil {
+				return
+			}
+		}
+	}()
+	users := streams.WatchUsers(channel)
+	defer streams.UnwatchUsers(users)
+	if err := writeJSON(conn, usersEvent(channel)); err != nil {
+		return
+	}
+	// A peeked channel stays while somebody watches it
+	keepPeek := time.NewTicker(10 * time.Second)
+	defer keepPeek.Stop()
+	ping := time.NewTicker(time.Duration(irc.config.WSPingIntervalSeconds) * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-keepPeek.C:
+			peeks.Touch(channel)
+		case <-users:
+			if err := writeJSON(conn, usersEvent(channel)); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.writeMutex.Lock()
+			err := conn.writeFrame(wsOpPing, nil)
+			conn.writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+		case m := <-messages:
+			if m.id <= lastID {
+				// Already sent while resuming
+				continue
+			}
+			if err := send(m); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handlerEvents streams the new messages and the user list of a channel as
+// Server-Sent Events, for browsers behind proxies that break WebSockets.
+// Message events carry the same JSON as on /ws and their id, so that the
+// browser resumes after the last one when it reconnects.
+func handlerEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	prefs := requestPrefs(w, r)
+	channel := requestChannel(r)
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.FormValue(formKeyLastID)
+	}
+	lastID, resume := strconv.Atoi(lastEventID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	messages, first := streams.Subscribe(channel)
+	if first {
+		irc.SetAway(false)
+	}
+	defer func() {
+		if streams.Unsubscribe(messages) {
+			irc.SetAway(true)
+		}
+	}()
+	users := streams.WatchUsers(channel)
+	defer streams.UnwatchUsers(users)
+
+	send := func(event string, id int, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if id > 0 {
+			_, _ = fmt.Fprintf(w, "id: %d\n", id)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	sendMessage := func(m IRCMessage) error {
+		lastID = m.id
+		return send("message", m.id, wsEvent{Type: "message", apiMessage: prefs.localize([]apiMessage{m.toAPI()})[0], HTML: renderMessage(m, prefs)})
+	}
+	if resume == nil {
+		for _, m := range irc.messagesForChatRoom(channel) {
+			if m.id <= lastID {
+				continue
+			}
+			if err := sendMessage(m); err != nil {
+				return
+			}
+		}
+	}
+	if err := send("users", 0, usersEvent(channel)); err != nil {
+		return
+	}
+
+	keepPeek := time.NewTicker(10 * time.Second)
+	defer keepPeek.Stop()
+	// A comment now and then keeps proxies from closing an idle stream
+	keepAlive := time.NewTicker(time.Duration(irc.config.WSPingIntervalSeconds) * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepPeek.C:
+			peeks.Touch(channel)
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-users:
+			if err := send("users", 0, usersEvent(channel)); err != nil {
+				return
+			}
+		case m := <-messages:
+			if m.id <= lastID {
+				continue
+			}
+			if err := sendMessage(m); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWSCommand carries out a wsCommand from the web UI
+func handleWSCommand(r *http.Request, channel string, data []byte, prefs viewPrefs) wsReply {
+	var command wsCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		return wsReply{Type: "error", Error: "invalid command"}
+	}
+	reply := wsReply{Type: "ack", ID: command.ID}
+	if command.Type != "send" || strings.TrimSpace(command.Message) == "" {
+		reply.Type, reply.Error = "error", "invalid command"
+		return reply
+	}
+	if !allowed(r, scopeSend) {
+		reply.Type, reply.Error = "error", errLoginRequired.Error()
+		return reply
+	}
+	sent, err := sendFromWebUI(r, channel, command.Message)
+	if err != nil {
+		reply.Type, reply.Error = "error", err.Error()
+		return reply
+	}
+	for _, m := range sent {
+		reply.MessageIDs = append(reply.MessageIDs, m.id)
+		reply.HTML += renderMessage(m, prefs)
+	}
+	return reply
+}
+
+// writeJSON sends v as a WebSocket text message
+func writeJSON(conn *wsConn, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(data)
+}
+
+// usersPage is the data of the users.html template
+type usersPage struct {
+	Lang     string
+	ThemeURL string
+	Users    htmltemplate.HTML
+}
+
+func handlerGetUsersForChannel(w http.ResponseWriter, r *http.Request) {
+	renderPage(w, "users.html", usersPage{
+		Lang:     requestLanguage(w, r),
+		ThemeURL: themeURL(requestTheme(w, r)),
+		Users:    htmltemplate.HTML(irc.GetUsersForChannel(requestChannel(r))),
+	})
+}
+
+// handlerAPIUsers returns the users in a channel as JSON
+func handlerAPIUsers(w http.ResponseWriter, r *http.Request) {
+	users := irc.UsersOfChannel(requestChannel(r))
+	if users == nil {
+		users = []User{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(users)
+}
+
+// requestWhois asks the server about the nick of r
+func requestWhois(r *http.Request, prefs viewPrefs) (Whois, error) {
+	nick := strings.TrimSpace(r.FormValue(formKeyNick))
+	if !validNick(nick) {
+		return Whois{}, fmt.Errorf("%w %q", errInvalidNick, nick)
+	}
+	whois, err := irc.Whois(r.Context(), nick)
+	if err != nil {
+		return whois, err
+	}
+	if whois.SignedOn != nil {
+		t := whois.SignedOn.In(prefs.location)
+		whois.SignedOn = &t
+	}
+	return whois, nil
+}
+
+// handlerAPIWhois returns what the server tells about ?nick=
+func handlerAPIWhois(w http.ResponseWriter, r *http.Request) {
+	whois, err := requestWhois(r, requestPrefs(w, r))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(whois)
+}
+
+// whoisPage is the data of the whois.html template: what the server told
+// about Nick, as rows labelled with UI strings, or why it did not
+type whoisPage struct {
+	Lang     string
+	ThemeURL string
+	Nick     string
+	Error    string
+	Rows     []whoisRow
+	IndexURL string
+}
+
+type whoisRow struct {
+	Label string
+	Value string
+}
+
+// handlerWhois shows the profile of ?nick=, where the nicks in the user list
+// link to
+func handlerWhois(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	whois, err := requestWhois(r, prefs)
+	page := whoisPage{
+		Lang:     prefs.lang,
+		ThemeURL: themeURL(prefs.theme),
+		Nick:     r.FormValue(formKeyNick),
+		IndexURL: channelURL("/", irc.config.Channel),
+	}
+	switch {
+	case errors.Is(err, ircclient.ErrNoSuchNick):
+		w.WriteHeader(http.StatusNotFound)
+		page.Error = tr(prefs.lang, uiNoSuchNick)
+	case err != nil:
+		w.WriteHeader(errorStatus(err))
+		page.Error = err.Error()
+	default:
+		row := func(label, value string) {
+			if value != "" {
+				page.Rows = append(page.Rows, whoisRow{Label: label, Value: value})
+			}
+		}
+		row(uiRealName, whois.RealName)
+		if whois.User != "" {
+			row(uiHostmask, whois.User+"@"+whois.Host)
+		}
+		row(uiAccount, whois.Account)
+		row(uiServer, strings.TrimSpace(whois.Server+" "+whois.ServerInfo))
+		row(uiChannels, strings.Join(whois.Channels, " "))
+		if whois.SignedOn != nil {
+			row(uiIdle, (time.Duration(whois.IdleSeconds) * time.Second).String())
+			row(uiSignedOn, prefs.formatTime(*whois.SignedOn))
+		}
+		row(uiAwayMessage, whois.Away)
+		if whois.Oper {
+			row(uiOper, tr(prefs.lang, uiYes))
+		}
+	}
+	renderPage(w, "whois.html", page)
+}
+
+// handlerStarMessage toggles the star on a message from the HTML view
+func handlerStarMessage(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		log.Printf("Error: %s", err)
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+	user, ok := webUser(r)
+	if !ok {
+		http.Redirect(w, r, endPointLogin, 302)
+		return
+	}
+	id, _ := strconv.Atoi(r.Form.Get(formKeyMessageID))
+	if bookmarks.Has(user, id) {
+		bookmarks.Remove(user, id)
+	} else if m, ok := irc.GetMessage(id); ok {
+		bookmarks.Add(user, m)
+	}
+	http.Redirect(w, r, channelURL("/", requestChannel(r)), 302)
+}
+
+// reportMessage files a report about the message with the given id and lets
+// the moderators know about it
+func reportMessage(r *http.Request, id int, reason string) (report, error) {
+	m, ok := irc.GetMessage(id)
+	if !ok || m.Channel == "" {
+		// Raw lines are not shown to anybody who could report them
+		return report{}, errMessageNotFound
+	}
+	reason = strings.Join(strings.Fields(reason), " ")
+	filed, isNew, err := reports.Add(m, irc.MessageContext(id, reportContextMessages), reason, clientAddress(r))
+	if err != nil || !isNew {
+		return filed, err
+	}
+	log.Printf("Message %d in %s reported by %s: %s", id, m.Channel, filed.Reporter, reason)
+	runHooks(hookEvent{Event: hookReport, Channel: m.Channel, Nick: m.Nick, Message: m.Message})
+	if target := irc.config.ReportNoticeTarget; target != "" {
+		notice := fmt.Sprintf("Report %d: message %d by %s in %s", filed.ID, id, m.Nick, m.Channel)
+		if reason != "" {
+			notice += ": " + reason
+		}
+		irc.Notice(target, notice)
+	}
+	return filed, nil
+}
+
+var (
+	errMessageNotFound = errors.New("message not found")
+	errTooManyReports  = errors.New("too many reports, try again later")
+)
+
+// handlerReportMessage reports a message from the web UI
+func handlerReportMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+	id, _ := strconv.Atoi(r.Form.Get(formKeyMessageID))
+	_, err := reportMessage(r, id, r.Form.Get(formKeyReason))
+	if errors.Is(err, errTooManyReports) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+	http.Redirect(w, r, channelURL("/", requestChannel(r)), 302)
+}
+
+// handlerAPIReports reports the message picked with the id parameter, with
+// an optional reason
+func handlerAPIReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(r.Form.Get(formKeyMessageID))
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+	filed, err := reportMessage(r, id, r.Form.Get(formKeyReason))
+	if errors.Is(err, errTooManyReports) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// The reporter only learns what became of the report, not the others'
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": filed.ID, "status": filed.Status})
+}
+
+// handlerAPIBookmarks lists the bookmarks of the user on GET, stars a
+// message on POST and removes a star on DELETE. The message is picked with
+// the id parameter.
+func handlerAPIBookmarks(w http.ResponseWriter, r *http.Request) {
+	user, ok := webUser(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, errLoginRequired.Error(), http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		id, err := strconv.Atoi(r.FormValue(formKeyMessageID))
+		if err != nil {
+			http.Error(w, "invalid message id", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			bookmarks.Remove(user, id)
+			break
+		}
+		m, ok := irc.GetMessage(id)
+		if !ok {
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
+		bookmarks.Add(user, m)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(requestPrefs(w, r).localize(bookmarks.List(user)))
+}
+
+// handlerAPIMessages returns the messages of a channel on GET and sends one
+// on POST, each for the clients allowed to
+func handlerAPIMessages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		requireLoginToRead(handlerAPIGetMessages)(w, r)
+	case http.MethodPost:
+		requireLogin(handlerAPISendMessage)(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handlerAPIGetMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(requestPrefs(w, r).localize(irc.GetAPIMessagesForChatRoom(requestChannel(r))))
+}
+
+// handlerAPISendMessage sends the "message" of a JSON or form body to the
+// channel like the web UI and returns the messages sent
+func handlerAPISendMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := readRelayMessage(w, r, irc.Nick())
+	if !ok {
+		return
+	}
+	channel := requestChannel(r)
+	sent, err := sendFromWebUI(r, channel, msg.Message)
+	if err != nil {
+		var limited guestLimitError
+		if errors.As(err, &limited) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(limited.wait.Seconds()+0.5)))
+		}
+		log.Printf("Failed to send to %s: %s", channel, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if token, ok := irc.config.apiToken(bearerToken(r)); ok {
+		log.Printf("API token %s sent %d message(s) to %s", token.Name, len(sent), channel)
+	}
+	msgs := make([]apiMessage, 0, len(sent))
+	for _, m := range sent {
+		msgs = append(msgs, m.toAPI())
+	}
+	msgs = requestPrefs(w, r).localize(msgs)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(msgs)
+}
+
+// handlerHistory serves the channel history as plain pages that work without
+// frames or refreshes, most recent messages on page 1
+func handlerHistory(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	channel := requestChannel(r)
+	msgs := irc.messagesForChatRoom(channel)
+	pageSize := irc.config.HistoryPageSize
+	pages := (len(msgs) + pageSize - 1) / pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if around, err := strconv.Atoi(r.URL.Query().Get(formKeyAround)); err == nil {
+		// The page with that message, which the URL fragment scrolls to
+		for i, m := range msgs {
+			if m.id == around {
+				page = (len(msgs)-1-i)/pageSize + 1
+			}
+		}
+	}
+	if page < 1 {
+		page = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	end := len(msgs) - (page-1)*pageSize
+	start := end - pageSize
+	if start < 0 {
+		start = 0
+	}
+
+	var nav []string
+	if page < pages {
+		nav = append(nav, fmt.Sprintf(`<a href="%s&amp;page=%d" rel="prev">%s</a>`, channelURL(endPointHistory, channel), page+1, tr(prefs.lang, uiOlder)))
+	}
+	nav = append(nav, fmt.Sprintf(tr(prefs.lang, uiPageOf), page, pages))
+	if page > 1 {
+		nav = append(nav, fmt.Sprintf(`<a href="%s&amp;page=%d" rel="next">%s</a>`, channelURL(endPointHistory, channel), page-1, tr(prefs.lang, uiNewer)))
+	}
+	navigation := `<nav aria-label="` + tr(prefs.lang, uiHistory) + `"><p>` + strings.Join(nav, " | ") + `</p></nav>`
+
+	content := `<!doctype html><html itemscope="" itemtype="http://schema.org/WebPage" lang="` + prefs.lang + `">
+	<head><title>` + tr(prefs.lang, uiTitleHistory) + `</title>` + pageHead(prefs.theme) + `</head>
+    <body><main><h1>` + html.EscapeString(channel) + `</h1>` + navigation +
+		renderMessages(msgs[start:end], prefs) + navigation + `<p><a href="` + channelURL("/", channel) + `">` + tr(prefs.lang, uiTitleIndex) + `</a></p></main></body></html>`
+	_, _ = fmt.Fprintf(w, "%s", content)
+}
+
+// searchQuery is what to look for in the messages of the web UI. Empty
+// fields match every message; Until is not included.
+type searchQuery struct {
+	Text    string
+	Nick    string
+	Channel string
+	Since   time.Time
+	Until   time.Time
+}
+
+// requestSearch reads a search from the form of r. since and until are
+// dates in loc, both included.
+func requestSearch(r *http.Request, loc *time.Location) (searchQuery, error) {
+	q := searchQuery{
+		Text: strings.TrimSpace(r.FormValue(formKeyQuery)),
+		Nick: strings.TrimSpace(r.FormValue(formKeyNick)),
+	}
+	if r.FormValue(formKeyChannel) != "" {
+		q.Channel = requestChannel(r)
+	}
+	for _, date := range []struct {
+		key string
+		t   *time.Time
+		add int
+	}{{formKeySince, &q.Since, 0}, {formKeyUntil, &q.Until, 1}} {
+		value := r.FormValue(date.key)
+		if value == "" {
+			continue
+		}
+		day, err := time.ParseInLocation("2006-01-02", value, loc)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s date %q, expected YYYY-MM-DD", date.key, value)
+		}
+		*date.t = day.AddDate(0, 0, date.add)
+	}
+	return q, nil
+}
+
+func (q searchQuery) matches(m IRCMessage) bool {
+	switch {
+	case m.redacted:
+		return false
+	case q.Text != "" && !strings.Contains(strings.ToLower(stripFormatting(m.message)), strings.ToLower(q.Text)):
+		return false
+	case q.Nick != "" && !strings.EqualFold(m.userName, q.Nick):
+		return false
+	case !q.Since.IsZero() && m.time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !m.time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// SearchMessages returns up to limit messages of the web UI's channels
+// that match q, newest first
+func (irc *IRC) SearchMessages(q searchQuery, limit int) []IRCMessage {
+	channels := webChannels()
+	if q.Channel != "" {
+		channels = []string{q.Channel}
+	}
+	var found []IRCMessage
+	for _, channel := range channels {
+		for _, m := range irc.messagesForChatRoom(channel) {
+			if q.matches(m) {
+				found = append(found, m)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].id > found[j].id })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// contextURL links to the history page around a message
+func contextURL(m IRCMessage) string {
+	return fmt.Sprintf("%s&%s=%d#m%d", channelURL(endPointHistory, m.channel), formKeyAround, m.id, m.id)
+}
+
+// searchResult is a message found by /api/v1/search
+type searchResult struct {
+	apiMessage
+	ContextURL string `json:"context-url"`
+}
+
+// handlerAPISearch returns the messages matching the search of the request
+// as JSON, see requestSearch
+func handlerAPISearch(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	q, err := requestSearch(r, prefs.location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	found := irc.SearchMessages(q, irc.config.HistoryPageSize)
+	msgs := make([]apiMessage, 0, len(found))
+	for _, m := range found {
+		msgs = append(msgs, m.toAPI())
+	}
+	results := make([]searchResult, 0, len(found))
+	for i, m := range prefs.localize(msgs) {
+		results = append(results, searchResult{apiMessage: m, ContextURL: contextURL(found[i])})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// searchPage is the data of the search.html template. Save is set for
+// logged in users, who may save the search.
+type searchPage struct {
+	Lang       string
+	ThemeURL   string
+	SearchForm htmltemplate.HTML
+	Searched   bool
+	Results    []searchResultLine
+	Save       *saveSearchForm
+	IndexURL   string
+}
+
+// searchResultLine is a message found, the text searched for highlighted in
+// Text, with a link to its context in the history
+type searchResultLine struct {
+	Time       string
+	Clock      string
+	Channel    string
+	ChannelURL string
+	Source     string
+	Nick       string
+	Text       htmltemplate.HTML
+	ContextURL string
+}
+
+// saveSearchForm is the form that saves the search, or deletes it
+type saveSearchForm struct {
+	URL       string
+	CSRFToken string
+	Query     searchQuery
+	Name      string
+}
+
+// handlerSearch serves the search form with the messages it found, which
+// the index page shows in place with Javascript
+func handlerSearch(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	q, err := requestSearch(r, prefs.location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page := searchPage{
+		Lang:       prefs.lang,
+		ThemeURL:   themeURL(prefs.theme),
+		SearchForm: htmltemplate.HTML(searchForm(r, prefs)),
+		Searched:   q != (searchQuery{}),
+		IndexURL:   channelURL("/", irc.config.Channel),
+	}
+	if page.Searched {
+		for _, m := range irc.SearchMessages(q, irc.config.HistoryPageSize) {
+			page.Results = append(page.Results, searchResultLine{
+				Time:       m.time.Format(time.RFC3339),
+				Clock:      prefs.formatTime(m.time),
+				Channel:    m.channel,
+				ChannelURL: channelURL("/", m.channel),
+				Source:     m.source(),
+				Nick:       m.userName,
+				Text:       htmltemplate.HTML(highlightMatches(stripFormatting(m.message), q.Text)),
+				ContextURL: contextURL(m),
+			})
+		}
+		if _, ok := prefsUser(r); ok {
+			page.Save = &saveSearchForm{URL: endPointSaveSearch, CSRFToken: csrfToken(w, r), Query: q, Name: r.FormValue(formKeyName)}
+		}
+	}
+	renderPage(w, "search.html", page)
+}
+
+// searchForm renders the search form, filled in from r
+func searchForm(r *http.Request, prefs viewPrefs) string {
+	input := func(key, kind, label string) string {
+		return fmt.Sprintf(`<label>%s <input type="%s" name="%s" value="%s" /></label> `,
+			tr(prefs.lang, label), kind, key, html.EscapeString(r.FormValue(key)))
+	}
+	var options strings.Builder
+	options.WriteString(`<option value="">` + tr(prefs.lang, uiAllChannels) + `</option>`)
+	for _, channel := range webChannels() {
+		selected := ""
+		if r.FormValue(formKeyChannel) == channel {
+			selected = ` selected="selected"`
+		}
+		options.WriteString(`<option` + selected + `>` + html.EscapeString(channel) + `</option>`)
+	}
+	saved := ""
+	if user, ok := prefsUser(r); ok {
+		var links []string
+		for _, search := range savedSearches(user) {
+			links = append(links, `<a href="`+html.EscapeString(search.url())+`">`+html.EscapeString(search.Name)+`</a>`)
+		}
+		if len(links) > 0 {
+			saved = `<p>` + tr(prefs.lang, uiSavedSearches) + `: ` + strings.Join(links, " | ") + `</p>`
+		}
+	}
+	return saved + `<form id="search" method="get" action="` + endPointSearch + `" data-api="` + endPointAPISearch +
+		`" data-context="` + tr(prefs.lang, uiContext) + `" data-none="` + tr(prefs.lang, uiNoResults) + `">` +
+		input(formKeyQuery, "search", uiSearchText) + input(formKeyNick, "text", uiNick) +
+		`<label>` + tr(prefs.lang, uiChannel) + ` <select name="` + formKeyChannel + `">` + options.String() + `</select></label> ` +
+		input(formKeySince, "date", uiSince) + input(formKeyUntil, "date", uiUntil) +
+		`<input type="submit" value="` + tr(prefs.lang, uiSearch) + `" /></form>`
+}
+
+// SavedSearch is a search a user saved in the saved-searches preference.
+// With Alert set, the alert hooks run for every new message it finds.
+type SavedSearch struct {
+	Name    string `json:"name"`
+	Query   string `json:"q,omitempty"`
+	Nick    string `json:"nick,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Alert   bool   `json:"alert,omitempty"`
+}
+
+func (s SavedSearch) query() searchQuery {
+	return searchQuery{Text: s.Query, Nick: s.Nick, Channel: s.Channel}
+}
+
+// url links to the search page showing what s finds
+func (s SavedSearch) url() string {
+	values := url.Values{}
+	for key, value := range map[string]string{formKeyQuery: s.Query, formKeyNick: s.Nick, formKeyChannel: s.Channel} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return endPointSearch + "?" + values.Encode()
+}
+
+// savedSearches returns the saved searches of user
+func savedSearches(user string) []SavedSearch {
+	var searches []SavedSearch
+	if value, ok := prefs.Get(user)[prefSavedSearches]; ok {
+		_ = json.Unmarshal(value, &searches)
+	}
+	return searches
+}
+
+// saveSearch adds search to those of user, replacing the one of the same
+// name, or deletes that one if search has nothing to look for
+func saveSearch(user string, search SavedSearch) error {
+	searches := []SavedSearch{}
+	for _, saved := range savedSearches(user) {
+		if saved.Name != search.Name {
+			searches = append(searches, saved)
+		}
+	}
+	if search.query() != (searchQuery{}) {
+		searches = append(searches, search)
+	}
+	data, _ := json.Marshal(searches)
+	return prefs.Set(user, map[string]json.RawMessage{prefSavedSearches: data})
+}
+
+// runAlerts runs the alert hooks for the saved searches with alerts that
+// find m
+func runAlerts(m IRCMessage) {
+	for user, value := range prefs.All(prefSavedSearches) {
+		var searches []SavedSearch
+		_ = json.Unmarshal(value, &searches)
+		for _, search := range searches {
+			if search.Alert && (search.Channel == "" || strings.EqualFold(search.Channel, m.channel)) && search.query().matches(m) {
+				runHooks(hookEvent{Event: hookAlert, Channel: m.channel, Nick: m.userName, Message: m.message, User: user, Search: search.Name, Time: m.time})
+			}
+		}
+	}
+}
+
+// runKeywordHighlights runs the highlight hooks for every user with one of
+// their keywords in m, unless they muted its channel
+func runKeywordHighlights(m IRCMessage) {
+	for user, value := range prefs.All(prefKeywords) {
+		var keywords []string
+		_ = json.Unmarshal(value, &keywords)
+		if len(keywords) == 0 || userMutedChannels(user)[m.channel] {
+			continue
+		}
+		for _, keyword := range keywords {
+			if mentionsKeyword(m.message, keyword) {
+				runHooks(hookEvent{Event: hookHighlight, Channel: m.channel, Nick: m.userName, Message: m.message, User: user, Keyword: keyword, Time: m.time})
+				break
+			}
+		}
+	}
+}
+
+// quietWindow is the quiet-hours preference of a user, e.g. from "23:00"
+// to "07:00", in the time zone of their timezone preference
+type quietWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// minutes returns the start and end of the window in minutes after midnight
+func (w quietWindow) minutes() (start, end int, err error) {
+	for _, clock := range []struct {
+		value   string
+		minutes *int
+	}{{w.Start, &start}, {w.End, &end}} {
+		t, err := time.Parse("15:04", clock.value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q is not a time like 23:00", clock.value)
+		}
+		*clock.minutes = t.Hour()*60 + t.Minute()
+	}
+	return start, end, nil
+}
+
+// contains tells whether the window is open at t, in the time zone of t. A
+// window ending before it starts lasts over midnight.
+func (w quietWindow) contains(t time.Time) bool {
+	start, end, err := w.minutes()
+	if err != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return start <= now && now < end
+	}
+	return now >= start || now < end
+}
+
+// userQuiet tells whether the quiet hours of user are on at now
+func userQuiet(user string, now time.Time) bool {
+	value, ok := prefs.Get(user)[prefQuietHours]
+	if !ok {
+		return false
+	}
+	var window quietWindow
+	if err := json.Unmarshal(value, &window); err != nil {
+		return false
+	}
+	tz, _ := prefs.String(user, prefTimezone)
+	loc, err := time.LoadLocation(tz)
+	if tz == "" || err != nil {
+		loc = logLocation()
+	}
+	return window.contains(now.In(loc))
+}
+
+// QuietHours holds back the hook events of users, their alerts and
+// highlights, during their quiet hours and sends them as a digest once they
+// are over. The events are kept until smirc restarts.
+type QuietHours struct {
+	mutex sync.Mutex
+	held  map[string][]hookEvent
+}
+
+// Hold keeps event back if the quiet hours of its user are on at now and
+// tells whether it did
+func (q *QuietHours) Hold(event hookEvent, now time.Time) bool {
+	if !userQuiet(event.User, now) {
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.held == nil {
+		q.held = make(map[string][]hookEvent)
+	}
+	held := append(q.held[event.User], event)
+	if len(held) > maxQuietEvents {
+		held = held[len(held)-maxQuietEvents:]
+	}
+	q.held[event.User] = held
+	return true
+}
+
+// Release returns and forgets the events held for the users whose quiet
+// hours are over at now
+func (q *QuietHours) Release(now time.Time) map[string][]hookEvent {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	released := make(map[string][]hookEvent)
+	for user, events := range q.held {
+		if !userQuiet(user, now) {
+			released[user] = events
+			delete(q.held, user)
+		}
+	}
+	return released
+}
+
+// Run sends the digests of the quiet hours that are over, checking every
+// minute until ctx is done
+func (q *QuietHours) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for user, events := range q.Release(now) {
+				sendDigest(user, events)
+			}
+		}
+	}
+}
+
+// sendDigest runs the digest hooks with the events held for user, or else
+// the hooks of the events themselves, one by one
+func sendDigest(user string, events []hookEvent) {
+	for _, hook := range irc.config.Hooks {
+		if hook.Event == hookDigest {
+			runHooks(hookEvent{
+				Event:   hookDigest,
+				User:    user,
+				Message: fmt.Sprintf("%d notifications during quiet hours", len(events)),
+				Digest:  events,
+			})
+			return
+		}
+	}
+	for _, event := range events {
+		runHooks(event)
+	}
+}
+
+// mentionsKeyword tells whether message has keyword as a word, or contains
+// it if it is several words, ignoring case
+func mentionsKeyword(message, keyword string) bool {
+	keyword = strings.TrimSpace(keyword)
+	if keyword == "" {
+		return false
+	}
+	if strings.ContainsAny(keyword, " \t") {
+		return strings.Contains(strings.ToLower(message), strings.ToLower(keyword))
+	}
+	return mentions(message, keyword)
+}
+
+// handlerSaveSearch saves the search of the form for the logged in user,
+// or deletes the one of that name, and shows what it finds
+func handlerSaveSearch(w http.ResponseWriter, r *http.Request) {
+	user, ok := prefsUser(r)
+	if !ok {
+		http.Error(w, "saved searches need web-users or web-token", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+	search := SavedSearch{
+		Name:    strings.TrimSpace(r.PostForm.Get(formKeyName)),
+		Query:   strings.TrimSpace(r.PostForm.Get(formKeyQuery)),
+		Nick:    strings.TrimSpace(r.PostForm.Get(formKeyNick)),
+		Channel: r.PostForm.Get(formKeyChannel),
+		Alert:   r.PostForm.Get(formKeyAlert) == "true",
+	}
+	redirect := search.url()
+	if r.PostForm.Get(formKeyAction) != "" {
+		search.Query, search.Nick, search.Channel = "", "", ""
+	}
+	if err := saveSearch(user, search); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// handlerAPISavedSearches lists the saved searches of the logged in user on
+// GET. POST saves the search in the JSON body, replacing the one of the same
+// name, and DELETE deletes the one named by ?name=.
+func handlerAPISavedSearches(w http.ResponseWriter, r *http.Request) {
+	user, ok := prefsUser(r)
+	if !ok {
+		http.Error(w, "saved searches need web-users or web-token", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		var search SavedSearch
+		r.Body = http.MaxBytesReader(w, r.Body, irc.config.MaxBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&search); err != nil || search.Name == "" || search.query() == (searchQuery{}) {
+			http.Error(w, "expected a JSON search with a name and something to look for", http.StatusBadRequest)
+			return
+		}
+		if err := saveSearch(user, search); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	case http.MethodDelete:
+		if err := saveSearch(user, SavedSearch{Name: r.URL.Query().Get(formKeyName)}); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	searches := savedSearches(user)
+	if searches == nil {
+		searches = []SavedSearch{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(searches)
+}
+
+// highlightMatches escapes text for HTML and marks where it contains
+// needle, ignoring case
+func highlightMatches(text, needle string) string {
+	if needle == "" {
+		return html.EscapeString(text)
+	}
+	re := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(needle))
+	var b strings.Builder
+	last := 0
+	for _, match := range re.FindAllStringIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:match[0]]))
+		b.WriteString(`<mark>` + html.EscapeString(text[match[0]:match[1]]) + `</mark>`)
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+func handlerAPIStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fullStatus())
+}
+
+// fullStatus is the status of the connection with the counters of the web
+// side
+func fullStatus() apiStatus {
+	status := irc.Status()
+	status.CTCPReceived, status.CTCPDropped = ctcpLimiter.Stats()
+	status.Onion = onion.Address()
+	status.OversizedRequests = atomic.LoadInt64(&oversizedRequests)
+	status.PasteQuotaExceeded = pastes.Rejected()
+	status.WebViewers = streams.Viewers()
+	status.WatchdogRestarts = watchdog.Restarts()
+	return status
+}
+
+// --- GraphQL, see https://spec.graphql.org and
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const graphQLSubprotocol = "graphql-transport-ws"
+
+// graphQLRequest is the body of a POST to /api/v1/graphql, and the payload
+// of a subscribe message on its WebSocket
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// graphQLMessage is a message of the graphql-transport-ws protocol
+type graphQLMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// operation parses the query of req and picks its operation
+func (req graphQLRequest) operation() (*graphql.Operation, error) {
+	doc, err := graphql.Parse(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Operation(req.OperationName)
+}
+
+// graphQLError is the response to a request that could not be executed
+func graphQLError(err error) *graphql.Response {
+	return &graphql.Response{Errors: []graphql.Error{{Message: err.Error()}}}
+}
+
+// graphQLValue turns v, a struct or a slice of them, as marshalled to JSON
+// into graphql.Objects of typename, with the kebab-case keys camel-cased as
+// GraphQL clients expect. The fields left out as empty are false or null.
+func graphQLValue(typename string, v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil
+	}
+	empty := make(map[string]interface{})
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			empty[name] = nil
+			if t.Field(i).Type.Kind() == reflect.Bool {
+				empty[name] = false
+			}
+		}
+	}
+	camelCase := func(key string) string {
+		parts := strings.Split(key, "-")
+		for i := 1; i < len(parts); i++ {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+		return strings.Join(parts, "")
+	}
+	var convert func(v interface{}, top bool) interface{}
+	convert = func(v interface{}, top bool) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			o := graphql.Object{}
+			if top {
+				o["__typename"] = typename
+				for key, value := range empty {
+					o[camelCase(key)] = value
+				}
+			}
+			for key, value := range v {
+				o[camelCase(key)] = convert(value, false)
+			}
+			return o
+		case []interface{}:
+			for i := range v {
+				v[i] = convert(v[i], top)
+			}
+		}
+		return v
+	}
+	return convert(value, true)
+}
+
+// stringArg returns the string argument called name, "" if it is missing
+func stringArg(args map[string]interface{}, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %q must be a string", name)
+}
+
+// intArg returns the integer argument called name, fallback if it is missing
+func intArg(args map[string]interface{}, name string, fallback int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return fallback, nil
+	case int:
+		return v, nil
+	case float64:
+		// Numbers in JSON variables
+		if v == math.Trunc(v) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be an integer", name)
+}
+
+// graphQLQuery is the root of the queries of the client that made r
+func graphQLQuery(r *http.Request, prefs viewPrefs) graphql.Object {
+	return graphql.Object{
+		"__typename": "Query",
+		"messages": graphql.Resolver(func(args map[string]interface{}) (interface{}, error) {
+			channel, err := stringArg(args, "channel")
+			if err != nil {
+				return nil, err
+			}
+			last, err := intArg(args, "last", 0)
+			if err != nil {
+				return nil, err
+			}
+			msgs := irc.GetAPIMessagesForChatRoom(pickChannel(channel))
+			if last > 0 && last < len(msgs) {
+				msgs = msgs[len(msgs)-last:]
+			}
+			return graphQLValue("Message", prefs.localize(msgs)), nil
+		}),
+		"message": graphql.Resolver(func(args map[string]interface{}) (interface{}, error) {
+			id, err := intArg(args, "id", 0)
+			if err != nil {
+				return nil, err
+			}
+			m, ok := irc.GetMessage(id)
+			if !ok {
+				return nil, nil
+			}
+			return graphQLValue("Message", prefs.localize([]apiMessage{m})[0]), nil
+		}),
+		"users": graphql.Resolver(func(args map[string]interface{}) (interface{}, error) {
+			channel, err := stringArg(args, "channel")
+			if err != nil {
+				return nil, err
+			}
+			users := irc.UsersOfChannel(pickChannel(channel))
+			if users == nil {
+				users = []User{}
+			}
+			return graphQLValue("User", users), nil
+		}),
+		"channels": graphql.Resolver(func(args map[string]interface{}) (interface{}, error) {
+			return graphQLValue("Channel", listChannels(readMarkers(r), mutedChannels(r), "").Channels), nil
+		}),
+		"stats": graphql.Resolver(func(args map[string]interface{}) (interface{}, error) {
+			return graphQLValue("Stats", fullStatus()), nil
+		}),
+	}
+}
+
+// handlerAPIGraphQL executes the GraphQL queries of a JSON POST body, or of
+// the query parameter on GET. Subscriptions are served over a WebSocket, see
+// handlerGraphQLWebSocket.
+func handlerAPIGraphQL(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		handlerGraphQLWebSocket(w, r)
+		return
+	}
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query, req.OperationName = r.FormValue("query"), r.FormValue("operationName")
+		if variables := r.FormValue("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				http.Error(w, "invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, irc.config.MaxBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response := executeGraphQL(r, requestPrefs(w, r), req)
+	w.Header().Set("Content-Type", "application/json")
+	if response.Data == nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// executeGraphQL executes a query of the client that made r
+func executeGraphQL(r *http.Request, prefs viewPrefs, req graphQLRequest) *graphql.Response {
+	op, err := req.operation()
+	if err != nil {
+		return graphQLError(err)
+	}
+	switch op.Type {
+	case "mutation":
+		return graphQLError(errors.New("mutations are not supported, send messages with " + endPointAPIMessages))
+	case "subscription":
+		return graphQLError(errors.New("subscriptions need a WebSocket with the " + graphQLSubprotocol + " protocol"))
+	}
+	return graphql.Execute(op, req.Variables, graphQLQuery(r, prefs))
+}
+
+// handlerGraphQLWebSocket speaks graphql-transport-ws: after connection_init
+// the client subscribes to operations, whose results it gets as next
+// messages until they complete. Queries complete after their result,
+// subscriptions when the client completes them or goes away.
+func handlerGraphQLWebSocket(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	conn, err := acceptWebSocket(w, r, graphQLSubprotocol)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
+	}
+	defer conn.Close()
+	send := func(id, typ string, payload interface{}) error {
+		message := graphQLMessage{ID: id, Type: typ}
+		if payload != nil {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				return err
+			}
+			message.Payload = data
+		}
+		return writeJSON(conn, message)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(time.Duration(irc.config.WSPingIntervalSeconds) * time.Second)
+		defer ping.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ping.C:
+				conn.writeMutex.Lock()
+				err := conn.writeFrame(wsOpPing, nil)
+				conn.writeMutex.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var mutex sync.Mutex
+	subscriptions := make(map[string]chan struct{})
+	defer func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, stop := range subscriptions {
+			close(stop)
+		}
+	}()
+	acknowledged := false
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			return
+		}
+		var message graphQLMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			return
+		}
+		switch message.Type {
+		case "connection_init":
+			acknowledged = true
+			err = send("", "connection_ack", nil)
+		case "ping":
+			err = send("", "pong", nil)
+		case "pong":
+		case "subscribe":
+			if !acknowledged {
+				return
+			}
+			var req graphQLRequest
+			if jsonErr := json.Unmarshal(message.Payload, &req); jsonErr != nil {
+				err = send(message.ID, "error", graphQLError(jsonErr).Errors)
+				break
+			}
+			op, opErr := req.operation()
+			switch {
+			case opErr != nil:
+				err = send(message.ID, "error", graphQLError(opErr).Errors)
+			case op.Type == "subscription":
+				stop := make(chan struct{})
+				mutex.Lock()
+				if _, ok := subscriptions[message.ID]; ok {
+					mutex.Unlock()
+					return
+				}
+				subscriptions[message.ID] = stop
+				mutex.Unlock()
+				go func(id string) {
+					err := graphQLSubscription(op, req.Variables, prefs, stop, func(response *graphql.Response) error {
+						return send(id, "next", response)
+					})
+					mutex.Lock()
+					defer mutex.Unlock()
+					if subscriptions[id] != stop {
+						// Completed by the client
+						return
+					}
+					delete(subscriptions, id)
+					if err != nil {
+						_ = send(id, "error", graphQLError(err).Errors)
+					} else {
+						_ = send(id, "complete", nil)
+					}
+				}(message.ID)
+			default:
+				if err = send(message.ID, "next", executeGraphQL(r, prefs, req)); err == nil {
+					err = send(message.ID, "complete", nil)
+				}
+			}
+		case "complete":
+			mutex.Lock()
+			if stop, ok := subscriptions[message.ID]; ok {
+				delete(subscriptions, message.ID)
+				close(stop)
+			}
+			mutex.Unlock()
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// graphQLSubscription passes the results of a subscription to send until
+// stop is closed. It subscribes to one of:
+//
+//	messages(channel: String): Message, the new messages of a channel
+//	users(channel: String): [User], the users of a channel when they change
+func graphQLSubscription(op *graphql.Operation, variables map[string]interface{}, prefs viewPrefs, stop chan struct{}, send func(*graphql.Response) error) error {
+	if len(op.Selection) != 1 {
+		return errors.New("a subscription selects exactly one field")
+	}
+	field := op.Selection[0]
+	channel, err := stringArg(field.Args(op.Variables(variables)), "channel")
+	if err != nil {
+		return err
+	}
+	channel = pickChannel(channel)
+	result := func(value interface{}) error {
+		return send(graphql.Execute(op, variables, graphql.Object{"__typename": "Subscription", field.Name: value}))
+	}
+	// A peeked channel stays while somebody watches it
+	keepPeek := time.NewTicker(10 * time.Second)
+	defer keepPeek.Stop()
+	switch field.Name {
+	case "messages":
+		messages, first := streams.Subscribe(channel)
+		if first {
+			irc.SetAway(false)
+		}
+		defer func() {
+			if streams.Unsubscribe(messages) {
+				irc.SetAway(true)
+			}
+		}()
+		for {
+			select {
+			case <-stop:
+				return nil
+			case <-keepPeek.C:
+				peeks.Touch(channel)
+			case m := <-messages:
+				if err := result(graphQLValue("Message", prefs.localize([]apiMessage{m.toAPI()})[0])); err != nil {
+					return nil
+				}
+			}
+		}
+	case "users":
+		users := streams.WatchUsers(channel)
+		defer streams.UnwatchUsers(users)
+		for {
+			list := irc.UsersOfChannel(channel)
+			if list == nil {
+				list = []User{}
+			}
+			if err := result(graphQLValue("User", list)); err != nil {
+				return nil
+			}
+			select {
+			case <-stop:
+				return nil
+			case <-keepPeek.C:
+				peeks.Touch(channel)
+			case <-users:
+			}
+		}
+	}
+	return fmt.Errorf("unknown subscription %q", field.Name)
+}
+
+// handlerAPIPrefs returns the preferences of the logged in user on GET. PUT
+// changes the preferences in the JSON object of the body, deleting those
+// set to null, and DELETE the one named by ?key=.
+func handlerAPIPrefs(w http.ResponseWriter, r *http.Request) {
+	user, ok := prefsUser(r)
+	if !ok {
+		http.Error(w, "preferences need web-users or web-token", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var changes map[string]json.RawMessage
+		r.Body = http.MaxBytesReader(w, r.Body, irc.config.MaxBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := prefs.Set(user, changes); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if err := prefs.Set(user, map[string]json.RawMessage{key: json.RawMessage("null")}); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(prefs.Get(user))
+}
+
+// handlerAPIConfigSchema serves the JSON Schema of the config file
+func handlerAPIConfigSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	_ = json.NewEncoder(w).Encode(configSchema())
+}
+
+// handlerHealthz answers as long as the process serves requests
+func handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// handlerReadyz answers 503 Service Unavailable while we are not registered
+// on the IRC server or not in all the configured channels
+func handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	if reason := irc.Unready(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// handlerMetrics exposes the metrics in the Prometheus text format
+func handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(w)
+	connected := 0.0
+	if irc.Registered() {
+		connected = 1
+	}
+	writeMetric(w, "smirc_connected", "gauge", "Whether the IRC server has welcomed us.", map[string]float64{"": connected})
+	users := make(map[string]int64)
+	for channel, count := range irc.UserCounts() {
+		users[channel] = int64(count)
+	}
+	writeMetric(w, "smirc_channel_users", "gauge", "Users in the channels we are in.", channelSamples(users))
+	writeMetric(w, "smirc_web_viewers", "gauge", "Browsers following the channels live.", map[string]float64{"": float64(streams.Viewers())})
+	writeMetric(w, "smirc_send_queue", "gauge", "Lines waiting to be sent to the IRC server.", map[string]float64{"": float64(irc.SendQueue())})
+	writeMetric(w, "smirc_watchdog_restarts_total", "counter", "Connections the watchdog cycled because they were stuck.", map[string]float64{"": float64(watchdog.Restarts())})
+}
+
+// requireAdmin checks the bearer token of an admin API request. It writes the
+// error response and returns false when the request may not proceed.
+func requireAdmin(w http.ResponseWriter, r *http.Request, method string) bool {
+	if !irc.config.adminEnabled() {
+		http.NotFound(w, r)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	validToken := irc.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(irc.config.AdminToken)) == 1
+	if !validToken && !irc.config.adminCertificate(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	if r.Method != method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// handlerAPIRelay adds a message from a webhook or bridge to the virtual
+// channel it has the token of. The message is taken from the form or from a
+// JSON relayMessage.
+func handlerAPIRelay(w http.ResponseWriter, r *http.Request) {
+	channel, ok := irc.config.virtualChannel(r.URL.Query().Get(formKeyChannel))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(channel.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid relay token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	msg, ok := readRelayMessage(w, r, channel.Name)
+	if !ok {
+		return
+	}
+	for _, line := range msg.lines() {
+		irc.AddIncomingMessage(channel.Name, msg.Nick, line)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// readRelayMessage reads the relayMessage of a request from the form or
+// the JSON body. The nick defaults to defaultNick. Otherwise it writes an
+// error response and returns false.
+func readRelayMessage(w http.ResponseWriter, r *http.Request, defaultNick string) (relayMessage, bool) {
+	var msg relayMessage
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		r.Body = http.MaxBytesReader(w, r.Body, irc.config.MaxBodyBytes)
+		err := json.NewDecoder(r.Body).Decode(&msg)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			atomic.AddInt64(&oversizedRequests, 1)
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return msg, false
+		}
+		if err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return msg, false
+		}
+	} else {
+		if !parseLimitedForm(w, r) {
+			return msg, false
+		}
+		msg = relayMessage{Nick: r.Form.Get(formKeyNick), Message: r.Form.Get(formKeyMessage)}
+	}
+	if msg.Nick == "" {
+		msg.Nick = defaultNick
+	}
+	// A NUL cannot be sent to IRC and ends the line on some servers
+	if strings.TrimSpace(msg.Message) == "" || strings.ContainsRune(msg.Message, 0) || strings.ContainsAny(msg.Nick, " !\r\n\x00") {
+		http.Error(w, "invalid nick or message", http.StatusBadRequest)
+		return msg, false
+	}
+	return msg, true
+}
+
+// lines splits the message into its lines like a message of the web UI
+func (msg relayMessage) lines() []string {
+	return splitLines(msg.Message)
+}
+
+// handlerAPIBridge sends the message of a user of another chat network to
+// an IRC channel of the bridge whose token the request has
+func handlerAPIBridge(w http.ResponseWriter, r *http.Request) {
+	bridge, ok := irc.config.bridge(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid bridge token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel := ""
+	for _, c := range bridge.Channels {
+		if strings.EqualFold(c, r.URL.Query().Get(formKeyChannel)) {
+			channel = c
+		}
+	}
+	if channel == "" {
+		http.Error(w, "the bridge may not post to this channel", http.StatusForbidden)
+		return
+	}
+	msg, ok := readRelayMessage(w, r, bridge.Name)
+	if !ok {
+		return
+	}
+	for _, line := range msg.lines() {
+		if err := irc.SendBridged(bridge, channel, msg.Nick, line); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// requireOper writes an error response and returns false when we are not an
+// IRC operator, so oper commands would be refused by the server anyway
+func requireOper(w http.ResponseWriter) bool {
+	if !irc.IsOper() {
+		http.Error(w, "not an IRC operator", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func handlerAPIAdminKill(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, http.MethodPost) || !requireOper(w) {
+		return
+	}
+	nick, reason := r.FormValue(formKeyNick), r.FormValue(formKeyReason)
+	if nick == "" || strings.ContainsAny(nick, " \r\n") || strings.ContainsAny(reason, "\r\n") {
+		http.Error(w, "invalid nick or reason", http.StatusBadRequest)
+		return
+	}
+	log.Printf(">> KILL %s :%s\n\n", nick, reason)
+	_, _ = fmt.Fprintf(irc, "KILL %s :%s\r\n", nick, reason)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handlerAPIAdminRehash(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, http.MethodPost) || !requireOper(w) {
+		return
+	}
+	log.Printf(">> REHASH\n\n")
+	_, _ = fmt.Fprintf(irc, "REHASH\r\n")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerAPIAdminModerate redacts (/admin/redact), masks (/admin/mask) or
+// annotates (/admin/annotate) the message with the given id, keeping the
+// original in the audit log
+func handlerAPIAdminModerate(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, http.MethodPost) {
+		return
+	}
+	action := moderationRedact
+	switch r.URL.Path {
+	case endPointAPIAdminAnnotate:
+		action = moderationAnnotate
+	case endPointAPIAdminMask:
+		action = moderationMask
+	}
+	id, err := strconv.Atoi(r.FormValue(formKeyMessageID))
+	note := strings.TrimSpace(r.FormValue(formKeyNote))
+	if err != nil || (action == moderationAnnotate && note == "") {
+		http.Error(w, "invalid id or note", http.StatusBadRequest)
+		return
+	}
+	original, ok := irc.Moderate(id, action, note)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	moderation.Add(moderationEntry{
+		MessageID: id,
+		Action:    action,
+		Original:  original.message,
+		Author:    original.source(),
+		Note:      note,
+		Client:    clientAddress(r),
+		Time:      time.Now(),
+	})
+	log.Printf("Message %d: %s by %s", id, action, clientAddress(r))
+	if m, ok := irc.GetMessage(id); ok {
+		bookmarks.Update(m)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(m)
+	}
+}
+
+// nickExport is everything stored about a nick, for data subject access
+// requests
+type nickExport struct {
+	Nick       string            `json:"nick"`
+	Exported   time.Time         `json:"exported"`
+	Users      []User            `json:"users"`
+	Messages   []apiMessage      `json:"messages"`
+	Bookmarks  []apiMessage      `json:"bookmarks"`
+	Pastes     []Paste           `json:"pastes"`
+	Moderation []moderationEntry `json:"moderation"`
+	Deletions  []deletionEntry   `json:"deletions"`
+}
+
+// exportNick collects everything stored about nick. As for purgeNick,
+// pastes are only attributed to our own nick.
+func exportNick(nick string) nickExport {
+	export := nickExport{
+		Nick:       nick,
+		Exported:   time.Now(),
+		Users:      irc.UsersNamed(nick),
+		Messages:   irc.MessagesSaidBy(nick),
+		Bookmarks:  []apiMessage{},
+		Pastes:     []Paste{},
+		Moderation: []moderationEntry{},
+		Deletions:  []deletionEntry{},
+	}
+	said := make(map[int]bool)
+	for _, m := range export.Messages {
+		said[m.ID] = true
+	}
+	for _, m := range bookmarks.All() {
+		if strings.EqualFold(m.Nick, nick) {
+			export.Bookmarks = append(export.Bookmarks, m)
+		}
+	}
+	if strings.EqualFold(nick, irc.Nick()) || strings.EqualFold(nick, envVarNickName) {
+		export.Pastes = pastes.List()
+	}
+	for _, entry := range moderation.List() {
+		if said[entry.MessageID] {
+			export.Moderation = append(export.Moderation, entry)
+		}
+	}
+	for _, entry := range deletions.List() {
+		if strings.EqualFold(entry.Nick, nick) {
+			export.Deletions = append(export.Deletions, entry)
+		}
+	}
+	return export
+}
+
+func handlerAPIAdminExport(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, http.MethodGet) {
+		return
+	}
+	nick := r.FormValue(formKeyNick)
+	if nick == "" || strings.ContainsAny(nick, " \r\n") {
+		http.Error(w, "invalid nick", http.StatusBadRequest)
+		return
+	}
+	export := exportNick(nick)
+	if pseudonymize, _ := strconv.ParseBool(r.FormValue(formKeyPseudonymize)); pseudonymize {
+		pseudonymizeExport(&export)
+	}
+	log.Printf("Exported the data of %s", nick)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="smirc-export.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(export)
+}
+
+// pseudonymizeExport replaces the nick of an export with its pseudonym,
+// along with the nicks of the users we know of where the messages mention
+// them, and leaves out the hosts it was seen from, raw lines included
+func pseudonymizeExport(export *nickExport) {
+	names := map[string]string{strings.ToLower(export.Nick): pseudonym(export.Nick)}
+	for _, channel := range irc.Channels() {
+		for _, u := range irc.UsersOfChannel(channel) {
+			names[strings.ToLower(u.Nickname)] = pseudonym(u.Nickname)
+		}
+	}
+	export.Nick = pseudonym(export.Nick)
+	for i := range export.Users {
+		u := &export.Users[i]
+		u.Nickname, u.Username, u.Hostname, u.Server = pseudonym(u.Nickname), "", "", ""
+	}
+	pseudonymizeMessages := func(msgs []apiMessage) []apiMessage {
+		kept := []apiMessage{}
+		for _, m := range msgs {
+			if m.Channel == "" {
+				continue
+			}
+			m.Nick, m.Message, m.Hostmask = pseudonym(m.Nick), replaceNicks(m.Message, names), ""
+			kept = append(kept, m)
+		}
+		return kept
+	}
+	export.Messages = pseudonymizeMessages(export.Messages)
+	export.Bookmarks = pseudonymizeMessages(export.Bookmarks)
+	for i := range export.Moderation {
+		entry := &export.Moderation[i]
+		entry.Author, entry.Original = pseudonym(entry.Author), replaceNicks(entry.Original, names)
+	}
+	for i := range export.Deletions {
+		export.Deletions[i].Nick = pseudonym(export.Deletions[i].Nick)
+	}
+}
+
+// handlerAPIAdminPurge deletes all data about a nick, e.g. on a GDPR request
+func handlerAPIAdminPurge(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, http.MethodPost) {
+		return
+	}
+	nick := r.FormValue(formKeyNick)
+	if nick == "" || strings.ContainsAny(nick, " \r\n") {
+		http.Error(w, "invalid nick", http.StatusBadRequest)
+		return
+	}
+	entry := purgeNick(nick)
+	log.Printf("Purged %s: %d messages, %d bookmarks, %d pastes", nick, entry.Messages, entry.Bookmarks, entry.Pastes)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+func handlerAPIAdminDeletions(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(deletions.List())
+}
+
+// handlerAPIAdminGuests lists the guests and their mutes, or lifts the mute
+// of the client given with DELETE
+func handlerAPIAdminGuests(w http.ResponseWriter, r *http.Request) {
+	method := http.MethodGet
+	if r.Method == http.MethodDelete {
+		method = http.MethodDelete
+	}
+	if !requireAdmin(w, r, method) {
+		return
+	}
+	if method == http.MethodDelete {
+		client := r.FormValue(formKeyClient)
+		if !guests.Pardon(client) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Guest %s pardoned by %s", client, clientAddress(r))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(guests.List())
+}
+
+// configChange is the answer to an edited config: whether it is valid,
+// how it differs from the config file and, once applied, what needs a
+// restart
+type configChange struct {
+	Valid   bool     `json:"valid"`
+	Errors  []string `json:"errors,omitempty"`
+	Diff    string   `json:"diff"`
+	Applied bool     `json:"applied"`
+	Restart []string `json:"restart,omitempty"`
+}
+
+// readConfigFile returns the config file as formatted JSON, keys in order,
+// with the secrets redacted or not
+func readConfigFile(redact bool) (map[string]interface{}, string, error) {
+	data, err := os.ReadFile(envVarConfigFileName)
+	if err != nil {
+		return nil, "", err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, "", err
+	}
+	return values, formatConfig(values, redact), nil
+}
+
+// formatConfig formats config values as they are written to the file
+func formatConfig(values map[string]interface{}, redact bool) string {
+	if redact {
+		copied := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			copied[key] = value
+		}
+		for _, key := range secretConfigKeys {
+			if value, ok := copied[key].(string); ok && value != "" {
+				copied[key] = "<redacted>"
+			}
+		}
+		values = copied
+	}
+	var b strings.Builder
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(values)
+	return b.String()
+}
+
+// writeFileAtomic replaces a file with data such that readers see either the
+// old or the new content, keeping its permissions
+func writeFileAtomic(fileName string, data []byte) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
+
+// lineDiff shows how b differs from a, line by line: removed lines start
+// with "-", added ones with "+", and two lines of context around changes
+// with " "
+func lineDiff(a, b string) string {
+	x, y := strings.Split(strings.TrimSuffix(a, "\n"), "\n"), strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	// lcs[i][j] is the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var lines []string
+	for i, j := 0, 0; i < len(x) || j < len(y); {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, " "+x[i]+"\n")
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+x[i]+"\n")
+			i++
+		default:
+			lines = append(lines, "+"+y[j]+"\n")
+			j++
+		}
+	}
+	const context = 2
+	var out strings.Builder
+	skipped := false
+	for i, line := range lines {
+		near := false
+		for k := i - context; k <= i+context && !near; k++ {
+			near = k >= 0 && k < len(lines) && lines[k][0] != ' '
+		}
+		if !near {
+			skipped = true
+			continue
+		}
+		if skipped && out.Len() > 0 {
+			out.WriteString("...\n")
+		}
+		skipped = false
+		out.WriteString(line)
+	}
+	return out.String()
+}
+
+// handlerAPIAdminConfig returns the config file on GET, with the secrets
+// redacted. On POST it checks the edited config in the body against the
+// schema and shows the differences; unless dry-run is set it then writes
+// the file and applies the config. Secrets left "<redacted>" are kept.
+func handlerAPIAdminConfig(w http.ResponseWriter, r *http.Request) {
+	method := http.MethodGet
+	if r.Method == http.MethodPost {
+		method = http.MethodPost
+	}
+	if !requireAdmin(w, r, method) {
+		return
+	}
+	current, shown, err := readConfigFile(true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if method == http.MethodGet {
+		_ = json.NewEncoder(w).Encode(map[string]string{"file": envVarConfigFileName, "config": shown})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, irc.config.MaxBodyBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var change configChange
+	var edited map[string]interface{}
+	if err := json.Unmarshal(body, &edited); err != nil {
+		change.Errors = []string{err.Error()}
+		_ = json.NewEncoder(w).Encode(change)
+		return
+	}
+	change.Diff = lineDiff(shown, formatConfig(edited, true))
+	for _, key := range secretConfigKeys {
+		if edited[key] == "<redacted>" {
+			edited[key] = current[key]
+		}
+	}
+	data := []byte(formatConfig(edited, false))
+	config, err := parseConfig(data)
+	if err == nil {
+		_, err = parseTemplates(config.Templates)
+	}
+	if err == nil {
+		_, err = parseUITemplates(config.UITemplatesDir)
+	}
+	if err == nil {
+		var css map[string][]byte
+		if css, err = parseThemes(config.ThemesDir); err == nil && css[config.Theme] == nil {
+			err = fmt.Errorf("unknown theme %q", config.Theme)
+		}
+	}
+	if err != nil {
+		change.Errors = strings.Split(err.Error(), "; ")
+		_ = json.NewEncoder(w).Encode(change)
+		return
+	}
+	change.Valid = true
+	if r.FormValue("dry-run") == "true" {
+		_ = json.NewEncoder(w).Encode(change)
+		return
+	}
+	if err := writeFileAtomic(envVarConfigFileName, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if change.Restart, err = irc.Reconfigure(config); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	change.Applied = true
+	log.Printf("Config edited by %s", clientAddress(r))
+	fmt.Printf("Config: %+v\n", config.redacted())
+	_ = json.NewEncoder(w).Encode(change)
+}
+
+// handlerAdminConfig is the page to edit the config in the browser with the
+// admin API. It asks for the admin token unless a client certificate does.
+func handlerAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if !irc.config.adminEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	apiPath, _ := json.Marshal(endPointAPIAdminConfig)
+	_, _ = fmt.Fprint(w, `<!doctype html><html lang="en">
+	<head><title>smirc: config</title></head><body><main>
+      <h1>Config</h1>
+      <p><label for="token">Admin token</label> <input type="password" id="token" autocomplete="off" />
+        <button type="button" id="load">Load</button></p>
+      <p id="file"></p>
+      <textarea id="config" rows="30" cols="100" spellcheck="false" aria-label="Config"></textarea>
+      <p><button type="button" id="check">Check</button> <button type="button" id="apply">Apply</button></p>
+      <p id="result" role="status"></p>
+      <pre id="diff"></pre>
+      <script>
+(function () {
+  var $ = function (id) { return document.getElementById(id); }, api = `+string(apiPath)+`;
+  $("token").value = sessionStorage.getItem("admin-token") || "";
+  var call = function (method, query, body) {
+    sessionStorage.setItem("admin-token", $("token").value);
+    var headers = $("token").value ? {Authorization: "Bearer " + $("token").value} : {};
+    return fetch(api + query, {method: method, headers: headers, body: body}).then(function (res) {
+      if (!res.ok) return res.text().then(function (text) { throw new Error(text); });
+      return res.json();
+    });
+  };
+  var show = function (text) { $("result").textContent = text; };
+  $("load").onclick = function () {
+    call("GET", "").then(function (c) {
+      $("file").textContent = c.file;
+      $("config").value = c.config;
+      $("diff").textContent = "";
+      show("Secrets are shown as <redacted> and kept unless you replace them.");
+    }, function (err) { show(err.message); });
+  };
+  var submit = function (dryRun) {
+    call("POST", dryRun ? "?dry-run=true" : "", $("config").value).then(function (c) {
+      $("diff").textContent = c.diff || "";
+      if (!c.valid) { show("Invalid: " + c.errors.join("; ")); return; }
+      if (!c.applied) { show(c.diff ? "Valid. Apply to save these changes." : "Valid, nothing changed."); return; }
+      show("Applied and saved." + (c.restart ? " A restart is needed for: " + c.restart.join(", ") : ""));
+    }, function (err) { show(err.message); });
+  };
+  $("check").onclick = function () { submit(true); };
+  $("apply").onclick = function () { submit(false); };
+  if ($("token").value) $("load").onclick();
+})();
+      </script>
+    </main></body></html>`)
+}
+
+// handlerAPIAdminHooks lists the latest hook deliveries on GET. POST
+// delivers the one with ?id= again, once and with the same payload, and
+// returns the new delivery.
+func handlerAPIAdminHooks(w http.ResponseWriter, r *http.Request) {
+	method := http.MethodGet
+	if r.Method == http.MethodPost {
+		method = http.MethodPost
+	}
+	if !requireAdmin(w, r, method) {
+		return
+	}
+	if method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(hookDeliveries.List())
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue(formKeyDeliveryID))
+	d, ok := hookDeliveries.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Hook delivery %d redelivered by %s", id, clientAddress(r))
+	redelivered := d.hook.deliver(d.webhook, d.event, d.Payload, 0, d.ID)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(redelivered)
+}
+
+// handlerAPIAdminDeadLetters lists the hook deliveries that failed for good
+// on GET. POST retries the one with ?id= once, forgetting it if that worked,
+// and returns the delivery. DELETE purges the one with ?id=, or all of them.
+func handlerAPIAdminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	method := http.MethodGet
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		method = r.Method
+	}
+	if !requireAdmin(w, r, method) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch method {
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(deadLetters.List())
+		return
+	case http.MethodDelete:
+		id, _ := strconv.Atoi(r.FormValue(formKeyDeliveryID))
+		purged := deadLetters.DeleteWhere(func(l deadLetter) bool { return id == 0 || l.ID == id })
+		if id != 0 && purged == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("%d dead letters purged by %s", purged, clientAddress(r))
+		_ = json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue(formKeyDeliveryID))
+	letter, ok := deadLetters.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Dead letter %d retried by %s", id, clientAddress(r))
+	_ = json.NewEncoder(w).Encode(deadLetters.Retry(letter))
+}
+
+// adminHooksPage is the data of the admin-hooks.html template, the API
+// endpoints its script calls
+type adminHooksPage struct {
+	APIPath         string
+	DeadLettersPath string
+}
+
+// handlerAdminHooks shows the hook deliveries with a button to deliver each
+// again, and the dead letters with buttons to retry or purge them
+func handlerAdminHooks(w http.ResponseWriter, r *http.Request) {
+	if !irc.config.adminEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	renderPage(w, "admin-hooks.html", adminHooksPage{APIPath: endPointAPIAdminHooks, DeadLettersPath: endPointAPIAdminDeadLetters})
+}
+
+// handlerDebugInject breaks things on purpose: it drops the connection to
+// the server, delays what is read from it, feeds it a line as if the server
+// had sent it, or floods the send queue
+func handlerDebugInject(w http.ResponseWriter, r *http.Request) {
+	if !irc.config.DebugInject {
+		http.NotFound(w, r)
+		return
+	}
+	if !requireAdmin(w, r, http.MethodPost) {
+		return
+	}
+	action := r.FormValue(formKeyAction)
+	result := map[string]interface{}{"action": action}
+	switch action {
+	case chaosDisconnect:
+		irc.connMutex.Lock()
+		client := irc.client
+		irc.connMutex.Unlock()
+		if client == nil {
+			http.Error(w, ircclient.ErrNotConnected.Error(), errorStatus(ircclient.ErrNotConnected))
+			return
+		}
+		_ = client.Close()
+	case chaosLag:
+		// Every line is held up by the lag, for three times as long
+		seconds, err := strconv.Atoi(r.FormValue(formKeySeconds))
+		if err != nil || seconds <= 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		lag := time.Duration(seconds) * time.Second
+		chaos.StartLag(lag, 3*lag)
+	case chaosLine:
+		line := r.FormValue(formKeyLine)
+		if panicked := injectLine(line); panicked != nil {
+			result["panic"] = fmt.Sprint(panicked)
+		}
+	case chaosFlood:
+		lines, err := strconv.Atoi(r.FormValue(formKeyLines))
+		if err != nil || lines <= 0 {
+			http.Error(w, "invalid lines", http.StatusBadRequest)
+			return
+		}
+		queued := 0
+		for i := 0; i < lines; i++ {
+			if _, err := fmt.Fprintf(irc, "PING :flood-%d\r\n", i); err == nil {
+				queued++
+			}
+		}
+		result["queued"], result["dropped"] = queued, lines-queued
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Injected %s from %s", action, clientAddress(r))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// injectLine handles line as if the server had sent it and returns what the
+// handlers panicked with, if they did
+func injectLine(line string) (panicked interface{}) {
+	defer func() {
+		if panicked = recover(); panicked != nil {
+			log.Printf("Handling injected line %q panicked: %v", line, panicked)
+		}
+	}()
+	irc.receive(line + "\r\n")
+	return nil
+}
+
+// handlerAPIAdminReports lists the reports, optionally only those with the
+// status parameter, on GET and sets the status of the report picked with
+// the id parameter on POST
+func handlerAPIAdminReports(w http.ResponseWriter, r *http.Request) {
+	method := http.MethodGet
+	if r.Method == http.MethodPost {
+		method = http.MethodPost
+	}
+	if !requireAdmin(w, r, method) {
+		return
+	}
+	status := r.FormValue(formKeyStatus)
+	if method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(reports.List(status))
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue(formKeyMessageID))
+	if err != nil || (status != reportOpen && status != reportResolved && status != reportDismissed) {
+		http.Error(w, "invalid id or status", http.StatusBadRequest)
+		return
+	}
+	updated, ok := reports.SetStatus(id, status, strings.TrimSpace(r.FormValue(formKeyNote)))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Report %d %s by %s", id, status, clientAddress(r))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(updated)
+}
+
+func handlerAPIAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(moderation.List())
+}
+
+// handlerAPIRegisterChannel starts registering the channel with ChanServ on
+// POST and reports how the last registration went on GET
+func handlerAPIRegisterChannel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		if !irc.Identified() {
+			http.Error(w, "not identified to services", http.StatusConflict)
+			return
+		}
+		if err := registration.Start(requestChannel(r), r.FormValue(formKeyDescription)); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+	state := registration.State()
+	_ = json.NewEncoder(w).Encode(&state)
+}
+
+// handlerRegisterChannel walks through registering the channel with ChanServ
+func handlerRegisterChannel(w http.ResponseWriter, r *http.Request) {
+	channel := requestChannel(r)
+	if r.Method == http.MethodPost {
+		if irc.Identified() {
+			if err := registration.Start(channel, r.FormValue(formKeyDescription)); err != nil {
+				log.Printf("Error: %s", err)
+			}
+		}
+		http.Redirect(w, r, channelURL(endPointRegisterChannel, channel), 302)
+		return
+	}
+
+	lang := requestLanguage(w, r)
+	state := registration.State()
+	refresh, body := "", ""
+	if irc.Identified() {
+		body = `<p>` + tr(lang, uiIdentified) + `</p>
+      <form method="post" action="` + endPointRegisterChannel + `">
+        ` + channelInput(channel) + csrfInput(csrfToken(w, r)) + `
+        <label for="` + formKeyDescription + `">` + tr(lang, uiDescription) + `</label>
+        <input type="text" id="` + formKeyDescription + `" name="` + formKeyDescription + `" />
+        <input type="submit" value="` + tr(lang, uiRegister) + `" />
+      </form>`
+	} else {
+		body = `<p>` + tr(lang, uiNotIdentified) + `</p>`
+	}
+	if state.Channel != "" {
+		statusText := map[string]string{
+			registrationPending:    uiRegPending,
+			registrationRegistered: uiRegDone,
+			registrationFailed:     uiRegFailed,
+			registrationTimedOut:   uiRegTimeout,
+		}[state.Status]
+		body += `<p role="status"><strong>` + html.EscapeString(state.Channel) + `:</strong> ` + tr(lang, statusText) + `</p>`
+		if state.Reply != "" {
+			body += `<blockquote>` + html.EscapeString(state.Reply) + `</blockquote>`
+		}
+		if state.Status == registrationPending {
+			refresh = `<meta http-equiv="refresh" content="2">`
+		}
+	}
+	content := `<!doctype html><html itemscope="" itemtype="http://schema.org/WebPage" lang="` + lang + `">
+	<head><title>` + tr(lang, uiRegister) + `</title>` + pageHead(requestTheme(w, r)) + refresh + `</head>
+    <body><main><h1>` + html.EscapeString(fmt.Sprintf(tr(lang, uiRegisterWith), channel, irc.config.ChanServNick)) + `</h1>
+      ` + body + `
+      <p><a href="` + channelURL("/", channel) + `">` + tr(lang, uiTitleIndex) + `</a></p></main></body></html>`
+	_, _ = fmt.Fprintf(w, "%s", content)
+}
+
+// liveMessagesScript shows the messages of the index page, the last one
+// being lastID, and appends new ones as they arrive on /ws, keeping the
+// user list and the topic up to date as well. A lost connection is resumed
+// from the last message received. When WebSockets do not get through, e.g.
+// because of a proxy, it falls back to /events and sends with a plain POST.
+// Without Javascript the page falls back to the refreshing iframes instead.
+// Alt+Up and Alt+Down switch to the previous and next channel, with Shift
+// to the previous and next one with unread messages. A nick clicked in the
+// user list shows its WHOIS below the list.
+func liveMessagesScript(channel string, lastID int) string {
+	wsPath, _ := json.Marshal(channelURL(endPointWebSocket, channel) + "&" + formKeyLastID + "=")
+	eventsPath, _ := json.Marshal(channelURL(endPointEvents, channel) + "&" + formKeyLastID + "=")
+	channelsPath, _ := json.Marshal(channelURL(endPointAPIChannels, channel))
+	return `
+(function () {
+  var live = document.getElementById("live"), list = live.firstChild, users = document.getElementById("users"), topic = document.getElementById("topic");
+  if ("serviceWorker" in navigator) navigator.serviceWorker.register("` + endPointServiceWorker + `");
+  live.style.display = "block";
+  live.scrollTop = live.scrollHeight;
+  if (users) users.style.display = "block";
+  // Messages we send are shown right away and replaced once acknowledged
+  var form = document.getElementById("send"), seen = {}, pending = {}, next = 0, lastID = ` + strconv.Itoa(lastID) + `, ws, events, opened = false;
+  var listen = function () {
+    if (!window.EventSource) { setTimeout(function () { location.reload(); }, 2000); return; }
+    events = new EventSource(` + string(eventsPath) + ` + lastID);
+    events.onmessage = receive;
+    events.addEventListener("users", receive);
+  };
+  var connect = function () {
+    if (!window.WebSocket) { listen(); return; }
+    ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + ` + string(wsPath) + ` + lastID);
+    ws.onopen = function () { opened = true; };
+    ws.onmessage = receive;
+    ws.onclose = function () {
+      for (var id in pending) {
+        pending[id].style.color = "red";
+        delete pending[id];
+      }
+      // A WebSocket that never opened is not getting through
+      if (opened) setTimeout(connect, 2000); else listen();
+    };
+  };
+  var receive = function (e) {
+    var ev = JSON.parse(e.data), li = pending[ev.id];
+    if (ev.type === "users") {
+      if (users) users.lastChild.innerHTML = ev.html;
+      topic.textContent = ev.topic;
+      topic.hidden = !ev.topic;
+      return;
+    }
+    if (ev.type === "message") {
+      lastID = Math.max(lastID, ev.id);
+      if (seen[ev.id]) return;
+      seen[ev.id] = true;
+      list.insertAdjacentHTML("beforeend", ev.html);
+      markRead();
+    } else if (li && ev.type === "ack") {
+      delete pending[ev.id];
+      var shown = ev["message-ids"].every(function (id) { return seen[id]; });
+      ev["message-ids"].forEach(function (id) { seen[id] = true; });
+      if (shown) li.remove(); else li.outerHTML = ev.html;
+    } else if (li) {
+      delete pending[ev.id];
+      li.style.color = "red";
+      li.title = ev.error;
+    }
+    live.scrollTop = live.scrollHeight;
+  };
+  var failed = function (li, error) {
+    li.style.color = "red";
+    li.title = error;
+  };
+  if (form) form.onsubmit = function (e) {
+    var text = form.elements.message.value;
+    var viaWS = ws && ws.readyState === 1, viaPost = !viaWS && events && window.fetch;
+    if (!(viaWS || viaPost) || !text.trim() || (e.submitter && e.submitter.hasAttribute("formaction"))) return;
+    e.preventDefault();
+    var id = "c" + (++next), li = document.createElement("li");
+    li.style.opacity = 0.5;
+    li.textContent = text;
+    list.appendChild(li);
+    if (viaWS) {
+      pending[id] = li;
+      ws.send(JSON.stringify({type: "send", id: id, message: text}));
+    } else {
+      // The message comes back on /events
+      fetch(form.action, {method: "POST", body: new URLSearchParams(new FormData(form))}).then(function (res) {
+        if (res.ok) li.remove(); else res.text().then(function (error) { failed(li, error); });
+      }, function (err) { failed(li, String(err)); });
+    }
+    form.elements.message.value = "";
+    live.scrollTop = live.scrollHeight;
+  };
+  // Messages arriving while the page is in view are read
+  var marking;
+  var markRead = function () {
+    if (document.hidden || marking || !window.fetch) return;
+    marking = setTimeout(function () {
+      marking = null;
+      fetch(` + string(channelsPath) + ` + "&read-id=" + lastID, {method: "POST"});
+    }, 1000);
+  };
+  document.addEventListener("visibilitychange", markRead);
+  if (users && window.fetch && window.DOMParser) users.onclick = function (e) {
+    var a = e.target.closest("a");
+    if (!a || e.ctrlKey || e.metaKey || e.shiftKey) return;
+    e.preventDefault();
+    fetch(a.href).then(function (res) { return res.text(); }).then(function (page) {
+      var main = new DOMParser().parseFromString(page, "text/html").querySelector("main"), old = document.getElementById("whois");
+      var whois = document.createElement("section");
+      whois.id = "whois";
+      // Without the link back to the index
+      main.lastElementChild.remove();
+      while (main.firstChild) whois.appendChild(main.firstChild);
+      if (old) old.replaceWith(whois); else users.after(whois);
+    });
+  };
+  // Search results are shown below the search form, the text searched for
+  // marked
+  var search = document.getElementById("search");
+  if (search && window.fetch) search.onsubmit = function (e) {
+    e.preventDefault();
+    var params = new URLSearchParams(new FormData(search)), q = search.elements.q.value.trim();
+    var re = q && new RegExp(q.replace(/[.*+?^${}()|[\]\\]/g, "\\$&"), "ig");
+    fetch(search.dataset.api + "?" + params).then(function (res) { return res.json(); }).then(function (found) {
+      var old = document.getElementById("search-results"), results = document.createElement(found.length ? "ol" : "p");
+      results.id = "search-results";
+      results.style.cssText = "list-style:none;margin:0;padding:0";
+      if (!found.length) results.textContent = search.dataset.none;
+      found.forEach(function (m) {
+        var li = document.createElement("li"), channel = document.createElement("a"), nick = document.createElement("b"), context = document.createElement("a");
+        var add = function (node) { li.appendChild(typeof node === "string" ? document.createTextNode(node) : node); };
+        channel.href = "/?channel=" + encodeURIComponent(m.channel);
+        channel.textContent = m.channel;
+        nick.textContent = m.nick;
+        nick.title = m.hostmask || m.nick;
+        add("[" + m.timestamp + "] ");
+        add(channel);
+        add(" ");
+        add(nick);
+        add(": ");
+        var at = 0, match;
+        while (re && (match = re.exec(m.message))) {
+          var mark = document.createElement("mark");
+          mark.textContent = match[0];
+          add(m.message.slice(at, match.index));
+          add(mark);
+          at = re.lastIndex;
+        }
+        add(m.message.slice(at) + " ");
+        context.href = m["context-url"];
+        context.textContent = search.dataset.context;
+        add(context);
+        results.appendChild(li);
+      });
+      if (old) old.replaceWith(results); else search.after(results);
+    });
+  };
+  document.addEventListener("keydown", function (e) {
+    if (!e.altKey || e.ctrlKey || e.metaKey || (e.key !== "ArrowUp" && e.key !== "ArrowDown") || !window.fetch) return;
+    e.preventDefault();
+    var up = e.key === "ArrowUp";
+    fetch(` + string(channelsPath) + `).then(function (res) { return res.json(); }).then(function (list) {
+      var to = e.shiftKey ? list[up ? "previous-unread" : "next-unread"] : list[up ? "previous" : "next"];
+      list.channels.forEach(function (channel) {
+        if (channel.name === to) location.href = channel.url;
+      });
+    });
+  });
+  connect();
+})();`
+}
+
+// channelLinks lets the user switch between the channels, the virtual ones
+// and the server buffer included, counting the unread messages of each.
+// Muted channels are collapsed at the end.
+func channelLinks(list channelList, lang string) string {
+	if len(list.Channels) < 2 {
+		return ""
+	}
+	var links, muted []string
+	for _, channel := range list.Channels {
+		link := `<strong aria-current="page">` + html.EscapeString(channel.Name) + `</strong>`
+		if channel.Name != list.Current {
+			link = `<a href="` + html.EscapeString(channel.URL) + `">` + html.EscapeString(channel.Name) + `</a>`
+			if channel.Unread > 0 {
+				link += fmt.Sprintf(" (%d)", channel.Unread)
+			}
+		}
+		if channel.Muted {
+			muted = append(muted, link)
+		} else {
+			links = append(links, link)
+		}
+	}
+	nav := `<nav><p>` + strings.Join(links, " | ") + `</p>`
+	if len(muted) > 0 {
+		nav += `<details><summary>` + tr(lang, uiMuted) + fmt.Sprintf(" (%d)", len(muted)) + `</summary><p>` + strings.Join(muted, " | ") + `</p></details>`
+	}
+	return nav + `</nav>`
+}
+
+// webChannels are the channels the web UI shows: the IRC channels, the
+// virtual ones and the server buffer
+func webChannels() []string {
+	channels := irc.Channels()
+	for _, channel := range irc.config.VirtualChannels {
+		channels = append(channels, channel.Name)
+	}
+	return append(channels, serverBuffer)
+}
+
+// channelInfo is what /api/v1/channels tells about a channel. ReadID is
+// the last message the client has seen, Unread counts the newer ones unless
+// the client muted the channel.
+type channelInfo struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	LastID int    `json:"last-id"`
+	ReadID int    `json:"read-id"`
+	Unread int    `json:"unread"`
+	Muted  bool   `json:"muted"`
+	Topic  string `json:"topic,omitempty"`
+	// Modes is the mode string of the channel, e.g. "+nt"
+	Modes string `json:"modes,omitempty"`
+}
+
+// channelList lists the channels for keyboard navigation: the ones before
+// and after Current, wrapping around, and the nearest ones with unread
+// messages in either direction
+type channelList struct {
+	Channels       []channelInfo `json:"channels"`
+	Current        string        `json:"current"`
+	Previous       string        `json:"previous,omitempty"`
+	Next           string        `json:"next,omitempty"`
+	PreviousUnread string        `json:"previous-unread,omitempty"`
+	NextUnread     string        `json:"next-unread,omitempty"`
+}
+
+// listChannels returns the channels with the read markers and muted
+// channels of a client, current being the one it shows
+func listChannels(markers map[string]int, muted map[string]bool, current string) channelList {
+	list := channelList{Current: current}
+	at := -1
+	for i, name := range webChannels() {
+		info := channelInfo{Name: name, URL: channelURL("/", name), ReadID: markers[name], Muted: muted[name]}
+		if topic, ok := irc.Topic(name); ok {
+			info.Topic = topic.Text
+		}
+		info.Modes = irc.ChannelModes(name)
+		for _, m := range irc.messagesForChatRoom(name) {
+			info.LastID = m.id
+			if m.id > info.ReadID && !info.Muted {
+				info.Unread++
+			}
+		}
+		if name == current {
+			at = i
+		}
+		list.Channels = append(list.Channels, info)
+	}
+	n := len(list.Channels)
+	if at < 0 || n < 2 {
+		return list
+	}
+	list.Previous, list.Next = list.Channels[(at+n-1)%n].Name, list.Channels[(at+1)%n].Name
+	for step := 1; step < n; step++ {
+		if next := list.Channels[(at+step)%n]; list.NextUnread == "" && next.Unread > 0 {
+			list.NextUnread = next.Name
+		}
+		if previous := list.Channels[(at+n-step)%n]; list.PreviousUnread == "" && previous.Unread > 0 {
+			list.PreviousUnread = previous.Name
+		}
+	}
+	return list
+}
+
+// readMarkers returns the last message read in every channel by the client
+// that made r: from the preferences of logged in users, from a cookie for
+// the others
+func readMarkers(r *http.Request) map[string]int {
+	markers := make(map[string]int)
+	if user, ok := prefsUser(r); ok {
+		if value, ok := prefs.Get(user)[prefReadMarkers]; ok {
+			_ = json.Unmarshal(value, &markers)
+		}
+		return markers
+	}
+	cookie, err := r.Cookie(cookieKeyRead)
+	if err != nil {
+		return markers
+	}
+	values, _ := url.ParseQuery(cookie.Value)
+	for channel := range values {
+		if id, err := strconv.Atoi(values.Get(channel)); err == nil {
+			markers[channel] = id
+		}
+	}
+	return markers
+}
+
+// mutedChannels returns the channels the user that made r muted with the
+// muted-channels preference. smirc still records their messages, it only
+// stops counting them as unread and raising the keywords of the user.
+func mutedChannels(r *http.Request) map[string]bool {
+	user, ok := prefsUser(r)
+	if !ok {
+		return make(map[string]bool)
+	}
+	return userMutedChannels(user)
+}
+
+// userMutedChannels are the channels user muted
+func userMutedChannels(user string) map[string]bool {
+	muted := make(map[string]bool)
+	var channels []string
+	if value, ok := prefs.Get(user)[prefMutedChannels]; ok {
+		_ = json.Unmarshal(value, &channels)
+	}
+	for _, channel := range channels {
+		muted[channel] = true
+	}
+	return muted
+}
+
+// markRead moves the read marker of channel forward to id for the client
+// that made r and returns all its markers
+func markRead(w http.ResponseWriter, r *http.Request, channel string, id int) map[string]int {
+	markers := readMarkers(r)
+	if id <= markers[channel] {
+		return markers
+	}
+	markers[channel] = id
+	if user, ok := prefsUser(r); ok {
+		data, _ := json.Marshal(markers)
+		if err := prefs.Set(user, map[string]json.RawMessage{prefReadMarkers: data}); err != nil {
+			log.Printf("Error: %s", err)
+		}
+		return markers
+	}
+	values := url.Values{}
+	for name, id := range markers {
+		values.Set(name, strconv.Itoa(id))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieKeyRead,
+		Value:    values.Encode(),
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return markers
+}
+
+// handlerAPIChannels lists the channels with their unread messages on GET,
+// see channelList. POST marks the channel read up to ?read-id=, or up to
+// its last message.
+func handlerAPIChannels(w http.ResponseWriter, r *http.Request) {
+	channel := requestChannel(r)
+	var markers map[string]int
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		markers = readMarkers(r)
+	case http.MethodPost:
+		msgs := irc.messagesForChatRoom(channel)
+		id := 0
+		if len(msgs) > 0 {
+			id = msgs[len(msgs)-1].id
+		}
+		if value := r.FormValue("read-id"); value != "" {
+			var err error
+			if id, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "invalid message id", http.StatusBadRequest)
+				return
+			}
+		}
+		markers = markRead(w, r, channel, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(listChannels(markers, mutedChannels(r), channel))
+}
+
+// indexPage is the data of the index.html template. The HTML fields are
+// rendered by smirc and already escaped.
+type indexPage struct {
+	Lang         string
+	ThemeURL     string
+	Channel      string
+	Topic        string
+	ChannelLinks htmltemplate.HTML
+	Messages     htmltemplate.HTML
+	Users        htmltemplate.HTML
+	ChannelInput htmltemplate.HTML
+	Draft        string
+	// Captcha is the form to solve before sending, if needed
+	Captcha *captchaForm
+	// SetTopicURL is where the topic is changed
+	SetTopicURL string
+	// ReadOnly is set for virtual channels, CanSend where messages can be sent
+	ReadOnly bool
+	CanSend  bool
+	Script   htmltemplate.JS
+	// CSRFToken has to be sent back with the forms
+	CSRFToken string
+
+	MessagesURL  string
+	UsersURL     string
+	HistoryURL   string
+	LogsURL      string
+	RegisterURL  string
+	SendURL      string
+	SaveDraftURL string
+	PeekURL      string
+
+	// LoginURL is set for clients that have to log in to send, LogoutURL
+	// for those logged in
+	LoginURL  string
+	LogoutURL string
+
+	TimePreferences timePreferences
+	Languages       []string
+	SearchForm      htmltemplate.HTML
+}
+
+func handlerIndex(w http.ResponseWriter, r *http.Request) {
+	prefs := requestPrefs(w, r)
+	channel := requestChannel(r)
+	msgs, lastID := irc.messagesForChatRoom(channel), 0
+	if len(msgs) > 0 {
+		lastID = msgs[len(msgs)-1].id
+	}
+	page := indexPage{
+		Lang:            prefs.lang,
+		ThemeURL:        themeURL(prefs.theme),
+		CSRFToken:       csrfToken(w, r),
+		Channel:         channel,
+		Topic:           topicText(channel),
+		ChannelLinks:    htmltemplate.HTML(channelLinks(listChannels(markRead(w, r, channel, lastID), mutedChannels(r), channel), prefs.lang)),
+		Messages:        htmltemplate.HTML(renderMessages(msgs, prefs)),
+		Script:          htmltemplate.JS(liveMessagesScript(channel, lastID)),
+		MessagesURL:     channelURL(endPointGetMessagesForChannel, channel),
+		HistoryURL:      channelURL(endPointHistory, channel),
+		PeekURL:         endPointPeekChannel,
+		TimePreferences: timePreferencesFor(prefs),
+		SearchForm:      htmltemplate.HTML(searchForm(r, prefs)),
+		Languages:       uiLanguages(),
+	}
+	for _, c := range logChannels() {
+		if c == channel {
+			page.LogsURL = logURL(channel, "")
+		}
+	}
+	switch {
+	case channel == serverBuffer:
+	case readOnlyChannel(channel):
+		// Nobody is in a virtual channel and nothing can be said there
+		page.ReadOnly = true
+	case !loggedIn(r):
+		page.LoginURL = endPointLogin + "?next=" + url.QueryEscape(r.URL.RequestURI())
+	case !captchaPassed(r):
+		page.Captcha = captchaFormFor(prefs.lang, channel)
+		page.RegisterURL = channelURL(endPointRegisterChannel, channel)
+	default:
+		page.CanSend = true
+		page.Users = htmltemplate.HTML(irc.GetUsersForChannel(channel))
+		page.ChannelInput = htmltemplate.HTML(channelInput(channel))
+		if user, ok := webUser(r); ok {
+			page.Draft = drafts.Get(user, channel)
+		}
+		page.UsersURL = channelURL(endPointGetUsersForChannel, channel)
+		page.SendURL = endPointSendMessage
+		page.SaveDraftURL = endPointSaveDraft
+		page.SetTopicURL = endPointSetTopic
+		page.RegisterURL = channelURL(endPointRegisterChannel, channel)
+	}
+	if authEnabled() && loggedIn(r) {
+		page.LogoutURL = endPointLogout
+	}
+	renderPage(w, "index.html", page)
+}
+
+// topicText is the topic of channel as shown in the web UI
+func topicText(channel string) string {
+	topic, _ := irc.Topic(channel)
+	return stripFormatting(topic.Text)
+}
+
+// Run keeps us connected to the IRC server. Whenever connecting fails or the
+// connection is lost it reconnects, waiting twice as long after every
+// attempt that did not get us welcomed.
+func (irc *IRC) Run(ctx context.Context) {
+	defer close(irc.stopped)
+	minDelay := time.Duration(irc.config.ReconnectDelaySeconds) * time.Second
+	delay := minDelay
+	for {
+		irc.ServerEvent("Connecting to %s:%d", irc.config.Server, irc.config.Port)
+		connected, err := irc.connect()
+		if !connected {
+			log.Printf("Failed to connect to IRC server [%s:%d]: %s", irc.config.Server, irc.config.Port, err)
+			irc.ServerEvent("Failed to connect: %s", err)
+		} else {
+			log.Printf("Failed to read message from IRC server: %s\n", err)
+			irc.ServerEvent("Disconnected")
+			if irc.Registered() {
+				runHooks(hookEvent{Event: hookDisconnect, Nick: irc.Nick()})
+				delay = minDelay
+			}
+			irc.dropConn()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Reconnecting in %s", delay)
+		metrics.Reconnected()
+		irc.ServerEvent("Reconnecting in %s", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// ping sends a PING every pingInterval until stop is closed, to measure the
+// round trip time to the server
+func (irc *IRC) ping(stop chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if irc.Registered() {
+				_, _ = fmt.Fprintf(irc, "PING :%s%d\r\n", pingTokenPrefix, time.Now().UnixNano())
+			}
+		}
+	}
+}
+
+// Quit says goodbye to the server once everything queued before has been
+// sent, and waits for Run to return after the server hung up. When ctx is
+// done first the connection is closed.
+func (irc *IRC) Quit(ctx context.Context, message string) {
+	irc.connMutex.Lock()
+	client := irc.client
+	irc.connMutex.Unlock()
+	if client != nil {
+		log.Printf(">> QUIT :%s\n\n", message)
+		_, _ = fmt.Fprintf(irc, "QUIT :%s\r\n", message)
+	}
+	select {
+	case <-irc.stopped:
+	case <-ctx.Done():
+		log.Printf("The server did not hang up in time")
+		if client != nil {
+			_ = client.Close()
+		}
+	}
+}
+
+// connect connects to the server and handles everything it sends until the
+// connection breaks. It reports whether it got connected at all and why it
+// stopped. A server that does not welcome us within the registration
+// timeout is hung up on.
+func (irc *IRC) connect() (connected bool, err error) {
+	if envVarNickName == "" || envVarUserName == "" || envVarRealName == "" {
+		log.Fatal("Environment variables IRC_NICKNAME, IRC_USERNAME, IRC_REALNAME are required")
+	}
+	var welcomeTimer *time.Timer
+	stopPinging := make(chan struct{})
+	defer close(stopPinging)
+	client := ircclient.New(net.JoinHostPort(irc.config.Server, strconv.Itoa(irc.config.Port)), envVarNickName,
+		ircclient.WithDialer(func(context.Context, string) (net.Conn, error) { return dialIRC(irc.config) }),
+		ircclient.WithFloodControl(irc.config.FloodBurstLines, time.Duration(irc.config.FloodIntervalSeconds)*time.Second),
+		ircclient.WithOnConnect(func(client *ircclient.Client, conn net.Conn) {
+			connected = true
+			irc.setConn(client)
+			if irc.config.SASLUsername != "" {
+				irc.sasl = &saslSession{
+					conn:      conn,
+					mechanism: irc.config.SASLMechanism,
+					username:  irc.config.SASLUsername,
+					password:  irc.config.SASLPassword,
+				}
+			}
+			timeout := time.Duration(irc.config.RegistrationTimeoutSeconds) * time.Second
+			welcomeTimer = time.AfterFunc(timeout, func() {
+				if !irc.Registered() {
+					log.Printf("The server did not welcome us within %s", timeout)
+					_ = client.Close()
+				}
+			})
+			watchdog.Watch(conn)
+			go irc.ping(stopPinging)
+		}),
+		ircclient.WithRegistration(irc.register),
+		ircclient.WithOnSent(watchdog.Sent),
+		ircclient.WithHandler(ircclient.AllLines, irc.readLine),
+	)
+	defer watchdog.Watch(nil)
+	// The connection outlives the context of Run, so that Quit can still
+	// say goodbye once it is done
+	err = client.Run(context.Background())
+	if welcomeTimer != nil {
+		welcomeTimer.Stop()
+	}
+	return connected, err
+}
+
+// register starts registering on a new connection. Registration waits for
+// CAP END, which is sent once the capabilities are negotiated and SASL is
+// done. Servers without capabilities ignore it.
+func (irc *IRC) register(*ircclient.Client) {
+	irc.sendCap("LS 302")
+	// Queued after CAP LS, which has to come first
+	_, _ = fmt.Fprintf(irc, "USER %s 0 * :realname\r\n", envVarUserName)
+	_, _ = fmt.Fprintf(irc, "NICK %s\r\n", envVarNickName)
+}
+
+// readLine handles a line read from the server
+func (irc *IRC) readLine(_ *ircclient.Client, l ircLine) {
+	watchdog.Read()
+	if lag := chaos.Lag(); lag > 0 {
+		time.Sleep(lag)
+	}
+	irc.receiveLine(l)
+
+	// Refresh the user lists with WHO, one channel at a time and only when
+	// nothing else waits to be sent, so that it never holds up what users
+	// send
+	if irc.Registered() && time.Since(lastWho) > irc.whoSpacing() && irc.SendQueue() == 0 {
+		if channels := irc.Channels(); len(channels) > 0 {
+			nextWho %= len(channels)
+			_, _ = fmt.Fprintf(irc, "WHO %s\r\n", channels[nextWho])
+			nextWho++
+		}
+		lastWho = time.Now()
+	}
+
+	// Look for new channels matching the channel patterns now and then
+	if len(irc.config.ChannelPatterns) > 0 && irc.Registered() && time.Since(lastList) > listInterval {
+		log.Printf(">> LIST\n\n")
+		_, _ = fmt.Fprintf(irc, "LIST\r\n")
+		lastList = time.Now()
+	}
+}
+
+// whoSpacing is the time between two WHOs: a round over all channels takes
+// whoInterval, but WHO takes at most half of the lines the flood protection
+// lets through
+func (irc *IRC) whoSpacing() time.Duration {
+	spacing := whoInterval
+	if channels := len(irc.Channels()); channels > 1 {
+		spacing /= time.Duration(channels)
+	}
+	if floodSpacing := 2 * time.Duration(irc.config.FloodIntervalSeconds) * time.Second; spacing < floodSpacing {
+		spacing = floodSpacing
+	}
+	return spacing
+}
+
+// receive handles a line as received from the server
+func (irc *IRC) receive(message string) {
+	irc.receiveLine(ircclient.ParseLine(message))
+}
+
+// receiveLine handles a line from the server once parsed
+func (irc *IRC) receiveLine(l ircLine) {
+	irc.receiveMutex.Lock()
+	defer irc.receiveMutex.Unlock()
+	if _, ok := irc.channel(l.Param(0)); !ok && irc.isEcho(l) {
+		// Echoes of what we told services, e.g. passwords, or answered to
+		// CTCP queries
+		return
+	}
+	events.Emit(irc, eventRaw, ircEvent{ircLine: l, raw: l.Raw})
+	irc.handleLine(l)
+	irc.waiters.Dispatch(l)
+}
+
+// handleLine dispatches a line received from the IRC server
+func (irc *IRC) handleLine(l ircLine) {
+	if reply, ok := numericReplies[l.Command]; ok {
+		params, ok := namedParams(l, reply.params)
+		if !ok {
+			log.Printf("Ignoring %s reply with too few parameters: %q", l.Command, l.Params)
+			return
+		}
+		reply.handle(irc, l, params)
+		return
+	}
+	if l.IsError() && len(l.Params) > 0 {
+		// Error replies we do not handle otherwise, e.g. 433 for a nick in use
+		irc.AddIncomingMessage(serverBuffer, l.Prefix, l.Command+" "+strings.Join(l.Params[1:], " "))
+		return
+	}
+
+	switch l.Command {
+	case "PONG":
+		// Answers our PINGs with the time they were sent
+		if len(l.Params) == 0 {
+			break
+		}
+		if token := l.Params[len(l.Params)-1]; strings.HasPrefix(token, pingTokenPrefix) {
+			if sent, err := strconv.ParseInt(token[len(pingTokenPrefix):], 10, 64); err == nil {
+				metrics.PingRTT(time.Since(time.Unix(0, sent)))
+			}
+		}
+	case "PRIVMSG":
+		events.Emit(irc, eventMessage, ircEvent{ircLine: l})
+	case "CAP":
+		handleCap(irc, l)
+	case "AUTHENTICATE":
+		irc.sasl.authenticate(l.Param(0))
+	case "NOTICE":
+		if strings.EqualFold(l.Nick(), irc.config.ChanServNick) {
+			registration.HandleNotice(l.Param(1))
+		}
+		if _, ok := irc.channel(l.Param(0)); !ok {
+			irc.AddIncomingMessage(serverBuffer, l.Prefix, l.Param(1))
+		}
+	case "ERROR":
+		irc.ServerEvent("ERROR: %s", l.Param(0))
+	case "NICK":
+		events.Emit(irc, eventNick, ircEvent{ircLine: l})
+	case "MODE":
+		if strings.EqualFold(l.Param(0), irc.Nick()) {
+			irc.ChangeUserModes(strings.Join(l.Params[1:], ""))
+		} else if channel, ok := irc.channel(l.Param(0)); ok && len(l.Params) > 1 {
+			irc.ChangeChannelModes(channel, l.Params[1], l.Params[2:])
+		}
+	case "JOIN":
+		events.Emit(irc, eventJoin, ircEvent{ircLine: l})
+	case "PART":
+		events.Emit(irc, eventPart, ircEvent{ircLine: l})
+	case "QUIT":
+		events.Emit(irc, eventQuit, ircEvent{ircLine: l})
+	case "KICK":
+		events.Emit(irc, eventKick, ircEvent{ircLine: l})
+	case "TOPIC":
+		at := irc.messageTime(l)
+		irc.SetTopic(l.Param(0), Topic{Text: l.Param(1), SetBy: l.Nick(), SetAt: &at})
+	case "AWAY":
+		// From away-notify: AWAY with a message is away, without it back
+		irc.SetUserAway(l.Nick(), l.Param(0) != "", l.Param(0))
+	case "INVITE":
+		log.Printf("%s invited us to %s", l.Nick(), l.Param(1))
+		irc.Discover(l.Param(1))
+	}
+}
+
+func handleWelcome(irc *IRC, l ircLine, _ map[string]string) {
+	// The welcome is addressed to the nick the server actually gave us
+	irc.stateMutex.Lock()
+	irc.nick = l.Param(0)
+	irc.registered = true
+	irc.stateMutex.Unlock()
+	events.Emit(irc, eventConnect, ircEvent{ircLine: l})
+}
+
+func identifyOnConnect(irc *IRC, _ ircEvent) {
+	irc.IdentifyToNickServ()
+	if irc.Identified() {
+		// Logged in through SASL already
+		irc.RegainNick()
+	}
+}
+
+// handleCTCPQuery answers CTCP queries, which are not shown
+func handleCTCPQuery(irc *IRC, e ircEvent) {
+	command, args, ok := ctcpParse(e.Param(1))
+	if !ok || command == "ACTION" {
+		return
+	}
+	if !ctcpLimiter.Allow(e.Nick()) {
+		log.Printf("Dropping CTCP %s from %s", command, e.Nick())
+		return
+	}
+	log.Printf("CTCP %s from %s", command, e.Nick())
+	if reply, ok := ctcpReply(command, args); ok {
+		irc.CTCPReply(e.Nick(), command, reply)
+	}
+}
+
+// handleChannelMessage keeps the messages sent to our channels
+func handleChannelMessage(irc *IRC, e ircEvent) {
+	if command, _, ok := ctcpParse(e.Param(1)); ok && command != "ACTION" {
+		return
+	}
+	channel, ok := irc.channel(e.Param(0))
+	if !ok {
+		return
+	}
+	username, msg := e.Nick(), e.Param(1)
+	fmt.Printf("[%s] %s: %s\n", channel, username, msg)
+	source, relayedBy := e.Prefix, ""
+	if userHost := e.Tags[tagUserHost]; userHost != "" && irc.HasCap(capMessageTags) {
+		// The real host, where the prefix may have a cloaked one
+		source = username + "!" + userHost
+	}
+	if irc.HasCap(capRelayMsg) {
+		relayedBy = e.Tags[tagRelayMsg]
+	}
+	at := irc.messageTime(e.ircLine)
+	irc.AddRelayedMessage(channel, source, relayedBy, msg, at)
+	if irc.isEcho(e.ircLine) {
+		return
+	}
+	if mentions(msg, irc.Nick()) {
+		runHooks(hookEvent{Event: hookHighlight, Channel: channel, Nick: username, Message: msg})
+	}
+	// At the time it was sent, which is long ago for chathistory and bouncer
+	// playback
+	m := IRCMessage{channel: channel, userName: username, message: msg, time: at}
+	runKeywordHighlights(m)
+	runAlerts(m)
+}
+
+// handleQuit drops those who left IRC from the user lists of all channels
+func handleQuit(irc *IRC, e ircEvent) {
+	// :<nick>!<user>@host QUIT :<reason>
+	// Sent once for all the channels we share with the nick
+	for _, channel := range irc.RemoveNick(e.Nick()) {
+		irc.PresenceMessage(channel, withReason("← "+e.Nick()+" quit", e.Param(0)))
+	}
+}
+
+// PresenceMessage adds text, about somebody coming or going, to a channel
+// as a system message with presence-messages
+func (irc *IRC) PresenceMessage(channel, text string) {
+	if !irc.config.PresenceMessages {
+		return
+	}
+	if c, ok := irc.channel(channel); ok {
+		irc.AddIncomingMessage(c, "*", text)
+	}
+}
+
+// withReason appends the reason to text, if there is one
+func withReason(text, reason string) string {
+	if reason == "" {
+		return text
+	}
+	return text + " (" + reason + ")"
+}
+
+// handleNick tells the server buffer about nick changes and keeps track of
+// our own
+func handleNick(irc *IRC, e ircEvent) {
+	// :<old-nick>!<user>@host NICK :<new-nick>
+	text := fmt.Sprintf("%s is now known as %s", e.Nick(), e.Param(0))
+	irc.AddIncomingMessage(serverBuffer, e.Prefix, text)
+	for _, channel := range irc.RenameNick(e.Nick(), e.Param(0)) {
+		if irc.config.NickChangeMessages || irc.config.PresenceMessages {
+			irc.AddIncomingMessage(channel, "*", text)
+		}
+	}
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	if strings.EqualFold(e.Nick(), irc.nick) {
+		// We got our nick back, or changed it some other way
+		irc.nick = e.Param(0)
+	}
+}
+
+// handleCap negotiates the capabilities: those of capabilities that are
+// wanted are requested when the server lists them, while registering or
+// later with CAP NEW, and SASL authentication starts once the server
+// acknowledges sasl
+func handleCap(irc *IRC, l ircLine) {
+	if len(l.Params) == 0 {
+		return
+	}
+	subcommand := strings.ToUpper(l.Param(1))
+	caps := l.Params[len(l.Params)-1]
+	switch subcommand {
+	case "LS":
+		// "CAP * LS * :caps" is followed by more lines, the last one has no "*"
+		irc.serverCaps = append(irc.serverCaps, strings.Fields(caps)...)
+		if len(l.Params) > 3 && l.Param(2) == "*" {
+			return
+		}
+		wanted := irc.wantedCaps(irc.serverCaps)
+		if irc.sasl != nil && !strings.Contains(" "+strings.Join(wanted, " ")+" ", " "+capSASL+" ") {
+			log.Printf("Continuing without SASL")
+		}
+		if len(wanted) == 0 {
+			irc.sendCap("END")
+			return
+		}
+		irc.sendCap("REQ :" + strings.Join(wanted, " "))
+	case "NEW":
+		irc.serverCaps = append(irc.serverCaps, strings.Fields(caps)...)
+		if wanted := irc.wantedCaps(strings.Fields(caps)); len(wanted) > 0 {
+			irc.sendCap("REQ :" + strings.Join(wanted, " "))
+		}
+	case "DEL":
+		log.Printf("The server withdrew the capabilities: %s", caps)
+		irc.stateMutex.Lock()
+		for _, c := range strings.Fields(caps) {
+			delete(irc.caps, c)
+		}
+		irc.stateMutex.Unlock()
+	case "ACK":
+		irc.stateMutex.Lock()
+		for _, c := range strings.Fields(caps) {
+			irc.caps[c] = ""
+			for _, offered := range irc.serverCaps {
+				if name, value, _ := strings.Cut(offered, "="); name == c {
+					irc.caps[c] = value
+				}
+			}
+		}
+		irc.stateMutex.Unlock()
+		if irc.sasl != nil && strings.Contains(" "+caps+" ", " "+capSASL+" ") {
+			// CAP END follows once SASL is done
+			irc.sasl.start()
+			return
+		}
+		if !irc.Registered() {
+			irc.sendCap("END")
+		}
+	case "NAK":
+		log.Printf("The server refused the capabilities: %s", caps)
+		if !irc.Registered() {
+			irc.sendCap("END")
+		}
+	}
+}
+
+// wantedCaps returns the capabilities of offered, "name" or "name=value",
+// to request on this connection
+func (irc *IRC) wantedCaps(offered []string) []string {
+	var wanted []string
+	for _, c := range offered {
+		name, value, _ := strings.Cut(c, "=")
+		if c, ok := capabilities[name]; ok && !irc.config.disabledCap(name) && c.wanted(irc, value) {
+			wanted = append(wanted, name)
+		}
+	}
+	return wanted
+}
+
+// messageTime is when the server got l: its server-time tag where the
+// server sends them, or else now
+func (irc *IRC) messageTime(l ircLine) time.Time {
+	if value := l.Tags[tagServerTime]; value != "" && irc.HasCap(capServerTime) {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// HasCap reports whether the server acknowledged a capability on this
+// connection
+func (irc *IRC) HasCap(name string) bool {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	_, ok := irc.caps[name]
+	return ok
+}
+
+// CapValue is the value the server offered an acknowledged capability
+// with, e.g. the separators of relayed nicks for draft/relaymsg
+func (irc *IRC) CapValue(name string) string {
+	irc.stateMutex.Lock()
+	defer irc.stateMutex.Unlock()
+	return irc.caps[name]
+}
+
+func (irc *IRC) sendCap(args string) {
+	log.Printf(">> CAP %s\n\n", args)
+	_, _ = fmt.Fprintf(irc, "CAP %s\r\n", args)
+}
+
+// handleSASLDone ends capability negotiation once SASL succeeded or failed,
+// which lets the server complete our registration
+func handleSASLDone(irc *IRC, l ircLine, p map[string]string) {
+	if l.Command == rplSASLSuccess {
+		log.Printf("SASL authentication succeeded")
+	} else {
+		log.Printf("SASL authentication failed (%s): %s", l.Command, p["text"])
+	}
+	irc.sendCap("END")
+}
+
+// handleServerText shows the text of a numeric reply in the server buffer
+func handleServerText(irc *IRC, l ircLine, p map[string]string) {
+	irc.AddIncomingMessage(serverBuffer, l.Prefix, p["text"])
+}
+
+// ServerEvent notes something that happened to the connection in the server
+// buffer
+func (irc *IRC) ServerEvent(format string, args ...interface{}) {
+	irc.AddIncomingMessage(serverBuffer, "*", fmt.Sprintf(format, args...))
+}
+
+// handleNickInUse picks another nick while registering: the alternate nick
+// first, then the rejected one with an underscore added
+func handleNickInUse(irc *IRC, l ircLine, p map[string]string) {
+	irc.AddIncomingMessage(serverBuffer, l.Prefix, fmt.Sprintf("%s: %s", p["nick"], p["text"]))
+	if irc.Registered() {
+		return
+	}
+	nick := irc.config.AlternateNick
+	if strings.EqualFold(p["nick"], nick) || !strings.EqualFold(p["nick"], envVarNickName) {
+		nick = p["nick"] + "_"
+	}
+	irc.stateMutex.Lock()
+	irc.nick = nick
+	irc.stateMutex.Unlock()
+	log.Printf(">> NICK %s\n\n", nick)
+	_, _ = fmt.Fprintf(irc, "NICK %s\r\n", nick)
+}
+
+// IdentifyToNickServ identifies us for our configured nick, if we have a
+// NickServ password
+func (irc *IRC) IdentifyToNickServ() {
+	if irc.config.NickServPassword == "" {
+		return
+	}
+	log.Printf(">> PRIVMSG %s :IDENTIFY %s <redacted>\n\n", irc.config.NickServNick, envVarNickName)
+	_, _ = fmt.Fprintf(irc, "PRIVMSG %s :IDENTIFY %s %s\r\n", irc.config.NickServNick, envVarNickName, irc.config.NickServPassword)
+}
+
+// RegainNick asks NickServ for our configured nick back when we had to
+// fall back to another one
+func (irc *IRC) RegainNick() {
+	if strings.EqualFold(irc.Nick(), envVarNickName) || (irc.config.NickServPassword == "" && irc.config.SASLUsername == "") {
+		return
+	}
+	log.Printf(">> PRIVMSG %s :REGAIN %s\n\n", irc.config.NickServNick, envVarNickName)
+	_, _ = fmt.Fprintf(irc, "PRIVMSG %s :REGAIN %s\r\n", irc.config.NickServNick, envVarNickName)
+}
+
+func handleOperError(irc *IRC, l ircLine, p map[string]string) {
+	log.Printf("OPER failed (%s): %s", l.Command, p["text"])
+}
+
+func handleJoin(irc *IRC, e ircEvent) {
+	// :web-50!web-50@freenode-otsuav.ut8c.4jho.iho72g.IP JOIN :#midnightcafe
+	// :<nick>!<user>@host JOIN :<channel>
+	user := &User{
+		Nickname: e.Nick(),
+		Channel:  e.Param(0),
+	}
+	_, user.Username, user.Hostname = ircclient.SplitHostmask(e.Prefix)
+	irc.AddUserForChannel(user)
+	irc.PresenceMessage(user.Channel, "→ "+user.Nickname+" joined")
+	if strings.EqualFold(user.Nickname, irc.Nick()) {
+		irc.stateMutex.Lock()
+		if user.Hostname != "" {
+			irc.userHost = user.Username + "@" + user.Hostname
+		}
+		irc.joined[strings.ToLower(user.Channel)] = true
+		irc.stateMutex.Unlock()
+		// The modes of the channel come in RPL_CHANNELMODEIS
+		log.Printf(">> MODE %s\n\n", user.Channel)
+		_, _ = fmt.Fprintf(irc, "MODE %s\r\n", user.Channel)
+	}
+}
+
+func handlePart(irc *IRC, e ircEvent) {
+	// :web-50!web-50@freenode-otsuav.ut8c.4jho.iho72g.IP PART :#midnightcafe
+	// :<nick>!<user>@server PART <channel> :<reason>
+	irc.RemoveUser(e.Param(0), e.Nick())
+	irc.PresenceMessage(e.Param(0), withReason("← "+e.Nick()+" left", e.Param(1)))
+	if strings.EqualFold(e.Nick(), irc.Nick()) {
+		irc.left(e.Param(0))
+		irc.Forget(e.Param(0))
+	}
+}
+
+// left forgets what we knew about a channel we are no longer in
+func (irc *IRC) left(channel string) {
+	irc.stateMutex.Lock()
+	delete(irc.joined, strings.ToLower(channel))
+	delete(irc.topics, strings.ToLower(channel))
+	delete(irc.channelModes, strings.ToLower(channel))
+	irc.stateMutex.Unlock()
+}
+
+func handleKick(irc *IRC, e ircEvent) {
+	// :<nick>!<user>@host KICK <channel> <kicked-nick> :<reason>
+	channel, kicked, reason := e.Param(0), e.Param(1), e.Param(2)
+	irc.RemoveUser(channel, kicked)
+	if !strings.EqualFold(kicked, irc.Nick()) {
+		irc.PresenceMessage(channel, withReason("← "+kicked+" was kicked by "+e.Nick(), reason))
+		return
+	}
+	log.Printf("Kicked from %s by %s: %s", channel, e.Nick(), reason)
+	irc.left(channel)
+	irc.RemoveChannelUsers(channel)
+	text := fmt.Sprintf("Kicked from %s by %s (%s)", channel, e.Nick(), reason)
+	irc.ServerEvent("%s", text)
+	if c, ok := irc.channel(channel); ok {
+		irc.AddIncomingMessage(c, "*", text)
+	}
+	runHooks(hookEvent{Event: hookKick, Channel: channel, Nick: e.Nick(), Message: reason})
+	if configured, ok := irc.config.channel(channel); ok && irc.config.AutoRejoin {
+		delay := time.Duration(irc.config.RejoinDelaySeconds) * time.Second
+		irc.ServerEvent("Rejoining %s in %s", configured, delay)
+		time.AfterFunc(delay, func() { irc.Rejoin(configured) })
+	} else {
+		irc.Forget(channel)
+	}
+}
+
+// Rejoin joins a configured channel again, unless we are back in it
+// already or it is no longer configured
+func (irc *IRC) Rejoin(channel string) {
+	if _, ok := irc.config.channel(channel); !ok || !irc.Registered() {
+		return
+	}
+	irc.stateMutex.Lock()
+	joined := irc.joined[strings.ToLower(channel)]
+	irc.stateMutex.Unlock()
+	if joined {
+		return
+	}
+	log.Printf(">> JOIN %s\n\n", channel)
+	_, _ = fmt.Fprintf(irc, "JOIN %s\r\n", channel)
+}
+
+func handleTopicWhoTime(irc *IRC, _ ircLine, p map[string]string) {
+	// :srv 333 me #channel nick!user@host 1700000000
+	topic, _ := irc.Topic(p["channel"])
+	topic.SetBy, _, _ = ircclient.SplitHostmask(p["set-by"])
+	if setAt, err := strconv.ParseInt(p["set-at"], 10, 64); err == nil {
+		t := time.Unix(setAt, 0)
+		topic.SetAt = &t
+	}
+	irc.SetTopic(p["channel"], topic)
+}
+
+func handleNamesReply(irc *IRC, _ ircLine, p map[string]string) {
+	// <server>        353 <my-nickname>    = <channel>     :<nick> <nick>
+	// :*.freenode.net 353 HelloMyNameIsGNU = #midnightcafe :@web-50 HelloMyNameIsGNU
+	// With userhost-in-names the names are full nick!user@host hostmasks
+	// With multi-prefix all the prefixes of a user are listed, "@+alice"
+	for _, name := range strings.Fields(p["names"]) {
+		user := &User{Channel: p["channel"]}
+		prefixes, hostmask := irc.splitPrefixes(name)
+		user.Nickname, user.Username, user.Hostname = ircclient.SplitHostmask(hostmask)
+		user.Prefixes = prefixes
+		irc.AddUserForChannel(user)
+	}
+}
+
+func handleWhoReply(irc *IRC, _ ircLine, p map[string]string) {
+	// The WHO command response has the following format:
+	// <server> 352 <my-nickname> <channel> <username> <hostname> <server> <nickname> <H|G>[*][@|+] :<hopcount> <realname>
+	// Example:
+	// :*.freenode.net 352 HelloMyNameIsGNU #midnightcafe web-50     freenode-otsuav.ut8c.4jho.iho72g.IP *.freenode.net web-50     H@s           :0          https://kiwiirc.com/
+	// <server>        352 <my-nickname>    <channel>     <username> <hostname>                          <server>       <nickname> <H|G>[*][@|+] :<hopcount> <realname>
+	user := &User{
+		Nickname: p["nick"],
+		Username: p["user"],
+		Hostname: p["host"],
+		Channel:  p["channel"],
+		Server:   p["server"],
+	}
+	// The flags are H or G, * for IRC operators and the membership
+	// prefixes, possibly followed by others, e.g. B for bots
+	user.Prefixes, _ = irc.splitPrefixes(strings.TrimPrefix(strings.TrimLeft(p["flags"], "HG"), "*"))
+	irc.AddUserForChannel(user)
+	// H is here, G gone
+	irc.SetUserAway(p["nick"], strings.HasPrefix(p["flags"], "G"), "")
+}
+
+// ircLineBreaks strips the characters a line of IRC must not contain
+var ircLineBreaks = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+func sendMessage(conn io.Writer, channel string, message string) error {
+	// A line break would start a command of its own, a NUL ends the line on
+	// some servers
+	message = ircLineBreaks.Replace(message)
+	log.Printf("Sending message: PRIVMSG %s :%s\r\n", channel, message)
+	// Send the message to the channel
+	_, err := fmt.Fprintf(conn, "PRIVMSG %s :%s\r\n", channel, message)
+	return err
+}
+
+// applyConfig puts config into effect, at startup and when it is edited.
+// Nothing changes if its templates do not parse. Readers of irc.config get
+// the new config on their next use.
+func applyConfig(config *IRCConfig) error {
+	templates, err := parseTemplates(config.Templates)
+	if err != nil {
+		return err
+	}
+	pages, err := parseUITemplates(config.UITemplatesDir)
+	if err != nil {
+		return err
+	}
+	css, err := parseThemes(config.ThemesDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := css[config.Theme]; !ok {
+		return fmt.Errorf("unknown theme %q", config.Theme)
+	}
+	outgoingTemplates, uiTemplates = templates, pages
+	themes.Set(css)
+	irc.config = config
+
+	pastes.mutex.Lock()
+	pastes.expiry = time.Duration(config.PasteExpiryHours) * time.Hour
+	pastes.quota = config.PasteQuotaBytes
+	pastes.mutex.Unlock()
+	guests.mutex.Lock()
+	guests.perHour = config.GuestLinesPerHour
+	guests.interval = time.Duration(config.GuestMinIntervalSeconds) * time.Second
+	guests.mute = time.Duration(config.GuestMuteSeconds) * time.Second
+	guests.mutex.Unlock()
+	ctcpLimiter.mutex.Lock()
+	ctcpLimiter.limit = config.CTCPLimit
+	ctcpLimiter.window = time.Duration(config.CTCPWindowSeconds) * time.Second
+	ctcpLimiter.ignoreFor = time.Duration(config.CTCPIgnoreSeconds) * time.Second
+	ctcpLimiter.ignoreAll = config.CTCPIgnoreAll
+	ctcpLimiter.mutex.Unlock()
+	peeks.mutex.Lock()
+	peeks.grace = time.Duration(config.PeekGraceSeconds) * time.Second
+	peeks.mutex.Unlock()
+	watchdog.mutex.Lock()
+	watchdog.readTimeout = time.Duration(config.WatchdogReadSeconds) * time.Second
+	watchdog.sendTimeout = time.Duration(config.WatchdogSendSeconds) * time.Second
+	watchdog.mutex.Unlock()
+	return nil
+}
+
+// restartConfigKeys are the config keys only read on startup
+var restartConfigKeys = []string{
+	"web-server-port-number", "web-tls-cert-file", "web-tls-key-file", "web-client-ca-file",
+	"web-autocert-domains", "web-autocert-email", "web-autocert-cache-dir", "web-http-port-number",
+	"database-file", "history-size", "bookmarks-file", "prefs-file", "deletion-log-file", "dead-letter-file", "tls-fingerprints-file",
+	"retention-hours", "tor-control-address", "tor-control-password", "tor-onion-key-file",
+}
+
+// Reconfigure switches to config while running: configured channels that
+// were added are joined and those that were removed parted. The connection
+// settings apply from the next reconnect. It returns the changed keys that
+// only take effect after a restart.
+func (irc *IRC) Reconfigure(config *IRCConfig) (restart []string, err error) {
+	old := irc.config
+	if err := applyConfig(config); err != nil {
+		return nil, err
+	}
+	for _, channel := range config.Channels {
+		if _, ok := old.channel(channel); !ok {
+			if _, err := irc.joinChannel(channel); err != nil {
+				log.Printf("Not joining %s: %s", channel, err)
+			}
+		}
+	}
+	for _, channel := range old.Channels {
+		if _, ok := config.channel(channel); !ok {
+			irc.Forget(channel)
+			log.Printf(">> PART %s\n\n", channel)
+			_, _ = fmt.Fprintf(irc, "PART %s\r\n", channel)
+		}
+	}
+	oldValues, newValues := configValues(old), configValues(config)
+	for _, key := range restartConfigKeys {
+		if !reflect.DeepEqual(oldValues[key], newValues[key]) {
+			restart = append(restart, key)
+		}
+	}
+	return restart, nil
+}
+
+// configValues returns the config keyed like the config file
+func configValues(config *IRCConfig) map[string]interface{} {
+	var values map[string]interface{}
+	data, _ := json.Marshal(config)
+	_ = json.Unmarshal(data, &values)
+	return values
+}
+
+// secretConfigKeys are the config keys shown as "<redacted>"
+var secretConfigKeys = []string{"oper-password", "admin-token", "sasl-password", "tor-control-password", "nickserv-password", "captcha-secret-key", "web-token", "pseudonym-key"}
+
+// redacted returns a copy of the config that is safe to log
+func (config IRCConfig) redacted() IRCConfig {
+	for _, secret := range []*string{&config.OperPassword, &config.AdminToken, &config.SASLPassword, &config.TorControlPassword, &config.NickServPassword, &config.CaptchaSecretKey, &config.WebToken, &config.PseudonymKey} {
+		if *secret != "" {
+			*secret = "<redacted>"
+		}
+	}
+	return config
+}
+
+// configEnums are the values allowed for config keys that take one of a few
+func configEnums() map[string][]string {
+	var providers []string
+	for provider := range captchaProviders {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	return map[string][]string{
+		"sasl-mechanism":   {saslScramSHA256, saslPlain},
+		"captcha-provider": providers,
+		"event":            {hookConnect, hookDisconnect, hookHighlight, hookReport, hookWatchdog, hookAlert, hookKick, hookDigest},
+		"vendor-caps":      vendorCaps,
+		"disable-caps":     capabilityNames(),
+		"formatting":       {formattingRender, formattingStrip},
+		"time-format":      {timeFormat24h, timeFormat12h, timeFormatRelative},
+		"scopes":           {scopeRead, scopeSend},
+	}
+}
+
+// schemaFor returns the JSON Schema of the values of type t
+func schemaFor(t reflect.Type, enums map[string][]string) *jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := schemaFor(t.Elem(), enums)
+		schema.Type = []interface{}{schema.Type, "null"}
+		return schema
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaFor(t.Elem(), enums)}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), enums)}
+	case reflect.Struct:
+		schema := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema), AdditionalProperties: false}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" || name == "" {
+				continue
+			}
+			schema.Properties[name] = schemaFor(field.Type, enums)
+			if items := schema.Properties[name].Items; items != nil {
+				// The enum of a list applies to its items
+				items.Enum = enums[name]
+			} else {
+				schema.Properties[name].Enum = enums[name]
+			}
+		}
+		return schema
+	}
+	return &jsonSchema{Type: "string"}
+}
+
+// configSchema is the JSON Schema of the config file
+func configSchema() *jsonSchema {
+	schema := schemaFor(reflect.TypeOf(IRCConfig{}), configEnums())
+	schema.Schema, schema.Title = "https://json-schema.org/draft/2020-12/schema", "smirc config"
+	return schema
+}
+
+// validateValue checks a value decoded from JSON against schema and returns
+// what is wrong with it, prefixed with its path
+func validateValue(schema *jsonSchema, value interface{}, path string) []string {
+	types, ok := schema.Type.([]interface{})
+	if !ok {
+		types = []interface{}{schema.Type}
+	}
+	valid := false
+	for _, t := range types {
+		switch v := value.(type) {
+		case nil:
+			valid = valid || t == "null"
+		case bool:
+			valid = valid || t == "boolean"
+		case float64:
+			valid = valid || t == "number" || t == "integer" && v == math.Trunc(v)
+		case string:
+			valid = valid || t == "string"
+		case []interface{}:
+			valid = valid || t == "array"
+		case map[string]interface{}:
+			valid = valid || t == "object"
+		}
+	}
+	if !valid {
+		return []string{fmt.Sprintf("%s: expected %v", path, schema.Type)}
+	}
+	var problems []string
+	switch v := value.(type) {
+	case string:
+		// An empty string leaves the setting unset
+		if len(schema.Enum) > 0 && v != "" {
+			known := false
+			for _, allowed := range schema.Enum {
+				known = known || strings.EqualFold(v, allowed)
+			}
+			if !known {
+				problems = append(problems, fmt.Sprintf("%s: %q is not one of %s", path, v, strings.Join(schema.Enum, ", ")))
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			problems = append(problems, validateValue(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := strings.TrimPrefix(path+"."+key, ".")
+			if property, ok := schema.Properties[key]; ok {
+				problems = append(problems, validateValue(property, v[key], keyPath)...)
+			} else if additional, ok := schema.AdditionalProperties.(*jsonSchema); ok {
+				problems = append(problems, validateValue(additional, v[key], keyPath)...)
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: unknown key", keyPath))
+			}
+		}
+	}
+	return problems
+}
+
+// validateConfig checks a config file against the config schema
+func validateConfig(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if problems := validateValue(configSchema(), value, ""); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func readConfig(fileName string) *IRCConfig {
+	// Load the JSON file
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		log.Fatalf("Failed to read config file [%s]: %s", fileName, err)
+	}
+	config, err := parseConfig(data)
+	if err != nil {
+		log.Fatalf("Invalid config file [%s]: %s", fileName, err)
+	}
+	fmt.Printf("Config: %+v\n", config.redacted())
+	return config
+}
+
+// parseConfig checks a config file and fills in the defaults
+func parseConfig(data []byte) (*IRCConfig, error) {
+	var config IRCConfig
+	if err := validateConfig(data); err != nil {
+		return nil, err
+	}
+
+	// Parse the JSON into a Config struct
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	if config.Port == 0 && config.TLS {
+		config.Port = defaultIRCTLSPort
+	}
+	if config.Port == 0 {
+		config.Port = defaultIRCPort
+	}
+	if config.TLSSkipVerify {
+		log.Printf("Warning: tls-skip-verify is set, the server certificate is not checked")
+	}
+	if config.Server == "" {
+		config.Server = defaultIRCServer
+	}
+	if config.WebServerPortNumber == 0 {
+		config.WebServerPortNumber = defaultWebServerPortNumber
+	}
+	if config.Channel != "" {
+		if _, ok := config.channel(config.Channel); !ok {
+			config.Channels = append([]string{config.Channel}, config.Channels...)
+		}
+	}
+	if len(config.Channels) == 0 {
+		config.Channels = []string{defaultChannel}
+	}
+	config.Channel = config.Channels[0]
+	if config.MaxChannels == 0 {
+		config.MaxChannels = defaultMaxChannels
+	}
+	if config.GuestLinesPerHour <= 0 {
+		config.GuestLinesPerHour = defaultGuestLinesPerHour
+	}
+	if config.GuestMinIntervalSeconds <= 0 {
+		config.GuestMinIntervalSeconds = defaultGuestInterval
+	}
+	if config.GuestMuteSeconds <= 0 {
+		config.GuestMuteSeconds = defaultGuestMuteSeconds
+	}
+	if config.CaptchaProvider != "" {
+		if _, ok := captchaProviders[config.CaptchaProvider]; !ok {
+			return nil, fmt.Errorf("unsupported captcha provider %q", config.CaptchaProvider)
+		}
+		if config.CaptchaSiteKey == "" || config.CaptchaSecretKey == "" {
+			return nil, errors.New("captcha-provider needs captcha-site-key and captcha-secret-key")
+		}
+	}
+	if config.CaptchaSessionHours <= 0 {
+		config.CaptchaSessionHours = defaultCaptchaSessionHours
+	}
+	if config.WebSessionHours <= 0 {
+		config.WebSessionHours = defaultWebSessionHours
+	}
+	if config.Theme == "" {
+		config.Theme = defaultTheme
+	}
+	for user, hash := range config.WebUsers {
+		if user == "" || strings.ContainsAny(user, ".\r\n") {
+			return nil, fmt.Errorf("invalid web user name %q", user)
+		}
+		if _, _, _, err := parsePasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("web user %s: %w, make one with \"smirc hash-password\"", user, err)
+		}
+	}
+	if config.FloodBurstLines <= 0 {
+		config.FloodBurstLines = defaultFloodBurst
+	}
+	if config.FloodIntervalSeconds <= 0 {
+		config.FloodIntervalSeconds = defaultFloodInterval
+	}
+	if config.WSPingIntervalSeconds <= 0 {
+		config.WSPingIntervalSeconds = defaultWSPingInterval
+	}
+	if config.PeekGraceSeconds == 0 {
+		config.PeekGraceSeconds = defaultPeekGraceSeconds
+	}
+	for _, pattern := range config.ChannelPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid channel pattern %q: %s", pattern, err)
+		}
+	}
+	if config.ThreadWindowSeconds == 0 {
+		config.ThreadWindowSeconds = defaultThreadWindowSeconds
+	}
+	if config.PasteThresholdLines == 0 {
+		config.PasteThresholdLines = defaultPasteThresholdLines
+	}
+	if config.PasteExpiryHours == 0 {
+		config.PasteExpiryHours = defaultPasteExpiryHours
+	}
+	if config.PasteQuotaBytes == 0 {
+		config.PasteQuotaBytes = defaultPasteQuotaBytes
+	}
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if config.SpoilerTags == nil {
+		config.SpoilerTags = []string{"[spoiler]", "[nsfw]"}
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultBufferSize
+	}
+	if config.HistorySize <= 0 {
+		config.HistorySize = defaultHistorySize
+	}
+	if config.HistoryPageSize <= 0 {
+		config.HistoryPageSize = defaultHistoryPageSize
+	}
+	if config.ChanServNick == "" {
+		config.ChanServNick = defaultChanServNick
+	}
+	if config.NickServNick == "" {
+		config.NickServNick = defaultNickServNick
+	}
+	if config.AlternateNick == "" {
+		config.AlternateNick = envVarNickName + "_"
+	}
+	if config.CTCPLimit == 0 {
+		config.CTCPLimit = defaultCTCPLimit
+	}
+	if config.CTCPWindowSeconds == 0 {
+		config.CTCPWindowSeconds = defaultCTCPWindowSeconds
+	}
+	replies := make(map[string]string)
+	for command, reply := range config.CTCPReplies {
+		replies[strings.ToUpper(command)] = reply
+	}
+	if _, ok := replies["VERSION"]; !ok {
+		replies["VERSION"] = defaultCTCPVersion
+	}
+	config.CTCPReplies = replies
+	if config.CTCPIgnoreSeconds == 0 {
+		config.CTCPIgnoreSeconds = defaultCTCPIgnoreSeconds
+	}
+
+	for _, pin := range config.TLSPins {
+		if !validPin(pin) {
+			return nil, fmt.Errorf("invalid TLS pin %q, expected a SHA-256 fingerprint or sha256/<base64 public key hash>", pin)
+		}
+	}
+	if config.SASLMechanism == "" {
+		config.SASLMechanism = defaultSASLMechanism
+	}
+	if config.Formatting == "" {
+		config.Formatting = formattingRender
+	}
+	if config.TimeFormat == "" {
+		config.TimeFormat = defaultTimeFormat
+	}
+	if _, err := time.LoadLocation(config.Timezone); err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", config.Timezone, err)
+	}
+	if config.DialTimeoutSeconds == 0 {
+		config.DialTimeoutSeconds = defaultDialTimeout
+	}
+	if config.TLSHandshakeTimeoutSeconds == 0 {
+		config.TLSHandshakeTimeoutSeconds = defaultTLSHandshakeTimeout
+	}
+	if config.RegistrationTimeoutSeconds == 0 {
+		config.RegistrationTimeoutSeconds = defaultWelcomeTimeout
+	}
+	if config.ReconnectDelaySeconds == 0 {
+		config.ReconnectDelaySeconds = defaultReconnectDelay
+	}
+	if config.RejoinDelaySeconds == 0 {
+		config.RejoinDelaySeconds = defaultRejoinDelay
+	}
+	if config.WatchdogReadSeconds <= 0 {
+		config.WatchdogReadSeconds = defaultWatchdogRead
+	}
+	if config.WatchdogSendSeconds <= 0 {
+		config.WatchdogSendSeconds = defaultWatchdogSend
+	}
+	if config.QuitMessage == "" {
+		config.QuitMessage = defaultQuitMessage
+	}
+	if config.ShutdownTimeoutSeconds <= 0 {
+		config.ShutdownTimeoutSeconds = defaultShutdownTimeout
+	}
+	if (config.WebTLSCertFile == "") != (config.WebTLSKeyFile == "") {
+		return nil, errors.New("web-tls-cert-file and web-tls-key-file must be set together")
+	}
+	if len(config.WebAutocertDomains) > 0 && config.WebTLSCertFile != "" {
+		return nil, errors.New("web-autocert-domains and web-tls-cert-file cannot be used together")
+	}
+	if config.WebAutocertCacheDir == "" {
+		config.WebAutocertCacheDir = defaultAutocertCacheDir
+	}
+	if config.WebClientCAFile != "" && !config.webTLS() {
+		return nil, errors.New("web-client-ca-file needs web-tls-cert-file and web-tls-key-file, or web-autocert-domains")
+	}
+	if config.WebHTTPPortNumber != 0 && !config.webTLS() {
+		return nil, errors.New("web-http-port-number only redirects to HTTPS, which needs web-tls-cert-file or web-autocert-domains")
+	}
+	for _, channel := range config.VirtualChannels {
+		if channel.Name == "" || channel.Name == serverBuffer || validChannelName(channel.Name) || strings.ContainsAny(channel.Name, " ,\r\n") {
+			return nil, fmt.Errorf("invalid virtual channel name %q: it must not be an IRC channel name", channel.Name)
+		}
+		if channel.Token == "" {
+			return nil, fmt.Errorf("virtual channel %s needs a token", channel.Name)
+		}
+	}
+	for _, token := range config.APITokens {
+		if token.Name == "" {
+			return nil, errors.New("every API token needs a name")
+		}
+		if token.Token == "" || len(token.Scopes) == 0 {
+			return nil, fmt.Errorf("API token %s needs a token and scopes", token.Name)
+		}
+	}
+	for _, bridge := range config.Bridges {
+		if bridge.Name == "" || strings.ContainsAny(bridge.Name, " !@\r\n") {
+			return nil, fmt.Errorf("invalid bridge name %q", bridge.Name)
+		}
+		if bridge.Token == "" {
+			return nil, fmt.Errorf("bridge %s needs a token", bridge.Name)
+		}
+		for _, channel := range bridge.Channels {
+			if _, ok := config.channel(channel); !ok {
+				return nil, fmt.Errorf("bridge %s: %s is not one of the channels", bridge.Name, channel)
+			}
+		}
+	}
+	for _, hook := range config.Hooks {
+		switch hook.Event {
+		case hookConnect, hookDisconnect, hookHighlight, hookReport, hookWatchdog, hookAlert, hookKick, hookDigest:
+		default:
+			return nil, fmt.Errorf("unknown hook event %q", hook.Event)
+		}
+		if len(hook.Command) == 0 && hook.URL == "" {
+			return nil, fmt.Errorf("hook for %s needs a command or a url", hook.Event)
+		}
+		if hook.Retries < 0 || hook.Retries > 10 {
+			return nil, fmt.Errorf("hook for %s: retries must be between 0 and 10", hook.Event)
+		}
+	}
+	if envVarSASLUsername != "" {
+		config.SASLUsername = envVarSASLUsername
+	}
+	if envVarSASLPassword != "" {
+		config.SASLPassword = envVarSASLPassword
+	}
+	config.SASLMechanism = strings.ToUpper(config.SASLMechanism)
+	if config.SASLMechanism != saslScramSHA256 && config.SASLMechanism != saslPlain {
+		return nil, fmt.Errorf("unsupported SASL mechanism %q", config.SASLMechanism)
+	}
+	if config.SASLMechanism == saslPlain && config.SASLUsername != "" && !config.TLS && !strings.HasPrefix(config.WebSocketURL, "wss:") {
+		log.Printf("Warning: SASL PLAIN sends the password in the clear without TLS")
+	}
+
+	return &config, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		hashPasswordCommand()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		benchCommand(os.Args[2:])
+		return
+	}
+	if err := applyConfig(readConfig(envVarConfigFileName)); err != nil {
+		log.Fatalf("Failed to apply the config: %s", err)
+	}
+	bookmarks.fileName = irc.config.BookmarksFile
+	deletions.fileName = irc.config.DeletionLogFile
+	fingerprints.fileName = irc.config.TLSFingerprintsFile
+	fingerprints.load()
+	irc.lastMessageID = bookmarks.load()
+	if irc.config.DatabaseFile != "" {
+		store, err := openSQLiteStore(irc.config.DatabaseFile)
+		if err != nil {
+			log.Fatalf("Failed to open database [%s]: %s", irc.config.DatabaseFile, err)
+		}
+		irc.store = store
+		irc.writer = newStoreWriter(store)
+		prefs.store = store
+		drafts.store = store
+		if err := drafts.load(); err != nil {
+			log.Fatalf("Failed to load the drafts from [%s]: %s", irc.config.DatabaseFile, err)
+		}
+		pastes.store = store
+		if err := pastes.load(); err != nil {
+			log.Fatalf("Failed to load the pastes from [%s]: %s", irc.config.DatabaseFile, err)
+		}
+		if err := irc.loadHistory(irc.config.HistorySize); err != nil {
+			log.Fatalf("Failed to load history from [%s]: %s", irc.config.DatabaseFile, err)
+		}
+	}
+	prefs.fileName = irc.config.PrefsFile
+	if err := prefs.load(); err != nil {
+		log.Fatalf("Failed to load the preferences: %s", err)
+	}
+	deadLetters.fileName = irc.config.DeadLetterFile
+	if err := deadLetters.load(); err != nil {
+		log.Fatalf("Failed to load the dead letters [%s]: %s", irc.config.DeadLetterFile, err)
+	}
+	irc.users = make(map[string]*User)
+	irc.joined = make(map[string]bool)
+	irc.channels = append([]string{}, irc.config.Channels...)
+	irc.stopped = make(chan struct{})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	subscribeHandlers()
+	go irc.Run(ctx)
+	go watchdog.Run(ctx)
+	go quietHours.Run(ctx)
+	go func() {
+		for {
+			time.Sleep(10 * time.Second)
+			peeks.Expire()
+		}
+	}()
+	if irc.config.RetentionHours > 0 {
+		retention := time.Duration(irc.config.RetentionHours) * time.Hour
+		go func() {
+			for {
+				expireMessages(retention)
+				time.Sleep(time.Minute)
+			}
+		}()
+	}
+
+	http.HandleFunc("/", requireLoginToRead(handlerIndex))
+	http.HandleFunc(endPointGetMessagesForChannel, requireLoginToRead(handlerGetMessagesForChannel))
+	http.HandleFunc(endPointGetUsersForChannel, requireLoginToRead(handlerGetUsersForChannel))
+	http.HandleFunc(endPointAPIUsers, requireLoginToRead(handlerAPIUsers))
+	http.HandleFunc(endPointWhois, requireLoginToRead(handlerWhois))
+	http.HandleFunc(endPointAPIWhois, requireLoginToRead(handlerAPIWhois))
+	http.HandleFunc(endPointSetTopic, requireLogin(requireCSRFToken(handlerSetTopic)))
+	http.HandleFunc(endPointAPITopic, handlerAPITopic)
+	http.HandleFunc(endPointSendMessage, requireLogin(requireCSRFToken(handlerSendMessage)))
+	http.HandleFunc(endPointCaptcha, handlerCaptcha)
+	http.HandleFunc(endPointLogin, requireCSRFToken(handlerLogin))
+	http.HandleFunc(endPointLogout, requireCSRFToken(handlerLogout))
+	http.HandleFunc(endPointThemes, handlerTheme)
+	http.HandleFunc(endPointStatic, handlerStatic)
+	http.HandleFunc(endPointManifest, handlerStatic)
+	http.HandleFunc(endPointServiceWorker, handlerStatic)
+	http.HandleFunc(endPointStarMessage, requireLogin(requireCSRFToken(handlerStarMessage)))
+	http.HandleFunc(endPointReportMessage, requireCSRFToken(handlerReportMessage))
+	http.HandleFunc(endPointSaveDraft, requireLogin(requireCSRFToken(handlerSaveDraft)))
+	http.HandleFunc(endPointPaste, requireLoginToRead(handlerPaste))
+	http.HandleFunc(endPointLogs, requireLoginToReadLogs(handlerLogs))
+	http.HandleFunc(endPointSitemap, requireLoginToReadLogs(handlerSitemap))
+	http.HandleFunc(endPointRobots, handlerRobots)
+	http.HandleFunc(endPointHistory, requireLoginToRead(handlerHistory))
+	http.HandleFunc(endPointSearch, requireLoginToRead(handlerSearch))
+	http.HandleFunc(endPointAPISearch, requireLoginToRead(handlerAPISearch))
+	http.HandleFunc(endPointAPIGraphQL, requireLoginToRead(handlerAPIGraphQL))
+	http.HandleFunc(endPointSaveSearch, requireLogin(requireCSRFToken(handlerSaveSearch)))
+	http.HandleFunc(endPointAPISavedSearches, requireLogin(handlerAPISavedSearches))
+	http.HandleFunc(endPointRegisterChannel, requireLogin(requireCSRFToken(handlerRegisterChannel)))
+	http.HandleFunc(endPointPeekChannel, requireLogin(requireCSRFToken(handlerPeekChannel)))
+	http.HandleFunc(endPointWebSocket, requireLoginToRead(handlerWebSocket))
+	http.HandleFunc(endPointEvents, requireLoginToRead(handlerEvents))
+	http.HandleFunc(endPointAPIMessages, handlerAPIMessages)
+	http.HandleFunc(endPointAPIBookmarks, requireLoginToChange(handlerAPIBookmarks))
+	http.HandleFunc(endPointAPIPrefs, requireLogin(handlerAPIPrefs))
+	http.HandleFunc(endPointAPIChannels, requireLoginToRead(handlerAPIChannels))
+	http.HandleFunc(endPointAPIReports, handlerAPIReports)
+	http.HandleFunc(endPointAPIStatus, requireLoginToRead(handlerAPIStatus))
+	http.HandleFunc(endPointAPIConfigSchema, handlerAPIConfigSchema)
+	http.HandleFunc(endPointMetrics, handlerMetrics)
+	http.HandleFunc(endPointHealthz, handlerHealthz)
+	http.HandleFunc(endPointReadyz, handlerReadyz)
+	http.HandleFunc(endPointAPIRelay, handlerAPIRelay)
+	http.HandleFunc(endPointAPIBridge, handlerAPIBridge)
+	http.HandleFunc(endPointAPIAdminKill, handlerAPIAdminKill)
+	http.HandleFunc(endPointAPIAdminRehash, handlerAPIAdminRehash)
+	http.HandleFunc(endPointAPIAdminConfig, handlerAPIAdminConfig)
+	http.HandleFunc(endPointAdminConfig, handlerAdminConfig)
+	http.HandleFunc(endPointAPIAdminHooks, handlerAPIAdminHooks)
+	http.HandleFunc(endPointAdminHooks, handlerAdminHooks)
+	http.HandleFunc(endPointAPIAdminDeadLetters, handlerAPIAdminDeadLetters)
+	http.HandleFunc(endPointAPIAdminRedact, handlerAPIAdminModerate)
+	http.HandleFunc(endPointAPIAdminAnnotate, handlerAPIAdminModerate)
+	http.HandleFunc(endPointAPIAdminMask, handlerAPIAdminModerate)
+	http.HandleFunc(endPointAPIAdminAudit, handlerAPIAdminAudit)
+	http.HandleFunc(endPointAPIAdminReports, handlerAPIAdminReports)
+	http.HandleFunc(endPointDebugInject, handlerDebugInject)
+	http.HandleFunc(endPointAPIAdminPurge, handlerAPIAdminPurge)
+	http.HandleFunc(endPointAPIAdminDeletions, handlerAPIAdminDeletions)
+	http.HandleFunc(endPointAPIAdminGuests, handlerAPIAdminGuests)
+	http.HandleFunc(endPointAPIAdminExport, handlerAPIAdminExport)
+	http.HandleFunc(endPointAPIRegisterChannel, requireLogin(handlerAPIRegisterChannel))
+
+	onionPort := 80
+	if irc.config.webTLS() {
+		onionPort = 443
+	}
+	if irc.config.TorControlAddress != "" {
+		onion.keyFile = irc.config.TorOnionKeyFile
+		onion.password = irc.config.TorControlPassword
+		go func() {
+			err := onion.Publish(irc.config.TorControlAddress, onionPort, irc.config.WebServerPortNumber)
+			log.Printf("Onion service stopped: %s", err)
+		}()
+	}
+
+	manager := autocertManager(irc.config)
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", irc.config.WebServerPortNumber),
+		Handler:   sameOriginOnly(metrics.Instrument(http.DefaultServeMux)),
+		TLSConfig: webTLSConfig(irc.config, manager),
+	}
+	go func() {
+		var err error
+		switch {
+		case manager != nil:
+			// The certificates come from the manager
+			err = server.ListenAndServeTLS("", "")
+		case irc.config.WebTLSCertFile != "":
+			err = server.ListenAndServeTLS(irc.config.WebTLSCertFile, irc.config.WebTLSKeyFile)
+		default:
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	var redirectServer *http.Server
+	if irc.config.WebHTTPPortNumber != 0 {
+		redirectServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", irc.config.WebHTTPPortNumber),
+			Handler: httpsRedirect(irc.config.WebServerPortNumber, manager),
+		}
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	// Another signal stops us right away
+	stop()
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(irc.config.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error: %s", err)
+	}
+	if redirectServer != nil {
+		_ = redirectServer.Close()
+	}
+	irc.Quit(shutdownCtx, irc.config.QuitMessage)
+	if irc.writer != nil {
+		if err := irc.writer.Close(); err != nil {
+			log.Printf("Error: %s", err)
+		}
+	}
+}
+
+// hashPasswordCommand reads a password from stdin and prints its hash for
+// web-users
+func hashPasswordCommand() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("Failed to read the password: %s", err)
+	}
+	hash, err := hashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		log.Fatalf("Failed to hash the password: %s", err)
+	}
+	fmt.Println(hash)
+}
+
+// benchPrefix starts the synthetic messages of smirc bench, followed by the
+// time they were received in nanoseconds
+const benchPrefix = "bench message "
+
+// benchCommand feeds synthetic PRIVMSG lines through the same path as the
+// lines from the server, parsing, storing and publishing them, to viewers
+// that render them like the event stream does, and reports how long that
+// took and how much it allocated
+func benchCommand(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	rate := flags.Int("rate", 1000, "messages per second, 0 for as fast as possible")
+	duration := flags.Duration("duration", 10*time.Second, "how long to send messages")
+	channels := flags.Int("channels", 4, "channels the messages are spread over")
+	viewers := flags.Int("viewers", 50, "viewers spread over the channels")
+	database := flags.String("database", "", "SQLite database to store the messages in, a scratch file as they are added to it")
+	_ = flags.Parse(args)
+	if *rate < 0 || *duration <= 0 || *channels < 1 || *viewers < 0 {
+		log.Fatalf("Invalid bench options, see smirc bench -help")
+	}
+
+	names := make([]string, *channels)
+	for i := range names {
+		names[i] = fmt.Sprintf("#bench%d", i+1)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"server": "bench.invalid", "channels": names})
+	config, err := parseConfig(data)
+	if err != nil {
+		log.Fatalf("Invalid bench config: %s", err)
+	}
+	if err := applyConfig(config); err != nil {
+		log.Fatalf("Failed to apply the bench config: %s", err)
+	}
+	if *database != "" {
+		store, err := openSQLiteStore(*database)
+		if err != nil {
+			log.Fatalf("Failed to open database [%s]: %s", *database, err)
+		}
+		irc.store = store
+		irc.writer = newStoreWriter(store)
+		defer irc.writer.Close()
+	}
+	irc.users = make(map[string]*User)
+	irc.joined = make(map[string]bool)
+	irc.channels = names
+	subscribeHandlers()
+
+	// The pipeline prints every line it handles
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %s", os.DevNull, err)
+	}
+	os.Stdout = devNull
+
+	// Every viewer renders the messages of its channel and notes how long
+	// after they were received that happened
+	prefs := viewPrefs{lang: defaultLanguage, location: time.Local, timeFormat: config.TimeFormat, theme: config.Theme}
+	latencies := make([][]time.Duration, *viewers)
+	perChannel := make(map[string]int)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for v := 0; v < *viewers; v++ {
+		channel := names[v%len(names)]
+		perChannel[channel]++
+		messages, _ := streams.Subscribe(channel)
+		wg.Add(1)
+		go func(v int) {
+			defer wg.Done()
+			defer streams.Unsubscribe(messages)
+			for {
+				select {
+				case <-done:
+					return
+				case m := <-messages:
+					event := wsEvent{Type: "message", apiMessage: prefs.localize([]apiMessage{m.toAPI()})[0], HTML: renderMessage(m, prefs)}
+					if _, err := json.Marshal(event); err != nil {
+						continue
+					}
+					if sent, err := strconv.ParseInt(strings.TrimPrefix(m.message, benchPrefix), 10, 64); err == nil {
+						latencies[v] = append(latencies[v], time.Since(time.Unix(0, sent)))
+					}
+				}
+			}
+		}(v)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var ingest []time.Duration
+	expected := 0
+	start := time.Now()
+	for i := 0; time.Since(start) < *duration; i++ {
+		if *rate > 0 {
+			// Catches up without pausing when it fell behind
+			if wait := time.Until(start.Add(time.Duration(i) * time.Second / time.Duration(*rate))); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		channel := names[i%len(names)]
+		received := time.Now()
+		irc.receive(fmt.Sprintf(":user%d!user@bench.invalid PRIVMSG %s :%s%d\r\n", i%100, channel, benchPrefix, received.UnixNano()))
+		ingest = append(ingest, time.Since(received))
+		expected += perChannel[channel]
+	}
+	elapsed := time.Since(start)
+	// Gives the viewers a moment to render what is still queued
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	runtime.ReadMemStats(&after)
+	os.Stdout = stdout
+
+	var delivered []time.Duration
+	for _, l := range latencies {
+		delivered = append(delivered, l...)
+	}
+	sent := len(ingest)
+	fmt.Printf("sent        %d messages in %s, %.0f/s, to %d channels\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds(), len(names))
+	fmt.Printf("ingest      %s (parsing, storing and publishing a line)\n", benchPercentiles(ingest))
+	fmt.Printf("delivered   %d of %d to %d viewers, %d dropped\n", len(delivered), expected, *viewers, expected-len(delivered))
+	if len(delivered) > 0 {
+		fmt.Printf("latency     %s (until a viewer rendered it)\n", benchPercentiles(delivered))
+	}
+	fmt.Printf("allocations %d bytes and %d objects per message, %d GCs\n",
+		(after.TotalAlloc-before.TotalAlloc)/uint64(sent), (after.Mallocs-before.Mallocs)/uint64(sent), after.NumGC-before.NumGC)
+}
+
+// benchPercentiles summarizes durations, which it sorts
+func benchPercentiles(durations []time.Duration) string {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	at := func(p float64) time.Duration {
+		return durations[int(p*float64(len(durations)-1))].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %s  p90 %s  p99 %s  max %s", at(0.5), at(0.9), at(0.99), at(1))
+}
+
+// webTLSConfig requires client certificates signed by the configured CA, if
+// there is one
+func webTLSConfig(config *IRCConfig, manager *autocert.Manager) *tls.Config {
+	var tlsConfig *tls.Config
+	if manager != nil {
+		tlsConfig = manager.TLSConfig()
+	}
+	if config.WebClientCAFile == "" {
+		return tlsConfig
+	}
+	data, err := os.ReadFile(config.WebClientCAFile)
+	if err != nil {
+		log.Fatalf("Failed to read client CA file [%s]: %s", config.WebClientCAFile, err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(data) {
+		log.Fatalf("No certificates found in client CA file [%s]", config.WebClientCAFile)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig
+}
+
+// webTLS reports whether the web UI is served over HTTPS
+func (config *IRCConfig) webTLS() bool {
+	return config.WebTLSCertFile != "" || len(config.WebAutocertDomains) > 0
+}
+
+// autocertManager gets the certificates of web-autocert-domains from
+// Let's Encrypt, or is nil when there are none
+func autocertManager(config *IRCConfig) *autocert.Manager {
+	if len(config.WebAutocertDomains) == 0 {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.WebAutocertDomains...),
+		Cache:      autocert.DirCache(config.WebAutocertCacheDir),
+		Email:      config.WebAutocertEmail,
+	}
+}
+
+// httpsRedirect sends plain HTTP requests to the same URL on the HTTPS
+// port. With a manager, it also answers the challenges of Let's Encrypt.
+func httpsRedirect(port int, manager *autocert.Manager) http.Handler {
+	var redirect http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	if manager != nil {
+		redirect = manager.HTTPHandler(redirect)
+	}
+	return redirect
 }
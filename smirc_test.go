@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// TestScramClient runs the SCRAM-SHA-256 exchange of RFC 7677, section 3
+func TestScramClient(t *testing.T) {
+	c := &scramClient{username: "user", password: "pencil"}
+	if _, err := c.clientFirst(); err != nil {
+		t.Fatal(err)
+	}
+	// The RFC's nonce instead of a random one
+	c.clientNonce = "rOprNGfwEbeRWgbNEkqO"
+	c.clientFirstBare = "n=user,r=" + c.clientNonce
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	clientFinal, err := c.clientFinal(serverFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if clientFinal != want {
+		t.Errorf("client-final-message is %q, want %q", clientFinal, want)
+	}
+	if err := c.verifyServerFinal("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("server-final-message: %s", err)
+	}
+	if err := c.verifyServerFinal("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err == nil {
+		t.Error("a wrong server signature was accepted")
+	}
+	if err := c.verifyServerFinal("e=invalid-proof"); err == nil {
+		t.Error("a server error was accepted")
+	}
+}
+
+func TestScramClientRefusesServerFirst(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		serverFirst string
+		wantErr     string
+	}{
+		{"nonce not ours", "r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", "nonce"},
+		{"nonce not extended", "r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", "nonce"},
+		{"invalid salt", "r=rOprNGfwEbeRWgbNEkqOxyz,s=!!!,i=4096", "salt"},
+		{"no iteration count", "r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==", "iteration"},
+		{"zero iterations", "r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0", "iteration"},
+		{"too many iterations", "r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=2147483647", "iteration"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &scramClient{username: "user", password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+			_, err := c.clientFinal(tc.serverFirst)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got error %v, want one about the %s", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	c := &IRC{nick: "me", userHost: "u@h"}
+	// What is left of a line of ":me!u@h PRIVMSG #c :...\r\n"
+	room := maxLineBytes - len(":me!u@h PRIVMSG #c :\r\n")
+	action := func(text string) string { return "\x01ACTION " + text + "\x01" }
+	actionRoom := room - len(action(""))
+	for _, tc := range []struct {
+		name    string
+		channel string
+		message string
+		want    []string
+	}{
+		{"short", "#c", "hello", []string{"hello"}},
+		{"exactly a line", "#c", strings.Repeat("a", room), []string{strings.Repeat("a", room)}},
+		{"one byte over", "#c", strings.Repeat("a", room+1), []string{strings.Repeat("a", room), "a"}},
+		{"between words", "#c", strings.Repeat("a", 300) + " " + strings.Repeat("b", 300),
+			[]string{strings.Repeat("a", 300), strings.Repeat("b", 300)}},
+		{"space right after a full line", "#c", strings.Repeat("a", room) + " b", []string{strings.Repeat("a", room), "b"}},
+		{"trailing space after a full line", "#c", strings.Repeat("a", room) + " ", []string{strings.Repeat("a", room)}},
+		// The cut at room falls into the second byte of an é
+		{"two byte characters", "#c", "x" + strings.Repeat("é", room/2),
+			[]string{"x" + strings.Repeat("é", room/2-1), "é"}},
+		{"four byte characters", "#c", strings.Repeat("😀", room/4+1),
+			[]string{strings.Repeat("😀", room/4), strings.Repeat("😀", 1)}},
+		{"action", "#c", action(strings.Repeat("a", 300) + " " + strings.Repeat("b", 300)),
+			[]string{action(strings.Repeat("a", 300)), action(strings.Repeat("b", 300))}},
+		{"action of exactly a line", "#c", action(strings.Repeat("a", actionRoom)), []string{action(strings.Repeat("a", actionRoom))}},
+		{"action one byte over", "#c", action(strings.Repeat("a", actionRoom+1)),
+			[]string{action(strings.Repeat("a", actionRoom)), action("a")}},
+		// Room for two bytes only: each character is sent, if too long
+		{"no room for a character", "#" + strings.Repeat("c", room-2), "😀😀", []string{"😀", "😀"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parts := c.splitMessage(tc.channel, tc.message)
+			if !reflect.DeepEqual(parts, tc.want) {
+				t.Errorf("got %d parts %q, want %d %q", len(parts), parts, len(tc.want), tc.want)
+			}
+			for _, part := range parts {
+				if !utf8.ValidString(part) {
+					t.Errorf("part %q is not valid UTF-8", part)
+				}
+				line := ":me!u@h PRIVMSG " + tc.channel + " :" + part + "\r\n"
+				if len(line) > maxLineBytes && utf8.RuneCountInString(strings.Trim(part, "\x01")) > 1 {
+					t.Errorf("line of %d bytes: %q", len(line), line)
+				}
+			}
+		})
+	}
+}
+
+// TestSplitMessageUnknownHost leaves room for the longest user@host while
+// the server has not told ours
+func TestSplitMessageUnknownHost(t *testing.T) {
+	c := &IRC{nick: "me"}
+	room := maxLineBytes - len(":me!"+strings.Repeat("x", maxUserHostBytes)+" PRIVMSG #c :\r\n")
+	parts := c.splitMessage("#c", strings.Repeat("a", room+1))
+	if len(parts) != 2 || len(parts[0]) != room {
+		t.Errorf("got parts of %d and %d bytes, want %d and 1", len(parts[0]), len(parts[len(parts)-1]), room)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	for text, want := range map[string][]string{
+		"one":                     {"one"},
+		"one\ntwo\n\n":            {"one", "two"},
+		"one\r\ntwo":              {"one", "two"},
+		"hi\rQUIT :bye":           {"hi", "QUIT :bye"},
+		"a\r\rb":                  {"a", "", "b"},
+		"x\r\nMODE #c +o eve\r\n": {"x", "MODE #c +o eve"},
+	} {
+		if got := splitLines(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitLines(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestSendMessageStripsLineBreaks(t *testing.T) {
+	var b strings.Builder
+	if err := sendMessage(&b, "#c", "hi\rQUIT :bye\n\x00"); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "PRIVMSG #c :hiQUIT :bye\r\n" {
+		t.Errorf("sent %q", got)
+	}
+}
+
+func TestRelayMessageLines(t *testing.T) {
+	msg := relayMessage{Nick: "hook", Message: "build ok\rPRIVMSG NickServ :DROP\r\n"}
+	if got, want := msg.lines(), []string{"build ok", "PRIVMSG NickServ :DROP"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines are %q, want %q", got, want)
+	}
+}
+
+// The PBKDF2-HMAC-SHA256 test vectors of RFC 7914 section 11, of which
+// password hashes keep the first block
+func TestCheckPasswordRFC7914(t *testing.T) {
+	for _, tc := range []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	} {
+		key, err := hex.DecodeString(tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", tc.iterations,
+			base64.RawStdEncoding.EncodeToString([]byte(tc.salt)), base64.RawStdEncoding.EncodeToString(key))
+		if !checkPassword(hash, tc.password) {
+			t.Errorf("%q with salt %q does not match its RFC 7914 key", tc.password, tc.salt)
+		}
+		if checkPassword(hash, tc.password+"x") {
+			t.Errorf("%q matches the key of %q", tc.password+"x", tc.password)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "correct horse") || checkPassword(hash, "correct horse ") {
+		t.Errorf("%s does not match only its password", hash)
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Errorf("two hashes of a password share their salt")
+	}
+}
+
+func TestRepliedToNick(t *testing.T) {
+	now := time.Now()
+	c := &IRC{
+		config: &IRCConfig{BufferSize: 10},
+		users:  map[string]*User{userKey("#c", "alice"): {Nickname: "alice", Channel: "#c"}},
+	}
+	c.ring("#c").push(IRCMessage{userName: "carol", message: "morning", time: now.Add(-time.Hour)})
+	c.ring("#c").push(IRCMessage{userName: "bob", message: "hi", time: now})
+	for _, tc := range []struct{ message, want string }{
+		{"alice: hello", "alice"},
+		{"Alice, hello", "Alice"},
+		{"bob: welcome back", "bob"},
+		{"carol: you left", ""},
+		{"http://example.com/a:b", ""},
+		{"https://example.com", ""},
+		{"note: this is not a reply", ""},
+		{"alice and bob: hello", ""},
+		{"#c: hello", ""},
+		{": hello", ""},
+		{"hello", ""},
+	} {
+		if got := c.repliedToNick("#c", tc.message, now.Add(-time.Minute)); got != tc.want {
+			t.Errorf("repliedToNick(%q) = %q, want %q", tc.message, got, tc.want)
+		}
+	}
+}
+
+// wsPipe returns the browser and the server end of a WebSocket
+func wsPipe() (client, server *wsConn) {
+	a, b := net.Pipe()
+	return &wsConn{Conn: a, reader: bufio.NewReader(a)}, &wsConn{Conn: b, server: true, reader: bufio.NewReader(b)}
+}
+
+// wsFrame builds a frame, masked with a fixed key if masked is set
+func wsFrame(fin bool, opcode byte, payload string, masked bool) []byte {
+	frame := []byte{opcode, byte(len(payload))}
+	if fin {
+		frame[0] |= 0x80
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame[1] |= 0x80
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// writeAsync writes data to conn without waiting for the other end of the
+// pipe to read it
+func writeAsync(t *testing.T, conn net.Conn, data ...[]byte) {
+	go func() {
+		for _, d := range data {
+			if _, err := conn.Write(d); err != nil {
+				t.Errorf("write: %s", err)
+				return
+			}
+		}
+	}()
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	client, server := wsPipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Each line becomes a masked text message and back
+	go func() { _, _ = client.Write([]byte("PRIVMSG #c :hi\r\nPING x\r\n")) }()
+	lines := bufio.NewReader(server)
+	for _, want := range []string{"PRIVMSG #c :hi\r\n", "PING x\r\n"} {
+		if got, err := lines.ReadString('\n'); got != want || err != nil {
+			t.Errorf("server read %q, %v; want %q", got, err, want)
+		}
+	}
+	go func() { _, _ = server.Write([]byte("PONG x\r\n")) }()
+	if got, err := bufio.NewReader(client).ReadString('\n'); got != "PONG x\r\n" || err != nil {
+		t.Errorf("client read %q, %v", got, err)
+	}
+
+	// A fragmented message with a ping in between, which is answered
+	writeAsync(t, client.Conn,
+		wsFrame(false, wsOpText, "PRIVMSG #c ", true),
+		wsFrame(true, wsOpPing, "are you there", true),
+		wsFrame(true, wsOpContinuation, ":split", true))
+	pong := make(chan string)
+	go func() {
+		_, opcode, payload, err := client.readFrame()
+		if err != nil || opcode != wsOpPong {
+			t.Errorf("got opcode %x, %v; want a pong", opcode, err)
+		}
+		pong <- string(payload)
+	}()
+	if message, err := server.readMessage(); string(message) != "PRIVMSG #c :split" || err != nil {
+		t.Errorf("server read %q, %v", message, err)
+	}
+	if payload := <-pong; payload != "are you there" {
+		t.Errorf("pong carries %q", payload)
+	}
+
+	// A close is echoed and ends the reading
+	writeAsync(t, client.Conn, wsFrame(true, wsOpClose, "\x03\xe8", true))
+	closed := make(chan byte)
+	go func() {
+		_, opcode, _, _ := client.readFrame()
+		closed <- opcode
+	}()
+	if _, err := server.readMessage(); err != io.EOF {
+		t.Errorf("got %v after a close, want EOF", err)
+	}
+	if opcode := <-closed; opcode != wsOpClose {
+		t.Errorf("the close was answered with opcode %x", opcode)
+	}
+}
+
+func TestWebSocketMasking(t *testing.T) {
+	client, server := wsPipe()
+	defer client.Close()
+	defer server.Close()
+	writeAsync(t, client.Conn, wsFrame(true, wsOpText, "PRIVMSG #c :unmasked", false))
+	if message, err := server.readMessage(); err == nil {
+		t.Errorf("the server read the unmasked frame %q", message)
+	}
+	writeAsync(t, server.Conn, wsFrame(true, wsOpText, "PRIVMSG #c :masked", true))
+	if message, err := client.readMessage(); err == nil {
+		t.Errorf("the client read the masked frame %q", message)
+	}
+}
+
+// openTestStore opens a store in a file that is removed after the test
+func openTestStore(t *testing.T) (*SQLiteStore, string) {
+	fileName := filepath.Join(t.TempDir(), "smirc.db")
+	store, err := openSQLiteStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fileName
+}
+
+func TestSQLiteStoreMessages(t *testing.T) {
+	store, fileName := openTestStore(t)
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []IRCMessage{
+		{id: 1, channel: "#go", userName: "alice", hostmask: "alice!a@host", message: "hi", time: day, threadID: 1},
+		{id: 2, channel: "#go", userName: "bob", message: "hello", time: day.Add(24 * time.Hour), threadID: 1, action: true, relayedBy: "matrix"},
+		{id: 3, channel: "", userName: "", message: ":alice!a@host QUIT :bye", time: day.Add(48 * time.Hour)},
+		{id: 4, channel: "#rust", userName: "carol", message: "hey", time: day.Add(48 * time.Hour), threadID: 4},
+	}
+	for _, m := range msgs {
+		if err := store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs[1].message, msgs[1].redacted, msgs[1].note, msgs[1].masked = "[redacted]", true, "spam", true
+	if err := store.Update(msgs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is still there after reopening the file
+	store, err := openSQLiteStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	recent, err := store.Recent(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 3 || recent[0].id != 2 || recent[2].id != 4 {
+		t.Fatalf("got %d recent messages starting with %d, want 2, 3 and 4", len(recent), recent[0].id)
+	}
+	for _, m := range recent {
+		want := msgs[m.id-1]
+		if !m.time.Equal(want.time) {
+			t.Errorf("message %d was said at %s, want %s", m.id, m.time, want.time)
+		}
+		m.time = want.time
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("loaded %+v, want %+v", m, want)
+		}
+	}
+	between, err := store.Between("#go", day, day.Add(24*time.Hour))
+	if err != nil || len(between) != 1 || between[0].id != 1 {
+		t.Errorf("got %v, %v between the days, want message 1", between, err)
+	}
+	days, err := store.Days("#go", time.UTC)
+	if err != nil || !reflect.DeepEqual(days, []string{"2024-03-01", "2024-03-02"}) {
+		t.Errorf("got days %v, %v", days, err)
+	}
+
+	ids, err := store.DeleteSaidBy("ALICE")
+	if err != nil || !reflect.DeepEqual(ids, []int{1, 3}) {
+		t.Errorf("deleted %v, %v; want the message and quit of alice", ids, err)
+	}
+	deleted, err := store.DeleteBefore(day.Add(36 * time.Hour))
+	if err != nil || deleted != 1 {
+		t.Errorf("deleted %d, %v before the cutoff, want 1", deleted, err)
+	}
+	if left, _ := store.Recent(10); len(left) != 1 || left[0].id != 4 {
+		t.Errorf("left %v, want message 4", left)
+	}
+}
+
+func TestSQLiteStorePrefsAndDrafts(t *testing.T) {
+	store, fileName := openTestStore(t)
+	p := &Prefs{store: store, users: make(map[string]map[string]json.RawMessage)}
+	if err := p.Set("ann", map[string]json.RawMessage{prefTimezone: json.RawMessage(`"Europe/Berlin"`), prefKeywords: json.RawMessage(`["go"]`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set("ann", map[string]json.RawMessage{prefKeywords: json.RawMessage("null")}); err != nil {
+		t.Fatal(err)
+	}
+	d := &Drafts{store: store, drafts: make(map[string]map[string]string)}
+	for _, draft := range [][3]string{{"ann", "#go", "half a"}, {"ann", "#rust", "gone"}, {"", "#go", "shared"}, {"ann", "#rust", ""}} {
+		if err := d.Set(draft[0], draft[1], draft[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openSQLiteStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	p = &Prefs{store: store}
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Get("ann"); !reflect.DeepEqual(got, map[string]json.RawMessage{prefTimezone: json.RawMessage(`"Europe/Berlin"`)}) {
+		t.Errorf("loaded the prefs %s", got)
+	}
+	d = &Drafts{store: store}
+	if err := d.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.drafts, map[string]map[string]string{"ann": {"#go": "half a"}, "": {"#go": "shared"}}) {
+		t.Errorf("loaded the drafts %v", d.drafts)
+	}
+}
+
+func TestBookmarksMigration(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "bookmarks.json")
+	// Before bookmarks were kept per user the file held a list
+	old := `[{"id": 7, "channel": "#go", "nick": "alice", "message": "hi", "time": "2024-03-01T12:00:00Z"},
+		{"id": 3, "channel": "#go", "nick": "bob", "message": "yo", "time": "2024-03-01T11:00:00Z"}]`
+	if err := os.WriteFile(fileName, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := &Bookmarks{fileName: fileName}
+	if maxID := b.load(); maxID != 7 {
+		t.Errorf("the highest bookmarked id is %d, want 7", maxID)
+	}
+	if list := b.List(""); len(list) != 2 || !b.Has("", 3) || !b.Has("", 7) {
+		t.Errorf("the shared bookmarks are %v, want 3 and 7", list)
+	}
+	b.Add("ann", apiMessage{ID: 9, Channel: "#go", Nick: "carol", Message: "star me"})
+
+	// Saving writes the new format, which loads the same
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		t.Errorf("the bookmarks were saved as %s", data)
+	}
+	b = &Bookmarks{fileName: fileName}
+	if maxID := b.load(); maxID != 9 || !b.Has("", 7) || !b.Has("ann", 9) || b.Has("ann", 7) {
+		t.Errorf("reloaded %v with the highest id %d", b.users, maxID)
+	}
+}
+
+func TestStoreWriter(t *testing.T) {
+	store, fileName := openTestStore(t)
+	w := newStoreWriter(store)
+	for id := 1; id <= 100; id++ {
+		m := IRCMessage{id: id, channel: "#go", userName: "alice", message: fmt.Sprint("message ", id), time: time.Now()}
+		w.Queue(func(s MessageStore) error { return s.Save(m) })
+	}
+	// Wait returns once the writes queued before it are done
+	var recent []IRCMessage
+	if err := w.Wait(func(s MessageStore) (err error) {
+		recent, err = s.Recent(1000)
+		return err
+	}); err != nil || len(recent) != 100 {
+		t.Errorf("got %d messages, %v after waiting, want 100", len(recent), err)
+	}
+	errFailed := errors.New("failed")
+	if err := w.Wait(func(MessageStore) error { return errFailed }); err != errFailed {
+		t.Errorf("Wait returned %v, want the error of the write", err)
+	}
+	// Close flushes the queue before it closes the store
+	w.Queue(func(s MessageStore) error { return s.Update(IRCMessage{id: 1, message: "[redacted]", redacted: true}) })
+	w.Queue(func(s MessageStore) error { return s.Save(IRCMessage{id: 101, channel: "#go", time: time.Now()}) })
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Recent(1); err == nil {
+		t.Errorf("the store is still open after Close")
+	}
+	store, err := openSQLiteStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	recent, err = store.Recent(1000)
+	if err != nil || len(recent) != 101 || !recent[0].redacted {
+		t.Errorf("got %d messages, %v after closing, want 101 with the first one redacted", len(recent), err)
+	}
+}
+
+func TestSQLiteStorePastes(t *testing.T) {
+	store, fileName := openTestStore(t)
+	p := &Pastes{store: store, expiry: time.Hour, quota: 1 << 20, pastes: make(map[string]*Paste)}
+	kept, err := p.Add("client", "func main() {}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := p.Add("client", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.Created = time.Now().Add(-2 * time.Hour)
+	if err := store.SavePaste(expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = openSQLiteStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	p = &Pastes{store: store, expiry: time.Hour, pastes: make(map[string]*Paste)}
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := p.Get(kept.ID); !ok || got.Text != kept.Text || got.Language != kept.Language || !got.Created.Equal(kept.Created) {
+		t.Errorf("loaded %+v, %t; want %+v", got, ok, kept)
+	}
+	if _, ok := p.Get(expired.ID); ok {
+		t.Errorf("the expired paste was loaded")
+	}
+	// Expiry and deletions remove the rows
+	if p.DeleteWhere(func(*Paste) bool { return true }) != 1 {
+		t.Errorf("deleted no paste")
+	}
+	if rows, err := store.LoadPastes(); err != nil || len(rows) != 0 {
+		t.Errorf("%d pastes, %v are left in the database", len(rows), err)
+	}
+}
+
+func TestQuietWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 3, 1, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		start, end, now string
+		want            bool
+	}{
+		{"23:00", "07:00", "23:00", true},
+		{"23:00", "07:00", "03:30", true},
+		{"23:00", "07:00", "07:00", false},
+		{"23:00", "07:00", "12:00", false},
+		{"12:00", "13:30", "13:29", true},
+		{"12:00", "13:30", "11:59", false},
+		{"09:00", "09:00", "09:00", false},
+		{"25:00", "07:00", "03:00", false},
+	} {
+		if got := (quietWindow{Start: tc.start, End: tc.end}).contains(at(tc.now)); got != tc.want {
+			t.Errorf("%s-%s contains %s: %t, want %t", tc.start, tc.end, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestQuietHoursHold(t *testing.T) {
+	defer delete(prefs.users, "quiet")
+	prefs.users["quiet"] = map[string]json.RawMessage{
+		prefQuietHours: json.RawMessage(`{"start": "23:00", "end": "07:00"}`),
+		prefTimezone:   json.RawMessage(`"America/New_York"`),
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	// 05:00 in Berlin is 23:00 in New York
+	night := time.Date(2024, 3, 1, 5, 0, 0, 0, berlin)
+	q := &QuietHours{}
+	for _, event := range []hookEvent{{Event: hookAlert, User: "quiet", Search: "deploys"}, {Event: hookHighlight, User: "quiet", Keyword: "release"}} {
+		if !q.Hold(event, night) {
+			t.Errorf("the %s was not held back at night", event.Event)
+		}
+	}
+	if q.Hold(hookEvent{Event: hookAlert, User: "loud"}, night) {
+		t.Errorf("held back the alert of a user without quiet hours")
+	}
+	if released := q.Release(night.Add(7 * time.Hour)); len(released) != 0 {
+		t.Errorf("released %v at 05:00 in New York", released)
+	}
+	released := q.Release(night.Add(8 * time.Hour))
+	if events := released["quiet"]; len(events) != 2 || events[0].Search != "deploys" || events[1].Keyword != "release" {
+		t.Errorf("released %v in the morning, want the alert and the highlight", released)
+	}
+	if released := q.Release(night.Add(8 * time.Hour)); len(released) != 0 {
+		t.Errorf("released %v twice", released)
+	}
+}
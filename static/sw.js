@@ -0,0 +1,42 @@
+// The service worker of smirc keeps the pages, styles and icons of the web
+// UI, so that the installed app opens without a connection and shows the
+// messages it saw last. Everything is fetched from the network first; the
+// live messages, the API and the forms are never cached.
+var CACHE = "smirc-shell";
+var SHELL = ["/", "/static/layout.css", "/static/icon.svg", "/manifest.webmanifest"];
+
+self.addEventListener("install", function (e) {
+  e.waitUntil(caches.open(CACHE).then(function (cache) {
+    // A page behind a login is not there yet, the rest is cached anyway
+    return Promise.all(SHELL.map(function (url) {
+      return cache.add(url).catch(function () {});
+    }));
+  }).then(function () { return self.skipWaiting(); }));
+});
+
+self.addEventListener("activate", function (e) {
+  e.waitUntil(self.clients.claim());
+});
+
+var cacheable = function (url) {
+  return url.origin === location.origin &&
+    (url.pathname === "/" || url.pathname.indexOf("/static/") === 0 || url.pathname.indexOf("/themes/") === 0 ||
+     url.pathname === "/manifest.webmanifest");
+};
+
+self.addEventListener("fetch", function (e) {
+  var url = new URL(e.request.url);
+  if (e.request.method !== "GET" || !cacheable(url)) return;
+  e.respondWith(fetch(e.request).then(function (res) {
+    if (res.ok && !res.redirected) {
+      var copy = res.clone();
+      caches.open(CACHE).then(function (cache) { cache.put(e.request, copy); });
+    }
+    return res;
+  }).catch(function () {
+    return caches.match(e.request).then(function (res) {
+      // Another channel than the ones seen shows the last page seen
+      return res || caches.match(e.request, {ignoreSearch: true});
+    });
+  }));
+});
@@ -0,0 +1,356 @@
+// Package store keeps what smirc has to remember across restarts, the
+// messages, the preferences and drafts of the web users and the pastes, in
+// a SQLite database file. It needs cgo for the SQLite driver.
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/draychev/smirc/ircclient"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DayLayout is how Days formats the days
+const DayLayout = "2006-01-02"
+
+// Message is a message said in a channel, or a raw line from the server
+// when Channel is ""
+type Message struct {
+	ID       int
+	Channel  string
+	Nick     string
+	Hostmask string
+	Message  string
+	Time     time.Time
+	ThreadID int
+	Redacted bool
+	Note     string
+	// Masked is set by moderators to hide the message until clicked
+	Masked bool
+	// Action is set for CTCP ACTIONs, whose message is stored without the
+	// CTCP framing
+	Action bool
+	// RelayedBy is the bridge that relayed the message of a user on
+	// another network
+	RelayedBy string
+}
+
+// Paste is a long message from the web UI, served at /paste/<id> instead of
+// being sent to the channel line by line
+type Paste struct {
+	ID       string
+	Text     string
+	Created  time.Time
+	Code     bool
+	Language string
+}
+
+// SQLite is a store in a SQLite database file
+type SQLite struct {
+	db *sql.DB
+}
+
+const messagesSchema = `CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY,
+	channel TEXT NOT NULL,
+	nick TEXT NOT NULL,
+	hostmask TEXT NOT NULL,
+	message TEXT NOT NULL,
+	time INTEGER NOT NULL,
+	thread_id INTEGER NOT NULL,
+	redacted INTEGER NOT NULL,
+	note TEXT NOT NULL,
+	masked INTEGER NOT NULL DEFAULT 0,
+	action INTEGER NOT NULL DEFAULT 0,
+	relayed_by TEXT NOT NULL DEFAULT ''
+)`
+
+// migrations add the columns missing from databases created by older
+// versions
+var migrations = []string{
+	"ALTER TABLE messages ADD COLUMN masked INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE messages ADD COLUMN action INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE messages ADD COLUMN relayed_by TEXT NOT NULL DEFAULT ''",
+}
+
+const prefsSchema = `CREATE TABLE IF NOT EXISTS prefs (
+	user TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (user, key)
+)`
+
+const draftsSchema = `CREATE TABLE IF NOT EXISTS drafts (
+	user TEXT NOT NULL,
+	channel TEXT NOT NULL,
+	text TEXT NOT NULL,
+	PRIMARY KEY (user, channel)
+)`
+
+const pastesSchema = `CREATE TABLE IF NOT EXISTS pastes (
+	id TEXT PRIMARY KEY,
+	text TEXT NOT NULL,
+	created INTEGER NOT NULL,
+	code INTEGER NOT NULL,
+	language TEXT NOT NULL
+)`
+
+const messageColumns = "id, channel, nick, hostmask, message, time, thread_id, redacted, note, masked, action, relayed_by"
+
+// Open opens the database in fileName, creating it and its tables as
+// needed
+func Open(fileName string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes the writes, which SQLite does anyway
+	db.SetMaxOpenConns(1)
+	for _, schema := range []string{messagesSchema, prefsSchema, draftsSchema, pastesSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	for _, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return &SQLite{db: db}, nil
+}
+
+// Save stores m, replacing the message with the same ID
+func (s *SQLite) Save(m Message) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO messages ("+messageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		m.ID, m.Channel, m.Nick, m.Hostmask, m.Message, m.Time.UnixNano(), m.ThreadID, m.Redacted, m.Note, m.Masked, m.Action, m.RelayedBy)
+	return err
+}
+
+// Update stores the moderation of a saved message
+func (s *SQLite) Update(m Message) error {
+	_, err := s.db.Exec("UPDATE messages SET message = ?, redacted = ?, note = ?, masked = ? WHERE id = ?",
+		m.Message, m.Redacted, m.Note, m.Masked, m.ID)
+	return err
+}
+
+// DeleteBefore deletes the messages from before cutoff and returns how many
+// there were
+func (s *SQLite) DeleteBefore(cutoff time.Time) (int, error) {
+	result, err := s.db.Exec("DELETE FROM messages WHERE time < ?", cutoff.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// DeleteSaidBy deletes the messages and raw lines of nick and returns their
+// ids
+func (s *SQLite) DeleteSaidBy(nick string) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	// Raw lines have the nick in their prefix only, so those mentioning it
+	// are checked one by one
+	rows, err := tx.Query("SELECT id, channel, message FROM messages WHERE nick = ? COLLATE NOCASE OR (channel = '' AND instr(lower(message), lower(?)) > 0)", nick, nick)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Channel, &m.Message); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if m.Channel != "" || strings.EqualFold(ircclient.ParseLine(m.Message).Nick(), nick) {
+			ids = append(ids, m.ID)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec("DELETE FROM messages WHERE id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// Recent returns the latest limit messages, oldest first
+func (s *SQLite) Recent(limit int) ([]Message, error) {
+	return s.query("SELECT "+messageColumns+" FROM (SELECT "+messageColumns+" FROM messages ORDER BY id DESC LIMIT ?) ORDER BY id", limit)
+}
+
+// Between returns the messages of channel said from from until before to,
+// oldest first
+func (s *SQLite) Between(channel string, from, to time.Time) ([]Message, error) {
+	return s.query("SELECT "+messageColumns+" FROM messages WHERE channel = ? AND time >= ? AND time < ? ORDER BY id",
+		channel, from.UnixNano(), to.UnixNano())
+}
+
+// Days returns the days in loc on which something was said in channel, in
+// DayLayout, oldest first
+func (s *SQLite) Days(channel string, loc *time.Location) ([]string, error) {
+	rows, err := s.db.Query("SELECT time FROM messages WHERE channel = ? ORDER BY time", channel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []string
+	for rows.Next() {
+		var nanos int64
+		if err := rows.Scan(&nanos); err != nil {
+			return nil, err
+		}
+		if day := time.Unix(0, nanos).In(loc).Format(DayLayout); len(days) == 0 || days[len(days)-1] != day {
+			days = append(days, day)
+		}
+	}
+	return days, rows.Err()
+}
+
+func (s *SQLite) query(query string, args ...interface{}) ([]Message, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		var nanos int64
+		if err := rows.Scan(&m.ID, &m.Channel, &m.Nick, &m.Hostmask, &m.Message, &nanos, &m.ThreadID, &m.Redacted, &m.Note, &m.Masked, &m.Action, &m.RelayedBy); err != nil {
+			return nil, err
+		}
+		m.Time = time.Unix(0, nanos)
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// LoadPrefs returns the preferences of all users by user and key
+func (s *SQLite) LoadPrefs() (map[string]map[string]json.RawMessage, error) {
+	rows, err := s.db.Query("SELECT user, key, value FROM prefs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]map[string]json.RawMessage)
+	for rows.Next() {
+		var user, key, value string
+		if err := rows.Scan(&user, &key, &value); err != nil {
+			return nil, err
+		}
+		if users[user] == nil {
+			users[user] = make(map[string]json.RawMessage)
+		}
+		users[user][key] = json.RawMessage(value)
+	}
+	return users, rows.Err()
+}
+
+// SavePrefs replaces all preferences of user
+func (s *SQLite) SavePrefs(user string, prefs map[string]json.RawMessage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM prefs WHERE user = ?", user); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for key, value := range prefs {
+		if _, err := tx.Exec("INSERT INTO prefs (user, key, value) VALUES (?, ?, ?)", user, key, string(value)); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadDrafts returns the drafts of all users by user and channel
+func (s *SQLite) LoadDrafts() (map[string]map[string]string, error) {
+	rows, err := s.db.Query("SELECT user, channel, text FROM drafts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]map[string]string)
+	for rows.Next() {
+		var user, channel, text string
+		if err := rows.Scan(&user, &channel, &text); err != nil {
+			return nil, err
+		}
+		if users[user] == nil {
+			users[user] = make(map[string]string)
+		}
+		users[user][channel] = text
+	}
+	return users, rows.Err()
+}
+
+// SaveDraft stores the draft of user for channel, deleting it when text is
+// empty
+func (s *SQLite) SaveDraft(user, channel, text string) error {
+	if text == "" {
+		_, err := s.db.Exec("DELETE FROM drafts WHERE user = ? AND channel = ?", user, channel)
+		return err
+	}
+	_, err := s.db.Exec("INSERT OR REPLACE INTO drafts (user, channel, text) VALUES (?, ?, ?)", user, channel, text)
+	return err
+}
+
+// LoadPastes returns all pastes
+func (s *SQLite) LoadPastes() ([]*Paste, error) {
+	rows, err := s.db.Query("SELECT id, text, created, code, language FROM pastes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var loaded []*Paste
+	for rows.Next() {
+		var paste Paste
+		var nanos int64
+		if err := rows.Scan(&paste.ID, &paste.Text, &nanos, &paste.Code, &paste.Language); err != nil {
+			return nil, err
+		}
+		paste.Created = time.Unix(0, nanos)
+		loaded = append(loaded, &paste)
+	}
+	return loaded, rows.Err()
+}
+
+// SavePaste stores paste, replacing the one with the same ID
+func (s *SQLite) SavePaste(paste *Paste) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO pastes (id, text, created, code, language) VALUES (?, ?, ?, ?, ?)",
+		paste.ID, paste.Text, paste.Created.UnixNano(), paste.Code, paste.Language)
+	return err
+}
+
+// DeletePastes deletes the pastes with the given ids
+func (s *SQLite) DeletePastes(ids []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec("DELETE FROM pastes WHERE id = ?", id); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenMigratesOldDatabases(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "smirc.db")
+	// Databases of older versions lack the masked, action and relayed_by
+	// columns
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"CREATE TABLE messages (id INTEGER PRIMARY KEY, channel TEXT NOT NULL, nick TEXT NOT NULL, hostmask TEXT NOT NULL, message TEXT NOT NULL, time INTEGER NOT NULL, thread_id INTEGER NOT NULL, redacted INTEGER NOT NULL, note TEXT NOT NULL)",
+		"INSERT INTO messages VALUES (1, '#go', 'alice', 'alice!a@host', 'hi', 0, 1, 0, '')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed := Message{ID: 2, Channel: "#go", Nick: "bob", Message: "waves", Time: time.Unix(0, 1), Action: true, RelayedBy: "matrix"}
+	if err := s.Save(relayed); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := s.Recent(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Message{
+		{ID: 1, Channel: "#go", Nick: "alice", Hostmask: "alice!a@host", Message: "hi", Time: time.Unix(0, 0), ThreadID: 1},
+		relayed,
+	}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("loaded %+v, want %+v", msgs, want)
+	}
+
+	// Opening it again finds the columns added
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+}